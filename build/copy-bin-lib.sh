@@ -7,12 +7,14 @@ set -o nounset
 FILE=${FILE:-"/etc/gpu-manager/volume.conf"}
 LIB_FILES=$(jq -r .volume[1].components.libraries[] ${FILE})
 BIN_FILES=$(jq -r .volume[1].components.binaries[] ${FILE})
+CONFIG_FILES=$(jq -r '.volume[1].components.configs[]?' ${FILE})
 readonly NV_DIR="/usr/local/nvidia"
 readonly FIND_BASE=${FIND_BASE:-"/usr/local/host"}
 
 function check_arch() {
   local readonly lib=$1
-  if [[ $(objdump -f ${lib} | grep -o "elf64-x86-64") == "elf64-x86-64" ]]; then
+  # elf64-x86-64, elf64-littleaarch64 and elf64-powerpcle are all 64bit
+  if [[ $(objdump -f ${lib} | grep -o "file format elf64-") == "file format elf64-" ]]; then
     echo "64"
   else
     echo ""
@@ -56,6 +58,15 @@ for file in ${BIN_FILES[@]}; do
   copy_bin ${file}
 done
 
+# loader vendor files are looked up by their original path
+for file in ${CONFIG_FILES[@]}; do
+  if [[ -f ${FIND_BASE}${file} ]]; then
+    mkdir -p $(dirname ${file})
+    echo "copy ${FIND_BASE}${file} to ${file}"
+    cp -Lf "${FIND_BASE}${file}" "${file}"
+  fi
+done
+
 # fix libvdpau_nvidia.so
 (
   cd ${NV_DIR}/lib
@@ -10,4 +10,5 @@ echo "rebuild ldcache"
 /usr/sbin/ldconfig
 
 echo "launch gpu manager"
-/usr/bin/gpu-manager --extra-config=/etc/gpu-manager/extra-config.json --v=${LOG_LEVEL} --hostname-override=${NODE_NAME} --share-mode=true --volume-config=/etc/gpu-manager/volume.conf --log-dir=/var/log/gpu-manager --query-addr=0.0.0.0 ${EXTRA_FLAGS:-""}
\ No newline at end of file
+# exec使gpu-manager直接接收SIGTERM, 退出前处理完分配结果并写入checkpoint
+exec /usr/bin/gpu-manager --extra-config=/etc/gpu-manager/extra-config.json --v=${LOG_LEVEL} --hostname-override=${NODE_NAME} --share-mode=true --volume-config=/etc/gpu-manager/volume.conf --log-dir=/var/log/gpu-manager --query-addr=0.0.0.0 --driver-refresh-command="/copy-bin-lib.sh && /usr/sbin/ldconfig" ${EXTRA_FLAGS:-""}
\ No newline at end of file
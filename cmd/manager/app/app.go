@@ -18,13 +18,15 @@
 package app
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"tkestack.io/gpu-manager/cmd/manager/options"
@@ -32,6 +34,7 @@ import (
 	"tkestack.io/gpu-manager/pkg/server"
 	"tkestack.io/gpu-manager/pkg/types"
 	"tkestack.io/gpu-manager/pkg/utils"
+	"tkestack.io/gpu-manager/pkg/utils/kubelet"
 
 	"github.com/fsnotify/fsnotify"
 	"k8s.io/klog"
@@ -39,6 +42,9 @@ import (
 
 // #lizard forgives
 func Run(opt *options.Options) error {
+	// 命令行和配置文件都没有指定时, 使用kubelet的配置
+	opt.CompleteKubeletSettings(kubelet.NewDiscovery().Discover())
+
 	cfg := &config.Config{
 		Driver:       opt.Driver,
 		QueryPort:    opt.QueryPort,
@@ -50,8 +56,16 @@ func Run(opt *options.Options) error {
 		DevicePluginPath:         opt.DevicePluginPath,
 		VirtualManagerPath:       opt.VirtualManagerPath,
 		VolumeConfigPath:         opt.VolumeConfigPath,
+		DriverRefreshCommand:     opt.DriverRefreshCommand,
 		EnableShare:              opt.EnableShare,
+		ShareBackend:             opt.ShareBackend,
+		WholeGPUResource:         opt.WholeGPUResource,
+		Standalone:               opt.Standalone,
+		EnablePreemption:         opt.EnablePreemption,
+		MPSPath:                  opt.MPSPath,
 		AllocationCheckPeriod:    time.Duration(opt.AllocationCheckPeriod) * time.Second,
+		HeartbeatPeriod:          time.Duration(opt.HeartbeatPeriod) * time.Second,
+		PublishGPUNode:           opt.PublishGPUNode,
 		CheckpointPath:           opt.CheckpointPath,
 		ContainerRuntimeEndpoint: opt.ContainerRuntimeEndpoint,
 		CgroupDriver:             opt.CgroupDriver,
@@ -73,17 +87,27 @@ func Run(opt *options.Options) error {
 		}
 	}
 
-	// TODO 加载额外配置文件，为不同节点配置差异信息
-	if err := readFromConfigFile(cfg); err != nil {
+	// 加载节点配置文件，为不同节点配置差异信息
+	nodeConfig := newNodeConfigLoader(cfg, options.DefaultDeviceConfig)
+	if err := nodeConfig.apply(cfg); err != nil {
 		return err
 	}
+	// 兼容unix://开头的CRI端点
+	cfg.ContainerRuntimeEndpoint = strings.TrimPrefix(cfg.ContainerRuntimeEndpoint, "unix://")
 	// TODO 校验配置信息
 	if err := checkConfig(cfg); err != nil {
 		return err
 	}
 
+	// 收到SIGTERM后停止服务, 处理完分配结果并写入checkpoint后退出
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
 	srv := server.NewManager(cfg)
-	go srv.Run()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- srv.Run(ctx)
+	}()
 	// 根据配置创建计时器
 	waitTimer := time.NewTimer(opt.WaitTimeout)
 	// 等待捆绑服务运行成功
@@ -112,18 +136,52 @@ func Run(opt *options.Options) error {
 	}
 	defer watcher.Close()
 
+	// configmap更新时会替换目录下的链接，因此监听整个目录
+	var configEvents <-chan fsnotify.Event
+	if configWatcher, err := utils.NewFSWatcher(filepath.Dir(options.DefaultDeviceConfig)); err != nil {
+		klog.Warningf("can't watch node config, changes are applied after restart, %v", err)
+	} else {
+		defer configWatcher.Close()
+		configEvents = configWatcher.Events
+	}
+	// nodeSelector按节点标签选择配置，标签变化后同样需要重新加载
+	labelEvents, err := nodeConfig.watchLabels(ctx.Done())
+	if err != nil {
+		klog.Warningf("can't watch labels of node, changes are applied after restart, %v", err)
+	}
+
+	var reloadTimer, registerTimer <-chan time.Time
 	for {
 		select {
+		case <-configEvents:
+			// 一次更新会产生多个事件，等待事件结束后再重新加载
+			reloadTimer = time.After(time.Second)
+		case <-labelEvents:
+			reloadTimer = time.After(time.Second)
+		case <-reloadTimer:
+			nodeConfig.reload(cfg)
 		case event := <-watcher.Events:
 			if event.Name == devicePluginSocket && event.Op&fsnotify.Create == fsnotify.Create {
-				time.Sleep(time.Second)
-				klog.Fatalf("inotify: %s created, restarting.", devicePluginSocket)
+				// kubelet重启后会清理目录下的socket, 等待kubelet启动完成后重新注册
+				klog.Infof("inotify: %s created, kubelet restarted", devicePluginSocket)
+				registerTimer = time.After(time.Second)
+			}
+		case <-registerTimer:
+			if err := srv.ReRegisterToKubelet(ctx); err != nil && ctx.Err() == nil {
+				// 无法重新注册时停止服务后退出, 由容器重启恢复
+				stop()
+				<-runErr
+				return err
 			}
 		case err := <-watcher.Errors:
 			klog.Fatalf("inotify: %s", err)
+		case <-ctx.Done():
+			klog.Infof("Received signal, waiting for server to stop")
+			return <-runErr
+		case err := <-runErr:
+			return err
 		}
 	}
-	return nil
 }
 
 func checkConfig(cfg *config.Config) error {
@@ -155,9 +213,17 @@ func checkConfig(cfg *config.Config) error {
 		return err
 	}
 
-	// TODO 未来升级虚拟显存实现后可以去掉限制
+	// 校验共享模式的实现方式
+	switch cfg.ShareBackend {
+	case types.ShareBackendVCuda, types.ShareBackendMPS:
+	default:
+		return fmt.Errorf("unknown share backend %s, only support [ %s | %s ]",
+			cfg.ShareBackend, types.ShareBackendVCuda, types.ShareBackendMPS)
+	}
+
+	// 显存超卖通过节点配置的overcommit实现, 缩放比只能缩小
 	if cfg.DeviceMemoryScaling > 1 {
-		return fmt.Errorf("device memory hyperallocation is not yet supported")
+		return fmt.Errorf("device memory hyperallocation is not supported by scaling, use overcommit of node config instead")
 	} else if cfg.DeviceMemoryScaling < 0 {
 		return fmt.Errorf("device memory scaling only supports any number between 0 and 1")
 	}
@@ -172,35 +238,3 @@ func checkCgroupDriver(cgroupDriver string) error {
 		return fmt.Errorf("unknown cgroup driver %s, only support [ cgroupfs | systemd ]", cgroupDriver)
 	}
 }
-
-func readFromConfigFile(cfg *config.Config) error {
-	jsonByte, err := os.ReadFile(options.DefaultDeviceConfig)
-	if err != nil {
-		if os.IsNotExist(err) {
-			klog.V(2).Info("device config.json not found use default config, path: %s", options.DefaultDeviceConfig)
-			return nil
-		}
-		return err
-	}
-	var deviceConfigs config.NodeConfigs
-	if err = json.Unmarshal(jsonByte, &deviceConfigs); err != nil {
-		klog.V(4).Infof("Deserialization config.json failed, err: %v", err)
-		return err
-	}
-	klog.V(2).Info("load node config: ", deviceConfigs)
-	for _, val := range deviceConfigs.NodeConfig {
-		if strings.Compare(os.Getenv("NODE_NAME"), val.Name) == 0 {
-			klog.V(2).Info("reading node config from file ", val.Name)
-			if len(val.CgroupDriver) > 0 {
-				cfg.CgroupDriver = val.CgroupDriver
-			}
-			if len(val.ContainerRuntimeEndpoint) > 0 {
-				cfg.ContainerRuntimeEndpoint = val.ContainerRuntimeEndpoint
-			}
-			if val.DeviceMemoryScaling > 0 {
-				cfg.DeviceMemoryScaling = val.DeviceMemoryScaling
-			}
-		}
-	}
-	return nil
-}
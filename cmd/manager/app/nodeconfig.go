@@ -0,0 +1,200 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+
+	"tkestack.io/gpu-manager/pkg/config"
+)
+
+// labelsBackoff retries getting labels of the node for about a minute
+var labelsBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Steps:    6,
+}
+
+// nodeConfigLoader selects the node config of this node from the config file
+type nodeConfigLoader struct {
+	path       string
+	nodeName   string
+	kubeConfig string
+	// labels returns labels of the node, the config isn't loaded when it
+	// fails so that entries with nodeSelector are never dropped silently
+	labels func() (map[string]string, error)
+
+	// applied is the node config gpu-manager started with
+	applied *config.NodeConfig
+}
+
+func newNodeConfigLoader(cfg *config.Config, path string) *nodeConfigLoader {
+	return &nodeConfigLoader{
+		path:       path,
+		nodeName:   cfg.Hostname,
+		kubeConfig: cfg.KubeConfig,
+		labels: func() (map[string]string, error) {
+			return getNodeLabels(cfg.KubeConfig, cfg.Hostname)
+		},
+	}
+}
+
+// load returns the node config, it's empty when the file doesn't exist
+func (l *nodeConfigLoader) load() (*config.NodeConfig, error) {
+	configs, err := config.LoadNodeConfigs(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			klog.V(2).Infof("device config.json not found use default config, path: %s", l.path)
+			return &config.NodeConfig{Name: l.nodeName}, nil
+		}
+		return nil, err
+	}
+	var labels map[string]string
+	if configs.HasNodeSelector() {
+		if labels, err = l.labels(); err != nil {
+			return nil, fmt.Errorf("can't get labels of %s to select node config, %v", l.nodeName, err)
+		}
+	}
+	nodeConfig, err := configs.Select(l.nodeName, labels)
+	if err != nil {
+		return nil, err
+	}
+	return nodeConfig, nodeConfig.Validate()
+}
+
+// apply loads the node config and sets it to cfg before gpu-manager starts
+func (l *nodeConfigLoader) apply(cfg *config.Config) error {
+	nodeConfig, err := l.load()
+	if err != nil {
+		return err
+	}
+	klog.V(2).Infof("load node config: %+v", *nodeConfig)
+	nodeConfig.Apply(cfg)
+	l.applied = nodeConfig
+	return nil
+}
+
+// reload loads the node config again after the file changed. Settings which can
+// be changed while running are updated, others are reported to restart.
+func (l *nodeConfigLoader) reload(cfg *config.Config) {
+	nodeConfig, err := l.load()
+	if err != nil {
+		klog.Errorf("can't reload node config, keep the current one, %v", err)
+		return
+	}
+	if cfg.Live.Update(nodeConfig.PlacementPolicy, nodeConfig.Health) {
+		klog.Infof("node config updated, placementPolicy: %s, health: %+v",
+			cfg.Live.PlacementPolicy(), cfg.Live.Health())
+	}
+	if cfg.Live.UpdateQuotas(nodeConfig.Quotas) {
+		klog.Infof("node config updated, quotas: %+v", nodeConfig.Quotas)
+	}
+	if names := l.applied.RestartRequired(nodeConfig); len(names) > 0 {
+		klog.Warningf("node config %s changed, restart gpu-manager to apply them", strings.Join(names, ", "))
+	}
+}
+
+// watchLabels notifies the returned channel when labels of the node changed,
+// entries with nodeSelector may select another node config then
+func (l *nodeConfigLoader) watchLabels(stopChan <-chan struct{}) (<-chan struct{}, error) {
+	client, err := newClient(l.kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", l.nodeName).String()
+		}))
+
+	changes := make(chan struct{}, 1)
+	_, err = factory.Core().V1().Nodes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, ok := oldObj.(*v1.Node)
+			if !ok {
+				return
+			}
+			newNode, ok := newObj.(*v1.Node)
+			if !ok || reflect.DeepEqual(oldNode.Labels, newNode.Labels) {
+				return
+			}
+			klog.V(2).Infof("labels of node %s changed", l.nodeName)
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	factory.Start(stopChan)
+
+	return changes, nil
+}
+
+func newClient(kubeConfig string) (kubernetes.Interface, error) {
+	clientCfg, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(clientCfg)
+}
+
+// getNodeLabels returns labels of the node, apiserver may be unreachable for
+// a while when the node boots, so it's retried before giving up
+func getNodeLabels(kubeConfig, nodeName string) (map[string]string, error) {
+	client, err := newClient(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		labels  map[string]string
+		lastErr error
+	)
+	err = wait.ExponentialBackoff(labelsBackoff, func() (bool, error) {
+		node, err := client.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+		if err != nil {
+			klog.Warningf("can't get labels of %s, retry later, %v", nodeName, err)
+			lastErr = err
+			return false, nil
+		}
+		labels = node.Labels
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%v, last error: %v", err, lastErr)
+	}
+	return labels, nil
+}
@@ -45,6 +45,19 @@ func main() {
 
 	version.PrintAndExitIfRequested()
 
+	if err := opt.Complete(pflag.CommandLine, os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if err := opt.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if opt.ValidateConfig {
+		fmt.Println("configuration is valid")
+		os.Exit(0)
+	}
+
 	if err := app.Run(opt); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
@@ -0,0 +1,166 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package options
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"tkestack.io/gpu-manager/pkg/apis/config/v1alpha1"
+	"tkestack.io/gpu-manager/pkg/apis/config/validation"
+)
+
+// LoadConfiguration reads, decodes and defaults the GPUManagerConfiguration file
+func LoadConfiguration(path string) (*v1alpha1.GPUManagerConfiguration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &v1alpha1.GPUManagerConfiguration{}
+	// 严格模式解析，拼写错误的字段会报错
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("can't decode %s, %v", path, err)
+	}
+	v1alpha1.SetDefaults_GPUManagerConfiguration(c)
+	return c, nil
+}
+
+// Complete loads the configuration file specified by --config. Values in the
+// file replace defaults, then args are parsed again so that flags on the
+// command line override the file.
+func (opt *Options) Complete(fs *pflag.FlagSet, args []string) error {
+	if len(opt.ConfigFile) == 0 {
+		return nil
+	}
+	c, err := LoadConfiguration(opt.ConfigFile)
+	if err != nil {
+		return err
+	}
+	klog.V(2).Infof("load configuration from %s", opt.ConfigFile)
+	opt.ApplyConfiguration(c)
+	return fs.Parse(args)
+}
+
+// Validate returns field errors of the options
+func (opt *Options) Validate() error {
+	return validation.ValidateGPUManagerConfiguration(opt.Configuration()).ToAggregate()
+}
+
+// ApplyConfiguration sets values of the configuration to the options, values
+// discovered from kubelet are kept when the configuration leaves them empty
+func (opt *Options) ApplyConfiguration(c *v1alpha1.GPUManagerConfiguration) {
+	opt.Driver = c.Driver
+	opt.ExtraPath = c.ExtraConfigPath
+	opt.VolumeConfigPath = c.VolumeConfigPath
+	opt.DriverRefreshCommand = c.DriverRefreshCommand
+	opt.QueryPort = c.QueryPort
+	opt.QueryAddr = c.QueryAddr
+	opt.KubeConfigFile = c.KubeConfig
+	opt.SamplePeriod = int(c.SamplePeriod.Duration / time.Second)
+	opt.NodeLabels = joinLabels(c.NodeLabels)
+	if len(c.HostnameOverride) > 0 {
+		opt.HostnameOverride = c.HostnameOverride
+	}
+	opt.VirtualManagerPath = c.VirtualManagerPath
+	if len(c.DevicePluginPath) > 0 {
+		opt.DevicePluginPath = c.DevicePluginPath
+	}
+	opt.CheckpointPath = c.CheckpointPath
+	opt.EnableShare = c.ShareMode
+	opt.ShareBackend = c.ShareBackend
+	opt.WholeGPUResource = c.WholeGPUResource
+	opt.Standalone = c.Standalone
+	opt.EnablePreemption = c.Preemption
+	opt.MPSPath = c.MPSPath
+	opt.AllocationCheckPeriod = int(c.AllocationCheckPeriod.Duration / time.Second)
+	opt.HeartbeatPeriod = int(c.HeartbeatPeriod.Duration / time.Second)
+	opt.PublishGPUNode = c.PublishGPUNode
+	opt.DeviceMemoryScaling = c.DeviceMemoryScaling
+	if len(c.ContainerRuntimeEndpoint) > 0 {
+		opt.ContainerRuntimeEndpoint = c.ContainerRuntimeEndpoint
+	}
+	if len(c.CgroupDriver) > 0 {
+		opt.CgroupDriver = c.CgroupDriver
+	}
+	opt.RequestTimeout = c.RuntimeRequestTimeout.Duration
+	opt.WaitTimeout = c.WaitTimeout.Duration
+}
+
+// Configuration converts the options to GPUManagerConfiguration
+func (opt *Options) Configuration() *v1alpha1.GPUManagerConfiguration {
+	return &v1alpha1.GPUManagerConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+			Kind:       v1alpha1.Kind,
+		},
+		Driver:                   opt.Driver,
+		ExtraConfigPath:          opt.ExtraPath,
+		VolumeConfigPath:         opt.VolumeConfigPath,
+		DriverRefreshCommand:     opt.DriverRefreshCommand,
+		QueryPort:                opt.QueryPort,
+		QueryAddr:                opt.QueryAddr,
+		KubeConfig:               opt.KubeConfigFile,
+		SamplePeriod:             metav1.Duration{Duration: time.Duration(opt.SamplePeriod) * time.Second},
+		NodeLabels:               splitLabels(opt.NodeLabels),
+		HostnameOverride:         opt.HostnameOverride,
+		VirtualManagerPath:       opt.VirtualManagerPath,
+		DevicePluginPath:         opt.DevicePluginPath,
+		CheckpointPath:           opt.CheckpointPath,
+		ShareMode:                opt.EnableShare,
+		ShareBackend:             opt.ShareBackend,
+		WholeGPUResource:         opt.WholeGPUResource,
+		Standalone:               opt.Standalone,
+		Preemption:               opt.EnablePreemption,
+		MPSPath:                  opt.MPSPath,
+		AllocationCheckPeriod:    metav1.Duration{Duration: time.Duration(opt.AllocationCheckPeriod) * time.Second},
+		HeartbeatPeriod:          metav1.Duration{Duration: time.Duration(opt.HeartbeatPeriod) * time.Second},
+		PublishGPUNode:           opt.PublishGPUNode,
+		DeviceMemoryScaling:      opt.DeviceMemoryScaling,
+		ContainerRuntimeEndpoint: opt.ContainerRuntimeEndpoint,
+		CgroupDriver:             opt.CgroupDriver,
+		RuntimeRequestTimeout:    metav1.Duration{Duration: opt.RequestTimeout},
+		WaitTimeout:              metav1.Duration{Duration: opt.WaitTimeout},
+	}
+}
+
+// joinLabels converts labels to the format of --node-labels
+func joinLabels(labels map[string]string) string {
+	items := make([]string, 0, len(labels))
+	for k, v := range labels {
+		items = append(items, k+"="+v)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func splitLabels(nodeLabels string) map[string]string {
+	labels := make(map[string]string)
+	for _, item := range strings.Split(nodeLabels, ",") {
+		if kvs := strings.SplitN(item, "=", 2); len(kvs) == 2 {
+			labels[kvs[0]] = kvs[1]
+		}
+	}
+	return labels
+}
@@ -0,0 +1,96 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package options
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"tkestack.io/gpu-manager/pkg/utils/kubelet"
+)
+
+const testConfiguration = `apiVersion: config.gpu.tydic.io/v1alpha1
+kind: GPUManagerConfiguration
+shareMode: true
+shareBackend: mps
+heartbeatPeriod: 10s
+deviceMemoryScaling: 0.8
+nodeLabels:
+  gaia.nvidia.com/gpu-model: ""
+`
+
+func TestCompleteConfiguration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(testConfiguration), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := NewOptions()
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	opt.AddFlags(fs)
+	args := []string{"--config=" + path, "--share-backend=vcuda", "--query-port=1234"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := opt.Complete(fs, args); err != nil {
+		t.Fatal(err)
+	}
+
+	// 命令行参数覆盖配置文件，配置文件覆盖默认值
+	if opt.ShareBackend != "vcuda" || opt.QueryPort != 1234 {
+		t.Errorf("flags should override the configuration file, %+v", opt)
+	}
+	if !opt.EnableShare || opt.HeartbeatPeriod != 10 || opt.DeviceMemoryScaling != 0.8 ||
+		opt.NodeLabels != "gaia.nvidia.com/gpu-model=" {
+		t.Errorf("values of the configuration file are not applied, %+v", opt)
+	}
+	if opt.SamplePeriod != DefaultSamplePeriod || opt.WaitTimeout != time.Minute {
+		t.Errorf("defaults are not applied, %+v", opt)
+	}
+	if err := opt.Validate(); err != nil {
+		t.Errorf("unexpected validation error %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(testConfiguration+"unknownField: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfiguration(path); err == nil {
+		t.Errorf("expect error for unknown field")
+	}
+}
+
+func TestCompleteKubeletSettings(t *testing.T) {
+	settings := &kubelet.Settings{
+		CgroupDriver:             kubelet.Setting{Value: "systemd", Source: kubelet.SourceConfigFile},
+		ContainerRuntimeEndpoint: kubelet.Setting{Value: "/var/run/crio/crio.sock", Source: kubelet.SourceCommandLine},
+	}
+
+	// 已指定的配置不会被kubelet的配置覆盖
+	opt := NewOptions()
+	opt.CgroupDriver = "cgroupfs"
+	opt.CompleteKubeletSettings(settings)
+	if opt.CgroupDriver != "cgroupfs" || opt.ContainerRuntimeEndpoint != "/var/run/crio/crio.sock" {
+		t.Errorf("unexpected settings, cgroup driver %s, runtime %s", opt.CgroupDriver, opt.ContainerRuntimeEndpoint)
+	}
+	if opt.DevicePluginPath != "/var/lib/kubelet/device-plugins/" {
+		t.Errorf("unexpected device plugin path %s", opt.DevicePluginPath)
+	}
+}
@@ -18,30 +18,35 @@
 package options
 
 import (
-	"k8s.io/klog"
-	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/spf13/pflag"
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"tkestack.io/gpu-manager/pkg/apis/config/v1alpha1"
+	"tkestack.io/gpu-manager/pkg/types"
+	"tkestack.io/gpu-manager/pkg/utils/kubelet"
 )
 
 const (
-	DefaultDriver                = "nvidia"
-	DefaultQueryPort             = 5678
-	DefaultSamplePeriod          = 1
-	DefaultDeviceMemoryScaling   = 1
-	DefaultVirtualManagerPath    = "/etc/gpu-manager/vm"
+	DefaultDriver                = v1alpha1.DefaultDriver
+	DefaultQueryPort             = v1alpha1.DefaultQueryPort
+	DefaultSamplePeriod          = int(v1alpha1.DefaultSamplePeriod / time.Second)
+	DefaultDeviceMemoryScaling   = v1alpha1.DefaultDeviceMemoryScaling
+	DefaultVirtualManagerPath    = v1alpha1.DefaultVirtualManagerPath
 	DefaultDeviceConfig          = "/etc/gpu-manager/config/config.json"
-	DefaultAllocationCheckPeriod = 30
-	DefaultCheckpointPath        = "/etc/gpu-manager/checkpoint"
-
-	DefaultKubeletConfig = "/var/lib/kubelet/config.yaml"
+	DefaultAllocationCheckPeriod = int(v1alpha1.DefaultAllocationCheckPeriod / time.Second)
+	DefaultHeartbeatPeriod       = int(v1alpha1.DefaultHeartbeatPeriod / time.Second)
+	DefaultCheckpointPath        = v1alpha1.DefaultCheckpointPath
+	DefaultShareBackend          = v1alpha1.DefaultShareBackend
+	DefaultMPSPath               = v1alpha1.DefaultMPSPath
 
 	DockerShimRuntimeEndpoint = "/var/run/dockershim.sock"
 	DockerCriRuntimeEndpoint  = "/var/run/cri-dockerd.sock"
 	ContainerdRuntimeEndpoint = "/var/run/containerd/containerd.sock"
+	CrioRuntimeEndpoint       = "/var/run/crio/crio.sock"
 )
 
 // TODO 不断添加兼容列表
@@ -49,13 +54,18 @@ var ContainerRuntimeCompatibilityList = []string{
 	DockerShimRuntimeEndpoint,
 	DockerCriRuntimeEndpoint,
 	ContainerdRuntimeEndpoint,
+	CrioRuntimeEndpoint,
 }
 
 // Options contains plugin information
 type Options struct {
+	// ConfigFile is the GPUManagerConfiguration file, flags override values in it
+	ConfigFile               string
+	ValidateConfig           bool
 	Driver                   string
 	ExtraPath                string
 	VolumeConfigPath         string
+	DriverRefreshCommand     string
 	QueryPort                int
 	QueryAddr                string
 	KubeConfigFile           string
@@ -65,7 +75,14 @@ type Options struct {
 	VirtualManagerPath       string
 	DevicePluginPath         string
 	EnableShare              bool
+	ShareBackend             string
+	WholeGPUResource         bool
+	Standalone               bool
+	EnablePreemption         bool
+	MPSPath                  string
 	AllocationCheckPeriod    int
+	HeartbeatPeriod          int
+	PublishGPUNode           bool
 	DeviceMemoryScaling      float64
 	CheckpointPath           string
 	ContainerRuntimeEndpoint string
@@ -77,61 +94,62 @@ type Options struct {
 // NewOptions gives a default options template.
 func NewOptions() *Options {
 	return &Options{
-		Driver:                   DefaultDriver,
-		QueryPort:                DefaultQueryPort,
-		QueryAddr:                "localhost",
-		SamplePeriod:             DefaultSamplePeriod,
-		VirtualManagerPath:       DefaultVirtualManagerPath,
-		AllocationCheckPeriod:    DefaultAllocationCheckPeriod,
-		DeviceMemoryScaling:      DefaultDeviceMemoryScaling,
-		CheckpointPath:           DefaultCheckpointPath,
-		ContainerRuntimeEndpoint: getDefaultRuntimeEndpoint(),
-		CgroupDriver:             getDefaultCgroupDriver(),
-		RequestTimeout:           time.Second * 5,
-		WaitTimeout:              time.Minute,
-		DevicePluginPath:         pluginapi.DevicePluginPath,
-		HostnameOverride:         os.Getenv("NODE_NAME"),
+		Driver:                DefaultDriver,
+		QueryPort:             DefaultQueryPort,
+		QueryAddr:             v1alpha1.DefaultQueryAddr,
+		SamplePeriod:          DefaultSamplePeriod,
+		VirtualManagerPath:    DefaultVirtualManagerPath,
+		AllocationCheckPeriod: DefaultAllocationCheckPeriod,
+		HeartbeatPeriod:       DefaultHeartbeatPeriod,
+		DeviceMemoryScaling:   DefaultDeviceMemoryScaling,
+		CheckpointPath:        DefaultCheckpointPath,
+		ShareBackend:          DefaultShareBackend,
+		MPSPath:               DefaultMPSPath,
+		RequestTimeout:        v1alpha1.DefaultRequestTimeout,
+		WaitTimeout:           v1alpha1.DefaultWaitTimeout,
+		DevicePluginPath:      pluginapi.DevicePluginPath,
+		HostnameOverride:      os.Getenv("NODE_NAME"),
+	}
+}
+
+// CompleteKubeletSettings fills the runtime endpoint and cgroup driver not
+// configured with the ones discovered from kubelet
+func (opt *Options) CompleteKubeletSettings(settings *kubelet.Settings) {
+	if len(opt.ContainerRuntimeEndpoint) == 0 {
+		opt.ContainerRuntimeEndpoint = getDefaultRuntimeEndpoint(settings)
+	}
+	if len(opt.CgroupDriver) == 0 {
+		opt.CgroupDriver = settings.CgroupDriver.Value
 	}
 }
 
-// TODO 兼容containerd配置, 当找不到 dockershim.sock, 默认值改为containerd.sock默认路径
+// getDefaultRuntimeEndpoint returns the runtime endpoint of kubelet, and tries
+// the known sockets when kubelet doesn't configure one.
 // https://github.com/tkestack/gpu-manager/commit/42599a6880513e6c683bbdd40022fffc8973a634
-func getDefaultRuntimeEndpoint() string {
+func getDefaultRuntimeEndpoint(settings *kubelet.Settings) string {
+	if len(settings.ContainerRuntimeEndpoint.Value) > 0 {
+		return settings.ContainerRuntimeEndpoint.Value
+	}
 	for _, endpoint := range ContainerRuntimeCompatibilityList {
 		if _, err := os.Stat(endpoint); os.IsNotExist(err) {
 			klog.Warning(endpoint, " is not exist, skip it")
 		} else {
-			klog.Info("automatically recognized endpoint %s", endpoint)
+			klog.Infof("automatically recognized endpoint %s", endpoint)
 			return endpoint
 		}
 	}
 	return ""
 }
 
-func getDefaultCgroupDriver() string {
-	if fileContext, err := os.ReadFile(DefaultKubeletConfig); err != nil {
-		klog.Warning("read ", DefaultDeviceConfig, " file failed: %s", err.Error())
-	} else {
-		kubeletConfig := string(fileContext)
-		if strings.LastIndex(kubeletConfig, "cgroupDriver:") > 0 {
-			content := strings.ToLower(kubeletConfig)
-			if strings.Contains(content, "systemd") {
-				return "systemd"
-			}
-			if strings.Contains(content, "cgroupfs") {
-				return "cgroupfs"
-			}
-		}
-	}
-	klog.Warning("cgroup driver not automatically recognized")
-	return ""
-}
-
 // AddFlags add some commandline flags.
 func (opt *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&opt.ConfigFile, "config", opt.ConfigFile, "The GPUManagerConfiguration file location, "+
+		"flags specified on the command line override values in it")
+	fs.BoolVar(&opt.ValidateConfig, "validate-config", opt.ValidateConfig, "validate the configuration and exit")
 	fs.StringVar(&opt.Driver, "driver", opt.Driver, "The driver name for manager")
 	fs.StringVar(&opt.ExtraPath, "extra-config", opt.ExtraPath, "The extra config file location")
 	fs.StringVar(&opt.VolumeConfigPath, "volume-config", opt.VolumeConfigPath, "The volume config file location")
+	fs.StringVar(&opt.DriverRefreshCommand, "driver-refresh-command", opt.DriverRefreshCommand, "shell command to rebuild ld.so.cache after host driver is upgraded")
 	fs.IntVar(&opt.QueryPort, "query-port", opt.QueryPort, "port for query statistics information")
 	fs.StringVar(&opt.QueryAddr, "query-addr", opt.QueryAddr, "address for query statistics information")
 	fs.StringVar(&opt.KubeConfigFile, "kubeconfig", opt.KubeConfigFile, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
@@ -142,9 +160,20 @@ func (opt *Options) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&opt.DevicePluginPath, "device-plugin-path", opt.DevicePluginPath, "the path for kubelet receive device plugin registration")
 	fs.StringVar(&opt.CheckpointPath, "checkpoint-path", opt.CheckpointPath, "configuration path for checkpoint store file")
 	fs.BoolVar(&opt.EnableShare, "share-mode", opt.EnableShare, "enable share mode allocation")
+	fs.StringVar(&opt.ShareBackend, "share-backend", opt.ShareBackend, "backend used to limit containers in share mode. "+
+		"Possible values: 'vcuda', 'mps'")
+	fs.BoolVar(&opt.WholeGPUResource, "whole-gpu-resource", opt.WholeGPUResource, "advertise whole GPUs as "+types.NvidiaGPUResource+
+		" besides vcuda resources, for workloads written for NVIDIA device plugin")
+	fs.BoolVar(&opt.Standalone, "standalone", opt.Standalone, "choose GPUs for vcuda requests in device plugin without gpu-admission, "+
+		"pods scheduled by the default scheduler are supported")
+	fs.BoolVar(&opt.EnablePreemption, "preemption", opt.EnablePreemption, "evict share mode pods with lower priority "+
+		"when a shared GPU request can't be placed")
+	fs.StringVar(&opt.MPSPath, "mps-path", opt.MPSPath, "host path for pipe and log directories of MPS control daemons")
 	fs.IntVar(&opt.AllocationCheckPeriod, "allocation-check-period", opt.AllocationCheckPeriod, "allocation check period, unit second")
+	fs.IntVar(&opt.HeartbeatPeriod, "heartbeat-period", opt.HeartbeatPeriod, "period of node heartbeat annotation, unit second")
+	fs.BoolVar(&opt.PublishGPUNode, "publish-gpunode", opt.PublishGPUNode, "publish devices and allocations to the GPUNode resource, the CRD must be installed")
 	fs.Float64Var(&opt.DeviceMemoryScaling, "device-memory-scaling", opt.DeviceMemoryScaling, "define device memory scaling ratio")
-	fs.StringVar(&opt.ContainerRuntimeEndpoint, "container-runtime-endpoint", opt.ContainerRuntimeEndpoint, "container runtime endpoint")
+	fs.StringVar(&opt.ContainerRuntimeEndpoint, "container-runtime-endpoint", opt.ContainerRuntimeEndpoint, "container runtime endpoint, any CRI runtime is supported, e.g. unix:///var/run/crio/crio.sock")
 	fs.StringVar(&opt.CgroupDriver, "cgroup-driver", opt.CgroupDriver, "Driver that the kubelet uses to manipulate cgroups on the host.  "+
 		"Possible values: 'cgroupfs', 'systemd'")
 	fs.DurationVar(&opt.RequestTimeout, "runtime-request-timeout", opt.RequestTimeout,
@@ -0,0 +1,37 @@
+#!/usr/bin/env bash
+
+# Generates ld.so.cache files in pkg/services/volume/ldcache/testdata with
+# the ldconfig of each architecture, and saves the listing of ldconfig -p
+# next to every cache. Requires docker and qemu-user-static binfmt handlers
+# for foreign platforms.
+
+set -o errexit
+set -o pipefail
+set -o nounset
+
+ROOT=$(cd $(dirname ${BASH_SOURCE[0]})/.. && pwd -P)
+TESTDATA="${ROOT}/pkg/services/volume/ldcache/testdata"
+
+# ldcache::generate <platform> <image> <name> <libdir> [hwcap subdirectory]
+function ldcache::generate() {
+  local platform=$1 image=$2 name=$3 libdir=$4 subdir=${5:-}
+
+  docker run --rm --platform "${platform}" -v "${TESTDATA}:/testdata" "${image}" sh -ec "
+    lib=\$(readlink -f \$(ls /lib*/libz.so.1 /lib*/*/libz.so.1 /usr/lib*/libz.so.1 /usr/lib*/*/libz.so.1 2>/dev/null | head -n 1))
+    mkdir -p /cache/etc /cache${libdir}
+    cp \"\${lib}\" /cache${libdir}/
+    if [ -n '${subdir}' ]; then
+      mkdir -p /cache${libdir}/${subdir}
+      cp \"\${lib}\" /cache${libdir}/${subdir}/
+    fi
+    echo ${libdir} > /cache/etc/ld.so.conf
+    ldconfig -r /cache
+    cp /cache/etc/ld.so.cache /testdata/${name}.cache
+    ldconfig -p -C /cache/etc/ld.so.cache > /testdata/${name}.cache.ldconfig
+  "
+}
+
+ldcache::generate linux/arm64 debian:bookworm arm64-bookworm /usr/lib/aarch64-linux-gnu
+ldcache::generate linux/ppc64le debian:bookworm ppc64le-bookworm-hwcaps /usr/lib/powerpc64le-linux-gnu glibc-hwcaps/power9
+# glibc before 2.32 writes the old format header as well
+ldcache::generate linux/ppc64le centos:7 ppc64le-centos7-compat /usr/lib64 power8
@@ -0,0 +1,51 @@
+#!/usr/bin/env bash
+
+# Generates clientset, listers and informers of the APIs in pkg/apis into
+# pkg/client. Set CODEGEN_BIN to a directory holding client-gen, lister-gen
+# and informer-gen to skip installing them.
+
+set -o errexit
+set -o pipefail
+set -o nounset
+
+ROOT=$(cd $(dirname ${BASH_SOURCE[0]})/.. && pwd -P)
+
+source "${ROOT}/hack/common.sh"
+
+readonly CODEGEN_VERSION=${CODEGEN_VERSION:-"v0.33.3"}
+readonly CLIENT_PACKAGE="${PACKAGE}/pkg/client"
+readonly INPUT_APIS="gpu/v1alpha1"
+readonly HEADER="${ROOT}/hack/boilerplate.go.txt"
+
+CODEGEN_BIN=${CODEGEN_BIN:-}
+if [[ -z "${CODEGEN_BIN}" ]]; then
+  CODEGEN_BIN="${ROOT}/go/bin"
+  for gen in client-gen lister-gen informer-gen; do
+    GOBIN="${CODEGEN_BIN}" go install "k8s.io/code-generator/cmd/${gen}@${CODEGEN_VERSION}"
+  done
+fi
+
+cd "${ROOT}"
+rm -rf pkg/client/clientset pkg/client/listers pkg/client/informers
+
+"${CODEGEN_BIN}/client-gen" \
+  --go-header-file "${HEADER}" \
+  --input-base "${PACKAGE}/pkg/apis" \
+  --input "${INPUT_APIS}" \
+  --clientset-name versioned \
+  --output-dir pkg/client/clientset \
+  --output-pkg "${CLIENT_PACKAGE}/clientset"
+
+"${CODEGEN_BIN}/lister-gen" \
+  --go-header-file "${HEADER}" \
+  --output-dir pkg/client/listers \
+  --output-pkg "${CLIENT_PACKAGE}/listers" \
+  ./pkg/apis/${INPUT_APIS}
+
+"${CODEGEN_BIN}/informer-gen" \
+  --go-header-file "${HEADER}" \
+  --versioned-clientset-package "${CLIENT_PACKAGE}/clientset/versioned" \
+  --listers-package "${CLIENT_PACKAGE}/listers" \
+  --output-dir pkg/client/informers \
+  --output-pkg "${CLIENT_PACKAGE}/informers" \
+  ./pkg/apis/${INPUT_APIS}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	v1 "k8s.io/api/core/v1"
 	"sort"
+	"tkestack.io/gpu-manager/pkg/config"
 	"tkestack.io/gpu-manager/pkg/types"
 	"tkestack.io/gpu-manager/pkg/utils"
 
@@ -30,7 +31,8 @@ import (
 )
 
 type fragmentMode struct {
-	tree *nvidia.NvidiaTree
+	tree   *nvidia.NvidiaTree
+	config *config.Config
 }
 
 //NewFragmentMode returns a new fragmentMode struct.
@@ -43,8 +45,8 @@ type fragmentMode struct {
 
 // fragmentMode的Evaluate（）返回具有最小可用内核的节点，这些内核用于填充请求。
 // 碎片模式意味着首先在碎片节点上分配核心，这有助于link模式更好地工作。
-func NewFragmentMode(t *nvidia.NvidiaTree) *fragmentMode {
-	return &fragmentMode{t}
+func NewFragmentMode(t *nvidia.NvidiaTree, config *config.Config) *fragmentMode {
+	return &fragmentMode{t, config}
 }
 
 func (al *fragmentMode) Evaluate(cores int64, _ int64, pod *v1.Pod) []*nvidia.NvidiaNode {
@@ -67,7 +69,8 @@ func (al *fragmentMode) Evaluate(cores int64, _ int64, pod *v1.Pod) []*nvidia.Nv
 		sorter.Sort(candidate.Children)
 
 		for _, node := range candidate.Children {
-			if len(node.Children) == 0 || node.Available() < num {
+			// 只计算资源池允许使用的设备
+			if len(node.Children) == 0 || poolAvailable(al.config, pod, node) < num {
 				continue
 			}
 
@@ -87,6 +90,9 @@ func (al *fragmentMode) Evaluate(cores int64, _ int64, pod *v1.Pod) []*nvidia.Nv
 				node.Meta.MinorID, node.Meta.Name, fmt.Sprintf("%s or %s", types.PodAnnotationUseGpuType, types.PodAnnotationUnUseGpuType))
 			continue
 		}
+		if !checkPool(al.config, pod, node, true) {
+			continue
+		}
 
 		klog.V(2).Infof("Pick up %d mask %b", node.Meta.ID, node.Mask)
 		nodes = append(nodes, node)
@@ -45,7 +45,7 @@ GPU4     SOC     SOC     SOC     SOC      X      PIX
 GPU5     SOC     SOC     SOC     SOC     PIX      X
 `
 	tree.Init(testCase1)
-	algo := NewFragmentMode(tree)
+	algo := NewFragmentMode(tree, nil)
 
 	expectCase1 := []string{
 		"/dev/nvidia4", "/dev/nvidia5",
@@ -87,7 +87,7 @@ func TestFragmentOnlyOne(t *testing.T) {
 GPU0   x`
 
 	tree.Init(testCase1)
-	algo := NewFragmentMode(tree)
+	algo := NewFragmentMode(tree, nil)
 
 	expectCase1 := []string{
 		"/dev/nvidia0",
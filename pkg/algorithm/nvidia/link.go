@@ -21,6 +21,7 @@ import (
 	"fmt"
 	v1 "k8s.io/api/core/v1"
 	"sort"
+	"tkestack.io/gpu-manager/pkg/config"
 	"tkestack.io/gpu-manager/pkg/types"
 	"tkestack.io/gpu-manager/pkg/utils"
 
@@ -30,7 +31,8 @@ import (
 )
 
 type linkMode struct {
-	tree *nvidia.NvidiaTree
+	tree   *nvidia.NvidiaTree
+	config *config.Config
 }
 
 //NewLinkMode returns a new linkMode struct.
@@ -39,8 +41,8 @@ type linkMode struct {
 //of each other.
 
 // linkMode的Evaluate（）返回彼此连接开销最小的节点。
-func NewLinkMode(t *nvidia.NvidiaTree) *linkMode {
-	return &linkMode{t}
+func NewLinkMode(t *nvidia.NvidiaTree, config *config.Config) *linkMode {
+	return &linkMode{t, config}
 }
 
 func (al *linkMode) Evaluate(cores int64, memory int64, pod *v1.Pod) []*nvidia.NvidiaNode {
@@ -67,7 +69,7 @@ func (al *linkMode) Evaluate(cores int64, memory int64, pod *v1.Pod) []*nvidia.N
 	for _, node := range al.tree.Leaves() {
 		for node != root {
 			klog.V(2).Infof("Test %d mask %b", node.Meta.ID, node.Mask)
-			if node.Available() < num {
+			if poolAvailable(al.config, pod, node) < num {
 				node = node.Parent
 				continue
 			}
@@ -100,6 +102,9 @@ func (al *linkMode) Evaluate(cores int64, memory int64, pod *v1.Pod) []*nvidia.N
 				node.Meta.MinorID, node.Meta.Name, fmt.Sprintf("%s or %s", types.PodAnnotationUseGpuType, types.PodAnnotationUnUseGpuType))
 			continue
 		}
+		if !checkPool(al.config, pod, node, true) {
+			continue
+		}
 
 		klog.V(2).Infof("Pick up %d mask %b", node.Meta.ID, node.Mask)
 		nodes = append(nodes, node)
@@ -45,7 +45,7 @@ GPU4     SOC     SOC     SOC     SOC      X      PIX
 GPU5     SOC     SOC     SOC     SOC     PIX      X
 `
 	tree.Init(testCase1)
-	algo := NewLinkMode(tree)
+	algo := NewLinkMode(tree, nil)
 
 	expectCase1 := []string{
 		"/dev/nvidia0",
@@ -0,0 +1,55 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package nvidia
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+
+	"tkestack.io/gpu-manager/pkg/config"
+	"tkestack.io/gpu-manager/pkg/device/nvidia"
+	"tkestack.io/gpu-manager/pkg/types"
+)
+
+// checkPool returns true if the pool selected by pod allows node, exclusive
+// is true if the container requests whole GPUs
+func checkPool(cfg *config.Config, pod *v1.Pod, node *nvidia.NvidiaNode, exclusive bool) bool {
+	pool := pod.Annotations[types.PodAnnotationGPUPool]
+	if cfg.PoolAllows(pool, node.Meta.ID, node.Meta.UUID, exclusive) {
+		return true
+	}
+	// 设备不属于pod选择的资源池或资源池模式不匹配
+	klog.V(2).Infof("current gpu device %d is not allowed by pool %q of pod %s, skip device",
+		node.Meta.ID, pool, pod.Name)
+	return false
+}
+
+// poolAvailable returns count of available leaves of node which can be used
+// as whole GPUs by pod
+func poolAvailable(cfg *config.Config, pod *v1.Pod, node *nvidia.NvidiaNode) int {
+	if cfg == nil || len(cfg.Pools) == 0 {
+		return node.Available()
+	}
+	pool, n := pod.Annotations[types.PodAnnotationGPUPool], 0
+	for _, leaf := range node.GetAvailableLeaves() {
+		if cfg.PoolAllows(pool, leaf.Meta.ID, leaf.Meta.UUID, true) {
+			n++
+		}
+	}
+	return n
+}
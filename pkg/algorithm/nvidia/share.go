@@ -65,6 +65,14 @@ func (al *shareMode) Evaluate(cores int64, memory int64, pod *v1.Pod) []*nvidia.
 			// 按设备index
 			nvidia.ByMinorID)
 	)
+	// spread策略优先选择剩余资源多的设备
+	if al.config.Live.PlacementPolicy() == config.PlacementSpread {
+		sorter = shareModeSort(
+			reverse(nvidia.ByAllocatableCores),
+			reverse(nvidia.ByAllocatableMemory),
+			nvidia.ByPids,
+			nvidia.ByMinorID)
+	}
 
 	for i := 0; i < al.tree.Total(); i++ {
 		tmpStore[i] = al.tree.Leaves()[i]
@@ -87,6 +95,9 @@ func (al *shareMode) Evaluate(cores int64, memory int64, pod *v1.Pod) []*nvidia.
 					node.Meta.MinorID, node.Meta.Name, fmt.Sprintf("%s or %s", types.PodAnnotationUseGpuType, types.PodAnnotationUnUseGpuType))
 				continue
 			}
+			if !checkPool(al.config, pod, node, false) {
+				continue
+			}
 
 			klog.V(2).Infof("Pick up %d mask %b, cores: %d, memory: %d", node.Meta.ID, node.Mask, node.AllocatableMeta.Cores, node.AllocatableMeta.Memory)
 			nodes = append(nodes, node)
@@ -97,6 +108,12 @@ func (al *shareMode) Evaluate(cores int64, memory int64, pod *v1.Pod) []*nvidia.
 	return nodes
 }
 
+func reverse(less nvidia.LessFunc) nvidia.LessFunc {
+	return func(p1, p2 *nvidia.NvidiaNode) bool {
+		return less(p2, p1)
+	}
+}
+
 type shareModePriority struct {
 	data []*nvidia.NvidiaNode
 	less []nvidia.LessFunc
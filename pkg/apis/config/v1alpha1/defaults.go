@@ -0,0 +1,88 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package v1alpha1
+
+import (
+	"time"
+)
+
+const (
+	DefaultDriver                = "nvidia"
+	DefaultQueryPort             = 5678
+	DefaultQueryAddr             = "localhost"
+	DefaultSamplePeriod          = time.Second
+	DefaultDeviceMemoryScaling   = 1
+	DefaultVirtualManagerPath    = "/etc/gpu-manager/vm"
+	DefaultAllocationCheckPeriod = 30 * time.Second
+	DefaultHeartbeatPeriod       = 30 * time.Second
+	DefaultCheckpointPath        = "/etc/gpu-manager/checkpoint"
+	DefaultShareBackend          = "vcuda"
+	DefaultMPSPath               = "/etc/gpu-manager/mps"
+	DefaultRequestTimeout        = 5 * time.Second
+	DefaultWaitTimeout           = time.Minute
+)
+
+// SetDefaults_GPUManagerConfiguration sets defaults for fields not set in the
+// configuration file. The runtime endpoint, cgroup driver and device plugin
+// path are left empty to be discovered from kubelet.
+func SetDefaults_GPUManagerConfiguration(obj *GPUManagerConfiguration) {
+	if len(obj.APIVersion) == 0 {
+		obj.APIVersion = SchemeGroupVersion.String()
+	}
+	if len(obj.Kind) == 0 {
+		obj.Kind = Kind
+	}
+	if len(obj.Driver) == 0 {
+		obj.Driver = DefaultDriver
+	}
+	if obj.QueryPort == 0 {
+		obj.QueryPort = DefaultQueryPort
+	}
+	if len(obj.QueryAddr) == 0 {
+		obj.QueryAddr = DefaultQueryAddr
+	}
+	if obj.SamplePeriod.Duration == 0 {
+		obj.SamplePeriod.Duration = DefaultSamplePeriod
+	}
+	if len(obj.VirtualManagerPath) == 0 {
+		obj.VirtualManagerPath = DefaultVirtualManagerPath
+	}
+	if len(obj.CheckpointPath) == 0 {
+		obj.CheckpointPath = DefaultCheckpointPath
+	}
+	if len(obj.ShareBackend) == 0 {
+		obj.ShareBackend = DefaultShareBackend
+	}
+	if len(obj.MPSPath) == 0 {
+		obj.MPSPath = DefaultMPSPath
+	}
+	if obj.AllocationCheckPeriod.Duration == 0 {
+		obj.AllocationCheckPeriod.Duration = DefaultAllocationCheckPeriod
+	}
+	if obj.HeartbeatPeriod.Duration == 0 {
+		obj.HeartbeatPeriod.Duration = DefaultHeartbeatPeriod
+	}
+	if obj.DeviceMemoryScaling == 0 {
+		obj.DeviceMemoryScaling = DefaultDeviceMemoryScaling
+	}
+	if obj.RuntimeRequestTimeout.Duration == 0 {
+		obj.RuntimeRequestTimeout.Duration = DefaultRequestTimeout
+	}
+	if obj.WaitTimeout.Duration == 0 {
+		obj.WaitTimeout.Duration = DefaultWaitTimeout
+	}
+}
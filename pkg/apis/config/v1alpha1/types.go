@@ -0,0 +1,93 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupName is the group name of the gpu-manager configuration
+const GroupName = "config.gpu.tydic.io"
+
+// Kind is the kind of the gpu-manager configuration
+const Kind = "GPUManagerConfiguration"
+
+// SchemeGroupVersion is group version of the gpu-manager configuration
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha1"}
+
+// GPUManagerConfiguration contains every option of gpu-manager, each field has
+// a command line flag with the same meaning which overrides it
+type GPUManagerConfiguration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Driver is the driver name for manager, --driver
+	Driver string `json:"driver,omitempty"`
+	// ExtraConfigPath is the extra config file location, --extra-config
+	ExtraConfigPath string `json:"extraConfigPath,omitempty"`
+	// VolumeConfigPath is the volume config file location, --volume-config
+	VolumeConfigPath string `json:"volumeConfigPath,omitempty"`
+	// DriverRefreshCommand rebuilds ld.so.cache after host driver is upgraded, --driver-refresh-command
+	DriverRefreshCommand string `json:"driverRefreshCommand,omitempty"`
+	// QueryPort is the port for query statistics information, --query-port
+	QueryPort int `json:"queryPort,omitempty"`
+	// QueryAddr is the address for query statistics information, --query-addr
+	QueryAddr string `json:"queryAddr,omitempty"`
+	// KubeConfig is the path to kubeconfig file, in cluster config is used if empty, --kubeconfig
+	KubeConfig string `json:"kubeConfig,omitempty"`
+	// SamplePeriod is the sample period for each card, --sample-period
+	SamplePeriod metav1.Duration `json:"samplePeriod,omitempty"`
+	// NodeLabels are labels added to this node, --node-labels
+	NodeLabels map[string]string `json:"nodeLabels,omitempty"`
+	// HostnameOverride is used as identification instead of the actual hostname, --hostname-override
+	HostnameOverride string `json:"hostnameOverride,omitempty"`
+	// VirtualManagerPath is the path for virtual manager store files, --virtual-manager-path
+	VirtualManagerPath string `json:"virtualManagerPath,omitempty"`
+	// DevicePluginPath is the path for kubelet receive device plugin registration, --device-plugin-path
+	DevicePluginPath string `json:"devicePluginPath,omitempty"`
+	// CheckpointPath is the path for checkpoint store file, --checkpoint-path
+	CheckpointPath string `json:"checkpointPath,omitempty"`
+	// ShareMode enables share mode allocation, --share-mode
+	ShareMode bool `json:"shareMode,omitempty"`
+	// ShareBackend limits containers in share mode, vcuda or mps, --share-backend
+	ShareBackend string `json:"shareBackend,omitempty"`
+	// WholeGPUResource advertises whole GPUs as nvidia.com/gpu besides vcuda resources, --whole-gpu-resource
+	WholeGPUResource bool `json:"wholeGPUResource,omitempty"`
+	// Standalone chooses GPUs for vcuda requests without gpu-admission, --standalone
+	Standalone bool `json:"standalone,omitempty"`
+	// Preemption evicts share mode pods with lower priority for shared GPU requests, --preemption
+	Preemption bool `json:"preemption,omitempty"`
+	// MPSPath is the host path for pipe and log directories of MPS control daemons, --mps-path
+	MPSPath string `json:"mpsPath,omitempty"`
+	// AllocationCheckPeriod is the period of allocation check, --allocation-check-period
+	AllocationCheckPeriod metav1.Duration `json:"allocationCheckPeriod,omitempty"`
+	// HeartbeatPeriod is the period of node heartbeat annotation, --heartbeat-period
+	HeartbeatPeriod metav1.Duration `json:"heartbeatPeriod,omitempty"`
+	// PublishGPUNode publishes devices and allocations to the GPUNode resource, --publish-gpunode
+	PublishGPUNode bool `json:"publishGPUNode,omitempty"`
+	// DeviceMemoryScaling is the ratio of device memory registered, between 0 and 1, --device-memory-scaling
+	DeviceMemoryScaling float64 `json:"deviceMemoryScaling,omitempty"`
+	// ContainerRuntimeEndpoint is the container runtime endpoint, discovered from kubelet if empty,
+	// --container-runtime-endpoint
+	ContainerRuntimeEndpoint string `json:"containerRuntimeEndpoint,omitempty"`
+	// CgroupDriver is the cgroup driver of kubelet, discovered from kubelet if empty, --cgroup-driver
+	CgroupDriver string `json:"cgroupDriver,omitempty"`
+	// RuntimeRequestTimeout is the timeout of requests to container runtime, --runtime-request-timeout
+	RuntimeRequestTimeout metav1.Duration `json:"runtimeRequestTimeout,omitempty"`
+	// WaitTimeout is the timeout for resource server ready, --wait-timeout
+	WaitTimeout metav1.Duration `json:"waitTimeout,omitempty"`
+}
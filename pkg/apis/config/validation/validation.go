@@ -0,0 +1,130 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package validation
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"tkestack.io/gpu-manager/pkg/apis/config/v1alpha1"
+	"tkestack.io/gpu-manager/pkg/config"
+	"tkestack.io/gpu-manager/pkg/services/volume"
+	"tkestack.io/gpu-manager/pkg/types"
+)
+
+var (
+	supportedDrivers       = sets.NewString("nvidia", "dummy")
+	supportedShareBackends = sets.NewString(types.ShareBackendVCuda, types.ShareBackendMPS)
+	// 为空时从kubelet或者节点配置中获取
+	supportedCgroupDrivers = sets.NewString("", "cgroupfs", "systemd")
+)
+
+// ValidateGPUManagerConfiguration returns errors of fields in the configuration
+func ValidateGPUManagerConfiguration(c *v1alpha1.GPUManagerConfiguration) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if c.APIVersion != v1alpha1.SchemeGroupVersion.String() {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("apiVersion"), c.APIVersion,
+			[]string{v1alpha1.SchemeGroupVersion.String()}))
+	}
+	if c.Kind != v1alpha1.Kind {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("kind"), c.Kind, []string{v1alpha1.Kind}))
+	}
+	if !supportedDrivers.Has(c.Driver) {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("driver"), c.Driver, supportedDrivers.List()))
+	}
+	if c.QueryPort <= 0 || c.QueryPort > 65535 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("queryPort"), c.QueryPort, "must be between 1 and 65535"))
+	}
+	if c.DeviceMemoryScaling <= 0 || c.DeviceMemoryScaling > 1 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("deviceMemoryScaling"), c.DeviceMemoryScaling,
+			"must be greater than 0 and no more than 1"))
+	}
+	if !supportedShareBackends.Has(c.ShareBackend) {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("shareBackend"), c.ShareBackend, supportedShareBackends.List()))
+	}
+	if !supportedCgroupDrivers.Has(strings.ToLower(c.CgroupDriver)) {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("cgroupDriver"), c.CgroupDriver,
+			[]string{"cgroupfs", "systemd"}))
+	}
+
+	periods := map[string]int64{
+		"samplePeriod":          int64(c.SamplePeriod.Duration),
+		"allocationCheckPeriod": int64(c.AllocationCheckPeriod.Duration),
+		"heartbeatPeriod":       int64(c.HeartbeatPeriod.Duration),
+		"runtimeRequestTimeout": int64(c.RuntimeRequestTimeout.Duration),
+		"waitTimeout":           int64(c.WaitTimeout.Duration),
+	}
+	for _, name := range sets.StringKeySet(periods).List() {
+		if periods[name] <= 0 {
+			allErrs = append(allErrs, field.Invalid(field.NewPath(name), periods[name], "must be greater than 0"))
+		}
+	}
+
+	if len(c.VirtualManagerPath) == 0 {
+		allErrs = append(allErrs, field.Required(field.NewPath("virtualManagerPath"), ""))
+	}
+	if len(c.CheckpointPath) == 0 {
+		allErrs = append(allErrs, field.Required(field.NewPath("checkpointPath"), ""))
+	}
+
+	allErrs = append(allErrs, validateExtraConfig(field.NewPath("extraConfigPath"), c.ExtraConfigPath)...)
+	allErrs = append(allErrs, validateVolumeConfig(field.NewPath("volumeConfigPath"), c.VolumeConfigPath)...)
+	return allErrs
+}
+
+func validateExtraConfig(fldPath *field.Path, path string) field.ErrorList {
+	if len(path) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, path, err.Error())}
+	}
+	extra := make(map[string]*config.ExtraConfig)
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return field.ErrorList{field.Invalid(fldPath, path, err.Error())}
+	}
+	return nil
+}
+
+func validateVolumeConfig(fldPath *field.Path, path string) field.ErrorList {
+	if len(path) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, path, err.Error())}
+	}
+	volumes := struct {
+		Config []volume.Config `json:"volume"`
+	}{}
+	if err := json.Unmarshal(data, &volumes); err != nil {
+		return field.ErrorList{field.Invalid(fldPath, path, err.Error())}
+	}
+	var allErrs field.ErrorList
+	for i, v := range volumes.Config {
+		if len(v.Name) == 0 {
+			allErrs = append(allErrs, field.Required(fldPath.Key(path).Child("volume").Index(i).Child("name"), ""))
+		}
+	}
+	return allErrs
+}
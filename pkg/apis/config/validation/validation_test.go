@@ -0,0 +1,65 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package validation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tkestack.io/gpu-manager/pkg/apis/config/v1alpha1"
+)
+
+func TestValidateGPUManagerConfiguration(t *testing.T) {
+	newConfig := func() *v1alpha1.GPUManagerConfiguration {
+		c := &v1alpha1.GPUManagerConfiguration{}
+		v1alpha1.SetDefaults_GPUManagerConfiguration(c)
+		return c
+	}
+	if errs := ValidateGPUManagerConfiguration(newConfig()); len(errs) > 0 {
+		t.Fatalf("defaulted configuration should be valid, %v", errs)
+	}
+
+	extraConfig := filepath.Join(t.TempDir(), "extra-config.json")
+	if err := os.WriteFile(extraConfig, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		field  string
+		modify func(c *v1alpha1.GPUManagerConfiguration)
+	}{
+		{"kind", func(c *v1alpha1.GPUManagerConfiguration) { c.Kind = "KubeletConfiguration" }},
+		{"driver", func(c *v1alpha1.GPUManagerConfiguration) { c.Driver = "amd" }},
+		{"queryPort", func(c *v1alpha1.GPUManagerConfiguration) { c.QueryPort = 70000 }},
+		{"deviceMemoryScaling", func(c *v1alpha1.GPUManagerConfiguration) { c.DeviceMemoryScaling = 1.5 }},
+		{"shareBackend", func(c *v1alpha1.GPUManagerConfiguration) { c.ShareBackend = "mig" }},
+		{"cgroupDriver", func(c *v1alpha1.GPUManagerConfiguration) { c.CgroupDriver = "openrc" }},
+		{"heartbeatPeriod", func(c *v1alpha1.GPUManagerConfiguration) { c.HeartbeatPeriod.Duration = -time.Second }},
+		{"checkpointPath", func(c *v1alpha1.GPUManagerConfiguration) { c.CheckpointPath = "" }},
+		{"extraConfigPath", func(c *v1alpha1.GPUManagerConfiguration) { c.ExtraConfigPath = extraConfig }},
+	}
+	for _, tc := range testCases {
+		c := newConfig()
+		tc.modify(c)
+		errs := ValidateGPUManagerConfiguration(c)
+		if len(errs) != 1 || errs[0].Field != tc.field {
+			t.Errorf("expect an error of %s, got %v", tc.field, errs)
+		}
+	}
+}
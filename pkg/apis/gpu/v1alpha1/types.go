@@ -0,0 +1,106 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// GPUNode describes GPU devices of a node and their allocations,
+// it has the same name as the node and its status is maintained by gpu-manager.
+type GPUNode struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GPUNodeSpec   `json:"spec,omitempty"`
+	Status GPUNodeStatus `json:"status,omitempty"`
+}
+
+// GPUNodeSpec is the spec of GPUNode
+type GPUNodeSpec struct {
+	// NodeName is the name of node which devices belong to
+	NodeName string `json:"nodeName"`
+}
+
+// GPUNodeStatus is the observed state of devices of a node
+type GPUNodeStatus struct {
+	// Capacity is total resource of healthy devices
+	Capacity GPUResource `json:"capacity"`
+	// Allocatable is resource of healthy devices not allocated yet
+	Allocatable GPUResource `json:"allocatable"`
+	Devices     []GPUDevice `json:"devices,omitempty"`
+	// LastUpdateTime is the last time status is changed
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// GPUResource is amount of vcuda resource, cores are in percent of a
+// device and memory is in MiB.
+type GPUResource struct {
+	Cores  int64 `json:"cores"`
+	Memory int64 `json:"memory"`
+}
+
+// GPUDevice describes a GPU device
+type GPUDevice struct {
+	Index int    `json:"index"`
+	UUID  string `json:"uuid,omitempty"`
+	// Path is the device file on host, e.g. /dev/nvidia0
+	Path              string `json:"path,omitempty"`
+	Model             string `json:"model,omitempty"`
+	ComputeCapability int    `json:"computeCapability,omitempty"`
+	MIG               bool   `json:"mig,omitempty"`
+	Healthy           bool   `json:"healthy"`
+	// Reasons explain why the device is unhealthy or can't be allocated
+	Reasons []string `json:"reasons,omitempty"`
+	// Pool is the name of pool containing the device
+	Pool        string         `json:"pool,omitempty"`
+	Capacity    GPUResource    `json:"capacity"`
+	Allocatable GPUResource    `json:"allocatable"`
+	Topology    []TopologyLink `json:"topology,omitempty"`
+	Pods        []AllocatedPod `json:"pods,omitempty"`
+}
+
+// TopologyLink contains indexes of devices connected with the device at
+// Level, e.g. PIX, PXB, PHB or SYS.
+type TopologyLink struct {
+	Level string `json:"level"`
+	Peers []int  `json:"peers"`
+}
+
+// AllocatedPod is a container which is allocated resource of a device
+type AllocatedPod struct {
+	Namespace string      `json:"namespace,omitempty"`
+	Name      string      `json:"name,omitempty"`
+	UID       string      `json:"uid"`
+	Container string      `json:"container"`
+	Resource  GPUResource `json:"resource"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// GPUNodeList is a list of GPUNode
+type GPUNodeList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []GPUNode `json:"items"`
+}
@@ -36,25 +36,66 @@ type Config struct {
 	VirtualManagerPath       string
 	DevicePluginPath         string
 	VolumeConfigPath         string
+	DriverRefreshCommand     string
 	EnableShare              bool
+	ShareBackend             string
+	WholeGPUResource         bool
+	Standalone               bool
+	EnablePreemption         bool
+	MPSPath                  string
 	AllocationCheckPeriod    time.Duration
 	CheckpointPath           string
 	ContainerRuntimeEndpoint string
 	CgroupDriver             string
 	RequestTimeout           time.Duration
+	HeartbeatPeriod          time.Duration
+	PublishGPUNode           bool
+	// MemoryBlockSize is the bytes of one vcuda-memory resource, types.MemoryBlockSize if 0
+	MemoryBlockSize int64
+	// Pools partition GPUs of the node
+	Pools []PoolConfig
+	// Overcommit contains default overcommit ratios of GPUs in share pools
+	Overcommit *OvercommitConfig
+	// Live contains settings which can be changed without restarting
+	Live *LiveConfig
 
 	DeviceMemoryScaling float64
 
 	VCudaRequestsQueue chan *types.VCudaRequest
 }
 
-type NodeConfigs struct {
-	NodeConfig []struct {
-		Name                     string  `json:"name"`
-		ContainerRuntimeEndpoint string  `json:"containerRuntimeEndpoint,omitempty"`
-		CgroupDriver             string  `json:"cgroupDriver,omitempty"`
-		DeviceMemoryScaling      float64 `json:"deviceMemoryScaling,omitempty"`
-	} `json:"nodeConfig"`
+// GetMemoryBlockSize returns the bytes of one vcuda-memory resource
+func (c *Config) GetMemoryBlockSize() int64 {
+	if c != nil && c.MemoryBlockSize > 0 {
+		return c.MemoryBlockSize
+	}
+	return types.MemoryBlockSize
+}
+
+// HealthConfig contains rules which mark GPUs of the node unhealthy
+type HealthConfig struct {
+	// ExpectedGPUs is the number of GPUs the node should have, 0 disables the check
+	ExpectedGPUs int `json:"expectedGPUs,omitempty"`
+	// MaxResetFailures is the number of failed resets before a GPU is unhealthy
+	MaxResetFailures int `json:"maxResetFailures,omitempty"`
+	// Taint adds a NoSchedule taint to the node when GPUs are unhealthy
+	Taint bool `json:"taint,omitempty"`
+	// DisabledRules are names of rules which are not checked
+	DisabledRules []string `json:"disabledRules,omitempty"`
+}
+
+// QuotaConfig limits GPUs used by pods of a namespace on the node, limits
+// which are not set are unlimited
+type QuotaConfig struct {
+	Namespace string `json:"namespace"`
+	// Model limits only GPUs whose model contains it, e.g. A100, all GPUs if empty
+	Model string `json:"model,omitempty"`
+	// ExclusiveGPUs is the number of GPUs used by containers requesting whole cards
+	ExclusiveGPUs *int64 `json:"exclusiveGPUs,omitempty"`
+	// SharedCores is the vcuda-core used by containers sharing GPUs
+	SharedCores *int64 `json:"sharedCores,omitempty"`
+	// Memory is the MiB of vcuda-memory
+	Memory *int64 `json:"memory,omitempty"`
 }
 
 // ExtraConfig contains extra options other than Config
@@ -0,0 +1,100 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"reflect"
+	"sync"
+)
+
+// LiveConfig contains settings which can be updated while gpu-manager is
+// running. A nil LiveConfig returns the defaults.
+type LiveConfig struct {
+	lock            sync.RWMutex
+	placementPolicy string
+	health          HealthConfig
+	quotas          []QuotaConfig
+}
+
+// NewLiveConfig returns a LiveConfig with the given settings
+func NewLiveConfig(placementPolicy string, health *HealthConfig) *LiveConfig {
+	live := &LiveConfig{}
+	live.Update(placementPolicy, health)
+	return live
+}
+
+// PlacementPolicy returns the policy to choose a GPU for shared containers
+func (l *LiveConfig) PlacementPolicy() string {
+	if l == nil {
+		return PlacementBinpack
+	}
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.placementPolicy
+}
+
+// Health returns the rules of GPU health check
+func (l *LiveConfig) Health() HealthConfig {
+	if l == nil {
+		return HealthConfig{}
+	}
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.health
+}
+
+// Update replaces the settings and returns whether they are changed
+func (l *LiveConfig) Update(placementPolicy string, health *HealthConfig) bool {
+	if len(placementPolicy) == 0 {
+		placementPolicy = PlacementBinpack
+	}
+	newHealth := HealthConfig{}
+	if health != nil {
+		newHealth = *health
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.placementPolicy == placementPolicy && reflect.DeepEqual(l.health, newHealth) {
+		return false
+	}
+	l.placementPolicy = placementPolicy
+	l.health = newHealth
+	return true
+}
+
+// Quotas returns GPU quotas of namespaces
+func (l *LiveConfig) Quotas() []QuotaConfig {
+	if l == nil {
+		return nil
+	}
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.quotas
+}
+
+// UpdateQuotas replaces GPU quotas and returns whether they are changed
+func (l *LiveConfig) UpdateQuotas(quotas []QuotaConfig) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if reflect.DeepEqual(l.quotas, quotas) {
+		return false
+	}
+	l.quotas = quotas
+	return true
+}
@@ -0,0 +1,275 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// PlacementBinpack places shared containers on the GPU with the least allocatable resources
+	PlacementBinpack = "binpack"
+	// PlacementSpread places shared containers on the GPU with the most allocatable resources
+	PlacementSpread = "spread"
+)
+
+// NodeConfigs is the content of the node config file
+type NodeConfigs struct {
+	NodeConfig []NodeConfig `json:"nodeConfig"`
+}
+
+// NodeConfig contains settings for the nodes it selects. An entry selects the
+// node with the same name, or nodes matching its nodeSelector, or every node
+// when both are empty.
+type NodeConfig struct {
+	Name         string                `json:"name,omitempty"`
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+
+	ContainerRuntimeEndpoint string  `json:"containerRuntimeEndpoint,omitempty"`
+	CgroupDriver             string  `json:"cgroupDriver,omitempty"`
+	DeviceMemoryScaling      float64 `json:"deviceMemoryScaling,omitempty"`
+	ShareMode                *bool   `json:"shareMode,omitempty"`
+	ShareBackend             string  `json:"shareBackend,omitempty"`
+	// MemoryBlockSize is the MiB of one vcuda-memory resource
+	MemoryBlockSize int64 `json:"memoryBlockSize,omitempty"`
+	// Pools partition GPUs of the node
+	Pools []PoolConfig `json:"pools,omitempty"`
+	// Overcommit contains default overcommit ratios of GPUs in share pools
+	Overcommit *OvercommitConfig `json:"overcommit,omitempty"`
+
+	// PlacementPolicy, Health and Quotas are applied without restarting
+	PlacementPolicy string        `json:"placementPolicy,omitempty"`
+	Health          *HealthConfig `json:"health,omitempty"`
+	Quotas          []QuotaConfig `json:"quotas,omitempty"`
+}
+
+// LoadNodeConfigs reads the node config file
+func LoadNodeConfigs(path string) (*NodeConfigs, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	configs := &NodeConfigs{}
+	if err := json.Unmarshal(data, configs); err != nil {
+		return nil, fmt.Errorf("can't decode %s, %v", path, err)
+	}
+	return configs, nil
+}
+
+// Validate checks settings of the node config
+func (c *NodeConfig) Validate() error {
+	switch c.PlacementPolicy {
+	case "", PlacementBinpack, PlacementSpread:
+	default:
+		return fmt.Errorf("unknown placement policy %s, only support [ %s | %s ]",
+			c.PlacementPolicy, PlacementBinpack, PlacementSpread)
+	}
+	if c.MemoryBlockSize < 0 {
+		return fmt.Errorf("memory block size %d is negative", c.MemoryBlockSize)
+	}
+	if err := c.Overcommit.validate("node"); err != nil {
+		return err
+	}
+	if err := validatePools(c.Pools); err != nil {
+		return err
+	}
+	if c.Overcommit.enabled() {
+		// 只有共享资源池中的设备会超卖
+		shared := false
+		for _, p := range c.Pools {
+			shared = shared || p.Mode == PoolShare
+		}
+		if !shared {
+			return fmt.Errorf("overcommit of node only applies to %s pools, but there isn't any", PoolShare)
+		}
+	}
+	for i, q := range c.Quotas {
+		if len(q.Namespace) == 0 {
+			return fmt.Errorf("namespace of quota %d is empty", i)
+		}
+		for _, limit := range []*int64{q.ExclusiveGPUs, q.SharedCores, q.Memory} {
+			if limit != nil && *limit < 0 {
+				return fmt.Errorf("quota of namespace %s is negative", q.Namespace)
+			}
+		}
+	}
+	return nil
+}
+
+// precedence returns the precedence of the entry for the node, -1 if the
+// entry doesn't select it. An entry with name wins over entries with
+// selector, and a selector with more requirements wins over fewer.
+func (c *NodeConfig) precedence(nodeName string, nodeLabels map[string]string) (int, error) {
+	if len(c.Name) > 0 {
+		if c.Name != nodeName {
+			return -1, nil
+		}
+		return int(^uint(0) >> 1), nil
+	}
+	if c.NodeSelector == nil {
+		return 0, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(c.NodeSelector)
+	if err != nil {
+		return -1, err
+	}
+	if !selector.Matches(labels.Set(nodeLabels)) {
+		return -1, nil
+	}
+	return 1 + len(c.NodeSelector.MatchLabels) + len(c.NodeSelector.MatchExpressions), nil
+}
+
+// HasNodeSelector returns true if any entry selects nodes by labels
+func (c *NodeConfigs) HasNodeSelector() bool {
+	for i := range c.NodeConfig {
+		if c.NodeConfig[i].NodeSelector != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Select merges entries selecting the node. Each setting comes from the entry
+// with the highest precedence which sets it, entries with the same precedence
+// are taken in file order.
+func (c *NodeConfigs) Select(nodeName string, nodeLabels map[string]string) (*NodeConfig, error) {
+	type matched struct {
+		precedence int
+		config     *NodeConfig
+	}
+	var matches []matched
+	for i := range c.NodeConfig {
+		precedence, err := c.NodeConfig[i].precedence(nodeName, nodeLabels)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nodeSelector of node config %d, %v", i, err)
+		}
+		if precedence >= 0 {
+			matches = append(matches, matched{precedence, &c.NodeConfig[i]})
+		}
+	}
+	// 优先级高的配置最后合并，同优先级时文件中靠前的生效
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].precedence > matches[j].precedence
+	})
+
+	merged := &NodeConfig{Name: nodeName}
+	for i := len(matches) - 1; i >= 0; i-- {
+		merged.merge(matches[i].config)
+	}
+	return merged, nil
+}
+
+func (c *NodeConfig) merge(o *NodeConfig) {
+	if len(o.ContainerRuntimeEndpoint) > 0 {
+		c.ContainerRuntimeEndpoint = o.ContainerRuntimeEndpoint
+	}
+	if len(o.CgroupDriver) > 0 {
+		c.CgroupDriver = o.CgroupDriver
+	}
+	if o.DeviceMemoryScaling > 0 {
+		c.DeviceMemoryScaling = o.DeviceMemoryScaling
+	}
+	if o.ShareMode != nil {
+		c.ShareMode = o.ShareMode
+	}
+	if len(o.ShareBackend) > 0 {
+		c.ShareBackend = o.ShareBackend
+	}
+	if o.MemoryBlockSize > 0 {
+		c.MemoryBlockSize = o.MemoryBlockSize
+	}
+	if o.Pools != nil {
+		c.Pools = o.Pools
+	}
+	if o.Overcommit != nil {
+		c.Overcommit = o.Overcommit
+	}
+	if len(o.PlacementPolicy) > 0 {
+		c.PlacementPolicy = o.PlacementPolicy
+	}
+	if o.Health != nil {
+		c.Health = o.Health
+	}
+	if o.Quotas != nil {
+		c.Quotas = o.Quotas
+	}
+}
+
+// Apply sets the node config to cfg, it should be called before gpu-manager starts
+func (c *NodeConfig) Apply(cfg *Config) {
+	if len(c.CgroupDriver) > 0 {
+		cfg.CgroupDriver = c.CgroupDriver
+	}
+	if len(c.ContainerRuntimeEndpoint) > 0 {
+		cfg.ContainerRuntimeEndpoint = c.ContainerRuntimeEndpoint
+	}
+	if c.DeviceMemoryScaling > 0 {
+		cfg.DeviceMemoryScaling = c.DeviceMemoryScaling
+	}
+	if c.ShareMode != nil {
+		cfg.EnableShare = *c.ShareMode
+	}
+	if len(c.ShareBackend) > 0 {
+		cfg.ShareBackend = c.ShareBackend
+	}
+	if c.MemoryBlockSize > 0 {
+		cfg.MemoryBlockSize = c.MemoryBlockSize << 20
+	}
+	cfg.Pools = c.Pools
+	cfg.Overcommit = c.Overcommit
+	cfg.Live = NewLiveConfig(c.PlacementPolicy, c.Health)
+	cfg.Live.UpdateQuotas(c.Quotas)
+}
+
+// RestartRequired returns names of settings changed from c to o which are
+// only applied after restarting
+func (c *NodeConfig) RestartRequired(o *NodeConfig) []string {
+	var names []string
+	if c.ContainerRuntimeEndpoint != o.ContainerRuntimeEndpoint {
+		names = append(names, "containerRuntimeEndpoint")
+	}
+	if c.CgroupDriver != o.CgroupDriver {
+		names = append(names, "cgroupDriver")
+	}
+	if c.DeviceMemoryScaling != o.DeviceMemoryScaling {
+		names = append(names, "deviceMemoryScaling")
+	}
+	if !reflect.DeepEqual(c.ShareMode, o.ShareMode) {
+		names = append(names, "shareMode")
+	}
+	if c.ShareBackend != o.ShareBackend {
+		names = append(names, "shareBackend")
+	}
+	if c.MemoryBlockSize != o.MemoryBlockSize {
+		names = append(names, "memoryBlockSize")
+	}
+	if !reflect.DeepEqual(c.Pools, o.Pools) {
+		names = append(names, "pools")
+	}
+	if !reflect.DeepEqual(c.Overcommit, o.Overcommit) {
+		names = append(names, "overcommit")
+	}
+	return names
+}
@@ -0,0 +1,177 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testNodeConfigs = `{
+    "nodeConfig": [
+        {
+            "deviceMemoryScaling": 0.9,
+            "cgroupDriver": "systemd"
+        },
+        {
+            "nodeSelector": {"matchLabels": {"gpu": "a100", "zone": "a"}},
+            "placementPolicy": "spread",
+            "memoryBlockSize": 256
+        },
+        {
+            "nodeSelector": {"matchLabels": {"gpu": "a100"}},
+            "placementPolicy": "binpack",
+            "shareMode": true,
+            "shareBackend": "mps"
+        },
+        {
+            "nodeSelector": {"matchExpressions": [{"key": "gpu", "operator": "In", "values": ["t4"]}]},
+            "shareBackend": "vcuda"
+        },
+        {
+            "name": "node-1",
+            "deviceMemoryScaling": 0.5,
+            "health": {"expectedGPUs": 8, "taint": true}
+        }
+    ]
+}`
+
+func TestSelectNodeConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(testNodeConfigs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configs, err := LoadNodeConfigs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shareMode := true
+	if !configs.HasNodeSelector() || (&NodeConfigs{NodeConfig: []NodeConfig{{Name: "node-1"}}}).HasNodeSelector() {
+		t.Errorf("unexpected HasNodeSelector")
+	}
+
+	testCases := []struct {
+		node   string
+		labels map[string]string
+		expect NodeConfig
+	}{
+		{
+			node:   "node-1",
+			labels: map[string]string{"gpu": "a100", "zone": "a"},
+			expect: NodeConfig{
+				Name:                "node-1",
+				CgroupDriver:        "systemd",
+				DeviceMemoryScaling: 0.5,
+				ShareMode:           &shareMode,
+				ShareBackend:        "mps",
+				MemoryBlockSize:     256,
+				PlacementPolicy:     "spread",
+				Health:              &HealthConfig{ExpectedGPUs: 8, Taint: true},
+			},
+		},
+		{
+			node:   "node-2",
+			labels: map[string]string{"gpu": "a100", "zone": "b"},
+			expect: NodeConfig{
+				Name:                "node-2",
+				CgroupDriver:        "systemd",
+				DeviceMemoryScaling: 0.9,
+				ShareMode:           &shareMode,
+				ShareBackend:        "mps",
+				PlacementPolicy:     "binpack",
+			},
+		},
+		{
+			node:   "node-3",
+			labels: map[string]string{"gpu": "t4"},
+			expect: NodeConfig{
+				Name:                "node-3",
+				CgroupDriver:        "systemd",
+				DeviceMemoryScaling: 0.9,
+				ShareBackend:        "vcuda",
+			},
+		},
+		{
+			node: "node-4",
+			expect: NodeConfig{
+				Name:                "node-4",
+				CgroupDriver:        "systemd",
+				DeviceMemoryScaling: 0.9,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		got, err := configs.Select(tc.node, tc.labels)
+		if err != nil {
+			t.Errorf("%s: %v", tc.node, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tc.expect) {
+			t.Errorf("%s: expect %+v, got %+v", tc.node, tc.expect, *got)
+		}
+	}
+}
+
+func TestApplyNodeConfig(t *testing.T) {
+	shareMode := true
+	nodeConfig := &NodeConfig{
+		ShareMode:       &shareMode,
+		MemoryBlockSize: 256,
+		PlacementPolicy: PlacementSpread,
+	}
+	cfg := &Config{}
+	nodeConfig.Apply(cfg)
+	if !cfg.EnableShare || cfg.GetMemoryBlockSize() != 256<<20 || cfg.Live.PlacementPolicy() != PlacementSpread {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	// 运行中只更新placementPolicy和health，其他配置需要重启
+	changed := *nodeConfig
+	changed.PlacementPolicy = ""
+	changed.Health = &HealthConfig{Taint: true}
+	changed.ShareBackend = "mps"
+	if !cfg.Live.Update(changed.PlacementPolicy, changed.Health) {
+		t.Errorf("expect live config changed")
+	}
+	if cfg.Live.PlacementPolicy() != PlacementBinpack || !cfg.Live.Health().Taint {
+		t.Errorf("unexpected live config %s %+v", cfg.Live.PlacementPolicy(), cfg.Live.Health())
+	}
+	if names := nodeConfig.RestartRequired(&changed); !reflect.DeepEqual(names, []string{"shareBackend"}) {
+		t.Errorf("unexpected restart required settings %v", names)
+	}
+
+	if err := (&NodeConfig{PlacementPolicy: "random"}).Validate(); err == nil {
+		t.Errorf("expect error for unknown placement policy")
+	}
+
+	// 配额在运行中更新
+	limit := int64(2)
+	quotas := []QuotaConfig{{Namespace: "research", Model: "A100", ExclusiveGPUs: &limit}}
+	if !cfg.Live.UpdateQuotas(quotas) || cfg.Live.UpdateQuotas(quotas) {
+		t.Errorf("expect quotas changed only once")
+	}
+	limit = -1
+	if err := (&NodeConfig{Quotas: quotas}).Validate(); err == nil {
+		t.Errorf("expect error for negative quota")
+	}
+	if err := (&NodeConfig{Quotas: []QuotaConfig{{Model: "A100"}}}).Validate(); err == nil {
+		t.Errorf("expect error for quota without namespace")
+	}
+}
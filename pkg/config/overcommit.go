@@ -0,0 +1,85 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package config
+
+import "fmt"
+
+// OvercommitConfig contains overcommit ratios of shared GPUs, a ratio of 0
+// is treated as 1 which means no overcommit
+type OvercommitConfig struct {
+	// Cores is the ratio of vcuda-core which can be allocated to physical cores
+	Cores float64 `json:"cores,omitempty"`
+	// Memory is the ratio of device memory which can be allocated to physical memory
+	Memory float64 `json:"memory,omitempty"`
+}
+
+// enabled returns true if any ratio is greater than 1
+func (o *OvercommitConfig) enabled() bool {
+	return o != nil && (o.Cores > 1 || o.Memory > 1)
+}
+
+func (o *OvercommitConfig) validate(name string) error {
+	if o == nil {
+		return nil
+	}
+	if o.Cores != 0 && o.Cores < 1 {
+		return fmt.Errorf("cores overcommit ratio %v of %s is less than 1", o.Cores, name)
+	}
+	if o.Memory != 0 && o.Memory < 1 {
+		return fmt.Errorf("memory overcommit ratio %v of %s is less than 1", o.Memory, name)
+	}
+	return nil
+}
+
+// OvercommitOf returns overcommit ratios of cores and memory of the device
+// with index or uuid. Only devices in share pools are overcommitted, since a
+// whole GPU request is charged HundredCore however large the device is.
+// Ratios of pool override ratios of node.
+func (c *Config) OvercommitOf(index int, uuid string) (cores, memory float64) {
+	cores, memory = 1, 1
+	if c == nil {
+		return
+	}
+	p := c.PoolOf(index, uuid)
+	if p == nil || p.Mode != PoolShare {
+		return
+	}
+	if c.Overcommit != nil {
+		cores, memory = ratio(c.Overcommit.Cores, cores), ratio(c.Overcommit.Memory, memory)
+	}
+	if p.Overcommit != nil {
+		cores, memory = ratio(p.Overcommit.Cores, cores), ratio(p.Overcommit.Memory, memory)
+	}
+	return
+}
+
+// Overcommitted returns v multiplied by ratio, v is returned if ratio is
+// not greater than 1
+func Overcommitted(v int64, ratio float64) int64 {
+	if ratio <= 1 {
+		return v
+	}
+	return int64(float64(v) * ratio)
+}
+
+func ratio(r, def float64) float64 {
+	if r == 0 {
+		return def
+	}
+	return r
+}
@@ -0,0 +1,179 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// PoolExclusive only accepts containers requesting whole GPUs
+	PoolExclusive = "exclusive"
+	// PoolShare only accepts containers sharing GPUs
+	PoolShare = "share"
+	// PoolReserved is kept for system daemons and never allocated
+	PoolReserved = "reserved"
+)
+
+// PoolConfig is a partition of GPUs of the node. Pools with a mode are open
+// to all pods, pools without a mode are only used by pods selecting them.
+type PoolConfig struct {
+	Name string `json:"name"`
+	// Mode is exclusive, share or reserved, any container can use the pool if empty
+	Mode string `json:"mode,omitempty"`
+	// Devices are indexes or UUIDs of GPUs
+	Devices []string `json:"devices"`
+	// Overcommit overrides overcommit ratios of the node for shared GPUs of the pool
+	Overcommit *OvercommitConfig `json:"overcommit,omitempty"`
+}
+
+// Has returns true if the device with index or uuid is in the pool
+func (p *PoolConfig) Has(index int, uuid string) bool {
+	for _, dev := range p.Devices {
+		if dev == uuid || dev == strconv.Itoa(index) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows returns true if a container of pod selecting pool can use the
+// device of p, exclusive is true if the container requests whole GPUs
+func (p *PoolConfig) Allows(pool string, exclusive bool) bool {
+	switch {
+	case p.Mode == PoolReserved:
+		return false
+	case len(pool) > 0:
+		return pool == p.Name && p.modeAllows(exclusive)
+	default:
+		return len(p.Mode) > 0 && p.modeAllows(exclusive)
+	}
+}
+
+func (p *PoolConfig) modeAllows(exclusive bool) bool {
+	switch p.Mode {
+	case PoolExclusive:
+		return exclusive
+	case PoolShare:
+		return !exclusive
+	}
+	return true
+}
+
+// PoolOf returns the pool containing the device with index or uuid, nil
+// if the device is not in any pool
+func (c *Config) PoolOf(index int, uuid string) *PoolConfig {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Pools {
+		if c.Pools[i].Has(index, uuid) {
+			return &c.Pools[i]
+		}
+	}
+	return nil
+}
+
+// PoolAllows returns true if a container of pod selecting pool can use the
+// device with index or uuid. Devices not in any pool are only used by pods
+// selecting no pool.
+func (c *Config) PoolAllows(pool string, index int, uuid string, exclusive bool) bool {
+	p := c.PoolOf(index, uuid)
+	if p == nil {
+		return len(pool) == 0
+	}
+	return p.Allows(pool, exclusive)
+}
+
+// IsReserved returns true if the device with index or uuid is reserved
+func (c *Config) IsReserved(index int, uuid string) bool {
+	p := c.PoolOf(index, uuid)
+	return p != nil && p.Mode == PoolReserved
+}
+
+// IsShared returns true if the device with index or uuid may be used by
+// share mode containers, devices of exclusive and reserved pools are not
+func (c *Config) IsShared(index int, uuid string) bool {
+	p := c.PoolOf(index, uuid)
+	return p == nil || (p.Mode != PoolExclusive && p.Mode != PoolReserved)
+}
+
+// ValidatePools checks pools against GPUs of the node, devices maps indexes
+// to UUIDs. Unknown devices and entries referring to the same GPU, e.g. its
+// index and UUID, are rejected.
+func (c *Config) ValidatePools(devices map[int]string) error {
+	if err := validatePools(c.Pools); err != nil {
+		return err
+	}
+	uuids := make(map[string]int, len(devices))
+	for index, uuid := range devices {
+		uuids[uuid] = index
+	}
+	pools := make(map[int]string)
+	for _, p := range c.Pools {
+		for _, dev := range p.Devices {
+			index, ok := uuids[dev]
+			if !ok {
+				i, err := strconv.Atoi(dev)
+				if _, found := devices[i]; err != nil || !found {
+					return fmt.Errorf("device %s of pool %s is not found on the node", dev, p.Name)
+				}
+				index = i
+			}
+			if other, ok := pools[index]; ok {
+				return fmt.Errorf("device %s of pool %s is GPU %d, which is already in pool %s", dev, p.Name, index, other)
+			}
+			pools[index] = p.Name
+		}
+	}
+	return nil
+}
+
+func validatePools(pools []PoolConfig) error {
+	names := make(map[string]bool)
+	devices := make(map[string]string)
+	for i, p := range pools {
+		if len(p.Name) == 0 {
+			return fmt.Errorf("name of pool %d is empty", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("pool %s is duplicated", p.Name)
+		}
+		names[p.Name] = true
+		switch p.Mode {
+		case "", PoolExclusive, PoolShare, PoolReserved:
+		default:
+			return fmt.Errorf("unknown mode %s of pool %s, only support [ %s | %s | %s ]",
+				p.Mode, p.Name, PoolExclusive, PoolShare, PoolReserved)
+		}
+		if err := p.Overcommit.validate("pool " + p.Name); err != nil {
+			return err
+		}
+		if p.Overcommit.enabled() && p.Mode != PoolShare {
+			return fmt.Errorf("overcommit of pool %s only applies to %s pools", p.Name, PoolShare)
+		}
+		for _, dev := range p.Devices {
+			if other, ok := devices[dev]; ok {
+				return fmt.Errorf("device %s is in both pool %s and %s", dev, other, p.Name)
+			}
+			devices[dev] = p.Name
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPoolAllows(t *testing.T) {
+	cfg := &Config{
+		Pools: []PoolConfig{
+			{Name: "train", Mode: PoolExclusive, Devices: []string{"0", "1"}},
+			{Name: "infer", Mode: PoolShare, Devices: []string{"GPU-2"}},
+			{Name: "system", Mode: PoolReserved, Devices: []string{"3"}},
+			{Name: "team-a", Devices: []string{"4"}},
+		},
+	}
+
+	testCases := []struct {
+		pool      string
+		index     int
+		uuid      string
+		exclusive bool
+		expect    bool
+	}{
+		{"", 0, "GPU-0", true, true},
+		{"", 0, "GPU-0", false, false},
+		{"train", 1, "GPU-1", true, true},
+		{"infer", 1, "GPU-1", true, false},
+		{"", 2, "GPU-2", false, true},
+		{"", 2, "GPU-2", true, false},
+		{"", 3, "GPU-3", false, false},
+		{"system", 3, "GPU-3", true, false},
+		// 没有模式的资源池只给选择了它的pod使用
+		{"", 4, "GPU-4", true, false},
+		{"team-a", 4, "GPU-4", false, true},
+		{"", 5, "GPU-5", false, true},
+		{"team-a", 5, "GPU-5", true, false},
+	}
+	for i, tc := range testCases {
+		if got := cfg.PoolAllows(tc.pool, tc.index, tc.uuid, tc.exclusive); got != tc.expect {
+			t.Errorf("case %d: expect %t, got %t", i, tc.expect, got)
+		}
+	}
+
+	if !cfg.IsReserved(3, "GPU-3") || cfg.IsReserved(4, "GPU-4") {
+		t.Errorf("only device 3 is reserved")
+	}
+	for i, expect := range []bool{false, false, true, false, true, true} {
+		if got := cfg.IsShared(i, ""); got != expect {
+			t.Errorf("device %d: expect shared %t, got %t", i, expect, got)
+		}
+	}
+	var empty *Config
+	if !empty.PoolAllows("", 0, "GPU-0", true) || empty.PoolAllows("train", 0, "GPU-0", true) {
+		t.Errorf("unexpected pools of empty config")
+	}
+
+	// 资源池需要重启才能生效
+	nodeConfig := &NodeConfig{Pools: cfg.Pools}
+	if names := nodeConfig.RestartRequired(&NodeConfig{}); !reflect.DeepEqual(names, []string{"pools"}) {
+		t.Errorf("unexpected restart required settings %v", names)
+	}
+
+	for _, pools := range [][]PoolConfig{
+		{{Mode: PoolShare, Devices: []string{"0"}}},
+		{{Name: "a", Mode: "random"}},
+		{{Name: "a", Devices: []string{"0"}}, {Name: "a", Devices: []string{"1"}}},
+		{{Name: "a", Devices: []string{"0"}}, {Name: "b", Devices: []string{"0"}}},
+	} {
+		if err := (&NodeConfig{Pools: pools}).Validate(); err == nil {
+			t.Errorf("expect error for pools %+v", pools)
+		}
+	}
+	if err := (&NodeConfig{Pools: cfg.Pools}).Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestOvercommitOf(t *testing.T) {
+	cfg := &Config{
+		Overcommit: &OvercommitConfig{Cores: 2, Memory: 1.5},
+		Pools: []PoolConfig{
+			{Name: "train", Mode: PoolExclusive, Devices: []string{"0"}},
+			{Name: "notebook", Mode: PoolShare, Devices: []string{"1"}, Overcommit: &OvercommitConfig{Cores: 4}},
+			{Name: "infer", Mode: PoolShare, Devices: []string{"2"}},
+			{Name: "team-a", Devices: []string{"3"}},
+		},
+	}
+
+	// 只有共享资源池中的设备超卖, 不属于资源池的设备可以整卡使用
+	testCases := []struct {
+		index         int
+		cores, memory float64
+	}{
+		{0, 1, 1},
+		{1, 4, 1.5},
+		{2, 2, 1.5},
+		{3, 1, 1},
+		{4, 1, 1},
+	}
+	for _, tc := range testCases {
+		if cores, memory := cfg.OvercommitOf(tc.index, ""); cores != tc.cores || memory != tc.memory {
+			t.Errorf("device %d: expect %v %v, got %v %v", tc.index, tc.cores, tc.memory, cores, memory)
+		}
+	}
+	if cores, memory := (*Config)(nil).OvercommitOf(0, ""); cores != 1 || memory != 1 {
+		t.Errorf("unexpected ratios %v %v of empty config", cores, memory)
+	}
+	if v := Overcommitted(100, 1.5); v != 150 {
+		t.Errorf("expect 150, got %d", v)
+	}
+
+	if err := (&NodeConfig{Overcommit: &OvercommitConfig{Cores: 0.5}}).Validate(); err == nil {
+		t.Errorf("expect error for ratio less than 1")
+	}
+	if err := (&NodeConfig{Pools: []PoolConfig{{Name: "a", Overcommit: &OvercommitConfig{Memory: 0.8}}}}).Validate(); err == nil {
+		t.Errorf("expect error for ratio of pool less than 1")
+	}
+	if err := (&NodeConfig{Overcommit: &OvercommitConfig{Cores: 2}}).Validate(); err == nil {
+		t.Errorf("expect error for overcommit of node without share pools")
+	}
+	if err := (&NodeConfig{Pools: []PoolConfig{{Name: "a", Mode: PoolExclusive, Overcommit: &OvercommitConfig{Cores: 2}}}}).Validate(); err == nil {
+		t.Errorf("expect error for overcommit of exclusive pool")
+	}
+	if err := (&NodeConfig{Overcommit: cfg.Overcommit, Pools: cfg.Pools}).Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestValidatePools(t *testing.T) {
+	devices := map[int]string{0: "GPU-0", 1: "GPU-1", 2: "GPU-2"}
+
+	for _, pools := range [][]PoolConfig{
+		{{Name: "a", Devices: []string{"3"}}},
+		{{Name: "a", Devices: []string{"GPU-3"}}},
+		{{Name: "a", Devices: []string{"first"}}},
+		// 同一张卡的index和UUID
+		{{Name: "a", Devices: []string{"0", "GPU-0"}}},
+		{{Name: "a", Devices: []string{"1"}}, {Name: "b", Devices: []string{"GPU-1"}}},
+		{{Mode: PoolShare, Devices: []string{"0"}}},
+	} {
+		if err := (&Config{Pools: pools}).ValidatePools(devices); err == nil {
+			t.Errorf("expect error for pools %+v", pools)
+		}
+	}
+	pools := []PoolConfig{
+		{Name: "a", Mode: PoolExclusive, Devices: []string{"0", "GPU-1"}},
+		{Name: "b", Mode: PoolShare, Devices: []string{"2"}},
+	}
+	if err := (&Config{Pools: pools}).ValidatePools(devices); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := (&Config{}).ValidatePools(nil); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -18,30 +18,340 @@
 package dummy
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
 	"tkestack.io/gpu-manager/pkg/config"
 	"tkestack.io/gpu-manager/pkg/device"
+
+	"k8s.io/klog"
+)
+
+const (
+	//NamePattern is the name pattern of dummy device.
+	NamePattern = "/dev/nvidia%d"
 )
 
 func init() {
 	device.Register("dummy", NewDummyTree)
 }
 
-//DummyTree represents dummy tree struct
+//DummyTree is an in-memory GPUTree, all leaves are connected to the root
+//directly. It has no leaves unless devices are given to Init.
 type DummyTree struct {
+	sync.Mutex
+
+	config *config.Config
+	leaves []*dummyLeaf
+	query  map[string]*dummyLeaf
+
+	watchLock sync.Mutex
+	watchers  []chan struct{}
+}
+
+type dummyLeaf struct {
+	info              device.DeviceInfo
+	allocatableCores  int64
+	allocatableMemory int64
+	// coreCapacity and memoryCapacity are allocatable resource of the free
+	// leaf, overcommit ratios are applied
+	coreCapacity   int64
+	memoryCapacity int64
+	// usage is keyed by pid
+	usage map[int]processUsage
+}
+
+type processUsage struct {
+	utilization uint32
+	memory      uint64
 }
 
 var _ device.GPUTree = &DummyTree{}
 
 //NewDummyTree creates a new DummyTree
-func NewDummyTree(_ *config.Config) device.GPUTree {
-	return &DummyTree{}
+func NewDummyTree(cfg *config.Config) device.GPUTree {
+	return &DummyTree{
+		config: cfg,
+		query:  make(map[string]*dummyLeaf),
+	}
 }
 
-//Init a DummyTree
-func (t *DummyTree) Init(_ string) {
+//Init a DummyTree with devices in JSON, e.g. [{"uuid":"GPU-0","totalMemory":1073741824}].
+//Name of device is /dev/nvidia<index> if not given, and devices are healthy
+//unless reasons are given.
+func (t *DummyTree) Init(input string) {
+	if input == "" {
+		return
+	}
+
+	var devices []device.DeviceInfo
+	if err := json.Unmarshal([]byte(input), &devices); err != nil {
+		klog.Fatalf("Can not initialize dummy tree, err %s", err)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.leaves = make([]*dummyLeaf, 0, len(devices))
+	t.query = make(map[string]*dummyLeaf)
+	for i, info := range devices {
+		info.Index = i
+		if info.Name == "" {
+			info.Name = fmt.Sprintf(NamePattern, i)
+		}
+		info.Healthy = len(info.Reasons) == 0
+		coreRatio, memoryRatio := t.config.OvercommitOf(info.Index, info.UUID)
+		leaf := &dummyLeaf{
+			info:           info,
+			coreCapacity:   config.Overcommitted(device.HundredCore, coreRatio),
+			memoryCapacity: config.Overcommitted(int64(info.TotalMemory), memoryRatio),
+			usage:          make(map[int]processUsage),
+		}
+		leaf.allocatableCores, leaf.allocatableMemory = leaf.coreCapacity, leaf.memoryCapacity
+		t.leaves = append(t.leaves, leaf)
+		t.query[info.Name] = leaf
+	}
 }
 
 //Update a DummyTree
 func (t *DummyTree) Update() {
 
 }
+
+// Devices returns metadata of leaves
+func (t *DummyTree) Devices() []device.DeviceInfo {
+	t.Lock()
+	defer t.Unlock()
+
+	devices := make([]device.DeviceInfo, 0, len(t.leaves))
+	for _, leaf := range t.leaves {
+		devices = append(devices, leaf.info)
+	}
+
+	return devices
+}
+
+// Device returns metadata of the leaf with name
+func (t *DummyTree) Device(name string) (device.DeviceInfo, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	leaf, ok := t.query[name]
+	if !ok {
+		return device.DeviceInfo{}, false
+	}
+
+	return leaf.info, true
+}
+
+// LeafStates returns a snapshot of allocation state of all leaves
+func (t *DummyTree) LeafStates() []device.LeafState {
+	t.Lock()
+	defer t.Unlock()
+
+	states := make([]device.LeafState, 0, len(t.leaves))
+	for _, leaf := range t.leaves {
+		states = append(states, device.LeafState{
+			Index:             leaf.info.Index,
+			UUID:              leaf.info.UUID,
+			MinorName:         leaf.info.Name,
+			TotalMemory:       leaf.info.TotalMemory,
+			AllocatableCores:  leaf.allocatableCores,
+			AllocatableMemory: leaf.allocatableMemory,
+			CoreCapacity:      leaf.coreCapacity,
+			MemoryCapacity:    leaf.memoryCapacity,
+			Topology:          []device.TopologyLink{},
+		})
+	}
+
+	return states
+}
+
+// Occupy takes cores and memory from the leaf, the same way as nvidia tree
+func (t *DummyTree) Occupy(name string, cores, memory int64) error {
+	t.Lock()
+	defer t.Unlock()
+
+	leaf, ok := t.query[name]
+	if !ok {
+		return fmt.Errorf("can not find device %s", name)
+	}
+
+	// exclusive mode
+	if cores >= device.HundredCore {
+		leaf.allocatableCores, leaf.allocatableMemory = 0, 0
+	} else {
+		leaf.allocatableCores -= cores
+		if leaf.allocatableCores < 0 {
+			leaf.allocatableCores = 0
+		}
+		leaf.allocatableMemory -= memory
+		if leaf.allocatableMemory < 0 {
+			leaf.allocatableMemory = 0
+		}
+	}
+	t.notify()
+
+	return nil
+}
+
+// Free gives cores and memory back to the leaf
+func (t *DummyTree) Free(name string, cores, memory int64) error {
+	t.Lock()
+	defer t.Unlock()
+
+	leaf, ok := t.query[name]
+	if !ok {
+		return fmt.Errorf("can not find device %s", name)
+	}
+
+	// exclusive mode
+	if cores >= device.HundredCore {
+		leaf.allocatableCores, leaf.allocatableMemory = leaf.coreCapacity, leaf.memoryCapacity
+	} else {
+		leaf.allocatableCores += cores
+		if leaf.allocatableCores > leaf.coreCapacity {
+			leaf.allocatableCores = leaf.coreCapacity
+		}
+		leaf.allocatableMemory += memory
+		if leaf.allocatableMemory > leaf.memoryCapacity {
+			leaf.allocatableMemory = leaf.memoryCapacity
+		}
+	}
+	t.notify()
+
+	return nil
+}
+
+func (t *DummyTree) notify() {
+	t.watchLock.Lock()
+	defer t.watchLock.Unlock()
+
+	for _, ch := range t.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Changes returns a new channel notified when allocation or state of
+// leaves changed
+func (t *DummyTree) Changes() <-chan struct{} {
+	t.watchLock.Lock()
+	defer t.watchLock.Unlock()
+
+	ch := make(chan struct{}, 1)
+	t.watchers = append(t.watchers, ch)
+
+	return ch
+}
+
+// PrintGraph returns the details of tree as string
+func (t *DummyTree) PrintGraph() string {
+	var buf bytes.Buffer
+
+	graph := t.Graph()
+	buf.WriteString(fmt.Sprintf("%s:%d\n", graph.Name, graph.Available))
+	for _, leaf := range graph.Children {
+		buf.WriteString(fmt.Sprintf("|---%s (aval: %d, pids: %+v, usedMemory: %d, totalMemory: %d, allocatableCores: %d, allocatableMemory: %d)\n",
+			leaf.Name, leaf.Available, leaf.Pids, leaf.UsedMemory, leaf.TotalMemory, leaf.AllocatableCores, leaf.AllocatableMemory))
+	}
+
+	return buf.String()
+}
+
+// Graph returns the root and leaves
+func (t *DummyTree) Graph() *device.GraphNode {
+	t.Lock()
+	defer t.Unlock()
+
+	root := &device.GraphNode{Name: "ROOT"}
+	for _, leaf := range t.leaves {
+		node := &device.GraphNode{
+			Name:              leaf.info.Name,
+			Pids:              make([]uint, 0),
+			TotalMemory:       leaf.info.TotalMemory,
+			AllocatableCores:  leaf.allocatableCores,
+			AllocatableMemory: leaf.allocatableMemory,
+		}
+		for pid, usage := range leaf.usage {
+			node.Pids = append(node.Pids, uint(pid))
+			node.UsedMemory += usage.memory
+		}
+		sort.Slice(node.Pids, func(i, j int) bool { return node.Pids[i] < node.Pids[j] })
+		if leaf.allocatableCores == leaf.coreCapacity {
+			node.Available = 1
+		}
+		root.Available += node.Available
+		root.TotalMemory += node.TotalMemory
+		root.UsedMemory += node.UsedMemory
+		root.Children = append(root.Children, node)
+	}
+
+	return root
+}
+
+// Probe returns devices given to Init with their health
+func (t *DummyTree) Probe() ([]device.DeviceInfo, error) {
+	return t.Devices(), nil
+}
+
+// Usage returns usage recorded by SetUsage for processes of pids
+func (t *DummyTree) Usage(name string, pids []int) (*device.DeviceUsage, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	leaf, ok := t.query[name]
+	if !ok {
+		return nil, fmt.Errorf("can not find device %s", name)
+	}
+
+	usage := &device.DeviceUsage{
+		BusID: leaf.info.BusID,
+		Pids:  make([]int, 0),
+	}
+	for _, pid := range pids {
+		if u, ok := leaf.usage[pid]; ok {
+			usage.Pids = append(usage.Pids, pid)
+			usage.Utilization += u.utilization
+			usage.UsedMemory += u.memory
+		}
+	}
+
+	return usage, nil
+}
+
+// SetUsage records utilization and memory of process pid on the leaf
+func (t *DummyTree) SetUsage(name string, pid int, utilization uint32, memory uint64) error {
+	t.Lock()
+	defer t.Unlock()
+
+	leaf, ok := t.query[name]
+	if !ok {
+		return fmt.Errorf("can not find device %s", name)
+	}
+	leaf.usage[pid] = processUsage{utilization: utilization, memory: memory}
+
+	return nil
+}
+
+// SetHealth marks the leaf unhealthy with reasons, or healthy if no reason
+// is given
+func (t *DummyTree) SetHealth(name string, reasons ...string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	leaf, ok := t.query[name]
+	if !ok {
+		return fmt.Errorf("can not find device %s", name)
+	}
+	leaf.info.Healthy = len(reasons) == 0
+	leaf.info.Reasons = reasons
+	t.notify()
+
+	return nil
+}
@@ -0,0 +1,181 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package dummy
+
+import (
+	"testing"
+	"time"
+
+	"tkestack.io/gpu-manager/pkg/config"
+	"tkestack.io/gpu-manager/pkg/device"
+)
+
+const testDevices = `[{"uuid":"GPU-0","model":"Dummy","totalMemory":1024},{"uuid":"GPU-1","model":"Dummy","totalMemory":2048,"reasons":["XID 79"]}]`
+
+func newTestTree(t *testing.T) *DummyTree {
+	tree := NewDummyTree(nil).(*DummyTree)
+	tree.Init(testDevices)
+	if len(tree.Devices()) != 2 {
+		t.Fatalf("expect 2 devices, got %+v", tree.Devices())
+	}
+
+	return tree
+}
+
+func TestInit(t *testing.T) {
+	tree := newTestTree(t)
+
+	dev, ok := tree.Device("/dev/nvidia0")
+	if !ok || dev.UUID != "GPU-0" || !dev.Healthy || dev.Index != 0 {
+		t.Errorf("unexpected device 0, %+v", dev)
+	}
+	dev, ok = tree.Device("/dev/nvidia1")
+	if !ok || dev.Healthy || len(dev.Reasons) != 1 {
+		t.Errorf("unexpected device 1, %+v", dev)
+	}
+	if _, ok := tree.Device("/dev/nvidia2"); ok {
+		t.Errorf("device 2 should not exist")
+	}
+
+	devices, err := tree.Probe()
+	if err != nil || len(devices) != 2 {
+		t.Errorf("unexpected probe result %+v, %v", devices, err)
+	}
+}
+
+func TestOccupyAndFree(t *testing.T) {
+	tree := newTestTree(t)
+	changes := tree.Changes()
+
+	if err := tree.Occupy("/dev/nvidia0", 30, 512); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Errorf("expect change notification after occupy")
+	}
+	expectLeaf(t, tree.LeafStates()[0], 70, 512)
+
+	// 超过剩余量时不能为负数
+	if err := tree.Occupy("/dev/nvidia0", 80, 1024); err != nil {
+		t.Fatal(err)
+	}
+	expectLeaf(t, tree.LeafStates()[0], 0, 0)
+
+	if err := tree.Free("/dev/nvidia0", 80, 1024); err != nil {
+		t.Fatal(err)
+	}
+	expectLeaf(t, tree.LeafStates()[0], 80, 1024)
+
+	if err := tree.Occupy("/dev/nvidia1", device.HundredCore, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectLeaf(t, tree.LeafStates()[1], 0, 0)
+	if err := tree.Free("/dev/nvidia1", device.HundredCore, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectLeaf(t, tree.LeafStates()[1], device.HundredCore, 2048)
+
+	if err := tree.Occupy("/dev/nvidia2", 10, 0); err == nil {
+		t.Errorf("expect error for unknown device")
+	}
+}
+
+func TestOvercommit(t *testing.T) {
+	tree := NewDummyTree(&config.Config{
+		Overcommit: &config.OvercommitConfig{Cores: 2, Memory: 1.5},
+		Pools:      []config.PoolConfig{{Name: "notebook", Mode: config.PoolShare, Devices: []string{"0"}}},
+	}).(*DummyTree)
+	tree.Init(testDevices)
+
+	leaves := tree.LeafStates()
+	if leaves[0].CoreCapacity != 200 || leaves[0].MemoryCapacity != 1536 {
+		t.Errorf("expect device 0 to be overcommitted, %+v", leaves[0])
+	}
+	expectLeaf(t, leaves[0], 200, 1536)
+	// 不属于共享资源池的设备不超卖
+	if leaves[1].CoreCapacity != device.HundredCore || leaves[1].MemoryCapacity != 2048 {
+		t.Errorf("expect device 1 not to be overcommitted, %+v", leaves[1])
+	}
+
+	if err := tree.Occupy("/dev/nvidia0", 80, 1024); err != nil {
+		t.Fatal(err)
+	}
+	expectLeaf(t, tree.LeafStates()[0], 120, 512)
+	if err := tree.Free("/dev/nvidia0", 90, 1024); err != nil {
+		t.Fatal(err)
+	}
+	expectLeaf(t, tree.LeafStates()[0], 200, 1536)
+	if tree.Graph().Available != 2 {
+		t.Errorf("expect free overcommitted device to be available")
+	}
+}
+
+func expectLeaf(t *testing.T, leaf device.LeafState, cores, memory int64) {
+	t.Helper()
+	if leaf.AllocatableCores != cores || leaf.AllocatableMemory != memory {
+		t.Errorf("expect %s allocatable %d cores %d memory, got %d cores %d memory",
+			leaf.MinorName, cores, memory, leaf.AllocatableCores, leaf.AllocatableMemory)
+	}
+}
+
+func TestGraphAndUsage(t *testing.T) {
+	tree := newTestTree(t)
+
+	if err := tree.Occupy("/dev/nvidia0", 50, 256); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.SetUsage("/dev/nvidia0", 200, 20, 128); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.SetUsage("/dev/nvidia0", 100, 10, 64); err != nil {
+		t.Fatal(err)
+	}
+
+	graph := tree.Graph()
+	if graph.Name != "ROOT" || graph.Available != 1 || len(graph.Children) != 2 {
+		t.Fatalf("unexpected root %+v", graph)
+	}
+	leaf := graph.Children[0]
+	if leaf.Name != "/dev/nvidia0" || leaf.Available != 0 || leaf.UsedMemory != 192 ||
+		leaf.AllocatableCores != 50 || leaf.AllocatableMemory != 768 {
+		t.Errorf("unexpected leaf %+v", leaf)
+	}
+	if len(leaf.Pids) != 2 || leaf.Pids[0] != 100 || leaf.Pids[1] != 200 {
+		t.Errorf("unexpected pids %v", leaf.Pids)
+	}
+	if tree.PrintGraph() == "" {
+		t.Errorf("empty graph")
+	}
+
+	usage, err := tree.Usage("/dev/nvidia0", []int{100, 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Utilization != 10 || usage.UsedMemory != 64 || len(usage.Pids) != 1 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+
+	if err := tree.SetHealth("/dev/nvidia1"); err != nil {
+		t.Fatal(err)
+	}
+	if dev, _ := tree.Device("/dev/nvidia1"); !dev.Healthy {
+		t.Errorf("device 1 should be healthy, %+v", dev)
+	}
+}
@@ -24,6 +24,8 @@ import (
 	"k8s.io/klog"
 
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"tkestack.io/gpu-manager/pkg/config"
+	"tkestack.io/gpu-manager/pkg/types"
 )
 
 // SchedulerCache contains allocatable resource of GPU
@@ -55,9 +57,24 @@ type NvidiaNode struct {
 	Mask     uint32
 
 	pendingReset bool
-	vchildren    map[int]*NvidiaNode
-	ntype        nvml.GpuTopologyLevel
-	tree         *NvidiaTree
+	// resetFailures counts failed resets since the node is pending reset
+	resetFailures int
+	// coreRatio and memoryRatio are overcommit ratios of the leaf
+	coreRatio, memoryRatio float64
+
+	vchildren map[int]*NvidiaNode
+	ntype     nvml.GpuTopologyLevel
+	tree      *NvidiaTree
+}
+
+// memoryBlockSize returns the bytes of one vcuda-memory resource configured
+// for the tree of n
+func (n *NvidiaNode) memoryBlockSize() int64 {
+	if n.tree == nil {
+		return types.MemoryBlockSize
+	}
+
+	return n.tree.config.GetMemoryBlockSize()
 }
 
 var (
@@ -91,6 +108,18 @@ func (n *NvidiaNode) MinorName() string {
 	return fmt.Sprintf(NamePattern, n.Meta.MinorID)
 }
 
+// CoreCapacity returns cores of the leaf which can be allocated when it's
+// free, overcommit ratio is applied
+func (n *NvidiaNode) CoreCapacity() int64 {
+	return config.Overcommitted(HundredCore, n.coreRatio)
+}
+
+// MemoryCapacity returns memory of the leaf which can be allocated when it's
+// free, overcommit ratio is applied
+func (n *NvidiaNode) MemoryCapacity() int64 {
+	return config.Overcommitted(int64(n.Meta.TotalMemory), n.memoryRatio)
+}
+
 // Type returns GpuTopologyLevel of this NvidiaNode
 func (n *NvidiaNode) Type() int {
 	return int(n.ntype)
@@ -0,0 +1,157 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package nvidia
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+
+	"tkestack.io/gpu-manager/pkg/device"
+)
+
+// Probe returns devices discovered by nvml, error is returned if nvml
+// can't be initialized or devices can't be counted.
+func (t *NvidiaTree) Probe() ([]device.DeviceInfo, error) {
+	if rs := nvml.Init(); rs != nvml.SUCCESS {
+		return nil, fmt.Errorf("can't initialize nvml library, %s", nvml.ErrorString(rs))
+	}
+	defer nvml.Shutdown()
+	count, rs := nvml.DeviceGetCount()
+	if rs != nvml.SUCCESS {
+		return nil, fmt.Errorf("can't get device count, %s", nvml.ErrorString(rs))
+	}
+
+	devices := make([]device.DeviceInfo, count)
+	for index := 0; index < count; index++ {
+		info := device.DeviceInfo{Index: index, Healthy: true}
+		fail := func(call string, r nvml.Return) {
+			info.Healthy = false
+			info.Reasons = append(info.Reasons, fmt.Sprintf("%s: %s", call, nvml.ErrorString(r)))
+		}
+
+		dev, r := nvml.DeviceGetHandleByIndex(index)
+		if r != nvml.SUCCESS {
+			fail("DeviceGetHandleByIndex", r)
+			devices[index] = info
+			continue
+		}
+		name, r := dev.GetName()
+		if r != nvml.SUCCESS {
+			fail("DeviceGetName", r)
+		}
+		memInfo, r := dev.GetMemoryInfo_v2()
+		if r != nvml.SUCCESS {
+			fail("DeviceGetMemoryInfo", r)
+		}
+		uuid, r := dev.GetUUID()
+		if r != nvml.SUCCESS {
+			fail("DeviceGetUUID", r)
+		}
+		if !info.Healthy {
+			devices[index] = info
+			continue
+		}
+		if minorID, r := dev.GetMinorNumber(); r == nvml.SUCCESS {
+			info.Name = fmt.Sprintf(NamePattern, minorID)
+		}
+		if pciInfo, r := dev.GetPciInfo(); r == nvml.SUCCESS {
+			info.BusID = B2S(pciInfo.BusId[:])
+		}
+		major, minor, _ := dev.GetCudaComputeCapability()
+		level := fmt.Sprintf("%d%d", major, minor)
+		if capability, err := strconv.Atoi(level); err == nil {
+			info.Capability = capability
+		}
+		currentMode, _, r := dev.GetMigMode()
+		info.MIG = r == nvml.SUCCESS && currentMode == nvml.DEVICE_MIG_ENABLE
+		info.UUID = uuid
+		info.Model = name
+		info.TotalMemory = memInfo.Total
+		devices[index] = info
+	}
+
+	return devices, nil
+}
+
+// Usage returns utilization and memory of the device used by processes of
+// pids in the last second
+func (t *NvidiaTree) Usage(name string, pids []int) (*device.DeviceUsage, error) {
+	n := t.Query(name)
+	if n == nil {
+		return nil, fmt.Errorf("can not find device %s", name)
+	}
+	deviceIdx := n.Meta.ID
+
+	if rs := nvml.Init(); rs != nvml.SUCCESS {
+		return nil, fmt.Errorf("can't initialize nvml library, %s", nvml.ErrorString(rs))
+	}
+	defer nvml.Shutdown()
+
+	// 更具设备index获取设备
+	dev, rs := nvml.DeviceGetHandleByIndex(deviceIdx)
+	if rs != nvml.SUCCESS {
+		return nil, fmt.Errorf("can't find device %d, error %s", deviceIdx, nvml.ErrorString(rs))
+	}
+	lastUtilizationTimestamp := uint64(time.Now().Add(-1 * time.Second).UnixMicro())
+	// 获取进程利用率
+	processSamples, rs := dev.GetProcessUtilization(lastUtilizationTimestamp)
+	if rs != nvml.SUCCESS {
+		return nil, fmt.Errorf("can't get processes utilization from device %d, error %s", deviceIdx, nvml.ErrorString(rs))
+	}
+	//获取正在当前设备上运行的进程
+	processOnDevices, rs := dev.GetComputeRunningProcesses()
+	if rs != nvml.SUCCESS {
+		return nil, fmt.Errorf("can't get processes info from device %d, error %s", deviceIdx, nvml.ErrorString(rs))
+	}
+	// 获取设备pci信息
+	pciInfo, rs := dev.GetPciInfo()
+	if rs != nvml.SUCCESS {
+		return nil, fmt.Errorf("can't get pci info from device %d, error %s", deviceIdx, nvml.ErrorString(rs))
+	}
+
+	// 容器进程id排序，从小到大排序
+	sorted := append([]int{}, pids...)
+	sort.Ints(sorted)
+	contains := func(pid uint32) bool {
+		// 二分查找 找到进程在pids上的索引号
+		idx := sort.SearchInts(sorted, int(pid))
+		return idx < len(sorted) && sorted[idx] == int(pid)
+	}
+
+	usage := &device.DeviceUsage{
+		BusID: B2S(pciInfo.BusId[:]),
+		Pids:  make([]int, 0),
+	}
+	for _, info := range processOnDevices {
+		if contains(info.Pid) {
+			usage.Pids = append(usage.Pids, int(info.Pid))
+			usage.UsedMemory += info.UsedGpuMemory
+		}
+	}
+	for _, sample := range processSamples {
+		if contains(sample.Pid) {
+			usage.Utilization += sample.SmUtil
+		}
+	}
+
+	return usage, nil
+}
@@ -19,8 +19,6 @@ package nvidia
 
 import (
 	"sort"
-
-	"tkestack.io/gpu-manager/pkg/types"
 )
 
 //LessFunc represents funcion to compare two NvidiaNode
@@ -64,7 +62,7 @@ var (
 
 	//ByAllocatableMemory compares two NvidiaNode by available memory
 	ByAllocatableMemory = func(p1, p2 *NvidiaNode) bool {
-		return p1.AllocatableMeta.Memory/types.MemoryBlockSize < p2.AllocatableMeta.Memory/types.MemoryBlockSize
+		return p1.AllocatableMeta.Memory/p1.memoryBlockSize() < p2.AllocatableMeta.Memory/p2.memoryBlockSize()
 	}
 
 	//PrintSorter is used to sort nodes when printing them out
@@ -41,7 +41,7 @@ const (
 	one         = uint32(1)
 	levelStep   = 10
 	//HundredCore represents 100 virtual cores.
-	HundredCore = 100
+	HundredCore = device.HundredCore
 )
 
 // LevelMap is a map stores NvidiaNode on each level.
@@ -58,8 +58,22 @@ type NvidiaTree struct {
 	query        map[string]*NvidiaNode
 	index        int
 	samplePeriod time.Duration
+	// config provides overcommit ratios of leaves
+	config *config.Config
+
+	// watchers are notified when allocation or state of leaves changed
+	watchLock sync.Mutex
+	watchers  []chan struct{}
 }
 
+// LeafState is a snapshot of allocation state of a leaf
+type LeafState = device.LeafState
+
+// TopologyLink contains indexes of leaves connected at Level
+type TopologyLink = device.TopologyLink
+
+var _ device.GPUTree = &NvidiaTree{}
+
 func init() {
 	device.Register("nvidia", NewNvidiaTree)
 }
@@ -79,6 +93,7 @@ func newNvidiaTree(cfg *config.Config) *NvidiaTree {
 
 	if cfg != nil {
 		tree.samplePeriod = cfg.SamplePeriod
+		tree.config = cfg
 	}
 
 	return tree
@@ -122,11 +137,10 @@ func (t *NvidiaTree) Update() {
 	for i := range t.Leaves() {
 		node := t.updateNode(i)
 
-		if node.pendingReset && node.AllocatableMeta.Cores == HundredCore {
-			resetGPUFeature(node, t.realMode)
-
-			if !node.pendingReset {
+		if node.pendingReset && node.AllocatableMeta.Cores == node.CoreCapacity() {
+			if t.resetNode(node) {
 				t.freeNode(node)
+				t.notify()
 			}
 		}
 
@@ -160,6 +174,14 @@ func (t *NvidiaTree) allocateNode(index int) *NvidiaNode {
 	return node
 }
 
+// setOvercommit sets overcommit ratios of leaf n from config
+func (t *NvidiaTree) setOvercommit(n *NvidiaNode) {
+	n.coreRatio, n.memoryRatio = t.config.OvercommitOf(n.Meta.ID, n.Meta.UUID)
+	if n.coreRatio > 1 || n.memoryRatio > 1 {
+		klog.V(2).Infof("%s is overcommitted, cores ratio %v, memory ratio %v", n.MinorName(), n.coreRatio, n.memoryRatio)
+	}
+}
+
 func (t *NvidiaTree) addNode(node *NvidiaNode) {
 	t.query[node.MinorName()] = node
 	t.leaves[node.Meta.ID] = node
@@ -198,15 +220,15 @@ func (t *NvidiaTree) parseFromLibrary() error {
 		name, _ := dev.GetName()
 		// 创建NvidiaNode
 		n := t.allocateNode(i)
-		// vcudaCores初始化100
-		n.AllocatableMeta.Cores = HundredCore
-		// 初始化设备总内存
-		n.AllocatableMeta.Memory = int64(memInfo.Total)
 		n.Meta.TotalMemory = memInfo.Total
 		n.Meta.BusId = B2S(pciInfo.BusId[:])
 		n.Meta.MinorID = minorID
 		n.Meta.UUID = uuid
 		n.Meta.Name = name
+		t.setOvercommit(n)
+		// vcudaCores初始化100, 显存初始化为设备总内存, 超卖时按比例放大
+		n.AllocatableMeta.Cores = n.CoreCapacity()
+		n.AllocatableMeta.Memory = n.MemoryCapacity()
 		t.addNode(n)
 	}
 	// 装填设备拓扑信息，用于多设备分配最近的
@@ -273,6 +295,7 @@ func (t *NvidiaTree) parseFromString(input string) error {
 			for i := 0; i < int(num); i++ {
 				n := t.allocateNode(i)
 				n.Meta.MinorID = i
+				t.setOvercommit(n)
 
 				t.addNode(n)
 			}
@@ -422,7 +445,7 @@ func (t *NvidiaTree) Available() int {
 
 // MarkFree updates a NvidiaNode by freeing request cores and memory.
 // If request cores < HundredCore, plus available cores and memory with request value.
-// If request cores >= HundredCore, set available cores and memory to total,
+// If request cores >= HundredCore, set available cores and memory to capacity,
 // and update mask of all parents of this node.
 func (t *NvidiaTree) MarkFree(node *NvidiaNode, util int64, memory int64) {
 	t.Lock()
@@ -437,33 +460,31 @@ func (t *NvidiaTree) MarkFree(node *NvidiaNode, util int64, memory int64) {
 	klog.V(2).Infof("Free %s with %d %d", n.MinorName(), util, memory)
 	// exclusive mode
 	if util >= HundredCore {
-		klog.V(2).Infof("%s cores %d->%d", n.MinorName(), n.AllocatableMeta.Cores, HundredCore)
-		n.AllocatableMeta.Cores = HundredCore
-		klog.V(2).Infof("%s memory %d->%d", n.MinorName(), n.AllocatableMeta.Memory, n.Meta.TotalMemory)
-		n.AllocatableMeta.Memory = int64(n.Meta.TotalMemory)
+		klog.V(2).Infof("%s cores %d->%d", n.MinorName(), n.AllocatableMeta.Cores, n.CoreCapacity())
+		n.AllocatableMeta.Cores = n.CoreCapacity()
+		klog.V(2).Infof("%s memory %d->%d", n.MinorName(), n.AllocatableMeta.Memory, n.MemoryCapacity())
+		n.AllocatableMeta.Memory = n.MemoryCapacity()
 	} else {
 		klog.V(2).Infof("%s cores %d->%d", n.MinorName(), n.AllocatableMeta.Cores, n.AllocatableMeta.Cores+util)
 		n.AllocatableMeta.Cores += util
-		if n.AllocatableMeta.Cores > HundredCore {
-			n.AllocatableMeta.Cores = HundredCore
+		if n.AllocatableMeta.Cores > n.CoreCapacity() {
+			n.AllocatableMeta.Cores = n.CoreCapacity()
 		}
 
 		n.AllocatableMeta.Memory += memory
 		klog.V(2).Infof("%s memory %d->%d", n.MinorName(), n.AllocatableMeta.Memory, n.AllocatableMeta.Memory+memory)
-		if n.AllocatableMeta.Memory > int64(n.Meta.TotalMemory) {
-			n.AllocatableMeta.Memory = int64(n.Meta.TotalMemory)
+		if n.AllocatableMeta.Memory > n.MemoryCapacity() {
+			n.AllocatableMeta.Memory = n.MemoryCapacity()
 		}
 	}
 
-	if n.AllocatableMeta.Cores == HundredCore {
+	defer t.notify()
+
+	if n.AllocatableMeta.Cores == n.CoreCapacity() {
 		if t.realMode {
 			n.pendingReset = true
 			// We need to clear user settings
-			if err := resetGPUFeature(n, t.realMode); err != nil {
-				klog.Warningf("can't reset GPU %s, %v", n.Meta.BusId, err)
-			}
-
-			if n.pendingReset {
+			if !t.resetNode(n) {
 				klog.Warningf("GPU %s has some functional error, waiting for reset", n.Meta.BusId)
 				return
 			}
@@ -474,6 +495,22 @@ func (t *NvidiaTree) MarkFree(node *NvidiaNode, util int64, memory int64) {
 	}
 }
 
+// resetNode tries to reset a node pending reset and returns whether the
+// reset is done, failed attempts are counted in resetFailures
+func (t *NvidiaTree) resetNode(n *NvidiaNode) bool {
+	if err := resetGPUFeature(n, t.realMode); err != nil {
+		klog.Warningf("can't reset GPU %s, %v", n.Meta.BusId, err)
+	}
+
+	if n.pendingReset {
+		n.resetFailures++
+		return false
+	}
+	n.resetFailures = 0
+
+	return true
+}
+
 func (t *NvidiaTree) freeNode(n *NvidiaNode) {
 	for p := n.Parent; p != nil; p = p.Parent {
 		klog.V(2).Infof("Free %s parent %b", n.MinorName(), p.Mask)
@@ -497,6 +534,7 @@ func (t *NvidiaTree) MarkOccupied(node *NvidiaNode, util int64, memory int64) {
 
 	klog.V(2).Infof("Occupy %s with %d %d, mask %b", n.MinorName(), util, memory, n.Mask)
 	t.occupyNode(n)
+	defer t.notify()
 
 	// exclusive mode
 	if util >= HundredCore {
@@ -528,6 +566,133 @@ func (t *NvidiaTree) occupyNode(n *NvidiaNode) {
 	}
 }
 
+// notify wakes up watchers of Changes without blocking, notifications
+// are coalesced if a watcher is busy.
+func (t *NvidiaTree) notify() {
+	t.watchLock.Lock()
+	defer t.watchLock.Unlock()
+
+	for _, ch := range t.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Changes returns a new channel notified when allocation or state of
+// leaves changed, each watcher should call it once.
+func (t *NvidiaTree) Changes() <-chan struct{} {
+	t.watchLock.Lock()
+	defer t.watchLock.Unlock()
+
+	ch := make(chan struct{}, 1)
+	t.watchers = append(t.watchers, ch)
+
+	return ch
+}
+
+// LeafStates returns a snapshot of allocation state of all leaves
+func (t *NvidiaTree) LeafStates() []LeafState {
+	t.Lock()
+	defer t.Unlock()
+
+	states := make([]LeafState, 0, len(t.leaves))
+	for i, n := range t.leaves {
+		states = append(states, LeafState{
+			Index:             i,
+			UUID:              n.Meta.UUID,
+			MinorName:         n.MinorName(),
+			TotalMemory:       n.Meta.TotalMemory,
+			AllocatableCores:  n.AllocatableMeta.Cores,
+			AllocatableMemory: n.AllocatableMeta.Memory,
+			CoreCapacity:      n.CoreCapacity(),
+			MemoryCapacity:    n.MemoryCapacity(),
+			PendingReset:      n.pendingReset,
+			ResetFailures:     n.resetFailures,
+			Topology:          topologyOf(n),
+		})
+	}
+
+	return states
+}
+
+// topologyOf walks up from leaf n, root is skipped because it connects all leaves
+func topologyOf(n *NvidiaNode) []TopologyLink {
+	links := make([]TopologyLink, 0)
+	for p := n.Parent; p != nil && p.Parent != nil; p = p.Parent {
+		peers := make([]int, 0)
+		for i := 0; i < 32; i++ {
+			if p.Mask&(one<<uint(i)) != 0 && i != n.Meta.ID {
+				peers = append(peers, i)
+			}
+		}
+		links = append(links, TopologyLink{Level: p.String(), Peers: peers})
+	}
+
+	return links
+}
+
+// Devices returns metadata of leaves, health is only known by probing
+func (t *NvidiaTree) Devices() []device.DeviceInfo {
+	t.Lock()
+	defer t.Unlock()
+
+	devices := make([]device.DeviceInfo, 0, len(t.leaves))
+	for _, n := range t.leaves {
+		devices = append(devices, deviceInfo(n))
+	}
+
+	return devices
+}
+
+// Device returns metadata of the leaf with name
+func (t *NvidiaTree) Device(name string) (device.DeviceInfo, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	n, ok := t.query[name]
+	if !ok {
+		return device.DeviceInfo{}, false
+	}
+
+	return deviceInfo(n), true
+}
+
+func deviceInfo(n *NvidiaNode) device.DeviceInfo {
+	return device.DeviceInfo{
+		Index:       n.Meta.ID,
+		Name:        n.MinorName(),
+		UUID:        n.Meta.UUID,
+		BusID:       n.Meta.BusId,
+		Model:       n.Meta.Name,
+		TotalMemory: n.Meta.TotalMemory,
+		Healthy:     !n.pendingReset,
+	}
+}
+
+// Occupy marks the leaf with name occupied, see MarkOccupied
+func (t *NvidiaTree) Occupy(name string, cores, memory int64) error {
+	n := t.Query(name)
+	if n == nil {
+		return fmt.Errorf("can not find device %s", name)
+	}
+	t.MarkOccupied(n, cores, memory)
+
+	return nil
+}
+
+// Free marks the leaf with name free, see MarkFree
+func (t *NvidiaTree) Free(name string, cores, memory int64) error {
+	n := t.Query(name)
+	if n == nil {
+		return fmt.Errorf("can not find device %s", name)
+	}
+	t.MarkFree(n, cores, memory)
+
+	return nil
+}
+
 // Leaves returns leaves of tree
 func (t *NvidiaTree) Leaves() []*NvidiaNode {
 	return t.leaves
@@ -584,6 +749,36 @@ func (t *NvidiaTree) PrintGraph() string {
 	return output
 }
 
+// Graph returns the details of tree in the same order as PrintGraph
+func (t *NvidiaTree) Graph() *device.GraphNode {
+	t.Lock()
+	defer t.Unlock()
+
+	return graphNode(t.root)
+}
+
+func graphNode(node *NvidiaNode) *device.GraphNode {
+	g := &device.GraphNode{
+		Name:              node.String(),
+		Available:         node.Available(),
+		Pids:              node.Meta.Pids,
+		UsedMemory:        node.Meta.UsedMemory,
+		TotalMemory:       node.Meta.TotalMemory,
+		AllocatableCores:  node.AllocatableMeta.Cores,
+		AllocatableMemory: node.AllocatableMeta.Memory,
+	}
+	if node.ntype == nvml.TOPOLOGY_INTERNAL {
+		g.Name = node.MinorName()
+	}
+
+	PrintSorter.Sort(node.Children)
+	for _, child := range node.Children {
+		g.Children = append(g.Children, graphNode(child))
+	}
+
+	return g
+}
+
 func (t *NvidiaTree) updateNode(idx int) *NvidiaNode {
 	nvml.Init()
 	defer nvml.Shutdown()
@@ -21,6 +21,7 @@ import (
 	"flag"
 	"testing"
 
+	"tkestack.io/gpu-manager/pkg/config"
 	"tkestack.io/gpu-manager/pkg/types"
 )
 
@@ -100,3 +101,49 @@ func testTree(t *testing.T, testCase string, nodeNum int) {
 		t.Fatalf("method Query get wrong node")
 	}
 }
+
+func TestTreeOvercommit(t *testing.T) {
+	flag.Parse()
+	cfg := &config.Config{
+		Overcommit: &config.OvercommitConfig{Cores: 2, Memory: 1.5},
+		Pools:      []config.PoolConfig{{Name: "train", Mode: config.PoolExclusive, Devices: []string{"1"}}},
+	}
+	obj := NewNvidiaTree(cfg)
+	tree, _ := obj.(*NvidiaTree)
+	tree.Init(`    GPU0    GPU1
+GPU0      X      PIX
+GPU1     PIX      X
+`)
+	leaves := tree.Leaves()
+	for _, n := range leaves {
+		n.Meta.TotalMemory = 1024 * types.MemoryBlockSize
+		n.AllocatableMeta.Cores = n.CoreCapacity()
+		n.AllocatableMeta.Memory = n.MemoryCapacity()
+	}
+	// 独占资源池中的设备不超卖
+	if leaves[0].CoreCapacity() != 200 || leaves[0].MemoryCapacity() != 1536*types.MemoryBlockSize ||
+		leaves[1].CoreCapacity() != HundredCore || leaves[1].MemoryCapacity() != 1024*types.MemoryBlockSize {
+		t.Fatalf("unexpected capacity %d %d, %d %d", leaves[0].CoreCapacity(), leaves[0].MemoryCapacity(),
+			leaves[1].CoreCapacity(), leaves[1].MemoryCapacity())
+	}
+
+	tree.MarkOccupied(leaves[0], 80, 768*types.MemoryBlockSize)
+	tree.MarkOccupied(leaves[0], 80, 768*types.MemoryBlockSize)
+	if leaves[0].AllocatableMeta.Cores != 40 || leaves[0].AllocatableMeta.Memory != 0 || tree.Available() != 1 {
+		t.Fatalf("unexpected allocatable %+v after MarkOccupied", leaves[0].AllocatableMeta)
+	}
+
+	tree.MarkFree(leaves[0], 80, 768*types.MemoryBlockSize)
+	if leaves[0].AllocatableMeta.Cores != 120 || tree.Available() != 1 {
+		t.Fatalf("unexpected allocatable %+v after MarkFree", leaves[0].AllocatableMeta)
+	}
+	tree.MarkFree(leaves[0], 80, 768*types.MemoryBlockSize)
+	if leaves[0].AllocatableMeta.Cores != 200 || leaves[0].AllocatableMeta.Memory != 1536*types.MemoryBlockSize || tree.Available() != 2 {
+		t.Fatalf("unexpected allocatable %+v after all freed", leaves[0].AllocatableMeta)
+	}
+
+	states := tree.LeafStates()
+	if states[0].CoreCapacity != 200 || states[1].CoreCapacity != HundredCore {
+		t.Errorf("unexpected leaf states %+v", states)
+	}
+}
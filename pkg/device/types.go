@@ -23,21 +23,115 @@ import (
 	"k8s.io/klog"
 )
 
-//GPUTree is an interface for GPU tree structure
+// HundredCore represents 100 virtual cores, a device is exclusively
+// occupied once HundredCore is requested
+const HundredCore = 100
+
+// GPUTree is an interface for GPU tree structure, leaves of the tree are
+// physical devices and they're named by device path, e.g. /dev/nvidia0
 type GPUTree interface {
 	Init(input string)
 	Update()
+
+	// Devices returns metadata of leaves ordered by index
+	Devices() []DeviceInfo
+	// Device returns metadata of the leaf with name
+	Device(name string) (DeviceInfo, bool)
+	// LeafStates returns a snapshot of allocatable resource of leaves
+	LeafStates() []LeafState
+	// Occupy takes cores and memory from the leaf with name, memory is in
+	// bytes, the leaf is exclusively occupied if cores >= HundredCore
+	Occupy(name string, cores, memory int64) error
+	// Free gives cores and memory back to the leaf with name
+	Free(name string, cores, memory int64) error
+	// Changes returns a new channel notified when allocation or state of
+	// leaves changed, each watcher should call it once
+	Changes() <-chan struct{}
+
+	// PrintGraph returns the details of tree as text
+	PrintGraph() string
+	// Graph returns the details of tree which can be encoded in JSON
+	Graph() *GraphNode
+
+	// Probe queries information and health of devices from the vendor
+	// library, error is returned if the library is not available
+	Probe() ([]DeviceInfo, error)
+	// Usage returns usage of the leaf with name by processes of pids
+	Usage(name string, pids []int) (*DeviceUsage, error)
+}
+
+// DeviceInfo contains metadata and health of a device
+type DeviceInfo struct {
+	// Index is the index of device in the vendor library
+	Index      int    `json:"index"`
+	Name       string `json:"name"`
+	UUID       string `json:"uuid"`
+	BusID      string `json:"busId,omitempty"`
+	Model      string `json:"model,omitempty"`
+	Capability int    `json:"capability,omitempty"`
+	MIG        bool   `json:"mig"`
+	// TotalMemory is in bytes
+	TotalMemory uint64   `json:"totalMemory"`
+	Healthy     bool     `json:"healthy"`
+	Reasons     []string `json:"reasons,omitempty"`
+}
+
+// LeafState is a snapshot of allocation state of a leaf
+type LeafState struct {
+	Index             int
+	UUID              string
+	MinorName         string
+	TotalMemory       uint64
+	AllocatableCores  int64
+	AllocatableMemory int64
+	// CoreCapacity and MemoryCapacity are allocatable resource of the free
+	// leaf, they are larger than physical resource if overcommitted
+	CoreCapacity   int64
+	MemoryCapacity int64
+	PendingReset   bool
+	ResetFailures  int
+	// Topology lists peers of the leaf at each level, from near to far
+	Topology []TopologyLink
+}
+
+// TopologyLink contains indexes of leaves connected at Level
+type TopologyLink struct {
+	Level string
+	Peers []int
+}
+
+// DeviceUsage is the usage of a device by a group of processes
+type DeviceUsage struct {
+	BusID string
+	// Utilization is the sum of SM utilization of processes in percent
+	Utilization uint32
+	// UsedMemory is in bytes
+	UsedMemory uint64
+	// Pids are processes running on the device
+	Pids []int
+}
+
+// GraphNode is a node of the tree, leaves have the name of device
+type GraphNode struct {
+	Name              string       `json:"name"`
+	Available         int          `json:"available"`
+	Pids              []uint       `json:"pids,omitempty"`
+	UsedMemory        uint64       `json:"usedMemory"`
+	TotalMemory       uint64       `json:"totalMemory"`
+	AllocatableCores  int64        `json:"allocatableCores"`
+	AllocatableMemory int64        `json:"allocatableMemory"`
+	Children          []*GraphNode `json:"children,omitempty"`
 }
 
-//NewFunc is a function to create GPUTree
+// NewFunc is a function to create GPUTree
 type NewFunc func(cfg *config.Config) GPUTree
 
 var (
 	factory = make(map[string]NewFunc)
 )
 
-//Register NewFunc with name, which can be get
-//by calling NewFuncForName() later.
+// Register NewFunc with name, which can be get
+// by calling NewFuncForName() later.
 func Register(name string, item NewFunc) {
 	if _, ok := factory[name]; ok {
 		return
@@ -48,8 +142,8 @@ func Register(name string, item NewFunc) {
 	factory[name] = item
 }
 
-//NewFuncForName tries to find functions with specific name
-//from factory, return nil if not found.
+// NewFuncForName tries to find functions with specific name
+// from factory, return nil if not found.
 func NewFuncForName(name string) NewFunc {
 	if item, ok := factory[name]; ok {
 		return item
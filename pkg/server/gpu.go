@@ -0,0 +1,122 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"tkestack.io/gpu-manager/pkg/types"
+)
+
+const (
+	gpuSocketName = "nvidia-gpu.sock"
+)
+
+// gpuResourceServer advertises whole GPUs by UUID as nvidia.com/gpu, so
+// workloads written for NVIDIA device plugin run without modification
+type gpuResourceServer struct {
+	resourceServerImpl
+}
+
+var _ pluginapi.DevicePluginServer = &gpuResourceServer{}
+var _ ResourceServer = &gpuResourceServer{}
+
+func newGPUServer(manager *managerImpl) ResourceServer {
+	socketFile := filepath.Join(manager.config.DevicePluginPath, gpuSocketName)
+
+	return &gpuResourceServer{
+		resourceServerImpl: resourceServerImpl{
+			socketFile: socketFile,
+			mgr:        manager,
+		},
+	}
+}
+
+func (gr *gpuResourceServer) SocketName() string {
+	return gr.socketFile
+}
+
+func (gr *gpuResourceServer) ResourceName() string {
+	return types.NvidiaGPUResource
+}
+
+func (gr *gpuResourceServer) Stop() {
+	gr.lock.Lock()
+	srv := gr.srv
+	gr.lock.Unlock()
+
+	if srv != nil {
+		srv.GracefulStop()
+	}
+}
+
+func (gr *gpuResourceServer) Run() error {
+	err := syscall.Unlink(gr.socketFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	l, err := net.Listen("unix", gr.socketFile)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer()
+	pluginapi.RegisterDevicePluginServer(srv, gr)
+	gr.lock.Lock()
+	gr.srv = srv
+	gr.lock.Unlock()
+
+	klog.V(2).Infof("Server %s is ready at %s", types.NvidiaGPUResource, gr.socketFile)
+
+	return srv.Serve(l)
+}
+
+/** device plugin interface */
+func (gr *gpuResourceServer) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	klog.V(2).Infof("%+v allocation request for gpu", reqs)
+	return gr.mgr.Allocate(ctx, reqs)
+}
+
+func (gr *gpuResourceServer) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	klog.V(2).Infof("ListAndWatch request for gpu")
+	return gr.mgr.ListAndWatchWithResourceName(types.NvidiaGPUResource, e, s)
+}
+
+func (gr *gpuResourceServer) GetPreferredAllocation(ctx context.Context, req *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	klog.V(2).Infof("GetPreferredAllocation request for gpu")
+	return gr.mgr.GetPreferredAllocation(ctx, req)
+}
+
+func (gr *gpuResourceServer) GetDevicePluginOptions(ctx context.Context, e *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	klog.V(2).Infof("GetDevicePluginOptions request for gpu")
+	return resourceOptions(types.NvidiaGPUResource), nil
+}
+
+func (gr *gpuResourceServer) PreStartContainer(ctx context.Context, req *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	klog.V(2).Infof("PreStartContainer request for gpu")
+	return gr.mgr.PreStartContainer(ctx, req)
+}
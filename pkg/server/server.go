@@ -27,10 +27,12 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
 	displayapi "tkestack.io/gpu-manager/pkg/api/runtime/display"
+	"tkestack.io/gpu-manager/pkg/client/clientset/versioned"
 	"tkestack.io/gpu-manager/pkg/config"
 	deviceFactory "tkestack.io/gpu-manager/pkg/device"
 	containerRuntime "tkestack.io/gpu-manager/pkg/runtime"
@@ -40,6 +42,7 @@ import (
 	// Register allocator controller
 	_ "tkestack.io/gpu-manager/pkg/services/allocator/register"
 	"tkestack.io/gpu-manager/pkg/services/display"
+	"tkestack.io/gpu-manager/pkg/services/mps"
 	"tkestack.io/gpu-manager/pkg/services/virtual-manager"
 	"tkestack.io/gpu-manager/pkg/services/volume"
 	"tkestack.io/gpu-manager/pkg/services/watchdog"
@@ -53,6 +56,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -60,15 +65,43 @@ import (
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
+const (
+	// httpShutdownTimeout is the time to wait for active http connections
+	httpShutdownTimeout = 5 * time.Second
+)
+
+var (
+	// registerBackoff retries registering to kubelet for about half a minute
+	registerBackoff = wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    6,
+		Cap:      30 * time.Second,
+	}
+)
+
 type managerImpl struct {
 	config *config.Config
 
 	allocator      allocFactory.GPUTopoService
 	displayer      *display.Display
 	virtualManager *vitrual_manager.VirtualManager
+	mpsManager     *mps.Manager
+	volumeManager  *volume.VolumeManager
+	podCache       *watchdog.PodCache
 
+	// lock protects bundleServer from restarting after stopped
+	lock         sync.Mutex
+	stopped      bool
 	bundleServer map[string]ResourceServer
 	srv          *grpc.Server
+	httpServer   *http.Server
+
+	// cancel stops workers started by Run, Stop waits for them
+	cancel   context.CancelFunc
+	workers  sync.WaitGroup
+	stopOnce sync.Once
 }
 
 // NewManager creates and returns a new managerImpl struct
@@ -100,7 +133,7 @@ func (m *managerImpl) Ready() bool {
 }
 
 // #lizard forgives
-func (m *managerImpl) Run() error {
+func (m *managerImpl) Run(ctx context.Context) error {
 	// 校验配置文件
 	if err := m.validExtraConfig(m.config.ExtraConfigPath); err != nil {
 		klog.Errorf("Can not load extra config, err %s", err)
@@ -113,7 +146,7 @@ func (m *managerImpl) Run() error {
 	}
 
 	if len(m.config.VolumeConfigPath) > 0 {
-		volumeManager, err := volume.NewVolumeManager(m.config.VolumeConfigPath, m.config.EnableShare)
+		volumeManager, err := volume.NewVolumeManager(m.config.VolumeConfigPath, m.config.EnableShare, m.config.DriverRefreshCommand)
 		if err != nil {
 			klog.Errorf("Can not create volume managerImpl, err %s", err)
 			return err
@@ -123,6 +156,7 @@ func (m *managerImpl) Run() error {
 			klog.Errorf("Can not start volume managerImpl, err %s", err)
 			return err
 		}
+		m.volumeManager = volumeManager
 	}
 
 	sent, err := systemd.SdNotify(true, "READY=1\n")
@@ -149,26 +183,31 @@ func (m *managerImpl) Run() error {
 		return fmt.Errorf("can not generate client from config: error(%v)", err)
 	}
 
+	ctx, m.cancel = context.WithCancel(ctx)
+	stopChan := ctx.Done()
+
+	podCache := watchdog.NewPodCache(client, m.config.Hostname)
+	m.podCache = podCache
+	klog.V(2).Infof("Watchdog is running")
+
 	containerRuntimeManager, err := containerRuntime.NewContainerRuntimeManager(
-		m.config.CgroupDriver, m.config.ContainerRuntimeEndpoint, m.config.RequestTimeout)
+		m.config.CgroupDriver, m.config.ContainerRuntimeEndpoint, m.config.RequestTimeout, podCache)
 	if err != nil {
 		klog.Errorf("can't create container runtime manager: %v", err)
 		return err
 	}
 	klog.V(2).Infof("Container runtime manager is running")
 
-	watchdog.NewPodCache(client, m.config.Hostname)
-	klog.V(2).Infof("Watchdog is running")
-
 	// TODO 检测更新节点label
 	labeler := watchdog.NewNodeLabeler(client.CoreV1(), m.config.Hostname, m.config.NodeLabels)
 	if err := labeler.Run(); err != nil {
 		return err
 	}
-	// TODO 更新节点注释 更新节点心跳
-	annotator := watchdog.NewNodeAnnotator(client.CoreV1(), m.config)
-	if err := annotator.Run(); err != nil {
-		return err
+	if m.config.Driver == "nvidia" {
+		// 发布GPU型号、显存、算力等特征label, 硬件变化后删除过期的label
+		featureLabeler := watchdog.NewFeatureLabeler(client.CoreV1(), m.config.Hostname,
+			watchdog.NewNvmlFeatureSource(m.config.EnableShare))
+		m.runWorker(func() { featureLabeler.Run(stopChan) })
 	}
 
 	klog.V(2).Infof("Load container response data")
@@ -179,7 +218,18 @@ func (m *managerImpl) Run() error {
 		return err
 	}
 
-	m.virtualManager = vitrual_manager.NewVirtualManager(m.config, containerRuntimeManager, responseManager)
+	if m.volumeManager != nil {
+		// 驱动升级后重新镜像驱动库, 并清理不再被容器引用的旧目录
+		m.runWorker(func() {
+			m.volumeManager.WatchDriver(func() sets.String {
+				return mountedHostPaths(responseManager, m.config.DevicePluginPath)
+			}, func(t time.Time) bool {
+				return podsStartedBefore(podCache, t)
+			}, stopChan)
+		})
+	}
+
+	m.virtualManager = vitrual_manager.NewVirtualManager(m.config, containerRuntimeManager, responseManager, podCache)
 	m.virtualManager.Run()
 
 	treeInitFn := deviceFactory.NewFuncForName(m.config.Driver)
@@ -188,30 +238,156 @@ func (m *managerImpl) Run() error {
 	tree.Init("")
 	tree.Update()
 
+	// 资源池中的设备必须是节点上的GPU
+	devices := make(map[int]string)
+	for _, dev := range tree.Devices() {
+		devices[dev.Index] = dev.UUID
+	}
+	if err := m.config.ValidatePools(devices); err != nil {
+		return fmt.Errorf("invalid pools, %v", err)
+	}
+
+	// 更新节点心跳, 设备或者分配状态变化时更新节点注解
+	annotator := watchdog.NewNodeAnnotator(client.CoreV1(), m.config, tree)
+	if err := annotator.Run(stopChan); err != nil {
+		return err
+	}
+
+	if m.config.Driver == "nvidia" {
+		// 设备丢失、重置失败或者nvml不可用时更新节点condition, 并按配置添加taint
+		healthMonitor := watchdog.NewHealthMonitor(client.CoreV1(), m.config, tree)
+		m.runWorker(func() { healthMonitor.Run(stopChan) })
+	}
+
+	if m.config.EnableShare && m.config.ShareBackend == types.ShareBackendMPS {
+		if err := m.runMPSManager(tree); err != nil {
+			klog.Errorf("Can not start MPS manager, err %s", err)
+			return err
+		}
+	}
+
+	if m.config.PublishGPUNode {
+		// 通过GPUNode资源发布设备、拓扑和分配情况, 供调度器和监控watch
+		gpuClient, err := versioned.NewForConfig(clientCfg)
+		if err != nil {
+			return fmt.Errorf("can not generate gpu client from config: error(%v)", err)
+		}
+		publisher := watchdog.NewGPUNodePublisher(gpuClient.GpuV1alpha1().GPUNodes(), m.config, tree, responseManager, podCache)
+		m.runWorker(func() { publisher.Run(stopChan) })
+	}
+
 	initAllocator := allocFactory.NewFuncForName(m.config.Driver)
 	if initAllocator == nil {
 		return fmt.Errorf("can not find allocator for %s", m.config.Driver)
 	}
 
-	m.allocator = initAllocator(m.config, tree, client, responseManager)
-	m.displayer = display.NewDisplay(m.config, tree, containerRuntimeManager)
+	m.allocator = initAllocator(m.config, tree, client, responseManager, podCache)
+	m.displayer = display.NewDisplay(m.config, tree, containerRuntimeManager, podCache, responseManager)
 
 	klog.V(2).Infof("Starting the GRPC server, driver %s, queryPort %d", m.config.Driver, m.config.QueryPort)
 	m.setupGRPCService()
-	mux, err := m.setupGRPCGatewayService()
+	mux, err := m.setupGRPCGatewayService(ctx)
 	if err != nil {
 		return err
 	}
 	m.setupMetricsService(mux)
+	mux.Handle("/topology", m.displayer)
+	if reporter, ok := m.allocator.(allocFactory.QuotaReporter); ok {
+		mux.Handle("/quota", display.NewQuotaHandler(reporter))
+	}
+	if m.volumeManager != nil {
+		mux.Handle("/volumes", m.volumeManager)
+	}
 
+	m.httpServer = &http.Server{
+		Addr:    net.JoinHostPort(m.config.QueryAddr, strconv.Itoa(m.config.QueryPort)),
+		Handler: mux,
+	}
 	go func() {
-		displayListenHandler := net.JoinHostPort(m.config.QueryAddr, strconv.Itoa(m.config.QueryPort))
-		if err := http.ListenAndServe(displayListenHandler, mux); err != nil {
+		if err := m.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			klog.Fatalf("failed to serve connections: %v", err)
 		}
 	}()
 
-	return m.runServer()
+	return m.runServer(ctx)
+}
+
+// runWorker runs fn in a goroutine which is waited by Stop, fn should return
+// once the context of Run is done
+func (m *managerImpl) runWorker(fn func()) {
+	m.workers.Add(1)
+	go func() {
+		defer m.workers.Done()
+		fn()
+	}()
+}
+
+// mountedHostPaths returns host paths mounted by containers allocated,
+// whole GPU containers are only recorded in the kubelet checkpoint
+func mountedHostPaths(responseManager response.Manager, devicePluginPath string) sets.String {
+	paths := sets.NewString()
+	for _, containers := range responseManager.ListAll() {
+		for _, resp := range containers {
+			for _, mount := range resp.Mounts {
+				paths.Insert(mount.HostPath)
+			}
+		}
+	}
+
+	cp, err := utils.GetCheckpointData(devicePluginPath)
+	if err != nil {
+		klog.V(4).Infof("Can not read kubelet checkpoint, %v", err)
+		return paths
+	}
+	for _, item := range cp.PodDeviceEntries {
+		resp := &pluginapi.ContainerAllocateResponse{}
+		if err := resp.Unmarshal(item.AllocResp); err != nil {
+			continue
+		}
+		for _, mount := range resp.Mounts {
+			paths.Insert(mount.HostPath)
+		}
+	}
+
+	return paths
+}
+
+// podsStartedBefore reports whether any active GPU pod was started before t,
+// pods which are not started yet are counted by creation time
+func podsStartedBefore(podCache *watchdog.PodCache, t time.Time) bool {
+	for _, pod := range podCache.GetActivePods() {
+		started := pod.CreationTimestamp.Time
+		if pod.Status.StartTime != nil {
+			started = pod.Status.StartTime.Time
+		}
+		if started.Before(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *managerImpl) runMPSManager(tree deviceFactory.GPUTree) error {
+	probed, err := tree.Probe()
+	if err != nil {
+		return fmt.Errorf("share backend %s requires devices, %v", types.ShareBackendMPS, err)
+	}
+
+	devices := make([]mps.Device, 0)
+	for _, dev := range probed {
+		// MIG设备和独占、预留资源池中的设备不参与共享
+		if dev.MIG || !dev.Healthy || !m.config.IsShared(dev.Index, dev.UUID) {
+			continue
+		}
+		devices = append(devices, mps.Device{
+			Index: dev.Index,
+			UUID:  dev.UUID,
+		})
+	}
+
+	m.mpsManager = mps.NewManager(m.config.MPSPath, devices)
+	return m.mpsManager.Run()
 }
 
 func (m *managerImpl) setupGRPCService() {
@@ -220,11 +396,14 @@ func (m *managerImpl) setupGRPCService() {
 
 	m.bundleServer[types.VCoreAnnotation] = vcoreServer
 	m.bundleServer[types.VMemoryAnnotation] = vmemoryServer
+	if m.config.WholeGPUResource {
+		m.bundleServer[types.NvidiaGPUResource] = newGPUServer(m)
+	}
 
 	displayapi.RegisterGPUDisplayServer(m.srv, m)
 }
 
-func (m *managerImpl) setupGRPCGatewayService() (*http.ServeMux, error) {
+func (m *managerImpl) setupGRPCGatewayService(ctx context.Context) (*http.ServeMux, error) {
 	mux := http.NewServeMux()
 	displayMux := runtime.NewServeMux()
 
@@ -232,7 +411,8 @@ func (m *managerImpl) setupGRPCGatewayService() (*http.ServeMux, error) {
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 
 	go func() {
-		if err := displayapi.RegisterGPUDisplayHandlerFromEndpoint(context.Background(), displayMux, types.ManagerSocket, utils.DefaultDialOptions); err != nil {
+		// 连接在ctx结束后关闭
+		if err := displayapi.RegisterGPUDisplayHandlerFromEndpoint(ctx, displayMux, types.ManagerSocket, utils.DefaultDialOptions); err != nil {
 			klog.Fatalf("Register display service failed, error %s", err)
 		}
 	}()
@@ -248,7 +428,7 @@ func (m *managerImpl) setupMetricsService(mux *http.ServeMux) {
 	mux.Handle("/metric", promhttp.HandlerFor(r, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}))
 }
 
-func (m *managerImpl) runServer() error {
+func (m *managerImpl) runServer(ctx context.Context) error {
 	for name, srv := range m.bundleServer {
 		klog.V(2).Infof("Server %s is running", name)
 		go srv.Run()
@@ -266,16 +446,60 @@ func (m *managerImpl) runServer() error {
 
 	klog.V(2).Infof("Server is ready at %s", types.ManagerSocket)
 
-	return m.srv.Serve(l)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- m.srv.Serve(l)
+	}()
+
+	select {
+	case <-ctx.Done():
+		m.Stop()
+		return nil
+	case err := <-serveErr:
+		return err
+	}
 }
 
+// Stop stops all services. ListAndWatch streams are closed and results in
+// the allocator queue are processed before the checkpoint is flushed, pod
+// informers are stopped at last.
 func (m *managerImpl) Stop() {
-	for name, srv := range m.bundleServer {
-		klog.V(2).Infof("Server %s is stopping", name)
-		srv.Stop()
-	}
-	m.srv.Stop()
-	klog.Fatal("Stop server")
+	m.stopOnce.Do(func() {
+		klog.V(2).Infof("Server is stopping")
+		if m.cancel != nil {
+			m.cancel()
+		}
+		// 先停止分配器, 使ListAndWatch和等待分配结果的请求返回
+		if m.allocator != nil {
+			m.allocator.Stop()
+		}
+		m.lock.Lock()
+		m.stopped = true
+		for name, srv := range m.bundleServer {
+			klog.V(2).Infof("Server %s is stopping", name)
+			srv.Stop()
+		}
+		m.lock.Unlock()
+		if m.virtualManager != nil {
+			m.virtualManager.Stop()
+		}
+		if m.httpServer != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+			if err := m.httpServer.Shutdown(ctx); err != nil {
+				klog.Warningf("can't shutdown http server, %v", err)
+			}
+			cancel()
+		}
+		m.srv.GracefulStop()
+		if m.mpsManager != nil {
+			m.mpsManager.Stop()
+		}
+		m.workers.Wait()
+		if m.podCache != nil {
+			m.podCache.Stop()
+		}
+		klog.V(2).Infof("Server is stopped")
+	})
 }
 
 func (m *managerImpl) validExtraConfig(path string) error {
@@ -349,7 +573,7 @@ func (m *managerImpl) RegisterToKubelet() error {
 			Version:      pluginapi.Version,
 			Endpoint:     path.Base(srv.SocketName()),
 			ResourceName: srv.ResourceName(),
-			Options:      &pluginapi.DevicePluginOptions{PreStartRequired: true},
+			Options:      resourceOptions(srv.ResourceName()),
 		}
 
 		klog.V(2).Infof("Register to kubelet with endpoint %s", req.Endpoint)
@@ -362,3 +586,54 @@ func (m *managerImpl) RegisterToKubelet() error {
 
 	return nil
 }
+
+// resourceOptions returns options of the resource server registered to kubelet,
+// kubelet asks for preferred allocation of whole GPUs to keep them close
+func resourceOptions(resourceName string) *pluginapi.DevicePluginOptions {
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired:                true,
+		GetPreferredAllocationAvailable: resourceName == types.NvidiaGPUResource,
+	}
+}
+
+// ReRegisterToKubelet serves resource servers at new sockets because kubelet
+// removes them when it restarts, then registers them again with backoff.
+// Allocator state is kept, kubelet resumes ListAndWatch once registered.
+func (m *managerImpl) ReRegisterToKubelet(ctx context.Context) error {
+	if err := m.restartResourceServers(); err != nil {
+		return err
+	}
+
+	err := wait.ExponentialBackoffWithContext(ctx, registerBackoff, func(context.Context) (bool, error) {
+		if err := m.RegisterToKubelet(); err != nil {
+			klog.Warningf("Register to kubelet failed, retrying, %v", err)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("can't register to kubelet after it restarted, %v", err)
+	}
+
+	klog.V(2).Infof("Registered to kubelet again")
+	return nil
+}
+
+func (m *managerImpl) restartResourceServers() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stopped {
+		return fmt.Errorf("server is stopped")
+	}
+	for name, srv := range m.bundleServer {
+		klog.V(2).Infof("Server %s is restarting", name)
+		srv.Stop()
+		go srv.Run()
+		if err := utils.WaitForServer(srv.SocketName()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -44,11 +44,13 @@ import (
 	"tkestack.io/gpu-manager/pkg/utils"
 
 	"github.com/pkg/errors"
+	"go.uber.org/goleak"
 	"google.golang.org/grpc"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes/fake"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -63,6 +65,8 @@ type kubeletStub struct {
 	socket          string
 	pluginEndpoints map[string]string
 	server          *grpc.Server
+	// failures is the number of registrations to reject
+	failures int
 }
 
 type podRawInfo struct {
@@ -89,6 +93,10 @@ func newKubeletStub(socket string) *kubeletStub {
 func (k *kubeletStub) Register(ctx context.Context, r *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
 	k.Lock()
 	defer k.Unlock()
+	if k.failures > 0 {
+		k.failures--
+		return nil, fmt.Errorf("kubelet is not ready")
+	}
 	k.pluginEndpoints[r.ResourceName] = r.Endpoint
 	return &pluginapi.Empty{}, nil
 }
@@ -109,12 +117,24 @@ func (k *kubeletStub) start() error {
 	return utils.WaitForServer(k.socket)
 }
 
+// restart simulates restarting of kubelet, which removes sockets of plugins
+// and forgets registered endpoints
+func (k *kubeletStub) restart() error {
+	k.server.Stop()
+
+	k.Lock()
+	for _, endpoint := range k.pluginEndpoints {
+		os.Remove(filepath.Join(filepath.Dir(k.socket), endpoint))
+	}
+	k.pluginEndpoints = make(map[string]string)
+	k.Unlock()
+
+	return k.start()
+}
+
 // stop servers and clean up
 func stopServer(srv *managerImpl) {
-	for _, s := range srv.bundleServer {
-		s.Stop()
-	}
-	srv.srv.Stop()
+	srv.Stop()
 	os.RemoveAll(srv.config.VirtualManagerPath)
 }
 
@@ -159,7 +179,9 @@ func TestServer(t *testing.T) {
 	// init manager
 	srv, _ := NewManager(cfg).(*managerImpl)
 	fakeRuntimeManager := runtime.NewContainerRuntimeManagerStub()
-	srv.virtualManager = virtual_manager.NewVirtualManagerForTest(cfg, fakeRuntimeManager, response.NewFakeResponseManager())
+	k8sClient := fake.NewSimpleClientset()
+	podCache := watchdog.NewPodCacheForTest(k8sClient)
+	srv.virtualManager = virtual_manager.NewVirtualManagerForTest(cfg, fakeRuntimeManager, response.NewFakeResponseManager(), podCache)
 	srv.virtualManager.Run()
 	defer stopServer(srv)
 
@@ -183,10 +205,8 @@ GPU5     SOC     SOC     SOC     SOC     PIX      X
 		n.Meta.TotalMemory = 1024 * 1024 * 1024
 	}
 
-	k8sClient := fake.NewSimpleClientset()
-	watchdog.NewPodCacheForTest(k8sClient)
 	initAllocator := allocFactory.NewFuncForName(cfg.Driver + "_test")
-	srv.allocator = initAllocator(cfg, tree, k8sClient, response.NewFakeResponseManager())
+	srv.allocator = initAllocator(cfg, tree, k8sClient, response.NewFakeResponseManager(), podCache)
 	srv.setupGRPCService()
 	srv.RegisterToKubelet()
 	for _, rs := range srv.bundleServer {
@@ -288,3 +308,129 @@ GPU5     SOC     SOC     SOC     SOC     PIX      X
 		}
 	}
 }
+
+func TestReRegisterToKubelet(t *testing.T) {
+	tempDir := t.TempDir()
+	cfg := &config.Config{
+		Driver:           "dummy",
+		DevicePluginPath: tempDir,
+		WholeGPUResource: true,
+	}
+	registerBackoff = wait.Backoff{Duration: 10 * time.Millisecond, Factor: 2, Steps: 3}
+
+	kubelet := newKubeletStub(filepath.Join(tempDir, types.KubeletSocket))
+	if err := kubelet.start(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer kubelet.server.Stop()
+
+	srv, _ := NewManager(cfg).(*managerImpl)
+	srv.allocator = allocFactory.NewFuncForName(cfg.Driver)(cfg, nil, nil, nil, nil)
+	srv.setupGRPCService()
+	for _, rs := range srv.bundleServer {
+		go rs.Run()
+		if err := utils.WaitForServer(rs.SocketName()); err != nil {
+			t.Fatalf("%s failed to start: %+v", rs.SocketName(), err)
+		}
+	}
+	defer srv.Stop()
+	if err := srv.RegisterToKubelet(); err != nil {
+		t.Fatalf("register to kubelet failed: %+v", err)
+	}
+
+	// kubelet重启后删除了插件socket, 并且第一次注册失败
+	if err := kubelet.restart(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	kubelet.failures = 1
+	if err := srv.ReRegisterToKubelet(context.Background()); err != nil {
+		t.Fatalf("re-register to kubelet failed: %+v", err)
+	}
+
+	expectEndpoints := map[string]string{
+		types.VCoreAnnotation:   vcoreSocketName,
+		types.VMemoryAnnotation: vmemorySocketName,
+		types.NvidiaGPUResource: gpuSocketName,
+	}
+	kubelet.Lock()
+	endpoints := kubelet.pluginEndpoints
+	kubelet.Unlock()
+	if !reflect.DeepEqual(expectEndpoints, endpoints) {
+		t.Fatalf("re-register to kubelet wrong, expect %v, got %v", expectEndpoints, endpoints)
+	}
+
+	// ListAndWatch works on the new socket
+	conn, err := grpc.Dial(filepath.Join(tempDir, vcoreSocketName), utils.DefaultDialOptions...)
+	if err != nil {
+		t.Fatalf("Failed to get connection: %+v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := pluginapi.NewDevicePluginClient(conn).ListAndWatch(ctx, &pluginapi.Empty{})
+	if err != nil {
+		t.Fatalf("ListAndWatch failed: %+v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("ListAndWatch failed: %+v", err)
+	}
+	if len(resp.Devices) != 1 {
+		t.Errorf("expect 1 device, got %v", resp.Devices)
+	}
+
+	// 停止后不再重启resource server
+	srv.Stop()
+	if err := srv.ReRegisterToKubelet(context.Background()); err == nil {
+		t.Errorf("expect error after stopped")
+	}
+}
+
+func TestServerStop(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	tempDir := t.TempDir()
+	cfg := &config.Config{
+		Driver:           "dummy",
+		DevicePluginPath: tempDir,
+		WholeGPUResource: true,
+	}
+
+	kubelet := newKubeletStub(filepath.Join(tempDir, types.KubeletSocket))
+	if err := kubelet.start(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer kubelet.server.Stop()
+
+	srv, _ := NewManager(cfg).(*managerImpl)
+	srv.allocator = allocFactory.NewFuncForName(cfg.Driver)(cfg, nil, nil, nil, nil)
+	srv.setupGRPCService()
+	for _, rs := range srv.bundleServer {
+		go rs.Run()
+		if err := utils.WaitForServer(rs.SocketName()); err != nil {
+			t.Fatalf("%s failed to start: %+v", rs.SocketName(), err)
+		}
+	}
+	if err := srv.RegisterToKubelet(); err != nil {
+		t.Fatalf("register to kubelet failed: %+v", err)
+	}
+
+	conn, err := grpc.Dial(filepath.Join(tempDir, vcoreSocketName), utils.DefaultDialOptions...)
+	if err != nil {
+		t.Fatalf("Failed to get connection: %+v", err)
+	}
+	defer conn.Close()
+	stream, err := pluginapi.NewDevicePluginClient(conn).ListAndWatch(context.Background(), &pluginapi.Empty{})
+	if err != nil {
+		t.Fatalf("ListAndWatch failed: %+v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("ListAndWatch failed: %+v", err)
+	}
+
+	// 停止后ListAndWatch返回, resource server全部退出
+	srv.Stop()
+	if _, err := stream.Recv(); err == nil {
+		t.Errorf("expect ListAndWatch closed after stopped")
+	}
+}
@@ -18,14 +18,22 @@
 package server
 
 import (
+	"context"
+	"sync"
+
 	"google.golang.org/grpc"
 )
 
 //Manager api
 type Manager interface {
 	Ready() bool
-	Run() error
+	// Run runs the manager until ctx is done, it returns after all services
+	// are stopped
+	Run(ctx context.Context) error
 	RegisterToKubelet() error
+	// ReRegisterToKubelet serves resource servers at new sockets and
+	// registers them again after kubelet restarted
+	ReRegisterToKubelet(ctx context.Context) error
 }
 
 //ResourceServer api for manager
@@ -37,6 +45,9 @@ type ResourceServer interface {
 }
 
 type resourceServerImpl struct {
+	// srv is replaced every time the server runs, a stopped grpc server
+	// can't serve again
+	lock       sync.Mutex
 	srv        *grpc.Server
 	socketFile string
 
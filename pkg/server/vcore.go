@@ -47,7 +47,6 @@ func newVcoreServer(manager *managerImpl) ResourceServer {
 
 	return &vcoreResourceServer{
 		resourceServerImpl: resourceServerImpl{
-			srv:        grpc.NewServer(),
 			socketFile: socketFile,
 			mgr:        manager,
 		},
@@ -63,12 +62,16 @@ func (vr *vcoreResourceServer) ResourceName() string {
 }
 
 func (vr *vcoreResourceServer) Stop() {
-	vr.srv.Stop()
+	vr.lock.Lock()
+	srv := vr.srv
+	vr.lock.Unlock()
+
+	if srv != nil {
+		srv.GracefulStop()
+	}
 }
 
 func (vr *vcoreResourceServer) Run() error {
-	pluginapi.RegisterDevicePluginServer(vr.srv, vr)
-
 	err := syscall.Unlink(vr.socketFile)
 	if err != nil && !os.IsNotExist(err) {
 		return err
@@ -79,9 +82,15 @@ func (vr *vcoreResourceServer) Run() error {
 		return err
 	}
 
+	srv := grpc.NewServer()
+	pluginapi.RegisterDevicePluginServer(srv, vr)
+	vr.lock.Lock()
+	vr.srv = srv
+	vr.lock.Unlock()
+
 	klog.V(2).Infof("Server %s is ready at %s", types.VCoreAnnotation, vr.socketFile)
 
-	return vr.srv.Serve(l)
+	return srv.Serve(l)
 }
 
 /** device plugin interface */
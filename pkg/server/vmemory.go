@@ -46,7 +46,6 @@ func newVmemoryServer(manager *managerImpl) ResourceServer {
 	socketFile := filepath.Join(manager.config.DevicePluginPath, vmemorySocketName)
 	return &vmemoryResourceServer{
 		resourceServerImpl: resourceServerImpl{
-			srv:        grpc.NewServer(),
 			socketFile: socketFile,
 			mgr:        manager,
 		},
@@ -62,12 +61,16 @@ func (vr *vmemoryResourceServer) ResourceName() string {
 }
 
 func (vr *vmemoryResourceServer) Stop() {
-	vr.srv.Stop()
+	vr.lock.Lock()
+	srv := vr.srv
+	vr.lock.Unlock()
+
+	if srv != nil {
+		srv.GracefulStop()
+	}
 }
 
 func (vr *vmemoryResourceServer) Run() error {
-	pluginapi.RegisterDevicePluginServer(vr.srv, vr)
-
 	err := syscall.Unlink(vr.socketFile)
 	if err != nil && !os.IsNotExist(err) {
 		return err
@@ -78,9 +81,15 @@ func (vr *vmemoryResourceServer) Run() error {
 		return err
 	}
 
+	srv := grpc.NewServer()
+	pluginapi.RegisterDevicePluginServer(srv, vr)
+	vr.lock.Lock()
+	vr.srv = srv
+	vr.lock.Unlock()
+
 	klog.V(2).Infof("Server %s is ready at %s", types.VMemoryAnnotation, vr.socketFile)
 
-	return vr.srv.Serve(l)
+	return srv.Serve(l)
 }
 
 /** device plugin interface */
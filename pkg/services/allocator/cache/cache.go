@@ -22,6 +22,15 @@ type Info struct {
 	Devices []string
 	Cores   int64
 	Memory  int64
+	// WholeGPU is true if devices are allocated as nvidia.com/gpu
+	WholeGPU bool
+	// Init is true for init containers which are not restartable, they
+	// run to completion before other containers start
+	Init bool
+	// Reused is true if nothing is reserved in the tree for the container,
+	// its devices are reused from other containers of the pod or returned
+	// once the init container completes
+	Reused bool
 }
 
 type containerToInfo map[string]*Info
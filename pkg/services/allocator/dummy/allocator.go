@@ -20,11 +20,12 @@ package dummy
 import (
 	"context"
 	"fmt"
-	"time"
+	"sync"
 
 	"tkestack.io/gpu-manager/pkg/config"
 	"tkestack.io/gpu-manager/pkg/device"
 	"tkestack.io/gpu-manager/pkg/services/response"
+	"tkestack.io/gpu-manager/pkg/services/watchdog"
 
 	// Register test allocator controller
 	_ "tkestack.io/gpu-manager/pkg/device/dummy"
@@ -39,15 +40,19 @@ func init() {
 	allocator.Register("dummy", NewDummyAllocator)
 }
 
-// DummyAllocator is a struct{}
+// DummyAllocator allocates /dev/fuse as dummy device
 type DummyAllocator struct {
+	stopChan chan struct{}
+	stopOnce sync.Once
 }
 
 var _ allocator.GPUTopoService = &DummyAllocator{}
 
 // NewDummyAllocator returns a new DummyAllocator
-func NewDummyAllocator(_ *config.Config, _ device.GPUTree, _ kubernetes.Interface, _ response.Manager) allocator.GPUTopoService {
-	return &DummyAllocator{}
+func NewDummyAllocator(_ *config.Config, _ device.GPUTree, _ kubernetes.Interface, _ response.Manager, _ *watchdog.PodCache) allocator.GPUTopoService {
+	return &DummyAllocator{
+		stopChan: make(chan struct{}),
+	}
 }
 
 // GetPreferredAllocation从可用设备列表中返回要分配的首选设备集。
@@ -93,8 +98,9 @@ func (ta *DummyAllocator) ListAndWatchWithResourceName(resourceName string, e *p
 	s.Send(&pluginapi.ListAndWatchResponse{Devices: devs})
 
 	// We don't send unhealthy state
-	for {
-		time.Sleep(time.Second)
+	select {
+	case <-s.Context().Done():
+	case <-ta.stopChan:
 	}
 
 	klog.V(2).Infof("ListAndWatch %s exit", resourceName)
@@ -102,6 +108,13 @@ func (ta *DummyAllocator) ListAndWatchWithResourceName(resourceName string, e *p
 	return nil
 }
 
+// Stop closes ListAndWatch streams
+func (ta *DummyAllocator) Stop() {
+	ta.stopOnce.Do(func() {
+		close(ta.stopChan)
+	})
+}
+
 // GetDevicePluginOptions returns empty DevicePluginOptions
 func (ta *DummyAllocator) GetDevicePluginOptions(ctx context.Context, e *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
 	return &pluginapi.DevicePluginOptions{}, nil
@@ -38,7 +38,9 @@ import (
 	"tkestack.io/gpu-manager/pkg/services/allocator"
 	"tkestack.io/gpu-manager/pkg/services/allocator/cache"
 	"tkestack.io/gpu-manager/pkg/services/allocator/checkpoint"
+	"tkestack.io/gpu-manager/pkg/services/mps"
 	"tkestack.io/gpu-manager/pkg/services/response"
+	"tkestack.io/gpu-manager/pkg/services/volume"
 	"tkestack.io/gpu-manager/pkg/services/watchdog"
 	"tkestack.io/gpu-manager/pkg/types"
 	"tkestack.io/gpu-manager/pkg/utils"
@@ -52,6 +54,7 @@ import (
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
@@ -73,15 +76,41 @@ type NvidiaTopoAllocator struct {
 	tree         *nvtree.NvidiaTree
 	allocatedPod *cache.PodCache
 
-	config            *config.Config
-	evaluators        map[string]Evaluator
-	extraConfig       map[string]*config.ExtraConfig
-	k8sClient         kubernetes.Interface
-	unfinishedPod     *v1.Pod
-	queue             workqueue.RateLimitingInterface
-	stopChan          chan struct{}
+	config      *config.Config
+	evaluators  map[string]Evaluator
+	extraConfig map[string]*config.ExtraConfig
+	k8sClient   kubernetes.Interface
+	queue       workqueue.RateLimitingInterface
+	stopChan    chan struct{}
+	stopOnce    sync.Once
+	workers     sync.WaitGroup
+	// resultWorker processes results in the queue until it's shut down
+	resultWorker sync.WaitGroup
+	// pendingResults are results queued and not processed yet, results
+	// are refused once resultsClosed is set
+	resultLock        sync.Mutex
+	pendingResults    map[*allocateResult]struct{}
+	resultsClosed     bool
 	checkpointManager *checkpoint.Manager
 	responseManager   response.Manager
+	podCache          *watchdog.PodCache
+	// wholeGPUPending records GPUs allocated as nvidia.com/gpu which are not
+	// attributed to any pod yet, keyed by minor name
+	wholeGPUPending map[string]time.Time
+	gpuChanges      <-chan struct{}
+	// plans are pods whose GPU containers are reserved but not all
+	// allocated by kubelet yet, keyed by pod uid
+	plans map[string]*podPlan
+	// holds are capacity freed by preemption, keyed by preemptionKey
+	holds map[string]*preemptionHold
+	// preemptions are preemptors whose victims are being evicted in
+	// background, keyed by preemptionKey
+	preemptions      map[string]*preemption
+	evictions        sync.WaitGroup
+	preemptionClosed bool
+	// recorder sends events of pods in background
+	eventBroadcaster record.EventBroadcaster
+	recorder         record.EventRecorder
 }
 
 const (
@@ -95,21 +124,50 @@ type allocateResult struct {
 	result  int
 	message string
 	reason  string
-	resChan chan struct{}
+	// done is closed once the result is processed or dropped, err is the
+	// reason it's dropped
+	done chan struct{}
+	err  error
+	once sync.Once
+}
+
+// finish marks the result processed if err is nil, or dropped with err
+func (ar *allocateResult) finish(err error) {
+	ar.once.Do(func() {
+		ar.err = err
+		close(ar.done)
+	})
 }
 
 var (
 	_           allocator.GPUTopoService = &NvidiaTopoAllocator{}
 	waitTimeout                          = 10 * time.Second
+
+	errNoFreeNode = fmt.Errorf("no free node")
+	// errAllocatorStopped is the error of results not processed before the
+	// allocator is stopped
+	errAllocatorStopped = fmt.Errorf("allocator is stopped")
 )
 
+// nvidiaTree returns the nvidia tree which topology evaluators rely on,
+// the allocator can't work with trees of other vendors.
+func nvidiaTree(tree device.GPUTree) *nvtree.NvidiaTree {
+	t, ok := tree.(*nvtree.NvidiaTree)
+	if !ok {
+		klog.Fatalf("Nvidia allocator requires nvidia device tree, got %T", tree)
+	}
+
+	return t
+}
+
 // NewNvidiaTopoAllocator returns a new NvidiaTopoAllocator
 func NewNvidiaTopoAllocator(config *config.Config,
 	tree device.GPUTree,
 	k8sClient kubernetes.Interface,
-	responseManager response.Manager) allocator.GPUTopoService {
+	responseManager response.Manager,
+	podCache *watchdog.PodCache) allocator.GPUTopoService {
 
-	_tree, _ := tree.(*nvtree.NvidiaTree)
+	_tree := nvidiaTree(tree)
 	cm, err := checkpoint.NewManager(config.CheckpointPath, checkpointFileName)
 	if err != nil {
 		klog.Fatalf("Failed to create checkpoint manager due to %s", err.Error())
@@ -123,9 +181,19 @@ func NewNvidiaTopoAllocator(config *config.Config,
 		k8sClient:         k8sClient,
 		queue:             queue,
 		stopChan:          make(chan struct{}),
+		pendingResults:    make(map[*allocateResult]struct{}),
 		checkpointManager: cm,
 		responseManager:   responseManager,
+		podCache:          podCache,
+		wholeGPUPending:   make(map[string]time.Time),
+		holds:             make(map[string]*preemptionHold),
+		preemptions:       make(map[string]*preemption),
+		plans:             make(map[string]*podPlan),
 	}
+	if config.WholeGPUResource {
+		alloc.gpuChanges = _tree.Changes()
+	}
+	alloc.eventBroadcaster, alloc.recorder = newEventRecorder(k8sClient, config.Hostname)
 	// Load kernel module if it's not loaded
 	alloc.loadModule()
 
@@ -137,12 +205,20 @@ func NewNvidiaTopoAllocator(config *config.Config,
 	alloc.loadExtraConfig(config.ExtraConfigPath)
 
 	// Process allocation results in another goroutine
-	go wait.Until(alloc.runProcessResult, time.Second, alloc.stopChan)
+	alloc.resultWorker.Add(1)
+	go func() {
+		defer alloc.resultWorker.Done()
+		alloc.runProcessResult()
+	}()
 
 	// Recover
 	alloc.recoverInUsed()
 
+	// pod结束后立即回收gpu, 不必等到下一次分配或者检查
+	podCache.OnRelease(alloc.releasePod)
+
 	// Check allocation in another goroutine periodically
+	alloc.workers.Add(1)
 	go alloc.checkAllocationPeriodically(alloc.stopChan)
 
 	return alloc
@@ -153,9 +229,10 @@ func NewNvidiaTopoAllocator(config *config.Config,
 func NewNvidiaTopoAllocatorForTest(config *config.Config,
 	tree device.GPUTree,
 	k8sClient kubernetes.Interface,
-	responseManager response.Manager) allocator.GPUTopoService {
+	responseManager response.Manager,
+	podCache *watchdog.PodCache) allocator.GPUTopoService {
 
-	_tree, _ := tree.(*nvtree.NvidiaTree)
+	_tree := nvidiaTree(tree)
 	cm, err := checkpoint.NewManager("/tmp", checkpointFileName)
 	if err != nil {
 		klog.Fatalf("Failed to create checkpoint manager due to %s", err.Error())
@@ -167,15 +244,26 @@ func NewNvidiaTopoAllocatorForTest(config *config.Config,
 		allocatedPod:      cache.NewAllocateCache(),
 		k8sClient:         k8sClient,
 		stopChan:          make(chan struct{}),
+		pendingResults:    make(map[*allocateResult]struct{}),
 		queue:             workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
 		checkpointManager: cm,
 		responseManager:   responseManager,
+		podCache:          podCache,
+		wholeGPUPending:   make(map[string]time.Time),
+		holds:             make(map[string]*preemptionHold),
+		preemptions:       make(map[string]*preemption),
+		plans:             make(map[string]*podPlan),
 	}
+	if config.WholeGPUResource {
+		alloc.gpuChanges = _tree.Changes()
+	}
+	alloc.eventBroadcaster, alloc.recorder = newEventRecorder(k8sClient, config.Hostname)
 
 	// Initialize evaluator
 	alloc.initEvaluator(_tree, k8sClient, config)
 
 	// Check allocation in another goroutine periodically
+	alloc.workers.Add(1)
 	go alloc.checkAllocationPeriodically(alloc.stopChan)
 
 	return alloc
@@ -186,6 +274,78 @@ func (ta *NvidiaTopoAllocator) runProcessResult() {
 	}
 }
 
+// Stop waits until results in the queue are processed, fails the results
+// waiting for retry, then closes ListAndWatch streams, stops checking
+// allocation and flushes the checkpoint
+func (ta *NvidiaTopoAllocator) Stop() {
+	ta.stopOnce.Do(func() {
+		klog.V(2).Infof("Stopping nvidia allocator")
+		ta.resultLock.Lock()
+		ta.resultsClosed = true
+		ta.resultLock.Unlock()
+
+		// 处理完队列中剩余的分配结果
+		ta.queue.ShutDownWithDrain()
+		ta.resultWorker.Wait()
+
+		// 失败重试的结果不再处理, 通知等待结果的请求
+		ta.resultLock.Lock()
+		for ar := range ta.pendingResults {
+			klog.Warningf("Drop allocation result of pod %s, %v", ar.pod.UID, errAllocatorStopped)
+			ar.finish(errAllocatorStopped)
+			delete(ta.pendingResults, ar)
+		}
+		ta.resultLock.Unlock()
+
+		// 等待正在进行的驱逐结束
+		ta.Lock()
+		ta.preemptionClosed = true
+		ta.Unlock()
+		ta.evictions.Wait()
+
+		close(ta.stopChan)
+		ta.workers.Wait()
+
+		ta.Lock()
+		ta.writeCheckpoint()
+		ta.Unlock()
+		ta.eventBroadcaster.Shutdown()
+		klog.V(2).Infof("Nvidia allocator is stopped")
+	})
+}
+
+// queueResult queues the allocation result to be processed by the result
+// worker, the result is dropped at once if the allocator is stopping
+func (ta *NvidiaTopoAllocator) queueResult(ar *allocateResult) {
+	ar.done = make(chan struct{})
+
+	ta.resultLock.Lock()
+	defer ta.resultLock.Unlock()
+	if ta.resultsClosed {
+		ar.finish(errAllocatorStopped)
+		return
+	}
+	ta.pendingResults[ar] = struct{}{}
+	ta.queue.AddRateLimited(ar)
+}
+
+// waitResult queues the allocation result and waits until it's processed,
+// an error is returned if it's dropped because the allocator is stopped
+func (ta *NvidiaTopoAllocator) waitResult(ar *allocateResult) error {
+	ta.queueResult(ar)
+	<-ar.done
+
+	return ar.err
+}
+
+// finishResult removes a processed result from pending results
+func (ta *NvidiaTopoAllocator) finishResult(ar *allocateResult) {
+	ta.resultLock.Lock()
+	delete(ta.pendingResults, ar)
+	ta.resultLock.Unlock()
+	ar.finish(nil)
+}
+
 // #lizard forgives
 func (ta *NvidiaTopoAllocator) recoverInUsed() {
 	// Read and unmarshal data from checkpoint to allocatedPod before recover from docker
@@ -194,23 +354,26 @@ func (ta *NvidiaTopoAllocator) recoverInUsed() {
 	// Recover device tree by reading checkpoint file
 	for uid, containerToInfo := range ta.allocatedPod.PodGPUMapping {
 		for cName, cache := range containerToInfo {
+			if cache.Reused {
+				continue
+			}
 			for _, dev := range cache.Devices {
 				if utils.IsValidGPUPath(dev) {
 					klog.V(2).Infof("Nvidia GPU %q is in use by container: %q", dev, cName)
 					klog.V(2).Infof("Uid: %s, Name: %s, util: %d, memory: %d", uid, cName, cache.Cores, cache.Memory)
 
-					id, _ := utils.GetGPUMinorID(dev)
-					ta.tree.MarkOccupied(&nvtree.NvidiaNode{
-						Meta: nvtree.DeviceMeta{
-							MinorID: id,
-						},
-					}, cache.Cores, cache.Memory)
+					if err := ta.tree.Occupy(dev, cache.Cores, cache.Memory); err != nil {
+						klog.Warningf("Can't recover %s of %s(%s), %v", dev, uid, cName, err)
+					}
 				}
 			}
 		}
 	}
 
 	ta.recycle()
+	if ta.config.WholeGPUResource {
+		ta.syncWholeGPUs()
+	}
 	ta.writeCheckpoint()
 	ta.checkAllocation()
 }
@@ -230,6 +393,10 @@ func (ta *NvidiaTopoAllocator) checkAllocation() {
 		if !utils.IsGPURequiredPod(&p) {
 			continue
 		}
+		// init容器完成后归还它占用的设备
+		if len(p.Spec.InitContainers) > 0 {
+			ta.releaseInitContainers(&pods[i])
+		}
 		switch p.Status.Phase {
 		case v1.PodFailed, v1.PodPending:
 			// 当分配了gpu的pod处于挂起、运行失败时
@@ -254,12 +421,12 @@ func (ta *NvidiaTopoAllocator) checkAllocation() {
 			}
 			if !pass {
 				ar := &allocateResult{
-					pod:     &pods[i],
-					result:  ALLOCATE_SUCCESS,
-					resChan: make(chan struct{}),
+					pod:    &pods[i],
+					result: ALLOCATE_SUCCESS,
+				}
+				if err := ta.waitResult(ar); err != nil {
+					klog.Warningf("failed to update annotations of pod %s, %v", p.UID, err)
 				}
-				ta.queue.AddRateLimited(ar)
-				<-ar.resChan
 			}
 		default:
 			continue
@@ -268,12 +435,22 @@ func (ta *NvidiaTopoAllocator) checkAllocation() {
 }
 
 func (ta *NvidiaTopoAllocator) checkAllocationPeriodically(quit chan struct{}) {
+	defer ta.workers.Done()
 	// 创建定时器：用于按周期去校验容器分配情况，触发一些额外的操作
 	ticker := time.NewTicker(ta.config.AllocationCheckPeriod)
 	for {
 		select {
 		case <-ticker.C:
+			ta.Lock()
+			ta.expirePlans()
+			ta.expireHolds()
+			ta.Unlock()
 			ta.checkAllocation()
+			if ta.config.WholeGPUResource {
+				ta.Lock()
+				ta.syncWholeGPUs()
+				ta.Unlock()
+			}
 		case <-quit:
 			ticker.Stop()
 			return
@@ -302,8 +479,8 @@ func (ta *NvidiaTopoAllocator) loadExtraConfig(path string) {
 }
 
 func (ta *NvidiaTopoAllocator) initEvaluator(tree *nvtree.NvidiaTree, k8sClient kubernetes.Interface, config *config.Config) {
-	ta.evaluators["link"] = nveval.NewLinkMode(tree)
-	ta.evaluators["fragment"] = nveval.NewFragmentMode(tree)
+	ta.evaluators["link"] = nveval.NewLinkMode(tree, config)
+	ta.evaluators["fragment"] = nveval.NewFragmentMode(tree, config)
 	ta.evaluators["share"] = nveval.NewShareMode(tree, k8sClient, config)
 }
 
@@ -327,12 +504,17 @@ func (ta *NvidiaTopoAllocator) capacity() (devs []*pluginapi.Device) {
 		totalMemory               int64
 	)
 
-	nodes := ta.tree.Leaves()
-	for i := range nodes {
-		totalMemory += int64(nodes[i].Meta.TotalMemory)
+	totalCores := 0
+	for _, leaf := range ta.tree.LeafStates() {
+		// 预留给系统守护进程的设备不上报
+		if ta.config.IsReserved(leaf.Index, leaf.UUID) {
+			continue
+		}
+		// 共享资源池中超卖的设备按比例放大上报的算力和显存
+		totalCores += int(leaf.CoreCapacity)
+		totalMemory += leaf.MemoryCapacity
 	}
 
-	totalCores := len(nodes) * nvtree.HundredCore
 	gpuDevices = make([]*pluginapi.Device, totalCores)
 	for i := 0; i < totalCores; i++ {
 		gpuDevices[i] = &pluginapi.Device{
@@ -342,11 +524,11 @@ func (ta *NvidiaTopoAllocator) capacity() (devs []*pluginapi.Device) {
 	}
 	// TODO根据缩放比来确定设备内存总量
 	totalMemory = int64(ta.config.DeviceMemoryScaling * float64(totalMemory))
-	totalMemoryBlocks := totalMemory / types.MemoryBlockSize
+	totalMemoryBlocks := totalMemory / ta.config.GetMemoryBlockSize()
 	memoryDevices = make([]*pluginapi.Device, totalMemoryBlocks)
 	for i := int64(0); i < totalMemoryBlocks; i++ {
 		memoryDevices[i] = &pluginapi.Device{
-			ID:     fmt.Sprintf("%s-%d-%d", types.VMemoryAnnotation, types.MemoryBlockSize, i),
+			ID:     fmt.Sprintf("%s-%d-%d", types.VMemoryAnnotation, ta.config.GetMemoryBlockSize(), i),
 			Health: pluginapi.Healthy,
 		}
 	}
@@ -358,19 +540,134 @@ func (ta *NvidiaTopoAllocator) capacity() (devs []*pluginapi.Device) {
 }
 
 // #lizard forgives
+// selectNodes evaluates nodes for container of pod without reserving them
+func (ta *NvidiaTopoAllocator) selectNodes(pod *v1.Pod, container *v1.Container, needCores, needMemory int64) ([]*nvtree.NvidiaNode, error) {
+	var nodes []*nvtree.NvidiaNode
+
+	// TODO 默认index0 的设备内存总量为基准 , 改造为寻找设备内存最大值
+	// singleNodeMemory := int64(ta.tree.Leaves()[0].Meta.TotalMemory)
+	singleNodeMemory := int64(ta.tree.GetLeaveMaxTotalMemory())
+
+	klog.V(2).Infof("Try allocate for %s(%s), vcore %d, vmemory %d", pod.UID, container.Name, needCores, needMemory)
+
+	switch {
+	case needCores > nvtree.HundredCore:
+		// 请求的核心数大于一百: 多张卡 使用 linkMode
+		eval, ok := ta.evaluators["link"]
+		if !ok {
+			return nil, fmt.Errorf("can not find evaluator link")
+		}
+		// 请求的核心数不是100的倍数则报错
+		if needCores%nvtree.HundredCore > 0 {
+			return nil, fmt.Errorf("cores are greater than %d, must be multiple of %d", nvtree.HundredCore, nvtree.HundredCore)
+		}
+		// 返回彼此连接开销最小的节点 比如分配两个最近的设备
+		nodes = eval.Evaluate(needCores, 0, pod)
+	case needCores == nvtree.HundredCore:
+		// 请求的核心等于100，整卡占用 使用 碎片模式 fragmentMode
+		eval, ok := ta.evaluators["fragment"]
+		if !ok {
+			return nil, fmt.Errorf("can not find evaluator fragment")
+		}
+		// 返回具有最小可用内核的节点
+		nodes = eval.Evaluate(needCores, 0, pod)
+	default:
+		// 请求核心小于100时 使用共享模式
+
+		// 校验是否开启共享模式开关
+		if !ta.config.EnableShare {
+			return nil, fmt.Errorf("share mode is not enabled")
+		}
+
+		// 校验请求核心或者显存不为0
+		if needCores == 0 || needMemory == 0 {
+			return nil, fmt.Errorf("that cores or memory is zero is not permitted in share mode")
+		}
+
+		// 请求的内存大于单个设备的最大内存，超卖时也不允许
+		if needMemory > singleNodeMemory {
+			return nil, fmt.Errorf("request memory %d is larger than %d", needMemory, singleNodeMemory)
+		}
+
+		// evaluate in share mode
+		eval, ok := ta.evaluators["share"]
+		if !ok {
+			return nil, fmt.Errorf("can not find evaluator share")
+		}
+		// 返回经过排序的具有最小可用内核的节点，以完成请求。
+		nodes = eval.Evaluate(needCores, needMemory, pod)
+		// 计算出的节点为0，没有可用节点
+		if len(nodes) == 0 {
+			break
+		}
+
+		if utils.IsGPUPredicatedPod(pod) {
+			// get predicate node by annotation
+			devStr, err := predicateDevice(pod, container)
+			if err != nil {
+				return nil, err
+			}
+
+			predicateNode := ta.tree.Query(devStr)
+			if predicateNode == nil {
+				return nil, fmt.Errorf("failed to get predicate node %s", devStr)
+			}
+
+			// check if we choose the same node as scheduler
+			// 检查设备插件是否选择了与调度器相同的节点
+			if predicateNode.MinorName() != nodes[0].MinorName() {
+				return nil, fmt.Errorf("Nvidia node mismatch for pod %s(%s), pick up:%s  predicate: %s",
+					pod.Name, container.Name, nodes[0].MinorName(), predicateNode.MinorName())
+			}
+		}
+	}
+
+	if len(nodes) == 0 {
+		return nil, errNoFreeNode
+	}
+
+	return nodes, nil
+}
+
+// predicateDevice returns the device chosen by scheduler for container
+// of pod in share mode
+func predicateDevice(pod *v1.Pod, container *v1.Container) (string, error) {
+	// 获取容器的index注解
+	key, err := utils.GetPredicateIndexAnnotation(pod, container.Name)
+	if err != nil {
+		return "", err
+	}
+	// 拼接index 注解获取调度器阶段分配的设备id
+	idxStr, ok := pod.ObjectMeta.Annotations[key]
+	if !ok {
+		// 当pod注解上没找到gpu设备id,则报错
+		return "", fmt.Errorf("failed to find predicate idx for pod %s", pod.UID)
+	}
+	// 找到设备id
+	if _, err := strconv.Atoi(idxStr); err != nil {
+		return "", fmt.Errorf("predicate idx %s invalid for pod %s ", idxStr, pod.UID)
+	}
+	// 拼接设备路径
+	devStr := types.NvidiaDevicePrefix + idxStr
+	//检查路径是否为有效的Nvidia GPU设备路径，无效则报错
+	if !utils.IsValidGPUPath(devStr) {
+		return "", fmt.Errorf("predicate idx %s invalid", devStr)
+	}
+
+	return devStr, nil
+}
+
+// #lizard forgives
+// allocateOne returns the response of container, devices of all GPU
+// containers of pod are planned and reserved once the first one arrives.
 func (ta *NvidiaTopoAllocator) allocateOne(pod *v1.Pod, container *v1.Container, req *pluginapi.ContainerAllocateRequest) (*pluginapi.ContainerAllocateResponse, error) {
 	var (
 		nodes                       []*nvtree.NvidiaNode
 		needCores, needMemoryBlocks int64
 		predicateMissed             bool
-		allocated                   bool
 	)
 
 	predicateMissed = !utils.IsGPUPredicatedPod(pod)
-	// TODO 默认index0 的设备内存总量为基准 , 改造为寻找设备内存最大值
-	// singleNodeMemory := int64(ta.tree.Leaves()[0].Meta.TotalMemory)
-
-	singleNodeMemory := int64(ta.tree.GetLeaveMaxTotalMemory())
 
 	for _, v := range req.DevicesIDs {
 		if strings.HasPrefix(v, types.VCoreAnnotation) {
@@ -385,130 +682,32 @@ func (ta *NvidiaTopoAllocator) allocateOne(pod *v1.Pod, container *v1.Container,
 		return nil, nil
 	}
 
-	needMemory := needMemoryBlocks * types.MemoryBlockSize
 	ta.tree.Update()
-	shareMode := false
-
-	podCache := ta.allocatedPod.GetCache(string(pod.UID))
-	containerCache := &cache.Info{}
-	if podCache != nil {
-		if c, ok := podCache[container.Name]; ok {
-			allocated = true
-			containerCache = c
-			klog.V(2).Infof("container %s of pod %s has already been allocated, the allcation will be skip", container.Name, pod.UID)
-		}
-	}
-	klog.V(2).Infof("Tree graph: %s", ta.tree.PrintGraph())
 
-	// 已分配过无需再次操作
-	if allocated {
+	containerCache, ok := ta.allocatedPod.GetCache(string(pod.UID))[container.Name]
+	if ok {
 		klog.V(2).Infof("container %s of pod %s has already been allocated, get devices from cached instead", container.Name, pod.UID)
-		for _, d := range containerCache.Devices {
-			node := ta.tree.Query(d)
-			if node != nil {
-				nodes = append(nodes, node)
-			}
-		}
 	} else {
-		klog.V(2).Infof("Try allocate for %s(%s), vcore %d, vmemory %d", pod.UID, container.Name, needCores, needMemory)
-
-		switch {
-		case needCores > nvtree.HundredCore:
-			// 请求的核心数大于一百: 多张卡 使用 linkMode
-			eval, ok := ta.evaluators["link"]
-			if !ok {
-				return nil, fmt.Errorf("can not find evaluator link")
-			}
-			// 请求的核心数不是100的倍数则报错
-			if needCores%nvtree.HundredCore > 0 {
-				return nil, fmt.Errorf("cores are greater than %d, must be multiple of %d", nvtree.HundredCore, nvtree.HundredCore)
-			}
-			// 返回彼此连接开销最小的节点 比如分配两个最近的设备
-			nodes = eval.Evaluate(needCores, 0, pod)
-		case needCores == nvtree.HundredCore:
-			// 请求的核心等于100，整卡占用 使用 碎片模式 fragmentMode
-			eval, ok := ta.evaluators["fragment"]
-			if !ok {
-				return nil, fmt.Errorf("can not find evaluator fragment")
-			}
-			// 返回具有最小可用内核的节点
-			nodes = eval.Evaluate(needCores, 0, pod)
-		default:
-			// 请求核心小于100时 使用共享模式
-
-			// 校验是否开启共享模式开关
-			if !ta.config.EnableShare {
-				return nil, fmt.Errorf("share mode is not enabled")
-			}
-
-			// 校验请求核心或者显存不为0
-			if needCores == 0 || needMemory == 0 {
-				return nil, fmt.Errorf("that cores or memory is zero is not permitted in share mode")
-			}
-
-			// evaluate in share mode
-			shareMode = true
-			eval, ok := ta.evaluators["share"]
-			if !ok {
-				return nil, fmt.Errorf("can not find evaluator share")
-			}
-			// 返回经过排序的具有最小可用内核的节点，以完成请求。
-			nodes = eval.Evaluate(needCores, needMemory, pod)
-			// 计算出的节点为0，没有可用节点
-			if len(nodes) == 0 {
-				// 在共享模式下当请求的内存大于单个设备的最大内存，抛出错误
-				if shareMode && needMemory > singleNodeMemory {
-					return nil, fmt.Errorf("request memory %d is larger than %d", needMemory, singleNodeMemory)
-				}
-
-				return nil, fmt.Errorf("no free node")
-			}
-
-			if !predicateMissed {
-				// get predicate node by annotation
-				// 获取容器index
-				containerIndex, err := utils.GetContainerIndexByName(pod, container.Name)
-				if err != nil {
-					return nil, err
-				}
-				var devStr string
-				// 拼接index 注解获取调度器阶段分配的设备id
-				if idxStr, ok := pod.ObjectMeta.Annotations[types.PredicateGPUIndexPrefix+strconv.Itoa(containerIndex)]; ok {
-					// 找到设备id
-					if _, err := strconv.Atoi(idxStr); err != nil {
-						return nil, fmt.Errorf("predicate idx %s invalid for pod %s ", idxStr, pod.UID)
-					}
-					// 拼接设备路径
-					devStr = types.NvidiaDevicePrefix + idxStr
-					//检查路径是否为有效的Nvidia GPU设备路径，无效则报错
-					if !utils.IsValidGPUPath(devStr) {
-						return nil, fmt.Errorf("predicate idx %s invalid", devStr)
-					}
-				} else {
-					// 当pod注解上没找到gpu设备id,则报错
-					return nil, fmt.Errorf("failed to find predicate idx for pod %s", pod.UID)
-				}
-
-				predicateNode := ta.tree.Query(devStr)
-				if predicateNode == nil {
-					return nil, fmt.Errorf("failed to get predicate node %s", devStr)
-				}
-
-				// check if we choose the same node as scheduler
-				// 检查设备插件是否选择了与调度器相同的节点
-				if predicateNode.MinorName() != nodes[0].MinorName() {
-					return nil, fmt.Errorf("Nvidia node mismatch for pod %s(%s), pick up:%s  predicate: %s",
-						pod.Name, container.Name, nodes[0].MinorName(), predicateNode.MinorName())
-				}
-			}
+		// 第一个容器到达时为pod的所有gpu容器预留设备
+		if err := ta.planPod(pod); err != nil {
+			return nil, err
+		}
+		if containerCache, ok = ta.allocatedPod.GetCache(string(pod.UID))[container.Name]; !ok {
+			ta.abortPlan(pod)
+			return nil, fmt.Errorf("container %s of pod %s is not planned", container.Name, pod.UID)
 		}
 	}
+	klog.V(2).Infof("Tree graph: %s", ta.tree.PrintGraph())
 
-	if len(nodes) == 0 {
-		if shareMode && needMemory > singleNodeMemory {
-			return nil, fmt.Errorf("request memory %d is larger than %d", needMemory, singleNodeMemory)
+	needCores, needMemory := containerCache.Cores, containerCache.Memory
+	shareMode := needCores < nvtree.HundredCore
+	for _, d := range containerCache.Devices {
+		if node := ta.tree.Query(d); node != nil {
+			nodes = append(nodes, node)
 		}
-
+	}
+	if len(nodes) == 0 {
+		ta.abortPlan(pod)
 		return nil, fmt.Errorf("no free node")
 	}
 
@@ -519,7 +718,6 @@ func (ta *NvidiaTopoAllocator) allocateOne(pod *v1.Pod, container *v1.Container,
 		Annotations: make(map[string]string),
 	}
 
-	allocatedDevices := sets.NewString()
 	deviceList := make([]string, 0)
 	for _, n := range nodes {
 		name := n.MinorName()
@@ -534,64 +732,107 @@ func (ta *NvidiaTopoAllocator) allocateOne(pod *v1.Pod, container *v1.Container,
 			Permissions:   "rwm",
 		})
 		deviceList = append(deviceList, n.Meta.UUID)
-
-		if !allocated {
-			ta.tree.MarkOccupied(n, needCores, needMemory)
-		}
-		allocatedDevices.Insert(name)
 	}
 
 	ctntResp.Annotations[types.VDeviceAnnotation] = vDeviceAnnotationStr(nodes)
-	if !allocated {
-		ta.allocatedPod.Insert(string(pod.UID), container.Name, &cache.Info{
-			Devices: allocatedDevices.UnsortedList(),
-			Cores:   needCores,
-			Memory:  needMemory,
-		})
-	}
 
-	// check if all containers of pod has been allocated; set unfinishedPod if not
-	unfinished := false
-	for _, c := range pod.Spec.Containers {
-		// 过滤非gpu容器
-		if !utils.IsGPURequiredContainer(&c) {
-			continue
-		}
-		// 找到任然需要分配的容器
-		podCache := ta.allocatedPod.GetCache(string(pod.UID))
-		if podCache != nil {
-			if _, ok := podCache[c.Name]; !ok {
-				unfinished = true
-				break
-			}
+	// 记录已经返回给kubelet的容器, 全部返回后计划完成
+	if plan, ok := ta.plans[string(pod.UID)]; ok {
+		plan.served.Insert(container.Name)
+		if plan.finished() {
+			klog.V(2).Infof("Plan of pod %s is finished", pod.UID)
+			delete(ta.plans, string(pod.UID))
 		}
 	}
-	// 当没完全分配完毕，设置unfinishedPod，否则置为空
-	if unfinished {
-		ta.unfinishedPod = pod
-	} else {
-		ta.unfinishedPod = nil
-	}
 	// 将分配信息写入check point 文件
 	ta.writeCheckpoint()
 
-	// Append control device
-	ctntResp.Devices = append(ctntResp.Devices, &pluginapi.DeviceSpec{
-		ContainerPath: types.NvidiaCtlDevice,
-		HostPath:      types.NvidiaCtlDevice,
-		Permissions:   "rwm",
+	// Append control device and default device
+	ctntResp.Devices = append(ctntResp.Devices, ta.controlDevices()...)
+
+	// LD_LIBRARY_PATH
+	ctntResp.Envs["LD_LIBRARY_PATH"] = libraryPath(container)
+
+	// NVIDIA_VISIBLE_DEVICES
+	ctntResp.Envs["NVIDIA_VISIBLE_DEVICES"] = strings.Join(deviceList, ",")
+
+	// 驱动升级后会切换到新的镜像目录, 持有分配锁避免选中的目录被回收
+	volume.LockAllocation()
+	driver := types.GetDriverInfo()
+	// 如果是独占模式，则mount原nvidia的cuda库
+	driverPath := driver.OriginLibraryPath
+	if shareMode && ta.config.ShareBackend == types.ShareBackendMPS {
+		// 如果是MPS共享模式，则mount原nvidia的cuda库，由MPS限制算力和显存
+		// 只挂载MPS的pipe和log目录, 容器保留自己的/dev/shm
+		ctntResp.Mounts = append(ctntResp.Mounts, &pluginapi.Mount{
+			ContainerPath: mps.ContainerPipeDirectory,
+			HostPath:      mps.PipeDirectory(ta.config.MPSPath, nodes[0].Meta.UUID),
+		}, &pluginapi.Mount{
+			ContainerPath: mps.ContainerLogDirectory,
+			HostPath:      mps.LogDirectory(ta.config.MPSPath, nodes[0].Meta.UUID),
+			ReadOnly:      true,
+		})
+		for k, v := range mps.ClientEnvs(needCores, needMemory) {
+			ctntResp.Envs[k] = v
+		}
+	} else if shareMode {
+		// 如果是共享模式，则mount修改后的vcuda库
+		driverPath = driver.LibraryPath
+	}
+
+	// 根据NVIDIA_DRIVER_CAPABILITIES只挂载容器需要的驱动组件
+	driverPath = ta.driverView(pod, container, driverPath)
+	volume.MarkInUse(driverPath)
+	volume.UnlockAllocation()
+	ctntResp.Mounts = append(ctntResp.Mounts, &pluginapi.Mount{
+		ContainerPath: "/usr/local/nvidia",
+		HostPath:      driverPath,
+		ReadOnly:      true,
 	})
+	for k, v := range volume.GraphicsEnvs(driverPath, "/usr/local/nvidia") {
+		ctntResp.Envs[k] = v
+	}
 
-	ctntResp.Devices = append(ctntResp.Devices, &pluginapi.DeviceSpec{
-		ContainerPath: types.NvidiaUVMDevice,
-		HostPath:      types.NvidiaUVMDevice,
-		Permissions:   "rwm",
+	ctntResp.Mounts = append(ctntResp.Mounts, &pluginapi.Mount{
+		ContainerPath: types.VCUDA_MOUNTPOINT,
+		HostPath:      filepath.Join(ta.config.VirtualManagerPath, string(pod.UID)),
+		ReadOnly:      true,
 	})
 
-	// Append default device
+	if predicateMissed {
+		ar := &allocateResult{
+			pod:    pod,
+			result: PREDICATE_MISSING,
+		}
+		if err := ta.waitResult(ar); err != nil {
+			return nil, fmt.Errorf("failed to update annotations of pod %s, %v", pod.UID, err)
+		}
+	}
+
+	ta.responseManager.InsertResp(string(pod.UID), container.Name, ctntResp)
+
+	return ctntResp, nil
+}
+
+// controlDevices returns control devices and default devices of extra config,
+// which are required by every GPU container
+func (ta *NvidiaTopoAllocator) controlDevices() []*pluginapi.DeviceSpec {
+	devices := []*pluginapi.DeviceSpec{
+		{
+			ContainerPath: types.NvidiaCtlDevice,
+			HostPath:      types.NvidiaCtlDevice,
+			Permissions:   "rwm",
+		},
+		{
+			ContainerPath: types.NvidiaUVMDevice,
+			HostPath:      types.NvidiaUVMDevice,
+			Permissions:   "rwm",
+		},
+	}
+
 	if cfg, found := ta.extraConfig["default"]; found {
 		for _, dev := range cfg.Devices {
-			ctntResp.Devices = append(ctntResp.Devices, &pluginapi.DeviceSpec{
+			devices = append(devices, &pluginapi.DeviceSpec{
 				ContainerPath: dev,
 				HostPath:      dev,
 				Permissions:   "rwm",
@@ -599,53 +840,67 @@ func (ta *NvidiaTopoAllocator) allocateOne(pod *v1.Pod, container *v1.Container,
 		}
 	}
 
-	// LD_LIBRARY_PATH
-	ctntResp.Envs["LD_LIBRARY_PATH"] = "/usr/local/nvidia/lib64"
+	return devices
+}
+
+// libraryPath returns LD_LIBRARY_PATH of the driver volume
+func libraryPath(container *v1.Container) string {
 	for _, env := range container.Env {
 		// 当容器环境变量指定了使用32位库，LD_LIBRARY_PATH环境变量改为32位库路径
 		if env.Name == "compat32" && strings.ToLower(env.Value) == "true" {
-			ctntResp.Envs["LD_LIBRARY_PATH"] = "/usr/local/nvidia/lib"
+			return "/usr/local/nvidia/lib"
 		}
 	}
 
-	// NVIDIA_VISIBLE_DEVICES
-	ctntResp.Envs["NVIDIA_VISIBLE_DEVICES"] = strings.Join(deviceList, ",")
+	return "/usr/local/nvidia/lib64"
+}
 
-	if shareMode {
-		// 如果是共享模式，则mount修改后的vcuda库
-		ctntResp.Mounts = append(ctntResp.Mounts, &pluginapi.Mount{
-			ContainerPath: "/usr/local/nvidia",
-			HostPath:      types.DriverLibraryPath,
-			ReadOnly:      true,
-		})
-	} else {
-		// 如果是独占模式，则mount原nvidia的cuda库
-		ctntResp.Mounts = append(ctntResp.Mounts, &pluginapi.Mount{
-			ContainerPath: "/usr/local/nvidia",
-			HostPath:      types.DriverOriginLibraryPath,
-			ReadOnly:      true,
-		})
+// driverView returns the view of driver volume dir which only contains
+// components required by NVIDIA_DRIVER_CAPABILITIES of container, default
+// capabilities are used if the environment is not set. The whole volume is
+// used if the environment comes from ConfigMaps or Secrets, they are never
+// read while allocating.
+func (ta *NvidiaTopoAllocator) driverView(pod *v1.Pod, container *v1.Container, dir string) string {
+	value, ok := containerEnv(container, volume.DriverCapabilitiesEnv)
+	if !ok {
+		klog.V(2).Infof("%s of %s/%s is not a literal value, use the whole volume",
+			volume.DriverCapabilitiesEnv, pod.Name, container.Name)
+		return dir
 	}
 
-	ctntResp.Mounts = append(ctntResp.Mounts, &pluginapi.Mount{
-		ContainerPath: types.VCUDA_MOUNTPOINT,
-		HostPath:      filepath.Join(ta.config.VirtualManagerPath, string(pod.UID)),
-		ReadOnly:      true,
-	})
+	caps := volume.ParseCapabilities(value)
+	view, err := volume.CapabilityView(dir, caps)
+	if err != nil {
+		klog.Warningf("Can not create driver view of %s for %v, use the whole volume, %v", dir, caps, err)
+		return dir
+	}
 
-	if predicateMissed {
-		ar := &allocateResult{
-			pod:     pod,
-			result:  PREDICATE_MISSING,
-			resChan: make(chan struct{}),
+	return view
+}
+
+// containerEnv returns the literal value of environment name of container,
+// false is returned if the value is set by valueFrom or may be set by
+// envFrom, which can't be resolved without the apiserver
+func containerEnv(container *v1.Container, name string) (string, bool) {
+	// env中后出现的值覆盖之前的值, 并且覆盖envFrom
+	for i := len(container.Env) - 1; i >= 0; i-- {
+		env := container.Env[i]
+		if env.Name != name {
+			continue
+		}
+		if env.ValueFrom != nil {
+			return "", false
 		}
-		ta.queue.AddRateLimited(ar)
-		<-ar.resChan
+		return env.Value, true
 	}
 
-	ta.responseManager.InsertResp(string(pod.UID), container.Name, ctntResp)
+	for _, from := range container.EnvFrom {
+		if strings.HasPrefix(name, from.Prefix) {
+			return "", false
+		}
+	}
 
-	return ctntResp, nil
+	return "", true
 }
 
 func (ta *NvidiaTopoAllocator) requestForVCuda(podUID string) error {
@@ -657,14 +912,23 @@ func (ta *NvidiaTopoAllocator) requestForVCuda(podUID string) error {
 	// 将当前pod信息添加到 vcuda信号队列
 	// VCudaRequestsQueue 另一端接收到信号后，
 	// 会为这个pod 创建用于生成vcuda config的grpc服务
-	ta.config.VCudaRequestsQueue <- vcudaEvent
+	select {
+	case ta.config.VCudaRequestsQueue <- vcudaEvent:
+	case <-ta.stopChan:
+		return fmt.Errorf("allocator is stopped")
+	}
 	// 等待grpc服务的启动结果
-	return <-vcudaEvent.Done
+	select {
+	case err := <-vcudaEvent.Done:
+		return err
+	case <-ta.stopChan:
+		return fmt.Errorf("allocator is stopped")
+	}
 }
 
 func (ta *NvidiaTopoAllocator) recycle() {
 	// 获取全部 gpu设备的活动中的 pod
-	activePods := watchdog.GetActivePods()
+	activePods := ta.podCache.GetActivePods()
 	// 已分配的pod uid
 	lastActivePodUids := sets.NewString()
 	// 全部活动中的pod uid
@@ -685,33 +949,43 @@ func (ta *NvidiaTopoAllocator) recycle() {
 	klog.V(5).Infof("Pods to be removed: %v", podsToBeRemoved.List())
 	// 将gpu占用释放
 	ta.freeGPU(podsToBeRemoved.List())
+	ta.dropPlans(podsToBeRemoved.List())
 }
 
+// releasePod frees GPU of pod once it's terminated or deleted
+func (ta *NvidiaTopoAllocator) releasePod(pod *v1.Pod) {
+	ta.Lock()
+	defer ta.Unlock()
+
+	uid := string(pod.UID)
+	if ta.allocatedPod.GetCache(uid) == nil {
+		return
+	}
+	klog.V(2).Infof("Pod %s/%s(%s) is released, free its GPU", pod.Namespace, pod.Name, uid)
+	ta.freeGPU([]string{uid})
+	ta.dropPlans([]string{uid})
+}
+
+// freeGPU frees devices of pods, it may be called without the lock, so plans
+// are dropped by callers holding the lock, see dropPlans
 func (ta *NvidiaTopoAllocator) freeGPU(podUids []string) {
 	for _, uid := range podUids {
 		for contName, info := range ta.allocatedPod.GetCache(uid) {
 			klog.V(2).Infof("Free %s(%s)", uid, contName)
-			// 遍历容器的设备
-			for _, devName := range info.Devices {
-				// 根据设备名找出 设备id
-				id, _ := utils.GetGPUMinorID(devName)
-				// MarkFree通过释放请求核心和内存来更新NvidiaNode。
-				ta.tree.MarkFree(&nvtree.NvidiaNode{
-					Meta: nvtree.DeviceMeta{
-						MinorID: id,
-					},
-				}, info.Cores, info.Memory)
+			// 遍历容器的设备, 复用的设备没有占用不需要释放
+			if !info.Reused {
+				for _, devName := range info.Devices {
+					// 释放设备上请求的核心和内存
+					if err := ta.tree.Free(devName, info.Cores, info.Memory); err != nil {
+						klog.Warningf("Can't free %s of %s(%s), %v", devName, uid, contName, err)
+					}
+				}
 			}
 			// 移除容器信息
 			ta.responseManager.DeleteResp(uid, contName)
 		}
 		// 从以分配中删除该pod
 		ta.allocatedPod.Delete(uid)
-		// 如果要清理的pod是未完成的pod, 则将未完成pod变量重置为nil
-		if ta.unfinishedPod != nil && uid == string(ta.unfinishedPod.UID) {
-			klog.V(2).Infof("unfinished pod %s was deleted, update cached reference to nil", uid)
-			ta.unfinishedPod = nil
-		}
 	}
 	// 更新checkpoint
 	ta.writeCheckpoint()
@@ -742,41 +1016,35 @@ func (ta *NvidiaTopoAllocator) Allocate(_ context.Context, reqs *pluginapi.Alloc
 
 	ta.recycle()
 
-	// 查找容器，当有未完成的pod，则处理
-	if ta.unfinishedPod != nil {
-		candidatePod = ta.unfinishedPod
-		cache := ta.allocatedPod.GetCache(string(candidatePod.UID))
-		if cache == nil {
-			msg := fmt.Sprintf("failed to find pod %s in cache", candidatePod.UID)
-			klog.Infof(msg)
-			return resps, fmt.Errorf(msg)
-		}
-		for i, c := range candidatePod.Spec.Containers {
-			// 跳过缓存中不存的容器
-			if _, ok := cache[c.Name]; ok {
-				continue
-			}
-			// 跳过非gpu的容器
-			if !utils.IsGPURequiredContainer(&c) {
-				continue
-			}
-			// 请求核心数和容器申请的数量不匹配则报错
-			if reqCount != utils.GetGPUResourceOfContainer(&c, types.VCoreAnnotation) {
-				msg := fmt.Sprintf("allocation request mismatch for pod %s, reqs %v", candidatePod.UID, reqs)
-				klog.Infof(msg)
-				return nil, fmt.Errorf(msg)
-			}
-			candidateContainer = &candidatePod.Spec.Containers[i]
-			found = true
-			break
-		}
+	// 整卡资源由kubelet选择设备, 不需要查找候选pod
+	if isWholeGPURequest(req.DevicesIDs) {
+		return ta.allocateWholeGPU(reqs)
+	}
+
+	// 未完成的计划超时则回滚
+	ta.expirePlans()
+	ta.expireHolds()
+
+	// 查找容器，优先从未完成计划的pod中取下一个容器, 请求不匹配的计划保留到超时
+	if pod, c := ta.nextPlanned(reqCount); pod != nil {
+		candidatePod = pod
+		candidateContainer = c
+		found = true
 	} else {
 		// 找出需要分配gpu的pod、基于调度时间排序
-		pods, err := getCandidatePods(ta.k8sClient, ta.config.Hostname)
+		var (
+			pods []*v1.Pod
+			err  error
+		)
+		if ta.config.Standalone {
+			pods, err = ta.getStandaloneCandidatePods()
+		} else {
+			pods, err = getCandidatePods(ta.k8sClient, ta.config.Hostname)
+		}
 		if err != nil {
 			msg := fmt.Sprintf("Failed to find candidate pods due to %v", err)
-			klog.Infof(msg)
-			nodelock.ReleaseNodeLock(ta.config.Hostname, ta.k8sClient)
+			klog.Info(msg)
+			ta.releaseNodeLock()
 			// return nil, fmt.Errorf(msg)
 			return resps, err
 		}
@@ -786,10 +1054,10 @@ func (ta *NvidiaTopoAllocator) Allocate(_ context.Context, reqs *pluginapi.Alloc
 				break
 			}
 
-			// 遍历pod下的容器
-			for i, c := range pod.Spec.Containers {
+			// 按kubelet的分配顺序遍历pod下的init容器和容器
+			for _, c := range utils.GetPodContainers(pod) {
 				// 过滤掉非gpu的容器
-				if !utils.IsGPURequiredContainer(&c) {
+				if !utils.IsGPURequiredContainer(c) {
 					continue
 				}
 				podCache := ta.allocatedPod.GetCache(string(pod.UID))
@@ -801,12 +1069,12 @@ func (ta *NvidiaTopoAllocator) Allocate(_ context.Context, reqs *pluginapi.Alloc
 					}
 				}
 				// 找到请求核心相同的容器，代表找到了pod
-				if utils.GetGPUResourceOfContainer(&pod.Spec.Containers[i], types.VCoreAnnotation) == reqCount {
+				if utils.GetGPUResourceOfContainer(c, types.VCoreAnnotation) == reqCount {
 					klog.Infof("Found candidate Pod %s(%s) with device count %d", pod.UID, c.Name, reqCount)
 					// 当卡前pod
 					candidatePod = pod
 					// 当前要分配的容器
-					candidateContainer = &pod.Spec.Containers[i]
+					candidateContainer = c
 					// 标记找到
 					found = true
 					break
@@ -823,8 +1091,9 @@ func (ta *NvidiaTopoAllocator) Allocate(_ context.Context, reqs *pluginapi.Alloc
 		}
 		resp, err := ta.allocateOne(candidatePod, candidateContainer, req)
 		if err != nil {
-			klog.Errorf(err.Error())
-			// 分配失败 写入分配失败 节点解锁
+			klog.Error(err.Error())
+			// 分配失败 回滚整个pod的预留, 写入分配失败 节点解锁
+			ta.abortPlan(candidatePod)
 			ta.PatchPodAllocationFailed(candidatePod)
 			return resps, err
 		}
@@ -834,23 +1103,27 @@ func (ta *NvidiaTopoAllocator) Allocate(_ context.Context, reqs *pluginapi.Alloc
 	} else {
 		// 没找到容器则报错
 		msg := fmt.Sprintf("candidate pod not found for request %v, allocation failed", reqs)
-		klog.Infof(msg)
+		klog.Info(msg)
 		// 没找打容器 则解锁
 		if candidatePod == nil {
-			nodelock.ReleaseNodeLock(ta.config.Hostname, ta.k8sClient)
+			ta.releaseNodeLock()
 		} else {
 			ta.PatchPodAllocationFailed(candidatePod)
 		}
-		return resps, fmt.Errorf(msg)
+		return resps, fmt.Errorf("%s", msg)
 	}
-	// 分配成功，无未完成分配的pod，写入分配完毕，节点解锁
-	if ta.unfinishedPod == nil {
+	// 分配成功，pod的计划已完成，写入分配完毕，节点解锁
+	if _, ok := ta.plans[string(candidatePod.UID)]; !ok {
 		ta.PatchPodAllocationSuccess(candidatePod)
 	}
 	return resps, nil
 }
 
 func (ta *NvidiaTopoAllocator) PatchPodAllocationFailed(pod *v1.Pod) {
+	// 单机模式下pod没有调度器的绑定标签, 节点也没有加锁
+	if ta.config.Standalone {
+		return
+	}
 	labels := map[string]string{types.PodLabelDeviceBindPhase: string(types.DeviceBindFailed)}
 	patch := utils.NewPatchLabel(labels)
 	bytes, _ := json.Marshal(patch)
@@ -859,13 +1132,14 @@ func (ta *NvidiaTopoAllocator) PatchPodAllocationFailed(pod *v1.Pod) {
 	if err != nil {
 		klog.Infof("patch pod %v failed, %v", pod.Name, err)
 	}
-	err = nodelock.ReleaseNodeLock(ta.config.Hostname, ta.k8sClient)
-	if err != nil {
-		klog.Errorf("release lock failed:%v", err.Error())
-	}
+	ta.releaseNodeLock()
 }
 
 func (ta *NvidiaTopoAllocator) PatchPodAllocationSuccess(pod *v1.Pod) {
+	// 单机模式下pod没有调度器的绑定标签, 节点也没有加锁
+	if ta.config.Standalone {
+		return
+	}
 	labels := map[string]string{types.PodLabelDeviceBindPhase: string(types.DeviceBindSuccess)}
 	patch := utils.NewPatchLabel(labels)
 	bytes, _ := json.Marshal(patch)
@@ -874,8 +1148,16 @@ func (ta *NvidiaTopoAllocator) PatchPodAllocationSuccess(pod *v1.Pod) {
 	if err != nil {
 		klog.Infof("patch pod %v failed, %v", pod.Name, err)
 	}
-	err = nodelock.ReleaseNodeLock(ta.config.Hostname, ta.k8sClient)
-	if err != nil {
+	ta.releaseNodeLock()
+}
+
+// releaseNodeLock releases the node lock taken by scheduler before binding,
+// nothing is locked in standalone mode
+func (ta *NvidiaTopoAllocator) releaseNodeLock() {
+	if ta.config.Standalone {
+		return
+	}
+	if err := nodelock.ReleaseNodeLock(ta.config.Hostname, ta.k8sClient); err != nil {
 		klog.Errorf("release lock failed:%v", err.Error())
 	}
 }
@@ -887,6 +1169,10 @@ func (ta *NvidiaTopoAllocator) ListAndWatch(e *pluginapi.Empty, s pluginapi.Devi
 
 // ListAndWatchWithResourceName send devices for request resource back to server
 func (ta *NvidiaTopoAllocator) ListAndWatchWithResourceName(resourceName string, e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	if resourceName == types.NvidiaGPUResource {
+		return ta.listAndWatchWholeGPU(s)
+	}
+
 	devs := make([]*pluginapi.Device, 0)
 	for _, dev := range ta.capacity() {
 		if strings.HasPrefix(dev.ID, resourceName) {
@@ -898,8 +1184,9 @@ func (ta *NvidiaTopoAllocator) ListAndWatchWithResourceName(resourceName string,
 
 	// We don't send unhealthy state
 	// 不更新设备不健康状态
-	for {
-		time.Sleep(time.Second)
+	select {
+	case <-s.Context().Done():
+	case <-ta.stopChan:
 	}
 
 	klog.V(2).Infof("ListAndWatch %s exit", resourceName)
@@ -907,13 +1194,6 @@ func (ta *NvidiaTopoAllocator) ListAndWatchWithResourceName(resourceName string,
 	return nil
 }
 
-// GetPreferredAllocation从可用设备列表中返回要分配的首选设备集。
-// 由此产生的首选分配不能保证是设备管理器最终执行的分配。
-// 它只是为了在可能的情况下帮助设备管理器做出更明智的分配决定。
-func (ta *NvidiaTopoAllocator) GetPreferredAllocation(context.Context, *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	return &pluginapi.PreferredAllocationResponse{}, nil
-}
-
 // GetDevicePluginOptions returns empty DevicePluginOptions
 func (ta *NvidiaTopoAllocator) GetDevicePluginOptions(ctx context.Context, e *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
 	return &pluginapi.DevicePluginOptions{PreStartRequired: true}, nil
@@ -927,6 +1207,9 @@ func (ta *NvidiaTopoAllocator) PreStartContainer(ctx context.Context, req *plugi
 	ta.Lock()
 	defer ta.Unlock()
 	klog.V(2).Infof("get preStartContainer call from k8s, req: %+v", req)
+	if isWholeGPURequest(req.DevicesIDs) {
+		return ta.preStartWholeGPU(req)
+	}
 	var (
 		podUID        string
 		containerName string
@@ -941,8 +1224,8 @@ func (ta *NvidiaTopoAllocator) PreStartContainer(ctx context.Context, req *plugi
 	if err != nil {
 		msg := fmt.Sprintf("%s, failed to read from checkpoint file due to %v",
 			types.PreStartContainerCheckErrMsg, err)
-		klog.Infof(msg)
-		return nil, fmt.Errorf(msg)
+		klog.Info(msg)
+		return nil, fmt.Errorf("%s", msg)
 	}
 
 	for _, entry := range cp.PodDeviceEntries {
@@ -969,22 +1252,22 @@ func (ta *NvidiaTopoAllocator) PreStartContainer(ctx context.Context, req *plugi
 	if podUID == "" || containerName == "" {
 		msg := fmt.Sprintf("%s, failed to get pod from deviceplugin checkpoint for PreStartContainer request %v",
 			types.PreStartContainerCheckErrMsg, req)
-		klog.Infof(msg)
-		return nil, fmt.Errorf(msg)
+		klog.Info(msg)
+		return nil, fmt.Errorf("%s", msg)
 	}
 	// 通过遍历本地缓存得到活动pod,从中根据pod uid找到具体的pod
-	pod, ok := watchdog.GetActivePods()[podUID]
+	pod, ok := ta.podCache.GetActivePod(podUID)
 	if !ok {
 		msg := fmt.Sprintf("%s, failed to get pod %s in watchdog", types.PreStartContainerCheckErrMsg, podUID)
-		klog.Infof(msg)
-		return nil, fmt.Errorf(msg)
+		klog.Info(msg)
+		return nil, fmt.Errorf("%s", msg)
 	}
 	// 开始校验容器设备分配情况
 	err = ta.preStartContainerCheck(podUID, containerName, vcore, vmemory)
 	if err != nil {
-		klog.Infof(err.Error())
+		klog.Info(err.Error())
 		// 校验容器失败，将错误信息加入限速队列，使其异步更新pod错误状态描述
-		ta.queue.AddRateLimited(&allocateResult{
+		ta.queueResult(&allocateResult{
 			pod:     pod,
 			result:  ALLOCATE_FAIL,
 			message: err.Error(),
@@ -998,20 +1281,22 @@ func (ta *NvidiaTopoAllocator) PreStartContainer(ctx context.Context, req *plugi
 	err = ta.requestForVCuda(podUID)
 	if err != nil {
 		msg := fmt.Sprintf("failed to setup VCuda for pod %s(%s) due to %v", podUID, containerName, err)
-		klog.Infof(msg)
-		return nil, fmt.Errorf(msg)
+		klog.Info(msg)
+		return nil, fmt.Errorf("%s", msg)
 	}
 
 	// prestart check pass, update pod annotation
 	// 走到这一步象征设备分配彻底完成
 	// 将其加入限速队列，队列另一边异步更新pod分配状态
 	ar := &allocateResult{
-		pod:     pod,
-		result:  ALLOCATE_SUCCESS,
-		resChan: make(chan struct{}),
+		pod:    pod,
+		result: ALLOCATE_SUCCESS,
+	}
+	if err := ta.waitResult(ar); err != nil {
+		msg := fmt.Sprintf("failed to update annotations of pod %s(%s) due to %v", podUID, containerName, err)
+		klog.Info(msg)
+		return nil, fmt.Errorf("%s", msg)
 	}
-	ta.queue.AddRateLimited(ar)
-	<-ar.resChan
 
 	return &pluginapi.PreStartContainerResponse{}, nil
 }
@@ -1022,30 +1307,30 @@ func (ta *NvidiaTopoAllocator) preStartContainerCheck(podUID string, containerNa
 	if cache == nil {
 		msg := fmt.Sprintf("%s, failed to get pod %s from allocatedPod cache",
 			types.PreStartContainerCheckErrMsg, podUID)
-		klog.Infof(msg)
-		return fmt.Errorf(msg)
+		klog.Info(msg)
+		return fmt.Errorf("%s", msg)
 	}
 	// 缓存中没有容器信息，则报错
 	if c, ok := cache[containerName]; !ok {
 		msg := fmt.Sprintf("%s, failed to get container %s of pod %s from allocatedPod cache",
 			types.PreStartContainerCheckErrMsg, containerName, podUID)
-		klog.Infof(msg)
-		return fmt.Errorf(msg)
-	} else if c.Memory != vmemory*types.MemoryBlockSize || c.Cores != vcore {
+		klog.Info(msg)
+		return fmt.Errorf("%s", msg)
+	} else if c.Memory != vmemory*ta.config.GetMemoryBlockSize() || c.Cores != vcore {
 		// 缓存中记录分配的设备信息不正确，则报错
 		// request and cache mismatch, evict the pod
 		msg := fmt.Sprintf("%s, pod %s container %s requset mismatch from cache. req: vcore %d vmemory %d; cache: vcore %d vmemory %d",
-			types.PreStartContainerCheckErrMsg, podUID, containerName, vcore, vmemory*types.MemoryBlockSize, c.Cores, c.Memory)
-		klog.Infof(msg)
-		return fmt.Errorf(msg)
+			types.PreStartContainerCheckErrMsg, podUID, containerName, vcore, vmemory*ta.config.GetMemoryBlockSize(), c.Cores, c.Memory)
+		klog.Info(msg)
+		return fmt.Errorf("%s", msg)
 	} else {
 		// 分配的设备不正确，则报错
 		devices := c.Devices
 		if (vcore < nvtree.HundredCore && len(devices) != 1) ||
 			(vcore >= nvtree.HundredCore && len(devices) != int(vcore/nvtree.HundredCore)) {
 			msg := fmt.Sprintf("allocated devices mismatch, request for %d vcore, allocate %v", vcore, devices)
-			klog.Infof(msg)
-			return fmt.Errorf(msg)
+			klog.Info(msg)
+			return fmt.Errorf("%s", msg)
 		}
 	}
 	return nil
@@ -1076,6 +1361,7 @@ func (ta *NvidiaTopoAllocator) processNextResult() bool {
 	}
 
 	ta.queue.Forget(key)
+	ta.finishResult(result)
 	return true
 }
 
@@ -1086,16 +1372,15 @@ func (ta *NvidiaTopoAllocator) processResult(ar *allocateResult) error {
 		annotationMap, err := ta.getReadyAnnotations(ar.pod, true)
 		if err != nil {
 			msg := fmt.Sprintf("failed to get ready annotation of pod %s due to %s", ar.pod.UID, err.Error())
-			klog.Infof(msg)
-			return fmt.Errorf(msg)
+			klog.Info(msg)
+			return fmt.Errorf("%s", msg)
 		}
 		err = patchPodWithAnnotations(ta.k8sClient, ar.pod, annotationMap)
 		if err != nil {
 			msg := fmt.Sprintf("add annotation for pod %s failed due to %s", ar.pod.UID, err.Error())
-			klog.Infof(msg)
-			return fmt.Errorf(msg)
+			klog.Info(msg)
+			return fmt.Errorf("%s", msg)
 		}
-		close(ar.resChan)
 	case ALLOCATE_FAIL:
 		// free GPU devices that are already allocated to this pod
 		// 回收这个pod已分配的gpu
@@ -1111,18 +1396,17 @@ func (ta *NvidiaTopoAllocator) processResult(ar *allocateResult) error {
 		err := ta.updatePodStatus(ar.pod)
 		if err != nil {
 			msg := fmt.Sprintf("failed to set status of pod %s to PodFailed due to %s", ar.pod.UID, err.Error())
-			klog.Infof(msg)
-			return fmt.Errorf(msg)
+			klog.Info(msg)
+			return fmt.Errorf("%s", msg)
 		}
 	case PREDICATE_MISSING:
 		annotationMap, err := ta.getReadyAnnotations(ar.pod, false)
 		err = patchPodWithAnnotations(ta.k8sClient, ar.pod, annotationMap)
 		if err != nil {
 			msg := fmt.Sprintf("add annotation for pod %s failed due to %s", ar.pod.UID, err.Error())
-			klog.Infof(msg)
-			return fmt.Errorf(msg)
+			klog.Info(msg)
+			return fmt.Errorf("%s", msg)
 		}
-		close(ar.resChan)
 	default:
 		klog.Infof("unknown allocation result %d for pod %s", ar.result, ar.pod.UID)
 	}
@@ -1135,23 +1419,23 @@ func (ta *NvidiaTopoAllocator) getReadyAnnotations(pod *v1.Pod, assigned bool) (
 	cache := ta.allocatedPod.GetCache(string(pod.UID))
 	if cache == nil {
 		msg := fmt.Sprintf("failed to get pod %s from allocatedPod cache", pod.UID)
-		klog.Infof(msg)
-		return nil, fmt.Errorf(msg)
+		klog.Info(msg)
+		return nil, fmt.Errorf("%s", msg)
 	}
 
 	annotationMap = make(map[string]string)
-	// 遍历pod的容器
-	for i, c := range pod.Spec.Containers {
+	// 遍历pod的init容器和容器
+	for _, c := range utils.GetPodContainers(pod) {
 		// 过滤掉非gpu的容器
-		if !utils.IsGPURequiredContainer(&c) {
+		if !utils.IsGPURequiredContainer(c) {
 			continue
 		}
 		var devices []string
 		containerCache, ok := cache[c.Name]
 		if !ok {
 			msg := fmt.Sprintf("failed to get container %s of pod %s from allocatedPod cache", c.Name, pod.UID)
-			klog.Infof(msg)
-			err = fmt.Errorf(msg)
+			klog.Info(msg)
+			err = fmt.Errorf("%s", msg)
 			continue
 		}
 
@@ -1163,7 +1447,8 @@ func (ta *NvidiaTopoAllocator) getReadyAnnotations(pod *v1.Pod, assigned bool) (
 		}
 		predicateIndexStr := strings.Join(devices, ",")
 		// 容器分配的gpu设备index
-		annotationMap[types.PredicateGPUIndexPrefix+strconv.Itoa(i)] = predicateIndexStr
+		key, _ := utils.GetPredicateIndexAnnotation(pod, c.Name)
+		annotationMap[key] = predicateIndexStr
 		// TODO 添加注解
 		//for k, v := range GetAnnotation(i, devices) {
 		//	annotationMap[k] = v
@@ -1220,18 +1505,9 @@ func (ta *NvidiaTopoAllocator) deletePodWithOwnerRef(pod *v1.Pod) error {
 		}
 		// delete the pod
 		klog.V(4).Infof("Try to delete pod %s", pod.UID)
-		err := wait.PollUntilContextTimeout(context.Background(), time.Second, waitTimeout, true,
-			func(ctx context.Context) (bool, error) {
-				err := ta.k8sClient.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
-				if err == nil {
-					return true, nil
-				}
-				if utils.ShouldRetry(err) {
-					return false, nil
-				}
-				klog.V(4).Infof("Failed to delete pod %s due to %v", pod.UID, err)
-				return false, err
-			})
+		err := retryPodRequest(func(ctx context.Context) error {
+			return ta.k8sClient.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		})
 		if err != nil {
 			klog.Errorf("failed to delete pod %s due to %v", pod.UID, err)
 			return err
@@ -1241,6 +1517,22 @@ func (ta *NvidiaTopoAllocator) deletePodWithOwnerRef(pod *v1.Pod) error {
 	return nil
 }
 
+// retryPodRequest calls request until it succeeds, fails with an error which
+// can't be retried or waitTimeout passes
+func retryPodRequest(request func(ctx context.Context) error) error {
+	return wait.PollUntilContextTimeout(context.Background(), time.Second, waitTimeout, true,
+		func(ctx context.Context) (bool, error) {
+			err := request(ctx)
+			if err == nil {
+				return true, nil
+			}
+			if utils.ShouldRetry(err) {
+				return false, nil
+			}
+			return false, err
+		})
+}
+
 func patchPodWithAnnotations(client kubernetes.Interface, pod *v1.Pod, annotationMap map[string]string) error {
 	// update annotations by patching to the pod
 	type patchMetadata struct {
@@ -1272,8 +1564,8 @@ func patchPodWithAnnotations(client kubernetes.Interface, pod *v1.Pod, annotatio
 	)
 	if err != nil {
 		msg := fmt.Sprintf("failed to add annotation %v to pod %s due to %s", annotationMap, pod.UID, err.Error())
-		klog.Infof(msg)
-		return fmt.Errorf(msg)
+		klog.Info(msg)
+		return fmt.Errorf("%s", msg)
 	}
 	return nil
 }
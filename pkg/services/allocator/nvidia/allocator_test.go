@@ -22,7 +22,10 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,17 +33,24 @@ import (
 	"tkestack.io/gpu-manager/pkg/device/nvidia"
 	"tkestack.io/gpu-manager/pkg/services/allocator/cache"
 	"tkestack.io/gpu-manager/pkg/services/response"
+	"tkestack.io/gpu-manager/pkg/services/volume"
 	"tkestack.io/gpu-manager/pkg/services/watchdog"
 	"tkestack.io/gpu-manager/pkg/types"
 	"tkestack.io/gpu-manager/pkg/utils"
 
+	"go.uber.org/goleak"
 	"k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
@@ -87,7 +97,7 @@ GPU5     SOC     SOC     SOC     SOC     PIX      X
 
 	//init allocator
 	k8sClient := fake.NewSimpleClientset()
-	alloc := initAllocator(tree, k8sClient)
+	alloc := initAllocator(tree, k8sClient, nil)
 	cfg := &config.Config{
 		Hostname: "k8s01",
 	}
@@ -187,7 +197,7 @@ GPU5     SOC     SOC     SOC     SOC     PIX      X
 		}
 	}
 
-	watchdog.NewPodCacheForTest(k8sClient)
+	alloc.podCache = watchdog.NewPodCacheForTest(k8sClient)
 	data, err := json.Marshal(podCache)
 	if err != nil {
 		t.Errorf("Failed to marshal allocatedPod due to %v", err)
@@ -249,8 +259,7 @@ GPU5     SOC     SOC     SOC     SOC     PIX      X
 
 	//init allocator k8sclient and watchdog
 	k8sClient := fake.NewSimpleClientset()
-	watchdog.NewPodCacheForTest(k8sClient)
-	alloc := initAllocator(tree, k8sClient)
+	alloc := initAllocator(tree, k8sClient, watchdog.NewPodCacheForTest(k8sClient))
 	cfg := &config.Config{
 		Hostname: "k8s01",
 	}
@@ -463,8 +472,7 @@ GPU5     SOC     SOC     SOC     SOC     PIX      X
 
 	//init allocator k8sclient and watchdog
 	k8sClient := fake.NewSimpleClientset()
-	watchdog.NewPodCacheForTest(k8sClient)
-	alloc := initAllocator(tree, k8sClient)
+	alloc := initAllocator(tree, k8sClient, watchdog.NewPodCacheForTest(k8sClient))
 	cfg := &config.Config{
 		Hostname: "k8s01",
 	}
@@ -530,8 +538,7 @@ GPU5     SOC     SOC     SOC     SOC     PIX      X
 
 	//init allocator k8sclient and watchdog
 	k8sClient := fake.NewSimpleClientset()
-	watchdog.NewPodCacheForTest(k8sClient)
-	alloc := initAllocator(tree, k8sClient)
+	alloc := initAllocator(tree, k8sClient, watchdog.NewPodCacheForTest(k8sClient))
 	cfg := &config.Config{
 		Hostname: "k8s01",
 	}
@@ -661,8 +668,7 @@ GPU5     SOC     SOC     SOC     SOC     PIX      X
 
 	//init allocator k8sclient and watchdog
 	k8sClient := fake.NewSimpleClientset()
-	watchdog.NewPodCacheForTest(k8sClient)
-	alloc := initAllocator(tree, k8sClient)
+	alloc := initAllocator(tree, k8sClient, watchdog.NewPodCacheForTest(k8sClient))
 	cfg := &config.Config{
 		Hostname: "k8s01",
 	}
@@ -863,7 +869,91 @@ func prepareContainerAllocateRequest(cores int, memory int) (req pluginapi.Conta
 	return req
 }
 
-func initAllocator(tree *nvidia.NvidiaTree, client kubernetes.Interface) *NvidiaTopoAllocator {
+func TestAllocateWholeGPU(t *testing.T) {
+	flag.Parse()
+	//init tree
+	obj := nvidia.NewNvidiaTree(nil)
+	tree, _ := obj.(*nvidia.NvidiaTree)
+
+	testCase1 :=
+		`    GPU0    GPU1    GPU2    GPU3
+GPU0      X      PIX     SOC     SOC
+GPU1     PIX      X      SOC     SOC
+GPU2     SOC     SOC      X      PIX
+GPU3     SOC     SOC     PIX      X
+`
+	tree.Init(testCase1)
+	for i, n := range tree.Leaves() {
+		n.AllocatableMeta.Cores = nvidia.HundredCore
+		n.AllocatableMeta.Memory = 1024 * 1024 * 1024
+		n.Meta.TotalMemory = 1024 * 1024 * 1024
+		n.Meta.UUID = fmt.Sprintf("GPU-%d", i)
+	}
+
+	//init allocator
+	k8sClient := fake.NewSimpleClientset()
+	alloc := initAllocator(tree, k8sClient, watchdog.NewPodCacheForTest(k8sClient))
+	alloc.initEvaluator(tree, k8sClient, &config.Config{Hostname: "k8s01"})
+	alloc.config.DevicePluginPath = t.TempDir()
+	if err := os.WriteFile(filepath.Join(alloc.config.DevicePluginPath, types.CheckPointFileName),
+		[]byte(`{"Data":{"PodDeviceEntries":[],"RegisteredDevices":{}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// GPU0被vcuda容器使用
+	tree.MarkOccupied(tree.Query("/dev/nvidia0"), 50, 1*types.MemoryBlockSize)
+	for _, dev := range alloc.wholeGPUDevices(sets.NewString()) {
+		if healthy := dev.Health == pluginapi.Healthy; healthy == (dev.ID == "GPU-0") {
+			t.Errorf("unexpected health of %s: %s", dev.ID, dev.Health)
+		}
+	}
+
+	if _, err := alloc.allocateWholeGPU(&pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-0"}}},
+	}); err == nil {
+		t.Errorf("expect error for GPU used by vcuda containers")
+	}
+
+	resps, err := alloc.allocateWholeGPU(&pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-1"}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to allocate whole GPU due to %+v", err)
+	}
+	if env := resps.ContainerResponses[0].Envs["NVIDIA_VISIBLE_DEVICES"]; env != "GPU-1" {
+		t.Errorf("unexpected NVIDIA_VISIBLE_DEVICES %s", env)
+	}
+	// 整卡分配后vcuda不可再使用
+	if meta := tree.Query("/dev/nvidia1").AllocatableMeta; meta.Cores != 0 || meta.Memory != 0 {
+		t.Errorf("expect GPU1 to be occupied, allocatable %+v", meta)
+	}
+
+	// 两张卡优先选择PIX连接的GPU2和GPU3
+	preferred, err := alloc.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+			AvailableDeviceIDs: []string{"GPU-1", "GPU-2", "GPU-3"},
+			AllocationSize:     2,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := preferred.ContainerResponses[0].DeviceIDs; !utils.IsStringSliceEqual(ids, []string{"GPU-2", "GPU-3"}) {
+		t.Errorf("unexpected preferred allocation %v", ids)
+	}
+
+	// kubelet没有使用的GPU超时后释放
+	wholeGPUPendingTimeout = 0
+	defer func() { wholeGPUPendingTimeout = time.Minute }()
+	alloc.Lock()
+	alloc.syncWholeGPUs()
+	alloc.Unlock()
+	if meta := tree.Query("/dev/nvidia1").AllocatableMeta; meta.Cores != nvidia.HundredCore || meta.Memory != 1024*1024*1024 {
+		t.Errorf("expect GPU1 to be freed, allocatable %+v", meta)
+	}
+}
+
+func initAllocator(tree *nvidia.NvidiaTree, client kubernetes.Interface, podCache *watchdog.PodCache) *NvidiaTopoAllocator {
 	cfg := &config.Config{
 		EnableShare:           true,
 		VCudaRequestsQueue:    make(chan *types.VCudaRequest, 10),
@@ -875,6 +965,794 @@ func initAllocator(tree *nvidia.NvidiaTree, client kubernetes.Interface) *Nvidia
 		}
 	}(cfg)
 
-	alloc := NewNvidiaTopoAllocatorForTest(cfg, tree, client, response.NewFakeResponseManager())
+	alloc := NewNvidiaTopoAllocatorForTest(cfg, tree, client, response.NewFakeResponseManager(), podCache)
 	return alloc.(*NvidiaTopoAllocator)
 }
+
+func TestAllocatePodPlan(t *testing.T) {
+	flag.Parse()
+	//init tree
+	obj := nvidia.NewNvidiaTree(nil)
+	tree, _ := obj.(*nvidia.NvidiaTree)
+
+	testCase1 :=
+		`    GPU0    GPU1
+GPU0      X      PIX
+GPU1     PIX      X
+`
+	tree.Init(testCase1)
+	for _, n := range tree.Leaves() {
+		n.AllocatableMeta.Cores = nvidia.HundredCore
+		n.AllocatableMeta.Memory = 1024 * 1024 * 1024
+		n.Meta.TotalMemory = 1024 * 1024 * 1024
+	}
+	freeCores := func() int64 {
+		var cores int64
+		for _, n := range tree.Leaves() {
+			cores += n.AllocatableMeta.Cores
+		}
+		return cores
+	}
+
+	//init allocator k8sclient and watchdog
+	k8sClient := fake.NewSimpleClientset()
+	alloc := initAllocator(tree, k8sClient, watchdog.NewPodCacheForTest(k8sClient))
+	alloc.initEvaluator(tree, k8sClient, &config.Config{Hostname: "k8s01"})
+
+	// 第三个容器无法放置时前两个容器也不能占用设备
+	pod1 := createPod(k8sClient, podRawInfo{
+		Name: "pod-1",
+		UID:  "uid-1",
+		Containers: []containerRawInfo{
+			{Name: "trainer", Cores: 100, Memory: 1, PredicateIndexes: "0"},
+			{Name: "evaluator", Cores: 100, Memory: 1, PredicateIndexes: "1"},
+			{Name: "sidecar", Cores: 100, Memory: 1, PredicateIndexes: "1"},
+		},
+	})
+	req := prepareContainerAllocateRequest(100, 1)
+	if _, err := alloc.allocateOne(pod1, &pod1.Spec.Containers[0], &req); err == nil {
+		t.Fatalf("expect error for pod which can't be placed")
+	}
+	if cores := freeCores(); cores != 2*nvidia.HundredCore || len(alloc.plans) != 0 || alloc.allocatedPod.GetCache("uid-1") != nil {
+		t.Errorf("expect pod-1 to be rolled back, free cores %d, plans %+v", cores, alloc.plans)
+	}
+
+	// 第一个容器到达时预留全部容器, 后续容器从计划中分配
+	pod2 := createPod(k8sClient, podRawInfo{
+		Name: "pod-2",
+		UID:  "uid-2",
+		Containers: []containerRawInfo{
+			{Name: "trainer", Cores: 100, Memory: 1, PredicateIndexes: "0"},
+			{Name: "evaluator", Cores: 100, Memory: 1, PredicateIndexes: "1"},
+		},
+	})
+	if _, err := alloc.allocateOne(pod2, &pod2.Spec.Containers[0], &req); err != nil {
+		t.Fatalf("Failed to allocate for pod %s due to %+v", pod2.Name, err)
+	}
+	if cores := freeCores(); cores != 0 || alloc.plans["uid-2"] == nil {
+		t.Fatalf("expect all containers of pod-2 to be reserved, free cores %d", cores)
+	}
+
+	// 其他pod到达时不回滚未完成的计划, 计划保留到超时
+	pod3 := createPod(k8sClient, podRawInfo{
+		Name:       "pod-3",
+		UID:        "uid-3",
+		Containers: []containerRawInfo{{Name: "cuda", Cores: 10, Memory: 1, PredicateIndexes: "0"}},
+	})
+	req3 := prepareContainerAllocateRequest(10, 1)
+	if _, err := alloc.allocateOne(pod3, &pod3.Spec.Containers[0], &req3); err == nil {
+		t.Fatalf("expect error for pod-3 while devices are reserved by pod-2")
+	}
+	if cores := freeCores(); cores != 0 || alloc.plans["uid-2"] == nil || alloc.plans["uid-3"] != nil {
+		t.Fatalf("expect plan of pod-2 to be kept, free cores %d, plans %+v", cores, alloc.plans)
+	}
+
+	pod, c := alloc.nextPlanned(100)
+	if pod == nil || pod.UID != "uid-2" || c.Name != "evaluator" {
+		t.Fatalf("unexpected next container %+v of pod %+v", c, pod)
+	}
+	resp, err := alloc.allocateOne(pod2, c, &req)
+	if err != nil {
+		t.Fatalf("Failed to allocate for pod %s due to %+v", pod2.Name, err)
+	}
+	if len(resp.Devices) == 0 || alloc.plans["uid-2"] != nil {
+		t.Errorf("expect plan of pod-2 to be finished, resp %+v", resp)
+	}
+	alloc.freeGPU([]string{"uid-2"})
+
+	// 重启前已经分配过的容器不会再次请求, 计划在其余容器分配后完成
+	if err := tree.Occupy("/dev/nvidia0", 100, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	alloc.allocatedPod.Insert("uid-2", "trainer", &cache.Info{Devices: []string{"/dev/nvidia0"}, Cores: 100, Memory: 1 << 20})
+	if _, err := alloc.allocateOne(pod2, &pod2.Spec.Containers[1], &req); err != nil {
+		t.Fatalf("Failed to allocate for pod %s due to %+v", pod2.Name, err)
+	}
+	if alloc.plans["uid-2"] != nil {
+		t.Errorf("expect plan of pod-2 to be finished with the container allocated before")
+	}
+	alloc.freeGPU([]string{"uid-2"})
+
+	// 不持有锁释放的pod(例如PreStartContainer失败)的计划在下次检查时丢弃
+	if _, err := alloc.allocateOne(pod2, &pod2.Spec.Containers[0], &req); err != nil {
+		t.Fatalf("Failed to allocate for pod %s due to %+v", pod2.Name, err)
+	}
+	alloc.freeGPU([]string{"uid-2"})
+	if alloc.plans["uid-2"] == nil {
+		t.Fatalf("expect plan of pod-2 to be kept by freeGPU")
+	}
+	alloc.Lock()
+	expired := alloc.expirePlans()
+	alloc.Unlock()
+	if cores := freeCores(); expired != 0 || len(alloc.plans) != 0 || cores != 2*nvidia.HundredCore {
+		t.Errorf("expect plan of freed pod-2 to be dropped, free cores %d, plans %+v", cores, alloc.plans)
+	}
+
+	// 计划超时后回滚
+	podPlanTimeout = 0
+	defer func() { podPlanTimeout = 2 * time.Minute }()
+	if _, err := alloc.allocateOne(pod2, &pod2.Spec.Containers[0], &req); err != nil {
+		t.Fatalf("Failed to allocate for pod %s due to %+v", pod2.Name, err)
+	}
+	alloc.Lock()
+	expired = alloc.expirePlans()
+	alloc.Unlock()
+	if cores := freeCores(); expired != 1 || cores != 2*nvidia.HundredCore {
+		t.Errorf("expect plan of pod-2 to expire, free cores %d", cores)
+	}
+}
+
+func TestAllocateInitContainers(t *testing.T) {
+	flag.Parse()
+	//init tree
+	obj := nvidia.NewNvidiaTree(nil)
+	tree, _ := obj.(*nvidia.NvidiaTree)
+
+	testCase1 :=
+		`    GPU0    GPU1    GPU2    GPU3
+GPU0      X      PIX     SOC     SOC
+GPU1     PIX      X      SOC     SOC
+GPU2     SOC     SOC      X      PIX
+GPU3     SOC     SOC     PIX      X
+`
+	tree.Init(testCase1)
+	for _, n := range tree.Leaves() {
+		n.AllocatableMeta.Cores = nvidia.HundredCore
+		n.AllocatableMeta.Memory = 1024 * 1024 * 1024
+		n.Meta.TotalMemory = 1024 * 1024 * 1024
+	}
+	freeCores := func() int64 {
+		var cores int64
+		for _, n := range tree.Leaves() {
+			cores += n.AllocatableMeta.Cores
+		}
+		return cores
+	}
+
+	//init allocator k8sclient and watchdog
+	k8sClient := fake.NewSimpleClientset()
+	alloc := initAllocator(tree, k8sClient, watchdog.NewPodCacheForTest(k8sClient))
+	alloc.initEvaluator(tree, k8sClient, &config.Config{Hostname: "k8s01"})
+
+	gpuContainer := func(name string, cores int) v1.Container {
+		return v1.Container{
+			Name: name,
+			Resources: v1.ResourceRequirements{
+				Limits: v1.ResourceList{
+					types.VCoreAnnotation:   resource.MustParse(fmt.Sprintf("%d", cores)),
+					types.VMemoryAnnotation: resource.MustParse("1"),
+				},
+			},
+		}
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod-1",
+			Namespace: "test-ns",
+			UID:       "uid-1",
+			Annotations: map[string]string{
+				types.PredicateTimeAnnotation: fmt.Sprintf("%d", time.Now().UnixNano()),
+				types.GPUAssigned:             "false",
+			},
+		},
+		Spec: v1.PodSpec{
+			InitContainers: []v1.Container{
+				// 模型下载可以复用trainer的整卡
+				gpuContainer("model-download", 100),
+				gpuContainer("log-agent", 100),
+				// 两张整卡的warmup无法复用, 需要单独占用
+				gpuContainer("warmup", 200),
+			},
+			Containers: []v1.Container{gpuContainer("trainer", 100)},
+		},
+	}
+	always := v1.ContainerRestartPolicyAlways
+	pod.Spec.InitContainers[1].RestartPolicy = &always
+	pod, _ = k8sClient.CoreV1().Pods("test-ns").Create(context.Background(), pod, metav1.CreateOptions{})
+
+	if n := utils.GetGPUResourceOfPod(pod, types.VCoreAnnotation); n != 300 {
+		t.Errorf("expect effective vcore 300, got %d", n)
+	}
+
+	req := prepareContainerAllocateRequest(100, 1)
+	if _, err := alloc.allocateOne(pod, &pod.Spec.InitContainers[0], &req); err != nil {
+		t.Fatalf("Failed to allocate for pod %s due to %+v", pod.Name, err)
+	}
+	allocated := alloc.allocatedPod.GetCache("uid-1")
+	if info := allocated["model-download"]; info == nil || !info.Reused ||
+		!utils.IsStringSliceEqual(info.Devices, allocated["trainer"].Devices) {
+		t.Errorf("expect model-download to reuse devices of trainer, got %+v", info)
+	}
+	if info := allocated["warmup"]; info == nil || info.Reused || len(info.Devices) != 2 {
+		t.Errorf("expect warmup to reserve 2 devices, got %+v", info)
+	}
+	// sidecar和trainer各占一张卡, warmup占用剩下的两张卡
+	if cores := freeCores(); cores != 0 {
+		t.Errorf("expect all devices to be occupied, free cores %d", cores)
+	}
+
+	// init容器完成后归还设备
+	pod.Status.InitContainerStatuses = []v1.ContainerStatus{{
+		Name:  "warmup",
+		State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 0}},
+	}}
+	alloc.releaseInitContainers(pod)
+	if cores := freeCores(); !allocated["warmup"].Reused || cores != 2*nvidia.HundredCore {
+		t.Errorf("expect warmup to be released, free cores %d", cores)
+	}
+
+	alloc.freeGPU([]string{"uid-1"})
+	if cores := freeCores(); cores != 4*nvidia.HundredCore {
+		t.Errorf("expect all devices to be freed, free cores %d", cores)
+	}
+}
+
+func TestAllocateStandalone(t *testing.T) {
+	flag.Parse()
+	//init tree
+	obj := nvidia.NewNvidiaTree(nil)
+	tree, _ := obj.(*nvidia.NvidiaTree)
+
+	testCase1 :=
+		`    GPU0    GPU1
+GPU0      X      PIX
+GPU1     PIX      X
+`
+	tree.Init(testCase1)
+	for _, n := range tree.Leaves() {
+		n.AllocatableMeta.Cores = nvidia.HundredCore
+		n.AllocatableMeta.Memory = 1024 * 1024 * 1024
+		n.Meta.TotalMemory = 1024 * 1024 * 1024
+	}
+
+	//init allocator k8sclient and watchdog
+	k8sClient := fake.NewSimpleClientset()
+	alloc := initAllocator(tree, k8sClient, watchdog.NewPodCacheForTest(k8sClient))
+	alloc.initEvaluator(tree, k8sClient, &config.Config{Hostname: "k8s01"})
+	alloc.config.Standalone = true
+	alloc.config.DevicePluginPath = t.TempDir()
+	// 没有调度器时分配结果由设备插件写回pod
+	go alloc.runProcessResult()
+	defer alloc.Stop()
+
+	// 默认调度器调度的pod没有任何注解
+	created := time.Now()
+	for i, name := range []string{"pod-running", "pod-old", "pod-new"} {
+		pod := createPod(k8sClient, podRawInfo{
+			Name:       name,
+			UID:        name,
+			Containers: []containerRawInfo{{Name: "cuda", Cores: 100, Memory: 1}},
+		})
+		pod.Annotations = nil
+		pod.CreationTimestamp = metav1.NewTime(created.Add(time.Duration(i) * time.Second))
+		if _, err := k8sClient.CoreV1().Pods(pod.Namespace).Update(context.Background(), pod, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// kubelet已经为pod-running分配过资源
+	if err := os.WriteFile(filepath.Join(alloc.config.DevicePluginPath, types.CheckPointFileName),
+		[]byte(`{"Data":{"PodDeviceEntries":[{"PodUID":"pod-running","ContainerName":"cuda","ResourceName":"`+
+			types.VCoreAnnotation+`","DeviceIDs":["`+types.VCoreAnnotation+`-0"]}],"RegisteredDevices":{}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pods, err := alloc.getStandaloneCandidatePods()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods) != 2 || pods[0].Name != "pod-old" || pods[1].Name != "pod-new" {
+		t.Fatalf("unexpected candidate pods %+v", pods)
+	}
+
+	req := prepareContainerAllocateRequest(100, 0)
+	resps, err := alloc.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{&req},
+	})
+	if err != nil {
+		t.Fatalf("Failed to allocate in standalone mode due to %+v", err)
+	}
+	if len(resps.ContainerResponses) != 1 || alloc.allocatedPod.GetCache("pod-old") == nil {
+		t.Fatalf("expect pod-old to be allocated, resps %+v", resps)
+	}
+	pod, err := k8sClient.CoreV1().Pods("test-ns").Get(context.Background(), "pod-old", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := alloc.allocatedPod.GetCache("pod-old")["cuda"].Devices
+	if idx := pod.Annotations[types.PredicateGPUIndexPrefix+"0"]; len(devices) != 1 || types.NvidiaDevicePrefix+idx != devices[0] {
+		t.Errorf("unexpected predicate index %s of pod-old, devices %v", idx, devices)
+	}
+}
+
+func TestAllocateQuota(t *testing.T) {
+	flag.Parse()
+	//init tree
+	obj := nvidia.NewNvidiaTree(nil)
+	tree, _ := obj.(*nvidia.NvidiaTree)
+
+	testCase1 :=
+		`    GPU0    GPU1    GPU2
+GPU0      X      PIX     SOC
+GPU1     PIX      X      SOC
+GPU2     SOC     SOC      X
+`
+	tree.Init(testCase1)
+	for i, n := range tree.Leaves() {
+		n.AllocatableMeta.Cores = nvidia.HundredCore
+		n.AllocatableMeta.Memory = 1024 * 1024 * 1024
+		n.Meta.TotalMemory = 1024 * 1024 * 1024
+		n.Meta.Name = "NVIDIA A100-SXM4-40GB"
+		if i == 2 {
+			n.Meta.Name = "Tesla T4"
+		}
+	}
+
+	//init allocator k8sclient and watchdog
+	k8sClient := fake.NewSimpleClientset()
+	podCache := watchdog.NewPodCacheForTest(k8sClient)
+	alloc := initAllocator(tree, k8sClient, podCache)
+	alloc.initEvaluator(tree, k8sClient, &config.Config{Hostname: "k8s01"})
+	one := int64(1)
+	alloc.config.Live = config.NewLiveConfig("", nil)
+	alloc.config.Live.UpdateQuotas([]config.QuotaConfig{
+		{Namespace: "test-ns", Model: "a100", ExclusiveGPUs: &one},
+		{Namespace: "other-ns", ExclusiveGPUs: &one},
+	})
+
+	req := prepareContainerAllocateRequest(100, 1)
+	var pods []*v1.Pod
+	for i := 0; i < 3; i++ {
+		pods = append(pods, createPod(k8sClient, podRawInfo{
+			Name:       fmt.Sprintf("pod-%d", i),
+			UID:        fmt.Sprintf("uid-%d", i),
+			Containers: []containerRawInfo{{Name: "trainer", Cores: 100, Memory: 1}},
+		}))
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(podCache.GetActivePods()) == len(pods), nil
+	}); err != nil {
+		t.Fatalf("pods are not synced to pod cache, %v", err)
+	}
+
+	if _, err := alloc.allocateOne(pods[0], &pods[0].Spec.Containers[0], &req); err != nil {
+		t.Fatalf("Failed to allocate for pod %s due to %+v", pods[0].Name, err)
+	}
+	if devices := alloc.allocatedPod.GetCache("uid-0")["trainer"].Devices; devices[0] == "/dev/nvidia2" {
+		t.Fatalf("expect an A100 to be allocated, got %v", devices)
+	}
+	// 第二张A100超出配额, 回滚并记录事件
+	if _, err := alloc.allocateOne(pods[1], &pods[1].Spec.Containers[0], &req); err == nil {
+		t.Fatalf("expect error for pod exceeding quota")
+	}
+	if alloc.allocatedPod.GetCache("uid-1") != nil || len(alloc.plans) != 0 {
+		t.Errorf("expect pod-1 to be rolled back")
+	}
+	// 事件在后台发送
+	var events *v1.EventList
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		var err error
+		events, err = k8sClient.CoreV1().Events("test-ns").List(context.Background(), metav1.ListOptions{})
+		return err == nil && len(events.Items) > 0, err
+	}); err != nil {
+		t.Fatalf("no event is recorded, %v", err)
+	}
+	if len(events.Items) != 1 || events.Items[0].Reason != quotaExceededReason || events.Items[0].InvolvedObject.Name != "pod-1" {
+		t.Errorf("unexpected events %+v", events.Items)
+	}
+
+	status := alloc.QuotaStatus()
+	if len(status) != 2 || status[0].Used.ExclusiveGPUs != 1 || status[0].Used.Memory != 1 || status[1].Used.ExclusiveGPUs != 0 {
+		t.Errorf("unexpected quota status %+v", status)
+	}
+	// 共享容器只计算算力, T4不受A100的配额限制
+	if usage := alloc.infoUsage(status[0].QuotaConfig, &cache.Info{Devices: []string{"/dev/nvidia0"}, Cores: 30}); usage.SharedCores != 30 || usage.ExclusiveGPUs != 0 {
+		t.Errorf("unexpected usage of shared container %+v", usage)
+	}
+	if usage := alloc.infoUsage(status[0].QuotaConfig, &cache.Info{Devices: []string{"/dev/nvidia2"}, Cores: 100}); usage.ExclusiveGPUs != 0 {
+		t.Errorf("unexpected usage of T4 %+v", usage)
+	}
+}
+
+func TestAllocatePool(t *testing.T) {
+	flag.Parse()
+	//init tree
+	obj := nvidia.NewNvidiaTree(nil)
+	tree, _ := obj.(*nvidia.NvidiaTree)
+
+	testCase1 :=
+		`    GPU0    GPU1    GPU2
+GPU0      X      PIX     PHB
+GPU1     PIX      X      PHB
+GPU2     PHB     PHB      X
+`
+	tree.Init(testCase1)
+	for _, n := range tree.Leaves() {
+		n.AllocatableMeta.Cores = nvidia.HundredCore
+		n.AllocatableMeta.Memory = 1024 * 1024 * 1024
+		n.Meta.TotalMemory = 1024 * 1024 * 1024
+	}
+
+	//init allocator k8sclient and watchdog
+	k8sClient := fake.NewSimpleClientset()
+	podCache := watchdog.NewPodCacheForTest(k8sClient)
+	alloc := initAllocator(tree, k8sClient, podCache)
+	alloc.config.DeviceMemoryScaling = 1
+	alloc.config.Pools = []config.PoolConfig{
+		{Name: "system", Mode: config.PoolReserved, Devices: []string{"0"}},
+		{Name: "team-a", Devices: []string{"2"}},
+	}
+	alloc.initEvaluator(tree, k8sClient, alloc.config)
+
+	// 预留的设备不计入容量
+	cores := 0
+	for _, dev := range alloc.capacity() {
+		if strings.HasPrefix(dev.ID, types.VCoreAnnotation) {
+			cores++
+		}
+	}
+	if cores != 2*nvidia.HundredCore {
+		t.Errorf("expect %d cores, got %d", 2*nvidia.HundredCore, cores)
+	}
+
+	req := prepareContainerAllocateRequest(100, 1)
+	var pods []*v1.Pod
+	for i := 0; i < 3; i++ {
+		pods = append(pods, createPod(k8sClient, podRawInfo{
+			Name:       fmt.Sprintf("pod-%d", i),
+			UID:        fmt.Sprintf("uid-%d", i),
+			Containers: []containerRawInfo{{Name: "trainer", Cores: 100, Memory: 1}},
+		}))
+	}
+	pods[2].Annotations[types.PodAnnotationGPUPool] = "team-a"
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(podCache.GetActivePods()) == len(pods), nil
+	}); err != nil {
+		t.Fatalf("pods are not synced to pod cache, %v", err)
+	}
+
+	if _, err := alloc.allocateOne(pods[0], &pods[0].Spec.Containers[0], &req); err != nil {
+		t.Fatalf("Failed to allocate for pod %s due to %+v", pods[0].Name, err)
+	}
+	if devices := alloc.allocatedPod.GetCache("uid-0")["trainer"].Devices; devices[0] != "/dev/nvidia1" {
+		t.Errorf("expect /dev/nvidia1 to be allocated, got %v", devices)
+	}
+	// 剩余的设备被预留或者属于其他资源池
+	if _, err := alloc.allocateOne(pods[1], &pods[1].Spec.Containers[0], &req); err == nil {
+		t.Errorf("expect error for pod without free device")
+	}
+	if _, err := alloc.allocateOne(pods[2], &pods[2].Spec.Containers[0], &req); err != nil {
+		t.Fatalf("Failed to allocate for pod %s due to %+v", pods[2].Name, err)
+	}
+	if devices := alloc.allocatedPod.GetCache("uid-2")["trainer"].Devices; devices[0] != "/dev/nvidia2" {
+		t.Errorf("expect /dev/nvidia2 to be allocated, got %v", devices)
+	}
+}
+
+func TestPreemptSharedGPU(t *testing.T) {
+	flag.Parse()
+	//init tree
+	obj := nvidia.NewNvidiaTree(nil)
+	tree, _ := obj.(*nvidia.NvidiaTree)
+
+	testCase1 :=
+		`    GPU0    GPU1
+GPU0      X      PIX
+GPU1     PIX      X
+`
+	tree.Init(testCase1)
+	for _, n := range tree.Leaves() {
+		n.AllocatableMeta.Cores = nvidia.HundredCore
+		n.AllocatableMeta.Memory = 1024 * 1024 * 1024
+		n.Meta.TotalMemory = 1024 * 1024 * 1024
+	}
+
+	//init allocator k8sclient and watchdog
+	k8sClient := fake.NewSimpleClientset()
+	var evicted []string
+	k8sClient.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(k8stesting.CreateAction).GetObject().(*policyv1.Eviction)
+		if eviction.Name == "notebook-pdb" {
+			return true, nil, apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 10)
+		}
+		if eviction.DeleteOptions != nil && len(eviction.DeleteOptions.DryRun) > 0 {
+			return true, nil, nil
+		}
+		if eviction.Name == "notebook-flaky" {
+			return true, nil, apierrors.NewForbidden(v1.Resource("pods"), eviction.Name, fmt.Errorf("forbidden"))
+		}
+		evicted = append(evicted, eviction.Name)
+		return true, nil, nil
+	})
+	podCache := watchdog.NewPodCacheForTest(k8sClient)
+	alloc := initAllocator(tree, k8sClient, podCache)
+	alloc.initEvaluator(tree, k8sClient, &config.Config{Hostname: "k8s01"})
+	alloc.config.EnablePreemption = true
+
+	// GPU0上运行两个低优先级的notebook, GPU1上运行同优先级的服务
+	created := time.Now()
+	running := []struct {
+		name     string
+		priority int32
+		device   string
+		cores    int64
+	}{
+		{"notebook-1", 0, "/dev/nvidia0", 30},
+		{"notebook-2", 0, "/dev/nvidia0", 40},
+		{"service", 1000, "/dev/nvidia1", 80},
+	}
+	for i, r := range running {
+		pod := createPod(k8sClient, podRawInfo{
+			Name:       r.name,
+			UID:        r.name,
+			Containers: []containerRawInfo{{Name: "cuda", Cores: int(r.cores), Memory: 256}},
+		})
+		pod.Spec.Priority = &running[i].priority
+		pod.CreationTimestamp = metav1.NewTime(created.Add(time.Duration(i) * time.Second))
+		pod.Status.Phase = v1.PodRunning
+		if _, err := k8sClient.CoreV1().Pods(pod.Namespace).Update(context.Background(), pod, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		memory := int64(256) * types.MemoryBlockSize
+		alloc.allocatedPod.Insert(r.name, "cuda", &cache.Info{Devices: []string{r.device}, Cores: r.cores, Memory: memory})
+		if err := tree.Occupy(r.device, r.cores, memory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	priority := int32(1000)
+	preemptor := createPod(k8sClient, podRawInfo{
+		Name:       "inference",
+		UID:        "inference",
+		Containers: []containerRawInfo{{Name: "cuda", Cores: 50, Memory: 256}},
+	})
+	preemptor.Spec.Priority = &priority
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		p, ok := podCache.GetActivePod("service")
+		return len(podCache.GetActivePods()) == 4 && ok && p.Spec.Priority != nil, nil
+	}); err != nil {
+		t.Fatalf("pods are not synced to pod cache, %v", err)
+	}
+
+	// 超出配额时不驱逐任何pod
+	limit := int64(40)
+	alloc.config.Live = config.NewLiveConfig("", nil)
+	alloc.config.Live.UpdateQuotas([]config.QuotaConfig{{Namespace: preemptor.Namespace, SharedCores: &limit}})
+	alloc.Lock()
+	err := alloc.reserve(preemptor, &preemptor.Spec.Containers[0])
+	alloc.Unlock()
+	alloc.evictions.Wait()
+	if err == nil || len(evicted) != 0 || len(alloc.preemptions) != 0 || len(alloc.holds) != 0 {
+		t.Fatalf("expect preemption to be rejected by quota, evicted %v, err %v", evicted, err)
+	}
+	alloc.config.Live.UpdateQuotas(nil)
+
+	// 只需要驱逐较新的notebook-2就能放下, 驱逐在后台进行
+	key := preemptionKey(preemptor)
+	alloc.Lock()
+	err = alloc.reserve(preemptor, &preemptor.Spec.Containers[0])
+	alloc.Unlock()
+	alloc.evictions.Wait()
+	if err == nil || !utils.IsStringSliceEqual(evicted, []string{"notebook-2"}) {
+		t.Fatalf("expect notebook-2 to be evicted, evicted %v, err %v", evicted, err)
+	}
+	if alloc.allocatedPod.GetCache("notebook-2") != nil || alloc.holds[key] == nil || len(alloc.preemptions) != 0 {
+		t.Fatalf("expect capacity of notebook-2 to be held for inference, holds %+v", alloc.holds)
+	}
+	// 保留的资源其他pod不能使用, pod回来后交还
+	if cores := tree.Query("/dev/nvidia0").AllocatableMeta.Cores; cores != 20 {
+		t.Errorf("expect 20 cores left on GPU0, got %d", cores)
+	}
+	alloc.releaseHold(preemptor)
+	if cores := tree.Query("/dev/nvidia0").AllocatableMeta.Cores; cores != 70 || len(alloc.holds) != 0 {
+		t.Errorf("expect held capacity to be released, cores %d", cores)
+	}
+
+	// 任意pod不能驱逐(违反PDB)时不驱逐任何pod
+	createPod(k8sClient, podRawInfo{
+		Name:       "notebook-pdb",
+		UID:        "notebook-pdb",
+		Containers: []containerRawInfo{{Name: "cuda", Cores: 70, Memory: 256}},
+	})
+	createPod(k8sClient, podRawInfo{
+		Name:       "notebook-flaky",
+		UID:        "notebook-flaky",
+		Containers: []containerRawInfo{{Name: "cuda", Cores: 40, Memory: 256}},
+	})
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		_, pdb := podCache.GetActivePod("notebook-pdb")
+		_, flaky := podCache.GetActivePod("notebook-flaky")
+		return pdb && flaky, nil
+	}); err != nil {
+		t.Fatalf("pods are not synced to pod cache, %v", err)
+	}
+	alloc.allocatedPod.Insert("notebook-pdb", "cuda", &cache.Info{Devices: []string{"/dev/nvidia0"}, Cores: 70, Memory: 256 * types.MemoryBlockSize})
+	tree.Occupy("/dev/nvidia0", 70, 256*types.MemoryBlockSize)
+	alloc.Lock()
+	err = alloc.reserve(preemptor, &preemptor.Spec.Containers[0])
+	alloc.Unlock()
+	alloc.evictions.Wait()
+	if err == nil || len(alloc.holds) != 0 || alloc.allocatedPod.GetCache("notebook-pdb") == nil ||
+		alloc.allocatedPod.GetCache("notebook-1") == nil || !utils.IsStringSliceEqual(evicted, []string{"notebook-2"}) {
+		t.Errorf("expect preemption to fail for pod protected by PDB, evicted %v, holds %+v, err %v", evicted, alloc.holds, err)
+	}
+
+	// 部分pod驱逐失败时只保留实际释放的资源
+	alloc.allocatedPod.Delete("notebook-pdb")
+	tree.Free("/dev/nvidia0", 70, 256*types.MemoryBlockSize)
+	alloc.allocatedPod.Insert("notebook-flaky", "cuda", &cache.Info{Devices: []string{"/dev/nvidia0"}, Cores: 40, Memory: 256 * types.MemoryBlockSize})
+	tree.Occupy("/dev/nvidia0", 40, 256*types.MemoryBlockSize)
+	larger := preemptor.Spec.Containers[0].DeepCopy()
+	larger.Resources.Limits[types.VCoreAnnotation] = resource.MustParse("70")
+	alloc.Lock()
+	err = alloc.reserve(preemptor, larger)
+	alloc.Unlock()
+	alloc.evictions.Wait()
+	if err == nil || alloc.allocatedPod.GetCache("notebook-1") != nil || alloc.allocatedPod.GetCache("notebook-flaky") == nil ||
+		!utils.IsStringSliceEqual(evicted, []string{"notebook-2", "notebook-1"}) {
+		t.Fatalf("expect only notebook-1 to be evicted, evicted %v, err %v", evicted, err)
+	}
+	if hold := alloc.holds[key]; hold == nil || hold.cores != 30 {
+		t.Fatalf("expect 30 cores freed from notebook-1 to be held, holds %+v", alloc.holds)
+	}
+	if cores := tree.Query("/dev/nvidia0").AllocatableMeta.Cores; cores != 30 {
+		t.Errorf("expect 30 cores left on GPU0, got %d", cores)
+	}
+	alloc.releaseHold(preemptor)
+
+	// 超时后释放保留的资源
+	alloc.holds["other"] = &preemptionHold{device: "/dev/nvidia1", cores: 10, deadline: time.Now()}
+	tree.Occupy("/dev/nvidia1", 10, 0)
+	alloc.expireHolds()
+	if cores := tree.Query("/dev/nvidia1").AllocatableMeta.Cores; cores != 20 || len(alloc.holds) != 0 {
+		t.Errorf("expect expired hold to be released, cores %d", cores)
+	}
+}
+
+func TestContainerEnv(t *testing.T) {
+	ref := v1.LocalObjectReference{Name: "driver"}
+
+	testCases := []struct {
+		name      string
+		container v1.Container
+		expect    string
+		resolved  bool
+	}{
+		{
+			name:     "unset",
+			expect:   "",
+			resolved: true,
+		},
+		{
+			name: "value",
+			container: v1.Container{Env: []v1.EnvVar{
+				{Name: "OTHER", Value: "graphics"},
+				{Name: volume.DriverCapabilitiesEnv, Value: "compute"},
+			}},
+			expect:   "compute",
+			resolved: true,
+		},
+		{
+			name: "envFrom",
+			container: v1.Container{EnvFrom: []v1.EnvFromSource{
+				{ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: ref}},
+			}},
+		},
+		{
+			name: "envFrom with other prefix",
+			container: v1.Container{EnvFrom: []v1.EnvFromSource{
+				{Prefix: "APP_", SecretRef: &v1.SecretEnvSource{LocalObjectReference: ref}},
+			}},
+			expect:   "",
+			resolved: true,
+		},
+		{
+			name: "value overrides envFrom",
+			container: v1.Container{
+				EnvFrom: []v1.EnvFromSource{
+					{ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: ref}},
+				},
+				Env: []v1.EnvVar{{Name: volume.DriverCapabilitiesEnv, Value: "graphics"}},
+			},
+			expect:   "graphics",
+			resolved: true,
+		},
+		{
+			name: "valueFrom",
+			container: v1.Container{Env: []v1.EnvVar{
+				{Name: volume.DriverCapabilitiesEnv, Value: "compute"},
+				{Name: volume.DriverCapabilitiesEnv, ValueFrom: &v1.EnvVarSource{
+					SecretKeyRef: &v1.SecretKeySelector{LocalObjectReference: ref, Key: "caps"},
+				}},
+			}},
+		},
+	}
+
+	for _, tc := range testCases {
+		value, ok := containerEnv(&tc.container, volume.DriverCapabilitiesEnv)
+		if ok != tc.resolved || value != tc.expect {
+			t.Errorf("%s: expect %q resolved %t, got %q %t", tc.name, tc.expect, tc.resolved, value, ok)
+		}
+	}
+}
+
+func TestAllocatorStop(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	obj := nvidia.NewNvidiaTree(nil)
+	tree, _ := obj.(*nvidia.NvidiaTree)
+	tree.Init(`    GPU0
+GPU0      X
+`)
+	k8sClient := fake.NewSimpleClientset()
+	podCache := watchdog.NewPodCacheForTest(k8sClient)
+	defer podCache.Stop()
+
+	cfg := &config.Config{AllocationCheckPeriod: time.Hour}
+	alloc := NewNvidiaTopoAllocatorForTest(cfg, tree, k8sClient, response.NewFakeResponseManager(),
+		podCache).(*NvidiaTopoAllocator)
+	alloc.resultWorker.Add(1)
+	go func() {
+		defer alloc.resultWorker.Done()
+		alloc.runProcessResult()
+	}()
+
+	pod := createPod(k8sClient, podRawInfo{
+		Name:       "pod-0",
+		UID:        "pod-0",
+		Containers: []containerRawInfo{{Name: "cuda", Cores: 100, Memory: 1}},
+	})
+	if err := alloc.waitResult(&allocateResult{pod: pod, result: ALLOCATE_FAIL, message: "test"}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// 不存在的pod无法更新状态, 结果一直等待重试
+	missing := &allocateResult{
+		pod:    &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "missing", UID: "missing"}},
+		result: ALLOCATE_FAIL,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- alloc.waitResult(missing)
+	}()
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return alloc.queue.NumRequeues(missing) > 0, nil
+	}); err != nil {
+		t.Fatalf("result of missing pod is not retried")
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected result %v before stopped", err)
+	default:
+	}
+
+	alloc.Stop()
+	if err := <-errs; err != errAllocatorStopped {
+		t.Errorf("expect result waiting for retry dropped, got %v", err)
+	}
+	// 停止后的结果直接丢弃
+	if err := alloc.waitResult(&allocateResult{pod: pod, result: ALLOCATE_SUCCESS}); err != errAllocatorStopped {
+		t.Errorf("expect result after stopped dropped, got %v", err)
+	}
+}
@@ -0,0 +1,339 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package nvidia
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+
+	nvtree "tkestack.io/gpu-manager/pkg/device/nvidia"
+	"tkestack.io/gpu-manager/pkg/services/allocator/cache"
+	"tkestack.io/gpu-manager/pkg/types"
+	"tkestack.io/gpu-manager/pkg/utils"
+)
+
+// podPlanTimeout is how long devices reserved by a plan are kept before all
+// GPU containers of the pod are allocated
+var podPlanTimeout = 2 * time.Minute
+
+// podPlan is the pod whose GPU containers are reserved at once, later
+// containers of the pod are served from the reservation
+type podPlan struct {
+	pod *v1.Pod
+	// served are names of containers returned to kubelet
+	served   sets.String
+	deadline time.Time
+}
+
+// newPodPlan returns the plan of pod, containers in served are allocated
+// before the plan, e.g. before gpu-manager restarted
+func newPodPlan(pod *v1.Pod, served []string) *podPlan {
+	return &podPlan{
+		pod:      pod,
+		served:   sets.NewString(served...),
+		deadline: time.Now().Add(podPlanTimeout),
+	}
+}
+
+// finished returns true if all GPU containers are served
+func (p *podPlan) finished() bool {
+	for _, c := range utils.GetPodContainers(p.pod) {
+		if utils.IsGPURequiredContainer(c) && !p.served.Has(c.Name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *podPlan) expired() bool {
+	return time.Now().After(p.deadline)
+}
+
+// next returns the first container which is not served yet in the order
+// of kubelet, error is returned if its vcuda-core doesn't match the request
+func (p *podPlan) next(reqCount uint) (*v1.Container, error) {
+	for _, c := range utils.GetPodContainers(p.pod) {
+		if !utils.IsGPURequiredContainer(c) || p.served.Has(c.Name) {
+			continue
+		}
+		if reqCount != utils.GetGPUResourceOfContainer(c, types.VCoreAnnotation) {
+			return nil, fmt.Errorf("allocation request mismatch for pod %s, request %d vcore, container %s requires %d",
+				p.pod.UID, reqCount, c.Name, utils.GetGPUResourceOfContainer(c, types.VCoreAnnotation))
+		}
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("all containers of pod %s are allocated", p.pod.UID)
+}
+
+// planPod selects and reserves devices for all GPU containers of pod which
+// are not allocated yet, nothing is reserved if any of them can't be placed.
+// Sidecars and containers are placed first, init containers which run to
+// completion reuse their devices if possible.
+func (ta *NvidiaTopoAllocator) planPod(pod *v1.Pod) error {
+	uid := string(pod.UID)
+	// 抢占保留的资源交还给设备树, 由当前pod重新选择
+	ta.releaseHold(pod)
+
+	// 已经分配过的容器(例如重启前)不会再次请求
+	allocated := ta.allocatedPod.GetCache(uid)
+	served := make([]string, 0, len(allocated))
+	for name := range allocated {
+		served = append(served, name)
+	}
+	var inits []*v1.Container
+	for _, c := range utils.GetPodContainers(pod) {
+		if !utils.IsGPURequiredContainer(c) {
+			continue
+		}
+		if _, ok := allocated[c.Name]; ok {
+			continue
+		}
+		if utils.IsInitContainer(pod, c.Name) && !utils.IsRestartableInitContainer(pod, c.Name) {
+			inits = append(inits, c)
+			continue
+		}
+		if err := ta.reserve(pod, c); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range inits {
+		if devices := ta.reusableDevices(pod, c); len(devices) > 0 {
+			klog.V(2).Infof("Init container %s of pod %s reuses %v", c.Name, uid, devices)
+			ta.allocatedPod.Insert(uid, c.Name, &cache.Info{
+				Devices: devices,
+				Cores:   int64(utils.GetGPUResourceOfContainer(c, types.VCoreAnnotation)),
+				Memory:  int64(utils.GetGPUResourceOfContainer(c, types.VMemoryAnnotation)) * ta.config.GetMemoryBlockSize(),
+				Init:    true,
+				Reused:  true,
+			})
+			continue
+		}
+		if err := ta.reserve(pod, c); err != nil {
+			return err
+		}
+	}
+
+	// 其他pod未完成的计划保留到超时
+	if _, ok := ta.plans[uid]; !ok {
+		ta.plans[uid] = newPodPlan(pod, served)
+	}
+	ta.writeCheckpoint()
+
+	return nil
+}
+
+// reserve selects and occupies devices for container of pod, the whole pod
+// is rolled back if the container can't be placed
+func (ta *NvidiaTopoAllocator) reserve(pod *v1.Pod, c *v1.Container) error {
+	uid := string(pod.UID)
+	needCores := int64(utils.GetGPUResourceOfContainer(c, types.VCoreAnnotation))
+	needMemory := int64(utils.GetGPUResourceOfContainer(c, types.VMemoryAnnotation)) * ta.config.GetMemoryBlockSize()
+	nodes, err := ta.selectNodes(pod, c, needCores, needMemory)
+	var p *preemption
+	if err == errNoFreeNode && ta.config.EnablePreemption {
+		// 驱逐低优先级的共享pod, 释放的资源保留给当前pod重建后使用
+		var node *nvtree.NvidiaNode
+		if p, node, err = ta.planPreemption(pod, needCores, needMemory); err == nil {
+			nodes = []*nvtree.NvidiaNode{node}
+		}
+	}
+	if err == nil {
+		// 占用设备或者驱逐其他pod之前检查命名空间的配额
+		err = ta.checkQuota(pod, c, nodes, needCores, needMemory)
+	}
+	if err == nil && p != nil {
+		err = ta.preempt(p, c)
+	}
+	if err != nil {
+		// 任意一个容器无法放置则回滚整个pod
+		ta.abortPlan(pod)
+		return fmt.Errorf("can't plan container %s of pod %s, %v", c.Name, uid, err)
+	}
+
+	devices := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		ta.tree.MarkOccupied(n, needCores, needMemory)
+		devices = append(devices, n.MinorName())
+	}
+	klog.V(2).Infof("Plan %v for %s(%s), vcore %d, vmemory %d", devices, uid, c.Name, needCores, needMemory)
+	ta.allocatedPod.Insert(uid, c.Name, &cache.Info{
+		Devices: devices,
+		Cores:   needCores,
+		Memory:  needMemory,
+		Init:    utils.IsInitContainer(pod, c.Name) && !utils.IsRestartableInitContainer(pod, c.Name),
+	})
+
+	return nil
+}
+
+// reusableDevices returns devices of containers of pod which are large
+// enough for init container c, nil is returned if there isn't any. Init
+// containers complete before containers start, so they can share devices.
+func (ta *NvidiaTopoAllocator) reusableDevices(pod *v1.Pod, c *v1.Container) []string {
+	needCores := int64(utils.GetGPUResourceOfContainer(c, types.VCoreAnnotation))
+	needMemory := int64(utils.GetGPUResourceOfContainer(c, types.VMemoryAnnotation)) * ta.config.GetMemoryBlockSize()
+	// 调度器为init容器选择了设备时只能复用该设备
+	predicated := ""
+	if needCores < nvtree.HundredCore && utils.IsGPUPredicatedPod(pod) {
+		devStr, err := predicateDevice(pod, c)
+		if err != nil {
+			return nil
+		}
+		predicated = devStr
+	}
+
+	allocated := ta.allocatedPod.GetCache(string(pod.UID))
+	var exclusive []string
+	for _, container := range pod.Spec.Containers {
+		info, ok := allocated[container.Name]
+		if !ok || info.WholeGPU {
+			continue
+		}
+		if info.Cores >= nvtree.HundredCore {
+			exclusive = append(exclusive, info.Devices...)
+			continue
+		}
+		if needCores < nvtree.HundredCore && info.Cores >= needCores && info.Memory >= needMemory &&
+			(predicated == "" || predicated == info.Devices[0]) {
+			return info.Devices[:1]
+		}
+	}
+
+	switch {
+	case needCores >= nvtree.HundredCore && len(exclusive) >= int(needCores/nvtree.HundredCore):
+		return exclusive[:needCores/nvtree.HundredCore]
+	case needCores < nvtree.HundredCore && len(exclusive) > 0:
+		for _, dev := range exclusive {
+			if predicated == "" || predicated == dev {
+				return []string{dev}
+			}
+		}
+	}
+
+	return nil
+}
+
+// releaseInitContainers returns devices reserved for init containers of
+// pod which have completed successfully
+func (ta *NvidiaTopoAllocator) releaseInitContainers(pod *v1.Pod) {
+	ta.Lock()
+	defer ta.Unlock()
+
+	allocated := ta.allocatedPod.GetCache(string(pod.UID))
+	changed := false
+	for _, status := range pod.Status.InitContainerStatuses {
+		info, ok := allocated[status.Name]
+		if !ok || !info.Init || info.Reused {
+			continue
+		}
+		if status.State.Terminated == nil || status.State.Terminated.ExitCode != 0 {
+			continue
+		}
+		klog.V(2).Infof("Init container %s of pod %s completed, free %v", status.Name, pod.UID, info.Devices)
+		for _, dev := range info.Devices {
+			if err := ta.tree.Free(dev, info.Cores, info.Memory); err != nil {
+				klog.Warningf("Can't free %s of %s(%s), %v", dev, pod.UID, status.Name, err)
+			}
+		}
+		info.Reused = true
+		changed = true
+	}
+
+	if changed {
+		ta.writeCheckpoint()
+	}
+}
+
+// abortPlan frees all devices reserved for pod, including containers
+// already returned to kubelet since kubelet rejects the whole pod
+func (ta *NvidiaTopoAllocator) abortPlan(pod *v1.Pod) {
+	klog.V(2).Infof("Roll back allocation of pod %s", pod.UID)
+	ta.freeGPU([]string{string(pod.UID)})
+	delete(ta.plans, string(pod.UID))
+}
+
+// dropPlans drops plans of pods whose devices are freed, the lock must be
+// held
+func (ta *NvidiaTopoAllocator) dropPlans(uids []string) {
+	for _, uid := range uids {
+		if _, ok := ta.plans[uid]; ok {
+			klog.V(2).Infof("planned pod %s was deleted, drop its plan", uid)
+			delete(ta.plans, uid)
+		}
+	}
+}
+
+// sortedPlans returns unfinished plans from the oldest one
+func (ta *NvidiaTopoAllocator) sortedPlans() []*podPlan {
+	plans := make([]*podPlan, 0, len(ta.plans))
+	for _, plan := range ta.plans {
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].deadline.Before(plans[j].deadline)
+	})
+
+	return plans
+}
+
+// nextPlanned returns the next container of the oldest plan which matches
+// the request, nil is returned if there isn't any
+func (ta *NvidiaTopoAllocator) nextPlanned(reqCount uint) (*v1.Pod, *v1.Container) {
+	for _, plan := range ta.sortedPlans() {
+		c, err := plan.next(reqCount)
+		if err != nil {
+			klog.V(4).Info(err.Error())
+			continue
+		}
+		return plan.pod, c
+	}
+
+	return nil, nil
+}
+
+// expirePlans rolls back plans which are not finished in time, returns the
+// number of plans rolled back. Plans of pods freed without the lock, e.g.
+// failed in PreStartContainer, are dropped.
+func (ta *NvidiaTopoAllocator) expirePlans() int {
+	expired := 0
+	for _, plan := range ta.sortedPlans() {
+		uid := string(plan.pod.UID)
+		if ta.allocatedPod.GetCache(uid) == nil {
+			ta.dropPlans([]string{uid})
+			continue
+		}
+		if !plan.expired() {
+			continue
+		}
+		pod := plan.pod
+		klog.Warningf("Plan of pod %s is not finished in %v, roll it back", pod.UID, podPlanTimeout)
+		ta.abortPlan(pod)
+		ta.PatchPodAllocationFailed(pod)
+		expired++
+	}
+
+	return expired
+}
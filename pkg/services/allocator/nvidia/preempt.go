@@ -0,0 +1,333 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package nvidia
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+
+	nvtree "tkestack.io/gpu-manager/pkg/device/nvidia"
+	"tkestack.io/gpu-manager/pkg/types"
+	"tkestack.io/gpu-manager/pkg/utils"
+)
+
+const preemptedReason = "GPUPreempted"
+
+// preemptionHoldTimeout is how long the capacity freed by preemption is held
+// for the preemptor, the workload controller recreates the rejected pod in
+// the meantime
+var preemptionHoldTimeout = 5 * time.Minute
+
+// preemptionHold is the capacity of a device freed for a preemptor
+type preemptionHold struct {
+	device   string
+	cores    int64
+	memory   int64
+	deadline time.Time
+}
+
+// victim is a pod which can be evicted to free a device
+type victim struct {
+	pod    *v1.Pod
+	cores  int64
+	memory int64
+}
+
+// preemption is a preemptor whose victims are being evicted
+type preemption struct {
+	key     string
+	pod     *v1.Pod
+	device  string
+	cores   int64
+	memory  int64
+	victims []*victim
+}
+
+// preemptionKey identifies the preemptor by its name and controller, so the
+// pod recreated with the same name by the controller gets the capacity
+func preemptionKey(pod *v1.Pod) string {
+	key := pod.Namespace + "/" + pod.Name
+	if ref := metav1.GetControllerOf(pod); ref != nil {
+		key += "/" + string(ref.UID)
+	}
+	return key
+}
+
+func podPriority(pod *v1.Pod) int32 {
+	if pod.Spec.Priority == nil {
+		return 0
+	}
+	return *pod.Spec.Priority
+}
+
+// planPreemption selects share mode pods with lower priority on one device
+// to evict so the request of pod fits, nothing is evicted until preempt is
+// called
+func (ta *NvidiaTopoAllocator) planPreemption(pod *v1.Pod, needCores, needMemory int64) (*preemption, *nvtree.NvidiaNode, error) {
+	if needCores >= nvtree.HundredCore {
+		return nil, nil, errNoFreeNode
+	}
+	key := preemptionKey(pod)
+	if _, ok := ta.holds[key]; ok {
+		return nil, nil, fmt.Errorf("%v, capacity held for pod %s is not enough", errNoFreeNode, pod.UID)
+	}
+	if p, ok := ta.preemptions[key]; ok {
+		return nil, nil, fmt.Errorf("%v, preempting pods on %s for pod %s", errNoFreeNode, p.device, pod.UID)
+	}
+	if ta.preemptionClosed {
+		return nil, nil, errAllocatorStopped
+	}
+
+	node, victims := ta.selectVictims(pod, needCores, needMemory)
+	if node == nil {
+		return nil, nil, fmt.Errorf("%v, no pod with lower priority can be preempted", errNoFreeNode)
+	}
+
+	return &preemption{
+		key:     key,
+		pod:     pod,
+		device:  node.MinorName(),
+		cores:   needCores,
+		memory:  needMemory,
+		victims: victims,
+	}, node, nil
+}
+
+// preempt evicts victims of p in background so container c fits, the freed
+// capacity is held for the preemptor until it's allocated again. The error
+// is always returned since victims are terminating.
+func (ta *NvidiaTopoAllocator) preempt(p *preemption, c *v1.Container) error {
+	names := make([]string, 0, len(p.victims))
+	for _, v := range p.victims {
+		names = append(names, v.pod.Namespace+"/"+v.pod.Name)
+	}
+	ta.preemptions[p.key] = p
+	// 驱逐需要请求apiserver, 不能在分配时同步进行
+	ta.evictions.Add(1)
+	go ta.evictVictims(p)
+
+	return fmt.Errorf("preempting %s on %s for container %s", strings.Join(names, ","), p.device, c.Name)
+}
+
+// evictVictims evicts victims of p if all of them can be evicted, the
+// capacity freed by evicted victims is held for the preemptor
+func (ta *NvidiaTopoAllocator) evictVictims(p *preemption) {
+	defer ta.evictions.Done()
+
+	var evicted []*victim
+	defer func() {
+		ta.Lock()
+		defer ta.Unlock()
+		ta.finishPreemption(p, evicted)
+	}()
+
+	// 先确认所有pod都能被驱逐(例如不违反PDB), 避免驱逐一部分后仍然放不下
+	for _, v := range p.victims {
+		if err := ta.evictPod(v.pod, true); err != nil {
+			klog.Warningf("Can't preempt %s for pod %s, pod %s/%s can't be evicted, %v", p.device, p.pod.UID, v.pod.Namespace, v.pod.Name, err)
+			return
+		}
+	}
+	for _, v := range p.victims {
+		if err := ta.evictPod(v.pod, false); err != nil {
+			klog.Warningf("Can't evict pod %s/%s, %v", v.pod.Namespace, v.pod.Name, err)
+			return
+		}
+		msg := fmt.Sprintf("Preempted by pod %s/%s with priority %d on %s", p.pod.Namespace, p.pod.Name, podPriority(p.pod), p.device)
+		ta.recorder.Event(v.pod, v1.EventTypeWarning, preemptedReason, msg)
+		evicted = append(evicted, v)
+	}
+}
+
+// finishPreemption frees devices of evicted victims and holds capacity for
+// the preemptor, only the capacity of evicted victims is held if some of
+// them are not evicted
+func (ta *NvidiaTopoAllocator) finishPreemption(p *preemption, evicted []*victim) {
+	delete(ta.preemptions, p.key)
+	if len(evicted) == 0 {
+		return
+	}
+
+	uids := make([]string, 0, len(evicted))
+	cores, memory := int64(0), int64(0)
+	for _, v := range evicted {
+		uids = append(uids, string(v.pod.UID))
+		cores += v.cores
+		memory += v.memory
+	}
+	// 被驱逐的pod正在退出, 立即回收它们的设备
+	ta.freeGPU(uids)
+	ta.dropPlans(uids)
+
+	node := ta.tree.Query(p.device)
+	if node == nil {
+		return
+	}
+	// 全部驱逐成功时保留请求的资源, 部分驱逐失败时只保留实际释放的资源
+	if len(evicted) == len(p.victims) {
+		cores, memory = p.cores, p.memory
+	}
+	hold := &preemptionHold{
+		device:   p.device,
+		cores:    min(p.cores, cores, node.AllocatableMeta.Cores),
+		memory:   min(p.memory, memory, node.AllocatableMeta.Memory),
+		deadline: time.Now().Add(preemptionHoldTimeout),
+	}
+	if hold.cores <= 0 && hold.memory <= 0 {
+		return
+	}
+	hold.cores, hold.memory = max(hold.cores, 0), max(hold.memory, 0)
+	ta.tree.MarkOccupied(node, hold.cores, hold.memory)
+	ta.holds[p.key] = hold
+	klog.V(2).Infof("Hold %s for pod %s, vcore %d, vmemory %d", hold.device, p.pod.UID, hold.cores, hold.memory)
+}
+
+// selectVictims returns the device and the fewest pods to evict from it
+// for the request, pods with lower priority and newer ones are preferred
+func (ta *NvidiaTopoAllocator) selectVictims(pod *v1.Pod, needCores, needMemory int64) (*nvtree.NvidiaNode, []*victim) {
+	priority := podPriority(pod)
+
+	candidates := make(map[string][]*victim)
+	for _, uid := range ta.allocatedPod.Pods() {
+		if uid == string(pod.UID) {
+			continue
+		}
+		p, ok := ta.podCache.GetActivePod(uid)
+		if !ok || podPriority(p) >= priority || ta.isVictim(uid) {
+			continue
+		}
+		used := make(map[string]*victim)
+		for _, info := range ta.allocatedPod.GetCache(uid) {
+			if info.Reused || info.WholeGPU || info.Cores >= nvtree.HundredCore || len(info.Devices) == 0 {
+				continue
+			}
+			v, ok := used[info.Devices[0]]
+			if !ok {
+				v = &victim{pod: p}
+				used[info.Devices[0]] = v
+			}
+			v.cores += info.Cores
+			v.memory += info.Memory
+		}
+		for dev, v := range used {
+			candidates[dev] = append(candidates[dev], v)
+		}
+	}
+
+	var (
+		best        *nvtree.NvidiaNode
+		bestVictims []*victim
+	)
+	for _, node := range ta.tree.Leaves() {
+		victims := candidates[node.MinorName()]
+		if len(victims) == 0 || !utils.CheckDeviceType(pod.Annotations, node.Meta.Name) ||
+			!ta.config.PoolAllows(pod.Annotations[types.PodAnnotationGPUPool], node.Meta.ID, node.Meta.UUID, false) {
+			continue
+		}
+		sort.Slice(victims, func(i, j int) bool {
+			pi, pj := podPriority(victims[i].pod), podPriority(victims[j].pod)
+			if pi != pj {
+				return pi < pj
+			}
+			return victims[j].pod.CreationTimestamp.Before(&victims[i].pod.CreationTimestamp)
+		})
+
+		cores, memory := node.AllocatableMeta.Cores, node.AllocatableMeta.Memory
+		n := 0
+		for n < len(victims) && (cores < needCores || memory < needMemory) {
+			cores += victims[n].cores
+			memory += victims[n].memory
+			n++
+		}
+		if n == 0 || cores < needCores || memory < needMemory {
+			continue
+		}
+		victims = victims[:n]
+		if best == nil || len(victims) < len(bestVictims) {
+			best, bestVictims = node, victims
+		}
+	}
+
+	return best, bestVictims
+}
+
+// isVictim returns true if pod with uid is being evicted by a preemption
+func (ta *NvidiaTopoAllocator) isVictim(uid string) bool {
+	for _, p := range ta.preemptions {
+		for _, v := range p.victims {
+			if string(v.pod.UID) == uid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// evictPod evicts pod through the Eviction API, so disruption budgets are
+// respected. Nothing is evicted if dryRun is true.
+func (ta *NvidiaTopoAllocator) evictPod(pod *v1.Pod, dryRun bool) error {
+	klog.V(2).Infof("Try to evict pod %s, dry run %t", pod.UID, dryRun)
+	eviction := &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+	}
+	if dryRun {
+		eviction.DeleteOptions = &metav1.DeleteOptions{DryRun: []string{metav1.DryRunAll}}
+	}
+	return retryPodRequest(func(ctx context.Context) error {
+		return ta.k8sClient.PolicyV1().Evictions(pod.Namespace).Evict(ctx, eviction)
+	})
+}
+
+// releaseHold returns the capacity held for pod to the tree, so it can be
+// allocated to the pod
+func (ta *NvidiaTopoAllocator) releaseHold(pod *v1.Pod) {
+	key := preemptionKey(pod)
+	if hold, ok := ta.holds[key]; ok {
+		klog.V(2).Infof("Release %s held for pod %s", hold.device, pod.UID)
+		ta.freeHold(key, hold)
+	}
+}
+
+// expireHolds returns capacity held for preemptors which don't come back
+func (ta *NvidiaTopoAllocator) expireHolds() {
+	now := time.Now()
+	for key, hold := range ta.holds {
+		if now.After(hold.deadline) {
+			klog.Warningf("Capacity of %s held for %s is not allocated in %v, release it", hold.device, key, preemptionHoldTimeout)
+			ta.freeHold(key, hold)
+		}
+	}
+}
+
+func (ta *NvidiaTopoAllocator) freeHold(key string, hold *preemptionHold) {
+	if err := ta.tree.Free(hold.device, hold.cores, hold.memory); err != nil {
+		klog.Warningf("Can't free %s held for %s, %v", hold.device, key, err)
+	}
+	delete(ta.holds, key)
+}
@@ -0,0 +1,172 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package nvidia
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"tkestack.io/gpu-manager/pkg/config"
+	nvtree "tkestack.io/gpu-manager/pkg/device/nvidia"
+	"tkestack.io/gpu-manager/pkg/services/allocator"
+	"tkestack.io/gpu-manager/pkg/services/allocator/cache"
+)
+
+const quotaExceededReason = "GPUQuotaExceeded"
+
+var _ allocator.QuotaReporter = &NvidiaTopoAllocator{}
+
+// QuotaStatus returns consumption of quotas on this node
+func (ta *NvidiaTopoAllocator) QuotaStatus() []allocator.QuotaStatus {
+	ta.Lock()
+	defer ta.Unlock()
+
+	quotas := ta.config.Live.Quotas()
+	status := make([]allocator.QuotaStatus, 0, len(quotas))
+	for _, q := range quotas {
+		status = append(status, allocator.QuotaStatus{
+			QuotaConfig: q,
+			Used:        ta.quotaUsage(q, nil),
+		})
+	}
+
+	return status
+}
+
+// checkQuota returns error if placing container c of pod on nodes exceeds
+// any quota of the namespace, an event is recorded for the pod
+func (ta *NvidiaTopoAllocator) checkQuota(pod *v1.Pod, c *v1.Container, nodes []*nvtree.NvidiaNode, cores, memory int64) error {
+	req := &cache.Info{Cores: cores, Memory: memory}
+	for _, n := range nodes {
+		req.Devices = append(req.Devices, n.MinorName())
+	}
+
+	for _, q := range ta.config.Live.Quotas() {
+		if q.Namespace != pod.Namespace {
+			continue
+		}
+		used := ta.quotaUsage(q, pod)
+		add := ta.infoUsage(q, req)
+		for _, item := range []struct {
+			name       string
+			limit      *int64
+			used, need int64
+		}{
+			{"exclusive GPUs", q.ExclusiveGPUs, used.ExclusiveGPUs, add.ExclusiveGPUs},
+			{"shared cores", q.SharedCores, used.SharedCores, add.SharedCores},
+			{"memory(MiB)", q.Memory, used.Memory, add.Memory},
+		} {
+			if item.limit == nil || item.need == 0 || item.used+item.need <= *item.limit {
+				continue
+			}
+			msg := fmt.Sprintf("%s of namespace %s exceed quota on %s, container %s requests %d, used %d, limit %d",
+				item.name, q.Namespace, quotaScope(q), c.Name, item.need, item.used, *item.limit)
+			ta.recorder.Event(pod, v1.EventTypeWarning, quotaExceededReason, msg)
+			return fmt.Errorf("%s", msg)
+		}
+	}
+
+	return nil
+}
+
+// quotaUsage returns GPUs used by namespace of q, containers of pod are
+// counted even if it's not in the pod cache yet
+func (ta *NvidiaTopoAllocator) quotaUsage(q config.QuotaConfig, pod *v1.Pod) allocator.QuotaUsage {
+	usage := allocator.QuotaUsage{}
+	for _, uid := range ta.allocatedPod.Pods() {
+		namespace := ""
+		if pod != nil && string(pod.UID) == uid {
+			namespace = pod.Namespace
+		} else if p, ok := ta.podCache.GetActivePod(uid); ok {
+			namespace = p.Namespace
+		}
+		if namespace != q.Namespace {
+			continue
+		}
+		for _, info := range ta.allocatedPod.GetCache(uid) {
+			add := ta.infoUsage(q, info)
+			usage.ExclusiveGPUs += add.ExclusiveGPUs
+			usage.SharedCores += add.SharedCores
+			usage.Memory += add.Memory
+		}
+	}
+
+	return usage
+}
+
+// infoUsage returns GPUs of the model of q used by a container
+func (ta *NvidiaTopoAllocator) infoUsage(q config.QuotaConfig, info *cache.Info) allocator.QuotaUsage {
+	usage := allocator.QuotaUsage{}
+	// 复用其他容器设备或者已经归还的init容器不占用配额
+	if info.Reused {
+		return usage
+	}
+
+	matched := int64(0)
+	for _, dev := range info.Devices {
+		if ta.matchModel(q.Model, dev) {
+			matched++
+		}
+	}
+	if matched == 0 {
+		return usage
+	}
+	if info.WholeGPU || info.Cores >= nvtree.HundredCore {
+		usage.ExclusiveGPUs = matched
+	} else {
+		usage.SharedCores = info.Cores
+	}
+	usage.Memory = info.Memory >> 20
+
+	return usage
+}
+
+// matchModel returns true if model of device contains model, case is ignored
+func (ta *NvidiaTopoAllocator) matchModel(model, name string) bool {
+	if len(model) == 0 {
+		return true
+	}
+	dev, ok := ta.tree.Device(name)
+	if !ok {
+		return false
+	}
+	return strings.Contains(strings.ToLower(dev.Model), strings.ToLower(model))
+}
+
+func quotaScope(q config.QuotaConfig) string {
+	if len(q.Model) == 0 {
+		return "all GPUs"
+	}
+	return q.Model + " GPUs"
+}
+
+// newEventRecorder returns a recorder which sends events to apiserver in
+// background, so recording never blocks allocation
+func newEventRecorder(client kubernetes.Interface, hostname string) (record.EventBroadcaster, record.EventRecorder) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "gpu-manager", Host: hostname})
+
+	return broadcaster, recorder
+}
@@ -0,0 +1,79 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package nvidia
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+
+	"tkestack.io/gpu-manager/pkg/types"
+	"tkestack.io/gpu-manager/pkg/utils"
+)
+
+// getStandaloneCandidatePods returns pending GPU pods on this node in
+// creation order when there is no scheduler extender, pods which kubelet
+// has already allocated vcuda resources for are skipped.
+func (ta *NvidiaTopoAllocator) getStandaloneCandidatePods() ([]*v1.Pod, error) {
+	candidatePods := []*v1.Pod{}
+	allPods, err := getPodsOnNode(ta.k8sClient, ta.config.Hostname, string(v1.PodPending), nil)
+	if err != nil {
+		return candidatePods, err
+	}
+
+	// kubelet分配后立即写入checkpoint, 已写入的容器不再是候选
+	allocated := sets.NewString()
+	if cp, err := utils.GetCheckpointData(ta.config.DevicePluginPath); err != nil {
+		klog.Warningf("Failed to read kubelet checkpoint, %v", err)
+	} else {
+		for _, entry := range cp.PodDeviceEntries {
+			if entry.ResourceName == types.VCoreAnnotation {
+				allocated.Insert(entry.PodUID + "/" + entry.ContainerName)
+			}
+		}
+	}
+
+	for _, pod := range allPods {
+		current := pod
+		if current.Status.Phase != v1.PodPending || !utils.IsGPURequiredPod(&current) ||
+			utils.IsGPUAssignedPod(&current) || utils.ShouldDelete(&current) {
+			continue
+		}
+		pending := false
+		for _, c := range utils.GetPodContainers(&current) {
+			if utils.IsGPURequiredContainer(c) && !allocated.Has(string(current.UID)+"/"+c.Name) {
+				pending = true
+				break
+			}
+		}
+		if pending {
+			candidatePods = append(candidatePods, &current)
+		}
+	}
+
+	if klog.V(4) {
+		for _, pod := range candidatePods {
+			klog.Infof("candidate pod %s in ns %s created at %s is found.",
+				pod.Name,
+				pod.Namespace,
+				pod.CreationTimestamp)
+		}
+	}
+	// 没有绑定时间标签时按创建时间排序
+	return OrderPodsdByBindTime(candidatePods), nil
+}
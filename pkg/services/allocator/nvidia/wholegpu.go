@@ -0,0 +1,382 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package nvidia
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	nvtree "tkestack.io/gpu-manager/pkg/device/nvidia"
+	"tkestack.io/gpu-manager/pkg/services/allocator/cache"
+	"tkestack.io/gpu-manager/pkg/services/volume"
+	"tkestack.io/gpu-manager/pkg/types"
+	"tkestack.io/gpu-manager/pkg/utils"
+)
+
+// wholeGPUPendingTimeout is how long a whole GPU allocated by kubelet is kept
+// before it shows up in the kubelet checkpoint, kubelet writes the checkpoint
+// right after Allocate so it only expires if the allocation is abandoned
+var wholeGPUPendingTimeout = time.Minute
+
+// isWholeGPURequest returns true if the device ids are GPU UUIDs of the
+// nvidia.com/gpu resource rather than vcuda resources
+func isWholeGPURequest(ids []string) bool {
+	for _, id := range ids {
+		if strings.HasPrefix(id, types.VCoreAnnotation) || strings.HasPrefix(id, types.VMemoryAnnotation) {
+			return false
+		}
+	}
+
+	return len(ids) > 0
+}
+
+// wholeGPUsInUse returns minor names of GPUs which are allocated as whole GPUs,
+// including the ones not attributed to any pod yet
+func (ta *NvidiaTopoAllocator) wholeGPUsInUse() sets.String {
+	inUse := sets.NewString()
+	for name := range ta.wholeGPUPending {
+		inUse.Insert(name)
+	}
+	for _, uid := range ta.allocatedPod.Pods() {
+		for _, info := range ta.allocatedPod.GetCache(uid) {
+			if info.WholeGPU {
+				inUse.Insert(info.Devices...)
+			}
+		}
+	}
+
+	return inUse
+}
+
+// migDevices returns minor names of GPUs in MIG mode, which are only used by
+// vcuda containers
+func (ta *NvidiaTopoAllocator) migDevices() sets.String {
+	mig := sets.NewString()
+	for _, n := range ta.tree.Leaves() {
+		if nvtree.IsMig(n.Meta.ID) {
+			mig.Insert(n.MinorName())
+		}
+	}
+
+	return mig
+}
+
+// wholeGPUDevices returns devices of nvidia.com/gpu, a GPU is healthy if it's
+// free or allocated as whole GPU. GPUs used by vcuda containers or whose pool
+// doesn't accept whole GPUs are reported unhealthy, so kubelet never hands
+// them out. Kubelet selects devices without the pod, so GPUs are reported
+// for pods selecting no pool, pools selected by pod annotation aren't
+// honored for nvidia.com/gpu.
+func (ta *NvidiaTopoAllocator) wholeGPUDevices(mig sets.String) []*pluginapi.Device {
+	ta.Lock()
+	defer ta.Unlock()
+
+	inUse := ta.wholeGPUsInUse()
+	devs := make([]*pluginapi.Device, 0)
+	for _, leaf := range ta.tree.LeafStates() {
+		if mig.Has(leaf.MinorName) {
+			continue
+		}
+		health := pluginapi.Unhealthy
+		// kubelet不会告诉设备插件pod, 只能上报没有选择资源池的pod可用的GPU
+		allowed := ta.config.PoolAllows("", leaf.Index, leaf.UUID, true)
+		if inUse.Has(leaf.MinorName) || (allowed && leaf.AllocatableCores == leaf.CoreCapacity && !leaf.PendingReset) {
+			health = pluginapi.Healthy
+		}
+		devs = append(devs, &pluginapi.Device{
+			ID:     leaf.UUID,
+			Health: health,
+		})
+	}
+
+	return devs
+}
+
+// listAndWatchWholeGPU sends devices of nvidia.com/gpu whenever occupation of
+// the tree changes
+func (ta *NvidiaTopoAllocator) listAndWatchWholeGPU(s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	var last []*pluginapi.Device
+	// MIG模式需要重置GPU才能切换, 每个连接只查询一次
+	mig := ta.migDevices()
+	for {
+		devs := ta.wholeGPUDevices(mig)
+		if !reflect.DeepEqual(devs, last) {
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+				return err
+			}
+			last = devs
+		}
+
+		select {
+		case <-ta.gpuChanges:
+		case <-s.Context().Done():
+			return nil
+		case <-ta.stopChan:
+			return nil
+		}
+	}
+}
+
+// wholeGPUNode returns the GPU with uuid if it can be allocated as whole GPU
+func (ta *NvidiaTopoAllocator) wholeGPUNode(uuid string, inUse sets.String) (*nvtree.NvidiaNode, error) {
+	for _, leaf := range ta.tree.LeafStates() {
+		if leaf.UUID != uuid {
+			continue
+		}
+		if !inUse.Has(leaf.MinorName) && (leaf.AllocatableCores < leaf.CoreCapacity || leaf.PendingReset) {
+			return nil, fmt.Errorf("GPU %s is in use by vcuda containers", uuid)
+		}
+		return ta.tree.Query(leaf.MinorName), nil
+	}
+
+	return nil, fmt.Errorf("unknown GPU %s", uuid)
+}
+
+// allocateWholeGPU occupies all cores and memory of GPUs chosen by kubelet,
+// kubelet doesn't tell which pod they are allocated for, GPUs are pending
+// until they're found in the kubelet checkpoint.
+func (ta *NvidiaTopoAllocator) allocateWholeGPU(reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	resps := &pluginapi.AllocateResponse{}
+	inUse := ta.wholeGPUsInUse()
+	for _, req := range reqs.ContainerRequests {
+		nodes := make([]*nvtree.NvidiaNode, 0, len(req.DevicesIDs))
+		for _, id := range req.DevicesIDs {
+			node, err := ta.wholeGPUNode(id, inUse)
+			if err != nil {
+				klog.Errorf("Failed to allocate %s, %v", types.NvidiaGPUResource, err)
+				return nil, err
+			}
+			nodes = append(nodes, node)
+		}
+
+		// kubelet可能将init容器的GPU再次分配给业务容器
+		for _, n := range nodes {
+			if !inUse.Has(n.MinorName()) {
+				klog.V(2).Infof("Allocate %s as whole GPU %s", n.MinorName(), n.Meta.UUID)
+				ta.tree.MarkOccupied(n, nvtree.HundredCore, int64(n.Meta.TotalMemory))
+				ta.wholeGPUPending[n.MinorName()] = time.Now()
+				inUse.Insert(n.MinorName())
+			}
+		}
+		resps.ContainerResponses = append(resps.ContainerResponses, ta.wholeGPUResponse(nodes))
+	}
+
+	return resps, nil
+}
+
+// wholeGPUResponse mounts the original driver library like NVIDIA device plugin
+func (ta *NvidiaTopoAllocator) wholeGPUResponse(nodes []*nvtree.NvidiaNode) *pluginapi.ContainerAllocateResponse {
+	ctntResp := &pluginapi.ContainerAllocateResponse{
+		Envs:    make(map[string]string),
+		Mounts:  make([]*pluginapi.Mount, 0),
+		Devices: make([]*pluginapi.DeviceSpec, 0),
+	}
+
+	uuids := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		ctntResp.Devices = append(ctntResp.Devices, &pluginapi.DeviceSpec{
+			ContainerPath: n.MinorName(),
+			HostPath:      n.MinorName(),
+			Permissions:   "rwm",
+		})
+		uuids = append(uuids, n.Meta.UUID)
+	}
+	ctntResp.Devices = append(ctntResp.Devices, ta.controlDevices()...)
+
+	// Allocate请求中没有容器信息，不支持compat32和NVIDIA_DRIVER_CAPABILITIES, 挂载完整的驱动目录
+	ctntResp.Envs["LD_LIBRARY_PATH"] = libraryPath(&v1.Container{})
+	ctntResp.Envs["NVIDIA_VISIBLE_DEVICES"] = strings.Join(uuids, ",")
+
+	volume.LockAllocation()
+	driverPath := types.GetDriverInfo().OriginLibraryPath
+	volume.MarkInUse(driverPath)
+	volume.UnlockAllocation()
+	ctntResp.Mounts = append(ctntResp.Mounts, &pluginapi.Mount{
+		ContainerPath: "/usr/local/nvidia",
+		HostPath:      driverPath,
+		ReadOnly:      true,
+	})
+	for k, v := range volume.GraphicsEnvs(driverPath, "/usr/local/nvidia") {
+		ctntResp.Envs[k] = v
+	}
+
+	return ctntResp
+}
+
+// syncWholeGPUs attributes pending GPUs to pods by reading the kubelet
+// checkpoint, and frees pending GPUs which kubelet has abandoned
+func (ta *NvidiaTopoAllocator) syncWholeGPUs() {
+	cp, err := utils.GetCheckpointData(ta.config.DevicePluginPath)
+	if err != nil {
+		klog.Warningf("Failed to read kubelet checkpoint, %v", err)
+		return
+	}
+
+	changed := false
+	inUse := ta.wholeGPUsInUse()
+	for _, entry := range cp.PodDeviceEntries {
+		if entry.ResourceName != types.NvidiaGPUResource {
+			continue
+		}
+		if c := ta.allocatedPod.GetCache(entry.PodUID); c != nil {
+			if _, ok := c[entry.ContainerName]; ok {
+				continue
+			}
+		}
+		// 已结束的pod会在recycle中回收
+		if _, ok := ta.podCache.GetActivePod(entry.PodUID); !ok {
+			continue
+		}
+
+		devices := make([]string, 0, len(entry.DeviceIDs))
+		memory := int64(0)
+		for _, id := range entry.DeviceIDs {
+			node, err := ta.wholeGPUNode(id, inUse)
+			if err != nil {
+				klog.Warningf("GPU of %s(%s) is conflicted, %v", entry.PodUID, entry.ContainerName, err)
+				continue
+			}
+			name := node.MinorName()
+			if !inUse.Has(name) {
+				// 重启后丢失了pending状态
+				ta.tree.MarkOccupied(node, nvtree.HundredCore, int64(node.Meta.TotalMemory))
+				inUse.Insert(name)
+			}
+			delete(ta.wholeGPUPending, name)
+			devices = append(devices, name)
+			memory += int64(node.Meta.TotalMemory)
+		}
+
+		klog.V(2).Infof("Whole GPU %v is used by %s(%s)", devices, entry.PodUID, entry.ContainerName)
+		ta.allocatedPod.Insert(entry.PodUID, entry.ContainerName, &cache.Info{
+			Devices:  devices,
+			Cores:    int64(len(devices)) * nvtree.HundredCore,
+			Memory:   memory,
+			WholeGPU: true,
+		})
+		changed = true
+	}
+
+	for name, allocated := range ta.wholeGPUPending {
+		if time.Since(allocated) < wholeGPUPendingTimeout {
+			continue
+		}
+		klog.V(2).Infof("Whole GPU %s is not used by any pod, free it", name)
+		if node := ta.tree.Query(name); node != nil {
+			ta.tree.MarkFree(node, nvtree.HundredCore, int64(node.Meta.TotalMemory))
+		} else {
+			klog.Warningf("Can't free whole GPU %s, it's not found", name)
+		}
+		delete(ta.wholeGPUPending, name)
+	}
+
+	if changed {
+		ta.writeCheckpoint()
+	}
+}
+
+// preStartWholeGPU checks GPUs of the container are attributed to the pod
+func (ta *NvidiaTopoAllocator) preStartWholeGPU(req *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	ta.syncWholeGPUs()
+
+	cp, err := utils.GetCheckpointData(ta.config.DevicePluginPath)
+	if err != nil {
+		msg := fmt.Sprintf("%s, failed to read from checkpoint file due to %v",
+			types.PreStartContainerCheckErrMsg, err)
+		klog.Info(msg)
+		return nil, fmt.Errorf("%s", msg)
+	}
+
+	for _, entry := range cp.PodDeviceEntries {
+		if entry.ResourceName != types.NvidiaGPUResource || !utils.IsStringSliceEqual(req.DevicesIDs, entry.DeviceIDs) {
+			continue
+		}
+		if c, ok := ta.allocatedPod.GetCache(entry.PodUID)[entry.ContainerName]; ok && c.WholeGPU {
+			return &pluginapi.PreStartContainerResponse{}, nil
+		}
+	}
+
+	msg := fmt.Sprintf("%s, failed to attribute whole GPU %v to any pod",
+		types.PreStartContainerCheckErrMsg, req.DevicesIDs)
+	klog.Info(msg)
+	return nil, fmt.Errorf("%s", msg)
+}
+
+// GetPreferredAllocation prefers whole GPUs which are close to each other, the
+// same way as vcuda containers requesting whole GPUs
+func (ta *NvidiaTopoAllocator) GetPreferredAllocation(_ context.Context, req *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	ta.Lock()
+	defer ta.Unlock()
+
+	resp := &pluginapi.PreferredAllocationResponse{}
+	for _, creq := range req.ContainerRequests {
+		resp.ContainerResponses = append(resp.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: ta.preferWholeGPUs(creq),
+		})
+	}
+
+	return resp, nil
+}
+
+func (ta *NvidiaTopoAllocator) preferWholeGPUs(req *pluginapi.ContainerPreferredAllocationRequest) []string {
+	size := int(req.AllocationSize)
+	available := sets.NewString(req.AvailableDeviceIDs...)
+	picked := make([]string, 0, size)
+	for _, id := range req.MustIncludeDeviceIDs {
+		if len(picked) < size {
+			picked = append(picked, id)
+			available.Delete(id)
+		}
+	}
+
+	if need := int64(size - len(picked)); need > 0 {
+		mode := "fragment"
+		if need > 1 {
+			mode = "link"
+		}
+		if eval, ok := ta.evaluators[mode]; ok {
+			for _, n := range eval.Evaluate(need*nvtree.HundredCore, 0, &v1.Pod{}) {
+				if len(picked) < size && available.Has(n.Meta.UUID) {
+					picked = append(picked, n.Meta.UUID)
+					available.Delete(n.Meta.UUID)
+				}
+			}
+		}
+	}
+
+	// 评估结果不足时按顺序补齐, 由kubelet做最终决定
+	rest := available.List()
+	sort.Strings(rest)
+	for _, id := range rest {
+		if len(picked) >= size {
+			break
+		}
+		picked = append(picked, id)
+	}
+
+	return picked
+}
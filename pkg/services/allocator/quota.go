@@ -0,0 +1,42 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package allocator
+
+import (
+	"tkestack.io/gpu-manager/pkg/config"
+)
+
+// QuotaUsage is GPUs used by containers of a namespace
+type QuotaUsage struct {
+	ExclusiveGPUs int64 `json:"exclusiveGPUs"`
+	SharedCores   int64 `json:"sharedCores"`
+	// Memory is the MiB of vcuda-memory
+	Memory int64 `json:"memory"`
+}
+
+// QuotaStatus is a quota and the current consumption of it
+type QuotaStatus struct {
+	config.QuotaConfig
+	Used QuotaUsage `json:"used"`
+}
+
+// QuotaReporter is implemented by GPUTopoService which enforces quotas
+type QuotaReporter interface {
+	// QuotaStatus returns consumption of quotas on this node
+	QuotaStatus() []QuotaStatus
+}
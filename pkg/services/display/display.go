@@ -19,18 +19,17 @@ package display
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"github.com/NVIDIA/go-nvml/pkg/nvml"
-	"sort"
+	"net/http"
 	"strings"
 	"sync"
-	"time"
 
 	displayapi "tkestack.io/gpu-manager/pkg/api/runtime/display"
 	"tkestack.io/gpu-manager/pkg/config"
 	"tkestack.io/gpu-manager/pkg/device"
-	nvtree "tkestack.io/gpu-manager/pkg/device/nvidia"
 	"tkestack.io/gpu-manager/pkg/runtime"
+	"tkestack.io/gpu-manager/pkg/services/response"
 	"tkestack.io/gpu-manager/pkg/services/watchdog"
 	"tkestack.io/gpu-manager/pkg/types"
 	"tkestack.io/gpu-manager/pkg/utils"
@@ -47,26 +46,30 @@ type Display struct {
 	sync.Mutex
 
 	config                  *config.Config
-	tree                    *nvtree.NvidiaTree
+	tree                    device.GPUTree
 	containerRuntimeManager runtime.ContainerRuntimeInterface
+	podCache                *watchdog.PodCache
+	responses               response.Manager
 }
 
 var _ displayapi.GPUDisplayServer = &Display{}
 var _ prometheus.Collector = &Display{}
 
 // NewDisplay returns a new Display
-func NewDisplay(config *config.Config, tree device.GPUTree, runtimeManager runtime.ContainerRuntimeInterface) *Display {
-	_tree, _ := tree.(*nvtree.NvidiaTree)
+func NewDisplay(config *config.Config, tree device.GPUTree, runtimeManager runtime.ContainerRuntimeInterface,
+	podCache *watchdog.PodCache, responses response.Manager) *Display {
 	return &Display{
-		tree:                    _tree,
+		tree:                    tree,
 		config:                  config,
 		containerRuntimeManager: runtimeManager,
+		podCache:                podCache,
+		responses:               responses,
 	}
 }
 
 // PrintGraph updates the tree and returns the result of tree.PrintGraph
 func (disp *Display) PrintGraph(context.Context, *google_protobuf1.Empty) (*displayapi.GraphResponse, error) {
-	// 从GPU设备获取信息更新NvidiaTree。如果没有真正的GPU设备，则立即返回。
+	// 从GPU设备获取信息更新设备树。如果没有真正的GPU设备，则立即返回。
 	disp.tree.Update()
 
 	return &displayapi.GraphResponse{
@@ -74,12 +77,22 @@ func (disp *Display) PrintGraph(context.Context, *google_protobuf1.Empty) (*disp
 	}, nil
 }
 
+// ServeHTTP updates the tree and writes the result of tree.Graph in JSON
+func (disp *Display) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	disp.tree.Update()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(disp.tree.Graph()); err != nil {
+		klog.Warningf("can't write graph, %v", err)
+	}
+}
+
 // PrintUsages returns usage info getting from docker and watchdog
 func (disp *Display) PrintUsages(context.Context, *google_protobuf1.Empty) (*displayapi.UsageResponse, error) {
 	disp.Lock()
 	defer disp.Unlock()
 	// 获取使用了gpu的活动中的pod
-	activePods := watchdog.GetActivePods()
+	activePods := disp.podCache.GetActivePods()
 	displayResp := &displayapi.UsageResponse{
 		Usage: make(map[string]*displayapi.ContainerStat),
 	}
@@ -113,10 +126,10 @@ func (disp *Display) PrintUsages(context.Context, *google_protobuf1.Empty) (*dis
 func (disp *Display) getPodSpec(pod *v1.Pod, devicesInfo map[string]*displayapi.Devices) map[string]*displayapi.Spec {
 	podSpec := make(map[string]*displayapi.Spec)
 
-	for _, ctnt := range pod.Spec.Containers {
+	for _, ctnt := range utils.GetPodContainers(pod) {
 		vcore := ctnt.Resources.Requests[types.VCoreAnnotation]
 		vmemory := ctnt.Resources.Requests[types.VMemoryAnnotation]
-		memBytes := vmemory.Value() * types.MemoryBlockSize
+		memBytes := vmemory.Value() * disp.config.GetMemoryBlockSize()
 
 		spec := &displayapi.Spec{
 			// gpu数
@@ -167,11 +180,8 @@ func (disp *Display) getPodUsage(pod *v1.Pod) map[string]*displayapi.Devices {
 		devicesUsage := make([]*displayapi.DeviceInfo, 0)
 		for _, deviceName := range deviceNames {
 			if utils.IsValidGPUPath(deviceName) {
-				node := disp.tree.Query(deviceName)
 				// 获取pod进程在当前gpu设备上的设备利用率
-				if usage := disp.getDeviceUsage(pidsInContainer, node.Meta.ID); usage != nil {
-					// 内存单位bytes转为mb
-					usage.DeviceMem = float32(node.Meta.TotalMemory >> 20)
+				if usage := disp.getDeviceUsage(pidsInContainer, deviceName); usage != nil {
 					devicesUsage = append(devicesUsage, usage)
 				}
 			}
@@ -196,76 +206,30 @@ func (disp *Display) Version(context.Context, *google_protobuf1.Empty) (*display
 	return resp, nil
 }
 
-func (disp *Display) getDeviceUsage(pidsInCont []int, deviceIdx int) *displayapi.DeviceInfo {
-	nvml.Init()
-	defer nvml.Shutdown()
-
-	// 更具设备index获取设备
-	dev, rs := nvml.DeviceGetHandleByIndex(deviceIdx)
-	if rs != nvml.SUCCESS {
-		klog.Warningf("can't find device %d, error %s", deviceIdx, nvml.ErrorString(rs))
-		return nil
-	}
-	lastUtilizationTimestamp := uint64(time.Now().Add(-1 * time.Second).UnixMicro())
-	// 获取进程利用率
-	processSamples, rs := dev.GetProcessUtilization(lastUtilizationTimestamp)
-	if rs != nvml.SUCCESS {
-		klog.Warningf("can't get processes utilization from device %d, error %s", deviceIdx, nvml.ErrorString(rs))
-		return nil
-	}
-	//获取正在当前设备上运行的进程
-	processOnDevices, rs := dev.GetComputeRunningProcesses()
-	if rs != nvml.SUCCESS {
-		klog.Warningf("can't get processes info from device %d, error %s", deviceIdx, nvml.ErrorString(rs))
+func (disp *Display) getDeviceUsage(pidsInCont []int, deviceName string) *displayapi.DeviceInfo {
+	dev, ok := disp.tree.Device(deviceName)
+	if !ok {
+		klog.Warningf("can't find device %s", deviceName)
 		return nil
 	}
-	// 获取设备pci信息
-	pciInfo, rs := dev.GetPciInfo()
-	if rs != nvml.SUCCESS {
-		klog.Warningf("can't get pci info from device %d, error %s", deviceIdx, nvml.ErrorString(rs))
+	usage, err := disp.tree.Usage(deviceName, pidsInCont)
+	if err != nil {
+		klog.Warningf("can't get usage of device %s, %v", deviceName, err)
 		return nil
 	}
-	// 容器进程id排序，从小到大排序
-	sort.Slice(pidsInCont, func(i, j int) bool {
-		return pidsInCont[i] < pidsInCont[j]
-	})
-	// 已使用设备内存
-	usedMemory := uint64(0)
-	// 使用设备中的进程id
-	usedPids := make([]int32, 0)
-	// 使用的gpu利用率
-	usedGPU := uint32(0)
-	for _, info := range processOnDevices {
-		// 二分查找 找到进程在pidsInCont上的索引号
-		idx := sort.Search(len(pidsInCont), func(pivot int) bool {
-			return pidsInCont[pivot] >= int(info.Pid)
-		})
-		// 根据容器pid 找到当前容器在设备上的进程
-		if idx < len(pidsInCont) && pidsInCont[idx] == int(info.Pid) {
-			// 加入到已使用进程中
-			usedPids = append(usedPids, int32(pidsInCont[idx]))
-			// 加上该进程已使用的显存
-			usedMemory += info.UsedGpuMemory
-		}
-	}
 
-	for _, sample := range processSamples {
-		// 二分查找 找到进程在pidsInCont上的索引号
-		idx := sort.Search(len(pidsInCont), func(pivot int) bool {
-			return pidsInCont[pivot] >= int(sample.Pid)
-		})
-		// 根据容器pid 找到当前容器在设备上的进程
-		if idx < len(pidsInCont) && pidsInCont[idx] == int(sample.Pid) {
-			// 加上进程的利用率
-			usedGPU += sample.SmUtil
-		}
+	usedPids := make([]int32, 0, len(usage.Pids))
+	for _, pid := range usage.Pids {
+		usedPids = append(usedPids, int32(pid))
 	}
 	return &displayapi.DeviceInfo{
-		Id:      utils.B2S(pciInfo.BusId[:]),
-		CardIdx: fmt.Sprintf("%d", deviceIdx),
-		Gpu:     float32(usedGPU),
-		Mem:     float32(usedMemory >> 20),
-		Pids:    usedPids,
+		Id:      usage.BusID,
+		CardIdx: fmt.Sprintf("%d", dev.Index),
+		Gpu:     float32(usage.Utilization),
+		// 内存单位bytes转为mb
+		Mem:       float32(usage.UsedMemory >> 20),
+		Pids:      usedPids,
+		DeviceMem: float32(dev.TotalMemory >> 20),
 	}
 }
 
@@ -338,12 +302,16 @@ func (disp *Display) Describe(ch chan<- *prometheus.Desc) {
 	ch <- utilSpecDescBuilder.getDescribeDesc()
 	ch <- memoryDescBuilder.getDescribeDesc()
 	ch <- memorySpecDescBuilder.getDescribeDesc()
+	ch <- overcommitRatioDescBuilder.getMetricDesc()
+	ch <- overcommitLevelDescBuilder.getMetricDesc()
 }
 
 // Collect implements prometheus Collector interface
 func (disp *Display) Collect(ch chan<- prometheus.Metric) {
+	disp.collectOvercommit(ch)
+
 	// 遍历当前节点下所有的活动中的gpu pod
-	for _, pod := range watchdog.GetActivePods() {
+	for _, pod := range disp.podCache.GetActivePods() {
 		valueLabels := make([]string, len(defaultMetricLabels))
 		valueLabels[metricPodName] = pod.Name
 		valueLabels[metricNamespace] = pod.Namespace
@@ -0,0 +1,123 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package display
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"tkestack.io/gpu-manager/pkg/device"
+	"tkestack.io/gpu-manager/pkg/types"
+)
+
+type gpuOvercommitRatioDesc struct{}
+type gpuOvercommitLevelDesc struct{}
+
+var (
+	overcommitMetricLabels     = []string{"node", "gpu", "resource"}
+	overcommitRatioDescBuilder = gpuOvercommitRatioDesc{}
+	overcommitLevelDescBuilder = gpuOvercommitLevelDesc{}
+)
+
+func (gpuOvercommitRatioDesc) getMetricDesc() *prometheus.Desc {
+	return prometheus.NewDesc("gpu_overcommit_ratio", "allocatable resource of gpu relative to physical resource",
+		overcommitMetricLabels, nil)
+}
+
+func (gpuOvercommitLevelDesc) getMetricDesc() *prometheus.Desc {
+	return prometheus.NewDesc("gpu_overcommit_level", "resource requested by containers on gpu relative to physical resource",
+		overcommitMetricLabels, nil)
+}
+
+// requested is the resource requested by containers on a gpu, memory is in
+// bytes
+type requested struct {
+	cores, memory int64
+}
+
+// collectOvercommit reports configured overcommit ratio and requested level
+// of cores and memory for each gpu, level above 1 means oversubscribed
+func (disp *Display) collectOvercommit(ch chan<- prometheus.Metric) {
+	leaves := disp.tree.LeafStates()
+	requests := disp.requestsOf(leaves)
+	for _, leaf := range leaves {
+		gpuID := fmt.Sprintf("gpu%d", leaf.Index)
+		req := requests[leaf.MinorName]
+		resources := []struct {
+			name                          string
+			physical, capacity, requested float64
+		}{
+			{"cores", device.HundredCore, float64(leaf.CoreCapacity), float64(req.cores)},
+			{"memory", float64(leaf.TotalMemory), float64(leaf.MemoryCapacity), float64(req.memory)},
+		}
+		for _, r := range resources {
+			if r.physical <= 0 {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(overcommitRatioDescBuilder.getMetricDesc(),
+				prometheus.GaugeValue, r.capacity/r.physical, disp.config.Hostname, gpuID, r.name)
+			ch <- prometheus.MustNewConstMetric(overcommitLevelDescBuilder.getMetricDesc(),
+				prometheus.GaugeValue, r.requested/r.physical, disp.config.Hostname, gpuID, r.name)
+		}
+	}
+}
+
+// requestsOf sums resource requested by containers allocated on leaves keyed
+// by device path. Resource of a container is shared evenly by its devices,
+// a container requesting whole GPUs takes all memory of its devices.
+func (disp *Display) requestsOf(leaves []device.LeafState) map[string]requested {
+	totalMemory := make(map[string]int64, len(leaves))
+	for _, leaf := range leaves {
+		totalMemory[leaf.MinorName] = int64(leaf.TotalMemory)
+	}
+
+	requests := make(map[string]requested)
+	if disp.responses == nil {
+		return requests
+	}
+	for _, containers := range disp.responses.ListAll() {
+		for _, resp := range containers {
+			devices := make([]string, 0, len(resp.Devices))
+			for _, dev := range resp.Devices {
+				if _, ok := totalMemory[dev.HostPath]; ok {
+					devices = append(devices, dev.HostPath)
+				}
+			}
+			if len(devices) == 0 {
+				continue
+			}
+
+			cores, _ := strconv.ParseInt(resp.Annotations[types.VCoreAnnotation], 10, 64)
+			memory, _ := strconv.ParseInt(resp.Annotations[types.VMemoryAnnotation], 10, 64)
+			for _, dev := range devices {
+				req := requests[dev]
+				req.cores += cores / int64(len(devices))
+				if cores >= device.HundredCore {
+					req.memory += totalMemory[dev]
+				} else {
+					req.memory += memory / int64(len(devices))
+				}
+				requests[dev] = req
+			}
+		}
+	}
+
+	return requests
+}
@@ -0,0 +1,98 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package display
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"tkestack.io/gpu-manager/pkg/config"
+	"tkestack.io/gpu-manager/pkg/device/dummy"
+	"tkestack.io/gpu-manager/pkg/services/response"
+	"tkestack.io/gpu-manager/pkg/types"
+)
+
+// overcommitCollector only collects overcommit metrics of disp
+type overcommitCollector struct {
+	disp *Display
+}
+
+func (c *overcommitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- overcommitRatioDescBuilder.getMetricDesc()
+	ch <- overcommitLevelDescBuilder.getMetricDesc()
+}
+
+func (c *overcommitCollector) Collect(ch chan<- prometheus.Metric) {
+	c.disp.collectOvercommit(ch)
+}
+
+func TestCollectOvercommit(t *testing.T) {
+	cfg := &config.Config{
+		Hostname:   "k8s01",
+		Overcommit: &config.OvercommitConfig{Cores: 2, Memory: 1.5},
+		Pools:      []config.PoolConfig{{Name: "notebook", Mode: config.PoolShare, Devices: []string{"0"}}},
+	}
+	tree := dummy.NewDummyTree(cfg)
+	tree.Init(`[{"uuid":"GPU-0","totalMemory":1024},{"uuid":"GPU-1","totalMemory":2048}]`)
+
+	responses := response.NewFakeResponseManager()
+	insert := func(pod, container string, cores, memory int64, devices ...string) {
+		resp := &pluginapi.ContainerAllocateResponse{
+			Annotations: map[string]string{
+				types.VCoreAnnotation:   fmt.Sprint(cores),
+				types.VMemoryAnnotation: fmt.Sprint(memory),
+			},
+		}
+		for _, dev := range devices {
+			resp.Devices = append(resp.Devices, &pluginapi.DeviceSpec{HostPath: dev})
+			if err := tree.Occupy(dev, cores, memory); err != nil {
+				t.Fatal(err)
+			}
+		}
+		responses.InsertResp(pod, container, resp)
+	}
+	// GPU0超卖后由三个共享容器使用, GPU1被整卡占用但只申请了100
+	insert("pod-1", "cuda", 80, 512, "/dev/nvidia0")
+	insert("pod-2", "cuda", 60, 512, "/dev/nvidia0")
+	insert("pod-2", "sidecar", 10, 256, "/dev/nvidia0")
+	insert("pod-3", "cuda", 100, 0, "/dev/nvidia1")
+
+	disp := NewDisplay(cfg, tree, nil, nil, responses)
+	expected := `
+# HELP gpu_overcommit_level resource requested by containers on gpu relative to physical resource
+# TYPE gpu_overcommit_level gauge
+gpu_overcommit_level{gpu="gpu0",node="k8s01",resource="cores"} 1.5
+gpu_overcommit_level{gpu="gpu0",node="k8s01",resource="memory"} 1.25
+gpu_overcommit_level{gpu="gpu1",node="k8s01",resource="cores"} 1
+gpu_overcommit_level{gpu="gpu1",node="k8s01",resource="memory"} 1
+# HELP gpu_overcommit_ratio allocatable resource of gpu relative to physical resource
+# TYPE gpu_overcommit_ratio gauge
+gpu_overcommit_ratio{gpu="gpu0",node="k8s01",resource="cores"} 2
+gpu_overcommit_ratio{gpu="gpu0",node="k8s01",resource="memory"} 1.5
+gpu_overcommit_ratio{gpu="gpu1",node="k8s01",resource="cores"} 1
+gpu_overcommit_ratio{gpu="gpu1",node="k8s01",resource="memory"} 1
+`
+	if err := testutil.CollectAndCompare(&overcommitCollector{disp}, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
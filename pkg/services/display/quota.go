@@ -0,0 +1,44 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package display
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"k8s.io/klog"
+
+	"tkestack.io/gpu-manager/pkg/services/allocator"
+)
+
+// quotaHandler writes consumption of GPU quotas in JSON
+type quotaHandler struct {
+	reporter allocator.QuotaReporter
+}
+
+// NewQuotaHandler returns a http.Handler showing quotas of the reporter
+func NewQuotaHandler(reporter allocator.QuotaReporter) http.Handler {
+	return &quotaHandler{reporter: reporter}
+}
+
+func (h *quotaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.reporter.QuotaStatus()); err != nil {
+		klog.Warningf("can't write quotas, %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package mps
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"tkestack.io/gpu-manager/pkg/types"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+const (
+	controlBinary = "nvidia-cuda-mps-control"
+
+	// ContainerPipeDirectory is the path where the pipe directory of
+	// MPS control daemon is mounted inside containers
+	ContainerPipeDirectory = "/tmp/nvidia-mps"
+	// ContainerLogDirectory is the path where the log directory of MPS
+	// control daemon is mounted inside containers
+	ContainerLogDirectory = "/var/log/nvidia-mps"
+
+	checkPeriod    = 10 * time.Second
+	commandTimeout = 5 * time.Second
+)
+
+// Device describes a GPU served by a MPS control daemon
+type Device struct {
+	Index int
+	UUID  string
+}
+
+// Manager runs and supervises one MPS control daemon for each shared GPU
+type Manager struct {
+	basePath string
+	binary   string
+	devices  []Device
+
+	wg       sync.WaitGroup
+	stopChan chan struct{}
+}
+
+// NewManager returns a new Manager
+func NewManager(basePath string, devices []Device) *Manager {
+	return &Manager{
+		basePath: basePath,
+		devices:  devices,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// PipeDirectory returns the host path of pipe directory for the daemon of device uuid
+func PipeDirectory(basePath, uuid string) string {
+	return filepath.Join(basePath, uuid, "pipe")
+}
+
+// LogDirectory returns the host path of log directory for the daemon of device uuid
+func LogDirectory(basePath, uuid string) string {
+	return filepath.Join(basePath, uuid, "log")
+}
+
+// ClientEnvs returns environments which limit a MPS client to cores
+// percent of SM and memory bytes of device memory. Device ordinal is
+// always 0 because only one device is visible to share mode container.
+func ClientEnvs(cores, memory int64) map[string]string {
+	return map[string]string{
+		"CUDA_MPS_PIPE_DIRECTORY":           ContainerPipeDirectory,
+		"CUDA_MPS_LOG_DIRECTORY":            ContainerLogDirectory,
+		"CUDA_MPS_ACTIVE_THREAD_PERCENTAGE": fmt.Sprintf("%d", cores),
+		"CUDA_MPS_PINNED_DEVICE_MEM_LIMIT":  fmt.Sprintf("0=%dM", memory/types.MemoryBlockSize),
+	}
+}
+
+func (m *Manager) daemonEnvs(dev Device) []string {
+	envs := []string{
+		"CUDA_VISIBLE_DEVICES=" + dev.UUID,
+		"CUDA_MPS_PIPE_DIRECTORY=" + PipeDirectory(m.basePath, dev.UUID),
+		"CUDA_MPS_LOG_DIRECTORY=" + LogDirectory(m.basePath, dev.UUID),
+	}
+	// 使用挂载出来的驱动时需要同时指定驱动库路径
+	if origin := types.GetDriverInfo().OriginLibraryPath; len(origin) > 0 && strings.HasPrefix(m.binary, origin) {
+		envs = append(envs, "LD_LIBRARY_PATH="+filepath.Join(origin, "lib64"))
+	}
+
+	return append(os.Environ(), envs...)
+}
+
+// Run starts all MPS control daemons and keeps them alive
+func (m *Manager) Run() error {
+	binary, err := lookupControlBinary()
+	if err != nil {
+		return err
+	}
+	m.binary = binary
+	klog.V(2).Infof("Use MPS control daemon %s", m.binary)
+
+	for _, dev := range m.devices {
+		for _, dir := range []string{PipeDirectory(m.basePath, dev.UUID), LogDirectory(m.basePath, dev.UUID)} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+
+		dev := dev
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			wait.Until(func() { m.ensureDaemon(dev) }, checkPeriod, m.stopChan)
+		}()
+	}
+
+	klog.V(2).Infof("MPS manager is running")
+
+	return nil
+}
+
+// Stop asks every MPS control daemon to quit
+func (m *Manager) Stop() {
+	close(m.stopChan)
+	m.wg.Wait()
+
+	for _, dev := range m.devices {
+		if _, err := m.control(dev, "quit"); err != nil {
+			klog.Warningf("can't stop MPS control daemon of %s, %v", dev.UUID, err)
+		}
+	}
+}
+
+func (m *Manager) ensureDaemon(dev Device) {
+	if _, err := m.control(dev, "get_server_list"); err == nil {
+		return
+	}
+
+	klog.V(2).Infof("MPS control daemon of GPU%d(%s) is not running, starting", dev.Index, dev.UUID)
+	cmd := exec.Command(m.binary, "-d")
+	cmd.Env = m.daemonEnvs(dev)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		klog.Errorf("can't start MPS control daemon of %s, %s, %v", dev.UUID, out, err)
+	}
+}
+
+// control sends command to the daemon of dev and returns its reply
+func (m *Manager) control(dev Device, command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, m.binary)
+	cmd.Env = m.daemonEnvs(dev)
+	cmd.Stdin = strings.NewReader(command + "\n")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", strings.TrimSpace(string(out)), err)
+	}
+
+	return string(out), nil
+}
+
+func lookupControlBinary() (string, error) {
+	if binary, err := exec.LookPath(controlBinary); err == nil {
+		return binary, nil
+	}
+
+	// 宿主机的二进制由volume manager镜像到了origin目录
+	if origin := types.GetDriverInfo().OriginLibraryPath; len(origin) > 0 {
+		binary := filepath.Join(origin, "bin", controlBinary)
+		if _, err := os.Stat(binary); err == nil {
+			return binary, nil
+		}
+	}
+
+	return "", fmt.Errorf("can not find %s", controlBinary)
+}
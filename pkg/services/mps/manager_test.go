@@ -0,0 +1,56 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package mps
+
+import (
+	"strings"
+	"testing"
+
+	"tkestack.io/gpu-manager/pkg/types"
+)
+
+func TestClientEnvs(t *testing.T) {
+	envs := ClientEnvs(30, 2048*types.MemoryBlockSize)
+
+	expect := map[string]string{
+		"CUDA_MPS_PIPE_DIRECTORY":           ContainerPipeDirectory,
+		"CUDA_MPS_LOG_DIRECTORY":            ContainerLogDirectory,
+		"CUDA_MPS_ACTIVE_THREAD_PERCENTAGE": "30",
+		"CUDA_MPS_PINNED_DEVICE_MEM_LIMIT":  "0=2048M",
+	}
+	for k, v := range expect {
+		if envs[k] != v {
+			t.Errorf("env %s expect %s, got %s", k, v, envs[k])
+		}
+	}
+}
+
+func TestDaemonEnvs(t *testing.T) {
+	m := NewManager("/etc/gpu-manager/mps", nil)
+	envs := strings.Join(m.daemonEnvs(Device{Index: 1, UUID: "GPU-1"}), "\n")
+
+	for _, expect := range []string{
+		"CUDA_VISIBLE_DEVICES=GPU-1",
+		"CUDA_MPS_PIPE_DIRECTORY=/etc/gpu-manager/mps/GPU-1/pipe",
+		"CUDA_MPS_LOG_DIRECTORY=/etc/gpu-manager/mps/GPU-1/log",
+	} {
+		if !strings.Contains(envs, expect) {
+			t.Errorf("env %s not found", expect)
+		}
+	}
+}
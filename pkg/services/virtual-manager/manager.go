@@ -40,6 +40,7 @@ import (
 	"tkestack.io/gpu-manager/pkg/utils"
 
 	"google.golang.org/grpc"
+	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 )
@@ -147,6 +148,10 @@ type VirtualManager struct {
 	containerRuntimeManager runtime.ContainerRuntimeInterface
 	vDeviceServers          map[string]*grpc.Server
 	responseManager         response.Manager
+	podCache                *watchdog.PodCache
+
+	wg       sync.WaitGroup
+	stopChan chan struct{}
 }
 
 var _ vcudaapi.VCUDAServiceServer = &VirtualManager{}
@@ -154,12 +159,15 @@ var _ vcudaapi.VCUDAServiceServer = &VirtualManager{}
 // NewVirtualManager returns a new VirtualManager.
 func NewVirtualManager(config *config.Config,
 	runtimeManager runtime.ContainerRuntimeInterface,
-	responseManager response.Manager) *VirtualManager {
+	responseManager response.Manager,
+	podCache *watchdog.PodCache) *VirtualManager {
 	manager := &VirtualManager{
 		cfg:                     config,
 		containerRuntimeManager: runtimeManager,
 		vDeviceServers:          make(map[string]*grpc.Server),
 		responseManager:         responseManager,
+		podCache:                podCache,
+		stopChan:                make(chan struct{}),
 	}
 
 	return manager
@@ -169,12 +177,15 @@ func NewVirtualManager(config *config.Config,
 // client for testing.
 func NewVirtualManagerForTest(config *config.Config,
 	runtimeManager runtime.ContainerRuntimeInterface,
-	responseManager response.Manager) *VirtualManager {
+	responseManager response.Manager,
+	podCache *watchdog.PodCache) *VirtualManager {
 	manager := &VirtualManager{
 		cfg:                     config,
 		vDeviceServers:          make(map[string]*grpc.Server),
 		containerRuntimeManager: runtimeManager,
 		responseManager:         responseManager,
+		podCache:                podCache,
+		stopChan:                make(chan struct{}),
 	}
 
 	return manager
@@ -191,18 +202,58 @@ func (vm *VirtualManager) Run() {
 	}
 
 	registered := make(chan struct{})
+	vm.wg.Add(3)
 	go vm.vDeviceWatcher(registered)
 	<-registered
 
+	// pod结束后立即关闭vDevice server并清理目录, 不必等待garbageCollector
+	vm.podCache.OnRelease(vm.releasePod)
+
 	go vm.garbageCollector()
 	go vm.process()
 	klog.V(2).Infof("Virtual manager is running")
 }
 
+// Stop stops background workers and all vDevice servers, directories of
+// pods are kept for recovering after restart
+func (vm *VirtualManager) Stop() {
+	close(vm.stopChan)
+	vm.wg.Wait()
+
+	vm.Lock()
+	defer vm.Unlock()
+	for dir, srv := range vm.vDeviceServers {
+		klog.V(2).Infof("Close vDevice server %s", dir)
+		srv.Stop()
+		delete(vm.vDeviceServers, dir)
+	}
+	klog.V(2).Infof("Virtual manager is stopped")
+}
+
+// releasePod stops vDevice server and removes directory of pod once it's
+// terminated or deleted
+func (vm *VirtualManager) releasePod(pod *v1.Pod) {
+	dir := filepath.Join(vm.cfg.VirtualManagerPath, string(pod.UID))
+
+	vm.Lock()
+	if srv, ok := vm.vDeviceServers[dir]; ok {
+		klog.V(2).Infof("Close vDevice server %s of pod %s/%s", dir, pod.Namespace, pod.Name)
+		srv.Stop()
+		delete(vm.vDeviceServers, dir)
+	}
+	vm.Unlock()
+
+	if _, err := os.Stat(dir); err == nil {
+		klog.V(2).Infof("Remove directory %s", dir)
+		os.RemoveAll(dir)
+	}
+}
+
 func (vm *VirtualManager) vDeviceWatcher(registered chan struct{}) {
+	defer vm.wg.Done()
 	klog.V(2).Infof("Start vDevice watcher")
 
-	activePods := watchdog.GetActivePods()
+	activePods := vm.podCache.GetActivePods()
 	possibleActiveVm := vm.responseManager.ListAll()
 
 	for uid, containerMapping := range possibleActiveVm {
@@ -251,7 +302,7 @@ func (vm *VirtualManager) vDeviceWatcher(registered chan struct{}) {
 
 	close(registered)
 
-	wait.Forever(func() {
+	wait.Until(func() {
 		vm.Lock()
 		defer vm.Unlock()
 
@@ -263,15 +314,16 @@ func (vm *VirtualManager) vDeviceWatcher(registered chan struct{}) {
 				delete(vm.vDeviceServers, dir)
 			}
 		}
-	}, time.Minute)
+	}, time.Minute, vm.stopChan)
 }
 
 func (vm *VirtualManager) garbageCollector() {
+	defer vm.wg.Done()
 	klog.V(2).Infof("Starting garbage directory collector")
-	wait.Forever(func() {
+	wait.Until(func() {
 		needDeleted := make([]string, 0)
 
-		activePods := watchdog.GetActivePods()
+		activePods := vm.podCache.GetActivePods()
 		possibleActiveVm := vm.responseManager.ListAll()
 
 		for uid, containerMapping := range possibleActiveVm {
@@ -290,7 +342,7 @@ func (vm *VirtualManager) garbageCollector() {
 			klog.V(2).Infof("Remove directory %s", dir)
 			os.RemoveAll(filepath.Clean(dir))
 		}
-	}, time.Minute)
+	}, time.Minute, vm.stopChan)
 }
 
 //	              Host                     |                Container
@@ -334,6 +386,7 @@ func (vm *VirtualManager) garbageCollector() {
 //	                                      |
 //	                                      v
 func (vm *VirtualManager) process() {
+	defer vm.wg.Done()
 	vcudaConfigFunc := func(podUID string) error {
 		// 创建vcuda manager目录 默认 /etc/gpu-manager/vm/{pod-uid}
 		dirName := filepath.Clean(filepath.Join(vm.cfg.VirtualManagerPath, podUID))
@@ -357,11 +410,16 @@ func (vm *VirtualManager) process() {
 	}
 
 	klog.V(2).Infof("Starting process vm events")
-	for evt := range vm.cfg.VCudaRequestsQueue {
-		podUID := evt.PodUID
-		klog.V(2).Infof("process %s", podUID)
-		// 创建vcuda config的grpc服务，并将结果放入信道
-		evt.Done <- vcudaConfigFunc(podUID)
+	for {
+		select {
+		case evt := <-vm.cfg.VCudaRequestsQueue:
+			podUID := evt.PodUID
+			klog.V(2).Infof("process %s", podUID)
+			// 创建vcuda config的grpc服务，并将结果放入信道
+			evt.Done <- vcudaConfigFunc(podUID)
+		case <-vm.stopChan:
+			return
+		}
 	}
 }
 
@@ -426,8 +484,7 @@ func (vm *VirtualManager) registerVDeviceWithContainerName(podUID, contName stri
 
 	containerID := ""
 	err := wait.Poll(time.Second, time.Minute, func() (done bool, err error) {
-		activePods := watchdog.GetActivePods()
-		pod, ok := activePods[podUID]
+		pod, ok := vm.podCache.GetActivePod(podUID)
 		if !ok {
 			return false, fmt.Errorf("can't locate %s", podUID)
 		}
@@ -513,8 +570,7 @@ func (vm *VirtualManager) writeConfigFile(filename string, podUID, name string)
 			return err
 		}
 		// 从缓存中取出活动中的gpu pod
-		activePods := watchdog.GetActivePods()
-		pod, ok := activePods[podUID]
+		pod, ok := vm.podCache.GetActivePod(podUID)
 		if !ok {
 			return fmt.Errorf("can't locate %s", podUID)
 		}
@@ -539,8 +595,8 @@ func (vm *VirtualManager) writeConfigFile(filename string, podUID, name string)
 		}
 		// 标记是否找到要分配gpu的容器
 		found := false
-		// 遍历pod的所有容器
-		for _, cont := range pod.Spec.Containers {
+		// 遍历pod的所有init容器和容器
+		for _, cont := range utils.GetPodContainers(pod) {
 			if cont.Name == name || strings.HasPrefix(name, utils.MakeContainerNamePrefix(cont.Name)) {
 				found = true
 				coresLimit := cont.Resources.Limits[types.VCoreAnnotation]
@@ -548,7 +604,7 @@ func (vm *VirtualManager) writeConfigFile(filename string, podUID, name string)
 				cores := (&coresLimit).Value()
 				memoryLimit := cont.Resources.Limits[types.VMemoryAnnotation]
 				// 分配的显存数
-				memory := (&memoryLimit).Value() * types.MemoryBlockSize
+				memory := (&memoryLimit).Value() * vm.cfg.GetMemoryBlockSize()
 
 				if err := func() error {
 					// 调用c语言代码构建对象
@@ -566,8 +622,9 @@ func (vm *VirtualManager) writeConfigFile(filename string, podUID, name string)
 					vcudaConfig.gpu_memory = C.uint64_t(memory)
 					vcudaConfig.utilization = C.int(cores)
 					vcudaConfig.hard_limit = 1
-					vcudaConfig.driver_version.major = C.int(types.DriverVersionMajor)
-					vcudaConfig.driver_version.minor = C.int(types.DriverVersionMinor)
+					driver := types.GetDriverInfo()
+					vcudaConfig.driver_version.major = C.int(driver.VersionMajor)
+					vcudaConfig.driver_version.minor = C.int(driver.VersionMinor)
 					// 当申请的核心数为独占完整的卡时,enable为0,需要切分算力时enable为1
 					if cores >= nvidia.HundredCore {
 						// 独占整卡时
@@ -0,0 +1,67 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package vitrual_manager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/goleak"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"tkestack.io/gpu-manager/pkg/config"
+	"tkestack.io/gpu-manager/pkg/services/response"
+	"tkestack.io/gpu-manager/pkg/services/watchdog"
+	"tkestack.io/gpu-manager/pkg/types"
+)
+
+func TestVirtualManagerStop(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	k8sClient := fake.NewSimpleClientset()
+	podCache := watchdog.NewPodCacheForTest(k8sClient)
+	defer podCache.Stop()
+
+	cfg := &config.Config{
+		VirtualManagerPath: t.TempDir(),
+		VCudaRequestsQueue: make(chan *types.VCudaRequest, 1),
+	}
+	vm := NewVirtualManagerForTest(cfg, nil, response.NewFakeResponseManager(), podCache)
+	vm.Run()
+
+	// 为pod启动vDevice server
+	req := &types.VCudaRequest{PodUID: "pod-0", Done: make(chan error, 1)}
+	cfg.VCudaRequestsQueue <- req
+	if err := <-req.Done; err != nil {
+		t.Fatalf("can't start vDevice server, %v", err)
+	}
+	dir := filepath.Join(cfg.VirtualManagerPath, "pod-0")
+	if _, err := os.Stat(filepath.Join(dir, types.VDeviceSocket)); err != nil {
+		t.Fatalf("vDevice socket is not created, %v", err)
+	}
+
+	// 停止后关闭所有vDevice server, 保留目录用于重启后恢复
+	vm.Stop()
+	if len(vm.vDeviceServers) != 0 {
+		t.Errorf("expect vDevice servers closed, got %d", len(vm.vDeviceServers))
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("directory of pod is removed, %v", err)
+	}
+}
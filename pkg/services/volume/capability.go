@@ -0,0 +1,186 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package volume
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+)
+
+const (
+	// DriverCapabilitiesEnv selects driver components mounted into container
+	DriverCapabilitiesEnv = "NVIDIA_DRIVER_CAPABILITIES"
+
+	CapabilityCompute  = "compute"
+	CapabilityUtility  = "utility"
+	CapabilityGraphics = "graphics"
+	CapabilityVideo    = "video"
+	CapabilityDisplay  = "display"
+	CapabilityNGX      = "ngx"
+	CapabilityAll      = "all"
+
+	viewsDir = ".capabilities"
+)
+
+var (
+	knownCapabilities = sets.NewString(CapabilityCompute, CapabilityUtility, CapabilityGraphics,
+		CapabilityVideo, CapabilityDisplay, CapabilityNGX)
+
+	// DefaultCapabilities are used if NVIDIA_DRIVER_CAPABILITIES is unset
+	// or empty, same as nvidia-container-runtime
+	DefaultCapabilities = []string{CapabilityCompute, CapabilityUtility}
+
+	// viewLock serializes creating capability views between allocations
+	viewLock sync.Mutex
+)
+
+// ParseCapabilities parses value of NVIDIA_DRIVER_CAPABILITIES, nil means
+// all components should be mounted.
+func ParseCapabilities(value string) []string {
+	if len(strings.TrimSpace(value)) == 0 {
+		return append([]string(nil), DefaultCapabilities...)
+	}
+
+	caps := sets.NewString()
+	for _, c := range strings.Split(value, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		switch {
+		case len(c) == 0:
+		case c == CapabilityAll:
+			return nil
+		case knownCapabilities.Has(c):
+			caps.Insert(c)
+		default:
+			klog.Warningf("Unknown driver capability %s", c)
+		}
+	}
+
+	if caps.Len() == 0 {
+		return nil
+	}
+
+	return caps.List()
+}
+
+// capabilitiesOf returns capabilities of the mirrored file name,
+// components in tags are matched by file name or library prefix.
+func capabilitiesOf(tags map[string][]string, name string) []string {
+	caps := make([]string, 0)
+	base := filepath.Base(name)
+	for c, components := range tags {
+		for _, component := range components {
+			if base == component || strings.HasPrefix(base, component+".") {
+				caps = append(caps, c)
+				break
+			}
+		}
+	}
+	sort.Strings(caps)
+
+	return caps
+}
+
+// CapabilityView returns a directory which only contains files of volume
+// dir tagged with one of caps, files without tags are always included.
+// Views are created on first use under the generation of the manifest, a
+// repaired or mirrored again volume gets new views so files mounted by
+// running containers are never changed. Views of old generations are
+// removed by garbage collection.
+func CapabilityView(dir string, caps []string) (string, error) {
+	if len(caps) == 0 {
+		return dir, nil
+	}
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return "", err
+	}
+
+	view := filepath.Join(dir, viewsDir, m.Generation, strings.Join(caps, "_"))
+	if _, err := os.Stat(view); err == nil {
+		return view, nil
+	}
+
+	viewLock.Lock()
+	defer viewLock.Unlock()
+
+	if _, err := os.Stat(view); err == nil {
+		return view, nil
+	}
+
+	// 先在临时目录中创建再重命名, 避免容器挂载到不完整的目录
+	tmp := view + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+
+	wanted := sets.NewString(caps...)
+	for _, entry := range m.Files {
+		if len(entry.Capabilities) > 0 && !wanted.HasAny(entry.Capabilities...) {
+			continue
+		}
+
+		target := filepath.Join(tmp, entry.Name)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return "", err
+		}
+		if err := clone(filepath.Join(dir, entry.Name), target); err != nil {
+			return "", err
+		}
+
+		for _, link := range entry.Links {
+			l := filepath.Join(tmp, link)
+			if err := os.MkdirAll(filepath.Dir(l), 0755); err != nil {
+				return "", err
+			}
+			name, _ := filepath.Rel(filepath.Dir(link), entry.Name)
+			if err := os.Symlink(name, l); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if err := os.Rename(tmp, view); err != nil {
+		return "", err
+	}
+	klog.V(2).Infof("Create driver view %s for capabilities %v", view, caps)
+
+	return view, nil
+}
+
+// GraphicsEnvs returns environments which let Vulkan and EGL loaders find
+// the vendor files mirrored into dir, dir is mounted at containerPath.
+func GraphicsEnvs(dir, containerPath string) map[string]string {
+	envs := make(map[string]string)
+
+	if _, err := os.Stat(filepath.Join(dir, configDir, "vulkan", "icd.d")); err == nil {
+		envs["XDG_DATA_DIRS"] = strings.Join([]string{filepath.Join(containerPath, configDir), "/usr/local/share", "/usr/share"}, ":")
+	}
+	if _, err := os.Stat(filepath.Join(dir, configDir, "glvnd", "egl_vendor.d")); err == nil {
+		envs["__EGL_VENDOR_LIBRARY_DIRS"] = strings.Join([]string{filepath.Join(containerPath, configDir, "glvnd", "egl_vendor.d"),
+			"/etc/glvnd/egl_vendor.d", "/usr/share/glvnd/egl_vendor.d"}, ":")
+	}
+
+	return envs
+}
@@ -0,0 +1,118 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package volume
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	testCases := map[string][]string{
+		"":                          {"compute", "utility"},
+		"all":                       nil,
+		"compute,all":               nil,
+		"utility, Compute":          {"compute", "utility"},
+		"graphics,unknown,graphics": {"graphics"},
+	}
+
+	for value, expect := range testCases {
+		if caps := ParseCapabilities(value); !reflect.DeepEqual(caps, expect) {
+			t.Errorf("%q expect %v, got %v", value, expect, caps)
+		}
+	}
+}
+
+func TestCapabilityView(t *testing.T) {
+	host, vol := t.TempDir(), t.TempDir()
+	sources := make(map[string]string)
+	for _, f := range []string{"bin/nvidia-smi", "bin/gpu-client", "lib64/libcuda.so.450.80", "lib64/libGLX_nvidia.so.450.80"} {
+		source := filepath.Join(host, filepath.Base(f))
+		if err := os.WriteFile(source, []byte(f), 0755); err != nil {
+			t.Fatal(err)
+		}
+		target := filepath.Join(vol, f)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fallbackCopy(source, target); err != nil {
+			t.Fatal(err)
+		}
+		sources[target] = source
+	}
+	if err := os.Symlink("libcuda.so.450.80", filepath.Join(vol, "lib64", "libcuda.so.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	tags := map[string][]string{
+		CapabilityUtility:  {"nvidia-smi"},
+		CapabilityCompute:  {"libcuda.so"},
+		CapabilityGraphics: {"libGLX_nvidia.so"},
+	}
+	m, err := newManifest("nvidia", vol, "450.80", sources, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.write(); err != nil {
+		t.Fatal(err)
+	}
+
+	view, err := CapabilityView(vol, []string{CapabilityCompute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]bool{
+		"bin/gpu-client":                true,
+		"bin/nvidia-smi":                false,
+		"lib64/libcuda.so.450.80":       true,
+		"lib64/libcuda.so.1":            true,
+		"lib64/libGLX_nvidia.so.450.80": false,
+	}
+	for f, exist := range expect {
+		_, err := os.Stat(filepath.Join(view, f))
+		if exist != (err == nil) {
+			t.Errorf("%s expect exist %t, got err %v", f, exist, err)
+		}
+	}
+
+	// 视图目录不应被当作镜像文件记录
+	m, err = newManifest("nvidia", vol, "450.80", sources, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != len(sources) {
+		t.Errorf("expect %d files, got %d", len(sources), len(m.Files))
+	}
+
+	// 重新写入manifest后使用新的视图, 已挂载的旧视图保持不变
+	if err := m.write(); err != nil {
+		t.Fatal(err)
+	}
+	newView, err := CapabilityView(vol, []string{CapabilityCompute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newView == view {
+		t.Errorf("expect a new view, got %s", newView)
+	}
+	if _, err := os.Stat(filepath.Join(view, "lib64/libcuda.so.450.80")); err != nil {
+		t.Errorf("old view is changed, %v", err)
+	}
+}
@@ -21,18 +21,35 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"syscall"
 	"unsafe"
+
+	"k8s.io/klog"
 )
 
-const ldcachePath = "/etc/ld.so.cache"
+// Path is the location of ld.so.cache
+const Path = "/etc/ld.so.cache"
 
 const (
 	magicString1 = "ld.so-1.7.0"
 	magicString2 = "glibc-ld.so.cache"
 	magicVersion = "1.1"
+
+	// magicExtension marks extension sections following the new format
+	magicExtension = 0xeaa42174
+	// extensionTagHwcaps section lists names of glibc-hwcaps subdirectories
+	extensionTagHwcaps = 1
+	// hwcapExtension is set in HWCap of entries under glibc-hwcaps
+	// subdirectories, the lower 32 bits index into the hwcaps section
+	hwcapExtension = uint64(1) << 62
+
+	endianUnset  = 0
+	endianLittle = 2
 )
 
 const (
@@ -42,10 +59,25 @@ const (
 	flagArchMask    = 0xff00
 	flagArchI386    = 0x0000
 	flagArchX8664   = 0x0300
-	flagArchX32     = 0x0800
 	flagArchPpc64le = 0x0500
+	flagArchX32     = 0x0800
+	flagArchArmHF   = 0x0900
+	flagArchAarch64 = 0x0a00
+	flagArchArmSF   = 0x0b00
 )
 
+type archFlags struct {
+	lib32, lib64 []int32
+}
+
+// archTable maps GOARCH to flags of 32 and 64 bit libraries it can load,
+// x32 libraries use a different ABI and can't be used by i386 programs.
+var archTable = map[string]archFlags{
+	"amd64":   {lib32: []int32{flagArchI386}, lib64: []int32{flagArchX8664}},
+	"arm64":   {lib32: []int32{flagArchArmHF, flagArchArmSF}, lib64: []int32{flagArchAarch64}},
+	"ppc64le": {lib64: []int32{flagArchPpc64le}},
+}
+
 var ErrInvalidCache = errors.New("invalid ld.so.cache file")
 
 type Header1 struct {
@@ -63,8 +95,12 @@ type Header2 struct {
 	Version   [len(magicVersion)]byte
 	NLibs     uint32
 	TableSize uint32
-	_         [3]uint32 // unused
-	_         uint64    // force 8 byte alignment
+	// Flags records endianness since glibc 2.32
+	Flags uint8
+	_     [3]uint8
+	// ExtensionOffset is the offset of extension sections since glibc 2.33
+	ExtensionOffset uint32
+	_               [3]uint32 // unused
 }
 
 type Entry2 struct {
@@ -74,16 +110,32 @@ type Entry2 struct {
 	HWCap      uint64
 }
 
+type extensionHeader struct {
+	Magic uint32
+	Count uint32
+}
+
+type extensionSection struct {
+	Tag    uint32
+	Flags  uint32
+	Offset uint32
+	Size   uint32
+}
+
 type LDCache struct {
 	*bytes.Reader
 
 	data, libs []byte
 	header     Header2
 	entries    []Entry2
+	// hwcaps are names of glibc-hwcaps subdirectories
+	hwcaps []string
+	arch   string
+	mapped bool
 }
 
 func Open() (*LDCache, error) {
-	f, err := os.Open(ldcachePath)
+	f, err := os.Open(Path)
 	if err != nil {
 		return nil, err
 	}
@@ -100,11 +152,19 @@ func Open() (*LDCache, error) {
 		return nil, err
 	}
 
-	cache := &LDCache{data: d, Reader: bytes.NewReader(d)}
+	cache := newLDCache(d, runtime.GOARCH)
+	cache.mapped = true
 	return cache, cache.parse()
 }
 
+func newLDCache(d []byte, arch string) *LDCache {
+	return &LDCache{data: d, Reader: bytes.NewReader(d), arch: arch}
+}
+
 func (c *LDCache) Close() error {
+	if !c.mapped {
+		return nil
+	}
 	// 释放内存
 	return syscall.Munmap(c.data)
 }
@@ -117,10 +177,33 @@ func (c *LDCache) Version() string {
 	return string(c.header.Version[:])
 }
 
+// Hwcaps returns names of glibc-hwcaps subdirectories in the cache
+func (c *LDCache) Hwcaps() []string {
+	return c.hwcaps
+}
+
 func strn(b []byte, n int) string {
 	return string(b[:n])
 }
 
+// str returns the null terminated string at offset of string table
+func (c *LDCache) str(offset uint32) (string, bool) {
+	return cstr(c.libs, offset)
+}
+
+func cstr(b []byte, offset uint32) (string, bool) {
+	if offset >= uint32(len(b)) {
+		return "", false
+	}
+	b = b[offset:]
+	n := bytes.IndexByte(b, 0)
+	if n < 0 {
+		return "", false
+	}
+
+	return strn(b, n), true
+}
+
 func (c *LDCache) parse() error {
 	var header Header1
 
@@ -137,7 +220,7 @@ func (c *LDCache) parse() error {
 		if err != nil {
 			return err
 		}
-		n = (-offset) & int64(unsafe.Alignof(c.header)-1)
+		n = (-offset) & int64(unsafe.Alignof(Entry2{})-1)
 		_, err = c.Seek(n, 1) // skip padding
 		if err != nil {
 			return err
@@ -151,60 +234,172 @@ func (c *LDCache) parse() error {
 	if c.Magic() != magicString2 || c.Version() != magicVersion {
 		return ErrInvalidCache
 	}
+	if c.header.Flags != endianUnset && c.header.Flags != endianLittle {
+		return ErrInvalidCache
+	}
 	c.entries = make([]Entry2, c.header.NLibs)
-	return binary.Read(c, binary.LittleEndian, &c.entries)
+	if err := binary.Read(c, binary.LittleEndian, &c.entries); err != nil {
+		return err
+	}
+
+	// 扩展段损坏时仍然可以使用缓存中的库, 只是无法得知glibc-hwcaps目录名
+	c.parseExtensions()
+
+	return nil
 }
 
+// parseExtensions reads extension sections, unlike entries all offsets in
+// extension are relative to the start of file as ldconfig reads them.
+func (c *LDCache) parseExtensions() {
+	offset := c.header.ExtensionOffset
+	if offset == 0 || uint64(offset)+8 > uint64(len(c.data)) {
+		return
+	}
+
+	r := bytes.NewReader(c.data[offset:])
+	var header extensionHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil || header.Magic != magicExtension {
+		return
+	}
+	if uint64(header.Count)*uint64(unsafe.Sizeof(extensionSection{})) > uint64(r.Len()) {
+		return
+	}
+	sections := make([]extensionSection, header.Count)
+	if err := binary.Read(r, binary.LittleEndian, &sections); err != nil {
+		return
+	}
+
+	for _, s := range sections {
+		if s.Tag != extensionTagHwcaps || s.Size%4 != 0 || uint64(s.Offset)+uint64(s.Size) > uint64(len(c.data)) {
+			continue
+		}
+		offsets := make([]uint32, s.Size/4)
+		if err := binary.Read(bytes.NewReader(c.data[s.Offset:s.Offset+s.Size]), binary.LittleEndian, &offsets); err != nil {
+			continue
+		}
+		c.hwcaps = make([]string, 0, len(offsets))
+		for _, o := range offsets {
+			name, _ := cstr(c.data, o)
+			c.hwcaps = append(c.hwcaps, name)
+		}
+	}
+}
+
+// hwcap returns the hwcap name of entry e, empty for the baseline library
+func (c *LDCache) hwcap(e Entry2) string {
+	switch {
+	case e.HWCap == 0:
+		return ""
+	case e.HWCap>>32 == hwcapExtension>>32:
+		if i := uint32(e.HWCap); i < uint32(len(c.hwcaps)) && len(c.hwcaps[i]) > 0 {
+			return "glibc-hwcaps/" + c.hwcaps[i]
+		}
+		return "glibc-hwcaps"
+	default:
+		return fmt.Sprintf("hwcap 0x%x", e.HWCap)
+	}
+}
+
+// Lookup returns libraries whose name starts with one of libs and can be
+// loaded on the host architecture, separated into 32 and 64 bit ones.
 func (c *LDCache) Lookup(libs ...string) (paths32, paths64 []string) {
-	type void struct{}
-	var paths *[]string
+	libs32, libs64 := c.lookup(libs...)
+
+	set := make(map[string]struct{})
+	resolve := func(libs []string) []string {
+		var paths []string
+		for _, lib := range libs {
+			path, err := filepath.EvalSymlinks(lib)
+			if err != nil {
+				continue
+			}
+			if _, ok := set[path]; ok {
+				continue
+			}
+			set[path] = struct{}{}
+			paths = append(paths, path)
+		}
+		return paths
+	}
+
+	return resolve(libs32), resolve(libs64)
+}
 
-	set := make(map[string]void)
-	prefix := make([][]byte, len(libs))
+// lookup returns cache entries matching libs without resolving them. If a
+// library exists in several hwcap levels, the baseline one is used because
+// mirrored libraries share one directory in container.
+func (c *LDCache) lookup(libs ...string) (paths32, paths64 []string) {
+	flags, ok := archTable[c.arch]
+	if !ok {
+		klog.Warningf("Unsupported architecture %s for ld.so.cache", c.arch)
+		return
+	}
+	bits := make(map[int32]int)
+	for _, f := range flags.lib32 {
+		bits[f] = 32
+	}
+	for _, f := range flags.lib64 {
+		bits[f] = 64
+	}
 
-	for i := range libs {
-		prefix[i] = []byte(libs[i])
+	type candidate struct {
+		bits  int
+		path  string
+		hwcap string
 	}
+	candidates := make([]*candidate, 0)
+	chosen := make(map[string]*candidate)
+
 	for _, e := range c.entries {
 		if ((e.Flags & flagTypeMask) & flagTypeELF) == 0 {
 			continue
 		}
-		switch e.Flags & flagArchMask {
-		case flagArchX8664:
-			fallthrough
-		case flagArchPpc64le:
-			paths = &paths64
-		case flagArchX32:
-			fallthrough
-		case flagArchI386:
-			paths = &paths32
-		default:
+		n, ok := bits[e.Flags&flagArchMask]
+		if !ok {
 			continue
 		}
-		if e.Key > uint32(len(c.libs)) || e.Value > uint32(len(c.libs)) {
+		lib, ok := c.str(e.Key)
+		if !ok || !hasAnyPrefix(lib, libs) {
 			continue
 		}
-		lib := c.libs[e.Key:]
-		value := c.libs[e.Value:]
-
-		for _, p := range prefix {
-			if bytes.HasPrefix(lib, p) {
-				n := bytes.IndexByte(value, 0)
-				if n < 0 {
-					break
-				}
-				path, err := filepath.EvalSymlinks(strn(value, n))
-				if err != nil {
-					break
-				}
-				if _, ok := set[path]; ok {
-					break
-				}
-				set[path] = void{}
-				*paths = append(*paths, path)
-				break
+		value, ok := c.str(e.Value)
+		if !ok {
+			continue
+		}
+
+		cand := &candidate{bits: n, path: value, hwcap: c.hwcap(e)}
+		key := fmt.Sprintf("%d/%s", n, lib)
+		if prev, ok := chosen[key]; ok {
+			// 同名的库优先使用不区分硬件能力的版本
+			if len(prev.hwcap) > 0 && len(cand.hwcap) == 0 {
+				klog.V(4).Infof("Prefer %s to %s(%s)", cand.path, prev.path, prev.hwcap)
+				*prev = *cand
+			} else {
+				klog.V(4).Infof("Skip %s(%s), use %s", cand.path, cand.hwcap, prev.path)
 			}
+			continue
 		}
+		chosen[key] = cand
+		candidates = append(candidates, cand)
 	}
+
+	for _, cand := range candidates {
+		if cand.bits == 32 {
+			paths32 = append(paths32, cand.path)
+		} else {
+			paths64 = append(paths64, cand.path)
+		}
+	}
+
 	return
 }
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,291 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package ldcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// amd64-hwcaps.cache is generated by ldconfig of glibc 2.36 from a root
+// containing libz in /usr/lib64 and /usr/lib64/glibc-hwcaps/x86-64-v3,
+// arm64.cache and ppc64le-compat.cache are generated by go test -update.
+// Caches of other architectures are generated by hack/ldcache-testdata.sh.
+// Each <cache>.ldconfig is the listing of ldconfig -p -C <cache> which
+// checks the parser against the decoder of glibc.
+var update = flag.Bool("update", false, "update generated caches in testdata")
+
+const flagELFLibc6 = 0x0003
+
+type testEntry struct {
+	flags      int32
+	key, value string
+	hwcap      uint64
+}
+
+type testCache struct {
+	entries []testEntry
+	hwcaps  []string
+	// compat prepends the old format header like ldconfig of glibc < 2.32
+	compat bool
+}
+
+var generatedCaches = map[string]testCache{
+	"arm64.cache": {
+		entries: []testEntry{
+			{flagELFLibc6 | flagArchAarch64, "libcuda.so.1", "/usr/lib/aarch64-linux-gnu/libcuda.so.1", 0},
+			{flagELFLibc6 | flagArchArmHF, "libcuda.so.1", "/usr/lib/arm-linux-gnueabihf/libcuda.so.1", 0},
+			{flagELFLibc6 | flagArchX8664, "libcuda.so.1", "/usr/lib/x86_64-linux-gnu/libcuda.so.1", 0},
+			{flagELFLibc6 | flagArchAarch64, "libnvidia-ml.so.1", "/usr/lib/aarch64-linux-gnu/libnvidia-ml.so.1", 0},
+		},
+	},
+	"ppc64le-compat.cache": {
+		entries: []testEntry{
+			{flagELFLibc6 | flagArchPpc64le, "libnvidia-ml.so.1", "/usr/lib64/glibc-hwcaps/power9/libnvidia-ml.so.1", hwcapExtension | 0},
+			{flagELFLibc6 | flagArchPpc64le, "libnvidia-ml.so.1", "/usr/lib64/libnvidia-ml.so.1", 0},
+			{flagELFLibc6 | flagArchPpc64le, "libcuda.so.1", "/usr/lib64/power8/libcuda.so.1", 0x10},
+		},
+		hwcaps: []string{"power9"},
+		compat: true,
+	},
+}
+
+func buildCache(tc testCache) []byte {
+	var strs bytes.Buffer
+	offsets := make(map[string]uint32)
+	base := uint32(binary.Size(Header2{}) + len(tc.entries)*binary.Size(Entry2{}))
+	str := func(s string) uint32 {
+		if o, ok := offsets[s]; ok {
+			return o
+		}
+		offsets[s] = base + uint32(strs.Len())
+		strs.WriteString(s)
+		strs.WriteByte(0)
+		return offsets[s]
+	}
+
+	entries := make([]Entry2, 0, len(tc.entries))
+	for _, e := range tc.entries {
+		entries = append(entries, Entry2{Flags: e.flags, Key: str(e.key), Value: str(e.value), HWCap: e.hwcap})
+	}
+	var buf bytes.Buffer
+	if tc.compat {
+		old := Header1{NLibs: uint32(len(entries))}
+		copy(old.Magic[:], magicString1)
+		binary.Write(&buf, binary.LittleEndian, old)
+		binary.Write(&buf, binary.LittleEndian, make([]Entry1, len(entries)))
+		for buf.Len()%8 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+
+	hwcaps := make([]uint32, 0, len(tc.hwcaps))
+	for _, h := range tc.hwcaps {
+		hwcaps = append(hwcaps, uint32(buf.Len())+str(h))
+	}
+	for strs.Len()%4 != 0 {
+		strs.WriteByte(0)
+	}
+
+	header := Header2{NLibs: uint32(len(entries)), TableSize: uint32(strs.Len()), Flags: endianLittle}
+	copy(header.Magic[:], magicString2)
+	copy(header.Version[:], magicVersion)
+	if len(hwcaps) > 0 {
+		header.ExtensionOffset = uint32(buf.Len()) + base + uint32(strs.Len())
+	}
+
+	binary.Write(&buf, binary.LittleEndian, header)
+	binary.Write(&buf, binary.LittleEndian, entries)
+	buf.Write(strs.Bytes())
+	if len(hwcaps) > 0 {
+		sectionOffset := header.ExtensionOffset + uint32(binary.Size(extensionHeader{})+binary.Size(extensionSection{}))
+		binary.Write(&buf, binary.LittleEndian, extensionHeader{Magic: magicExtension, Count: 1})
+		binary.Write(&buf, binary.LittleEndian, extensionSection{Tag: extensionTagHwcaps, Offset: sectionOffset, Size: uint32(len(hwcaps) * 4)})
+		binary.Write(&buf, binary.LittleEndian, hwcaps)
+	}
+
+	return buf.Bytes()
+}
+
+func TestGeneratedCaches(t *testing.T) {
+	for name, tc := range generatedCaches {
+		file := filepath.Join("testdata", name)
+		data := buildCache(tc)
+		if *update {
+			if err := os.WriteFile(file, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expect, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expect) {
+			t.Errorf("%s is outdated, run go test -update", file)
+		}
+	}
+}
+
+// ldconfigArch maps architecture flags to names printed by ldconfig -p
+var ldconfigArch = map[int32]string{
+	flagArchI386:    "",
+	flagArchX8664:   ",x86-64",
+	flagArchPpc64le: ",64bit",
+	flagArchX32:     ",x32",
+	flagArchArmHF:   ",hard-float",
+	flagArchAarch64: ",AArch64",
+	flagArchArmSF:   ",soft-float",
+}
+
+var ldconfigEntryRE = regexp.MustCompile(`^\t(\S+) \((.*)\) => (.*)$`)
+
+func TestLdconfigListing(t *testing.T) {
+	listings, err := filepath.Glob(filepath.Join("testdata", "*.cache.ldconfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listings) == 0 {
+		t.Fatal("no ldconfig listing in testdata")
+	}
+
+	for _, listing := range listings {
+		out, err := os.ReadFile(listing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := make([]string, 0)
+		for _, line := range strings.Split(string(out), "\n") {
+			if m := ldconfigEntryRE.FindStringSubmatch(line); m != nil {
+				expect = append(expect, m[1]+" ("+m[2]+") => "+m[3])
+			}
+		}
+		if len(expect) == 0 {
+			t.Errorf("%s has no entry", listing)
+		}
+
+		cache := strings.TrimSuffix(listing, ".ldconfig")
+		data, err := os.ReadFile(cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := newLDCache(data, "")
+		if err := c.parse(); err != nil {
+			t.Fatalf("%s: %v", cache, err)
+		}
+
+		entries := make([]string, 0, len(c.entries))
+		for _, e := range c.entries {
+			key, _ := c.str(e.Key)
+			value, _ := c.str(e.Value)
+			desc := "libc6" + ldconfigArch[e.Flags&flagArchMask]
+			switch hwcap := c.hwcap(e); {
+			case strings.HasPrefix(hwcap, "glibc-hwcaps/"):
+				desc += fmt.Sprintf(", hwcap: %q", strings.TrimPrefix(hwcap, "glibc-hwcaps/"))
+			case len(hwcap) > 0:
+				desc += fmt.Sprintf(", hwcap: 0x%016x", e.HWCap)
+			}
+			entries = append(entries, key+" ("+desc+") => "+value)
+		}
+
+		if !reflect.DeepEqual(entries, expect) {
+			t.Errorf("%s: expect %v, got %v", cache, expect, entries)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	testCases := []struct {
+		cache    string
+		arch     string
+		libs     []string
+		hwcaps   []string
+		expect32 []string
+		expect64 []string
+	}{
+		{
+			cache:    "amd64-hwcaps.cache",
+			arch:     "amd64",
+			libs:     []string{"libz.so"},
+			hwcaps:   []string{"x86-64-v3"},
+			expect64: []string{"/usr/lib64/libz.so.1"},
+		},
+		{
+			cache:    "amd64-hwcaps.cache",
+			arch:     "arm64",
+			libs:     []string{"libz.so"},
+			hwcaps:   []string{"x86-64-v3"},
+			expect64: nil,
+		},
+		{
+			cache:    "arm64.cache",
+			arch:     "arm64",
+			libs:     []string{"libcuda.so", "libnvidia-ml.so"},
+			expect32: []string{"/usr/lib/arm-linux-gnueabihf/libcuda.so.1"},
+			expect64: []string{"/usr/lib/aarch64-linux-gnu/libcuda.so.1", "/usr/lib/aarch64-linux-gnu/libnvidia-ml.so.1"},
+		},
+		{
+			cache:    "arm64.cache",
+			arch:     "amd64",
+			libs:     []string{"libcuda.so"},
+			expect64: []string{"/usr/lib/x86_64-linux-gnu/libcuda.so.1"},
+		},
+		{
+			cache:    "ppc64le-compat.cache",
+			arch:     "ppc64le",
+			libs:     []string{"libnvidia-ml.so", "libcuda.so"},
+			hwcaps:   []string{"power9"},
+			expect64: []string{"/usr/lib64/libnvidia-ml.so.1", "/usr/lib64/power8/libcuda.so.1"},
+		},
+	}
+
+	for _, tc := range testCases {
+		data, err := os.ReadFile(filepath.Join("testdata", tc.cache))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := newLDCache(data, tc.arch)
+		if err := c.parse(); err != nil {
+			t.Fatalf("%s: %v", tc.cache, err)
+		}
+
+		if hwcaps := c.Hwcaps(); !reflect.DeepEqual(hwcaps, tc.hwcaps) {
+			t.Errorf("%s: expect hwcaps %v, got %v", tc.cache, tc.hwcaps, hwcaps)
+		}
+		paths32, paths64 := c.lookup(tc.libs...)
+		if !reflect.DeepEqual(paths32, tc.expect32) || !reflect.DeepEqual(paths64, tc.expect64) {
+			t.Errorf("%s on %s: expect %v %v, got %v %v", tc.cache, tc.arch, tc.expect32, tc.expect64, paths32, paths64)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	data := buildCache(generatedCaches["arm64.cache"])
+	copy(data, "glibc-ld.so.cachX")
+	if err := newLDCache(data, "arm64").parse(); err != ErrInvalidCache {
+		t.Errorf("expect %v, got %v", ErrInvalidCache, err)
+	}
+}
@@ -0,0 +1,314 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package volume
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const manifestFileName = ".manifest.json"
+
+// Manifest records files mirrored into a volume directory
+type Manifest struct {
+	Volume        string          `json:"volume"`
+	Path          string          `json:"path"`
+	DriverVersion string          `json:"driverVersion,omitempty"`
+	Fingerprint   string          `json:"fingerprint"`
+	Files         []ManifestEntry `json:"files"`
+	VerifiedAt    time.Time       `json:"verifiedAt"`
+	Repaired      []string        `json:"repaired,omitempty"`
+	// Generation changes each time the manifest is written, capability
+	// views are created under the generation
+	Generation string `json:"generation,omitempty"`
+}
+
+// ManifestEntry describes a mirrored file
+type ManifestEntry struct {
+	// Name is the path relative to volume directory
+	Name     string   `json:"name"`
+	Source   string   `json:"source"`
+	Soname   string   `json:"soname,omitempty"`
+	ELFClass string   `json:"elfClass,omitempty"`
+	Size     int64    `json:"size"`
+	SHA256   string   `json:"sha256"`
+	Links    []string `json:"links,omitempty"`
+	// Capabilities are driver capabilities which need the file
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// VolumeStatus is reported by the volumes endpoint
+type VolumeStatus struct {
+	*Manifest
+	Drifted []string `json:"drifted,omitempty"`
+}
+
+// newManifest builds the manifest of volume directory dir, sources maps
+// absolute path of each mirrored file to its host file, tags maps driver
+// capability to components.
+func newManifest(volume, dir, version string, sources map[string]string, tags map[string][]string) (*Manifest, error) {
+	m := &Manifest{
+		Volume:        volume,
+		Path:          dir,
+		DriverVersion: version,
+		Files:         make([]ManifestEntry, 0),
+	}
+
+	links := make(map[string][]string)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(dir, p)
+
+		switch {
+		case d.IsDir() && name == viewsDir:
+			return filepath.SkipDir
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			target = filepath.Join(filepath.Dir(name), target)
+			links[target] = append(links[target], name)
+		case d.Type().IsRegular():
+			source, ok := sources[p]
+			if !ok {
+				return nil
+			}
+			entry, err := describe(source)
+			if err != nil {
+				return err
+			}
+			entry.Name = name
+			entry.Capabilities = capabilitiesOf(tags, name)
+
+			// 校验镜像的文件与宿主机文件是否一致
+			if err := entry.check(p); err != nil {
+				klog.Warningf("Mirrored file %s is broken, copy it again, %v", p, err)
+				if err := removeFile(p); err != nil {
+					return err
+				}
+				if err := fallbackCopy(source, p); err != nil {
+					return err
+				}
+				if err := entry.check(p); err != nil {
+					return err
+				}
+			}
+			m.Files = append(m.Files, *entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range m.Files {
+		m.Files[i].Links = links[m.Files[i].Name]
+		sort.Strings(m.Files[i].Links)
+	}
+	m.VerifiedAt = time.Now()
+
+	return m, nil
+}
+
+func readManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *Manifest) write() error {
+	m.Generation = strconv.FormatInt(time.Now().UnixNano(), 36)
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// 先写临时文件再重命名, 避免留下不完整的manifest
+	file := filepath.Join(m.Path, manifestFileName)
+	if err := os.WriteFile(file+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+// verify returns names of files which don't match the manifest
+func (m *Manifest) verify() []string {
+	drifted := make([]string, 0)
+
+	for _, entry := range m.Files {
+		if err := entry.check(filepath.Join(m.Path, entry.Name)); err != nil {
+			klog.V(4).Infof("Volume %s: %v", m.Path, err)
+			drifted = append(drifted, entry.Name)
+		}
+
+		for _, link := range entry.Links {
+			target, err := os.Readlink(filepath.Join(m.Path, link))
+			if err != nil || filepath.Join(filepath.Dir(link), target) != entry.Name {
+				drifted = append(drifted, link)
+			}
+		}
+	}
+
+	return drifted
+}
+
+// repair mirrors drifted or partial files again from their host files
+func (m *Manifest) repair() error {
+	drifted := m.verify()
+	if len(drifted) == 0 {
+		m.VerifiedAt = time.Now()
+		return nil
+	}
+
+	klog.Warningf("Volume %s has drifted files %v, repairing", m.Path, drifted)
+	for _, entry := range m.Files {
+		p := filepath.Join(m.Path, entry.Name)
+		if entry.check(p) != nil {
+			if err := removeFile(p); err != nil {
+				return err
+			}
+			if err := clone(entry.Source, p); err != nil {
+				return err
+			}
+			if err := entry.check(p); err != nil {
+				return err
+			}
+		}
+
+		for _, link := range entry.Links {
+			l := filepath.Join(m.Path, link)
+			if err := removeFile(l); err != nil {
+				return err
+			}
+			target, _ := filepath.Rel(filepath.Dir(link), entry.Name)
+			if err := os.Symlink(target, l); err != nil {
+				return err
+			}
+		}
+	}
+
+	m.Repaired = drifted
+	m.VerifiedAt = time.Now()
+
+	return m.write()
+}
+
+// check returns error if file p doesn't match size and digest of entry
+func (e *ManifestEntry) check(p string) error {
+	size, digest, err := fileDigest(p)
+	if err != nil {
+		return err
+	}
+
+	if size != e.Size || digest != e.SHA256 {
+		return fmt.Errorf("%s mismatch, size %d sha256 %s, expect size %d sha256 %s",
+			e.Name, size, digest, e.Size, e.SHA256)
+	}
+
+	return nil
+}
+
+// describe reads size, digest and ELF information of host file source
+func describe(source string) (*ManifestEntry, error) {
+	entry := &ManifestEntry{Source: source}
+
+	size, digest, err := fileDigest(source)
+	if err != nil {
+		return nil, err
+	}
+	entry.Size, entry.SHA256 = size, digest
+
+	obj, err := elf.Open(source)
+	if err != nil {
+		return entry, nil
+	}
+	defer obj.Close()
+
+	entry.ELFClass = obj.Class.String()
+	if soname, err := obj.DynString(elf.DT_SONAME); err == nil && len(soname) > 0 {
+		entry.Soname = soname[0]
+	}
+
+	return entry, nil
+}
+
+func fileDigest(p string) (int64, string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ServeHTTP reports manifests of volumes used by new containers,
+// files are verified again if query parameter verify is true.
+func (vm *VolumeManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	status := make([]VolumeStatus, 0, len(vm.manifests))
+	for _, m := range vm.manifests {
+		s := VolumeStatus{Manifest: m}
+		if r.URL.Query().Get("verify") == "true" {
+			s.Drifted = m.verify()
+		}
+		status = append(status, s)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Volume < status[j].Volume
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		klog.Errorf("Can not write volumes response, err %s", err)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package volume
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestRepair(t *testing.T) {
+	host, vol := t.TempDir(), t.TempDir()
+	source := filepath.Join(host, "libcuda.so.450.80")
+	if err := os.WriteFile(source, []byte("libcuda"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(vol, "lib64"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(vol, "lib64", "libcuda.so.450.80")
+	if err := fallbackCopy(source, target); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(vol, "lib64", "libcuda.so.1")
+	if err := os.Symlink("libcuda.so.450.80", link); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := newManifest("nvidia", vol, "450.80", map[string]string{target: source}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 1 || len(m.Files[0].Links) != 1 || m.Files[0].Links[0] != "lib64/libcuda.so.1" {
+		t.Fatalf("unexpected manifest %+v", m.Files)
+	}
+	if err := m.write(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟未完整拷贝的文件和被删除的软链
+	if err := os.WriteFile(target, []byte("lib"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = readManifest(vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drifted := m.verify(); len(drifted) != 2 {
+		t.Fatalf("expect 2 drifted files, got %v", drifted)
+	}
+	if err := m.repair(); err != nil {
+		t.Fatal(err)
+	}
+	if drifted := m.verify(); len(drifted) != 0 {
+		t.Errorf("expect no drifted file after repair, got %v", drifted)
+	}
+	if data, _ := os.ReadFile(link); string(data) != "libcuda" {
+		t.Errorf("unexpected content %q", data)
+	}
+}
@@ -24,8 +24,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"tkestack.io/gpu-manager/pkg/services/volume/ldcache"
 	"tkestack.io/gpu-manager/pkg/types"
@@ -35,6 +38,8 @@ import (
 
 // VolumeManager manages volumes used by containers running GPU application
 type VolumeManager struct {
+	sync.Mutex
+
 	Config  []Config `json:"volume,omitempty"`
 	cfgPath string
 
@@ -42,6 +47,13 @@ type VolumeManager struct {
 	cudaSoname      map[string]string
 	mlSoName        map[string]string
 	share           bool
+
+	refreshCommand string
+	// sources records the host file of each mirrored file
+	sources   map[string]string
+	manifests map[string]*Manifest
+	// unused records when garbage collection found each mirror directory unused
+	unused map[string]time.Time
 }
 
 type components map[string][]string
@@ -52,12 +64,17 @@ type Config struct {
 	Mode       string     `json:"mode,omitempty"`
 	Components components `json:"components,omitempty"`
 	BasePath   string     `json:"base,omitempty"`
+	// Capabilities tags components with driver capabilities, components
+	// without tag are mounted for every capability
+	Capabilities map[string][]string `json:"capabilities,omitempty"`
 }
 
 const (
 	binDir   = "bin"
 	lib32Dir = "lib"
 	lib64Dir = "lib64"
+	// configDir stores vendor files of Vulkan and EGL loaders
+	configDir = "share"
 )
 
 type volumeDir struct {
@@ -75,7 +92,7 @@ type Volume struct {
 type VolumeMap map[string]*Volume
 
 // NewVolumeManager returns a new VolumeManager
-func NewVolumeManager(config string, share bool) (*VolumeManager, error) {
+func NewVolumeManager(config string, share bool, refreshCommand string) (*VolumeManager, error) {
 	f, err := os.Open(config)
 	if err != nil {
 		return nil, err
@@ -84,10 +101,13 @@ func NewVolumeManager(config string, share bool) (*VolumeManager, error) {
 	defer f.Close()
 
 	volumeManager := &VolumeManager{
-		cfgPath:    filepath.Dir(config),
-		cudaSoname: make(map[string]string),
-		mlSoName:   make(map[string]string),
-		share:      share,
+		cfgPath:        filepath.Dir(config),
+		cudaSoname:     make(map[string]string),
+		mlSoName:       make(map[string]string),
+		share:          share,
+		refreshCommand: refreshCommand,
+		manifests:      make(map[string]*Manifest),
+		unused:         make(map[string]time.Time),
 	}
 
 	if err := json.NewDecoder(f).Decode(volumeManager); err != nil {
@@ -98,7 +118,23 @@ func NewVolumeManager(config string, share bool) (*VolumeManager, error) {
 }
 
 // Run starts a VolumeManager
-func (vm *VolumeManager) Run() (err error) {
+func (vm *VolumeManager) Run() error {
+	if err := vm.sync(); err != nil {
+		return err
+	}
+
+	klog.V(2).Infof("Volume manager is running")
+
+	return nil
+}
+
+// sync resolves components of volumes from ld.so.cache, mirrors them into
+// the directories of current driver version, then switches new containers
+// to those directories.
+func (vm *VolumeManager) sync() (err error) {
+	vm.Lock()
+	defer vm.Unlock()
+
 	cache, err := ldcache.Open()
 	if err != nil {
 		return err
@@ -111,16 +147,9 @@ func (vm *VolumeManager) Run() (err error) {
 	}()
 
 	vols := make(VolumeMap)
+	resolved := make([]string, 0)
 	for _, cfg := range vm.Config {
-		vol := &Volume{
-			Path: path.Join(cfg.BasePath, cfg.Name),
-		}
-
-		if cfg.Name == "nvidia" {
-			types.DriverLibraryPath = filepath.Join(cfg.BasePath, cfg.Name)
-		} else {
-			types.DriverOriginLibraryPath = filepath.Join(cfg.BasePath, cfg.Name)
-		}
+		vol := &Volume{}
 
 		for t, c := range cfg.Components {
 			switch t {
@@ -133,27 +162,175 @@ func (vm *VolumeManager) Run() (err error) {
 				klog.V(2).Infof("Find binaries: %+v", bins)
 
 				vol.dirs = append(vol.dirs, volumeDir{binDir, bins})
+				resolved = append(resolved, bins...)
 			case "libraries":
 				libs32, libs64 := cache.Lookup(c...)
 				klog.V(2).Infof("Find 32bit libraries: %+v", libs32)
 				klog.V(2).Infof("Find 64bit libraries: %+v", libs64)
 
 				vol.dirs = append(vol.dirs, volumeDir{lib32Dir, libs32}, volumeDir{lib64Dir, libs64})
+				resolved = append(resolved, libs32...)
+				resolved = append(resolved, libs64...)
+			case "configs":
+				configs := make([]string, 0)
+				for _, f := range c {
+					if _, err := os.Stat(f); err == nil {
+						configs = append(configs, f)
+					}
+				}
+
+				klog.V(2).Infof("Find configs: %+v", configs)
+
+				if len(configs) > 0 {
+					vol.dirs = append(vol.dirs, volumeDir{configDir, configs})
+				}
 			}
 
 			vols[cfg.Name] = vol
 		}
 	}
 
-	if err := vm.mirror(vols); err != nil {
+	driver := driverInfoFromFiles(resolved)
+	mirrors := make(VolumeMap)
+	manifests := make(map[string]*Manifest)
+	for _, cfg := range vm.Config {
+		p := volumePath(cfg, driver.Version)
+		if cfg.Name == "nvidia" {
+			driver.LibraryPath = p
+		} else {
+			driver.OriginLibraryPath = p
+		}
+
+		vol, ok := vols[cfg.Name]
+		if !ok {
+			continue
+		}
+		vol.Path = p
+		fingerprint := vm.fingerprint(cfg, vol)
+
+		// 驱动库没有变化时无需重新镜像
+		if m, ok := vm.manifests[cfg.Name]; ok && m.Path == p && m.Fingerprint == fingerprint {
+			manifests[cfg.Name] = m
+			continue
+		}
+
+		// 已有镜像时校验镜像文件, 修复被篡改或者复制不完整的文件
+		if m, err := readManifest(p); err == nil && m.Fingerprint == fingerprint {
+			if err := m.repair(); err == nil {
+				manifests[cfg.Name] = m
+				continue
+			} else {
+				klog.Warningf("Can not repair volume %s, mirror it again, err %s", p, err)
+			}
+		}
+
+		mirrors[cfg.Name] = vol
+	}
+
+	if len(mirrors) == 0 && types.GetDriverInfo() == driver {
+		klog.V(4).Infof("Driver libraries are not changed, skip mirroring")
+		vm.manifests = manifests
+		return nil
+	}
+
+	vm.cudaControlFile = ""
+	vm.cudaSoname = make(map[string]string)
+	vm.mlSoName = make(map[string]string)
+	vm.sources = make(map[string]string)
+	if err := vm.mirror(mirrors); err != nil {
 		return err
 	}
 
-	klog.V(2).Infof("Volume manager is running")
+	for _, cfg := range vm.Config {
+		vol, ok := mirrors[cfg.Name]
+		if !ok {
+			continue
+		}
+		m, err := newManifest(cfg.Name, vol.Path, driver.Version, vm.sources, cfg.Capabilities)
+		if err != nil {
+			return err
+		}
+		m.Fingerprint = vm.fingerprint(cfg, vol)
+		if err := m.write(); err != nil {
+			return err
+		}
+		manifests[cfg.Name] = m
+	}
+	vm.manifests = manifests
+
+	// 新创建的容器使用新镜像的目录，已运行的容器仍然使用旧目录
+	types.SetDriverInfo(driver)
+	klog.V(2).Infof("Driver version: %s, library path: %s, origin library path: %s",
+		driver.Version, driver.LibraryPath, driver.OriginLibraryPath)
 
 	return nil
 }
 
+// fingerprint identifies host files mirrored into vol
+func (vm *VolumeManager) fingerprint(cfg Config, vol *Volume) string {
+	files := make([]string, 0)
+	for _, d := range vol.dirs {
+		for _, f := range d.files {
+			files = append(files, d.name+"="+f)
+		}
+	}
+	if cfg.Name == "nvidia" {
+		files = append(files, fmt.Sprintf("share=%t", vm.share))
+	}
+	for c, components := range cfg.Capabilities {
+		files = append(files, fmt.Sprintf("capability=%s:%s", c, strings.Join(components, ",")))
+	}
+
+	return filesFingerprint(files)
+}
+
+// volumePath returns the mirror directory of volume cfg for driver version
+func volumePath(cfg Config, version string) string {
+	if len(version) == 0 {
+		return filepath.Join(cfg.BasePath, cfg.Name)
+	}
+
+	return filepath.Join(cfg.BasePath, cfg.Name+"-"+version)
+}
+
+func driverInfoFromFiles(files []string) types.DriverInfo {
+	driver := types.DriverInfo{}
+
+	for _, f := range files {
+		if strings.HasPrefix(path.Base(f), "libcuda.so.") {
+			driver.Version = strings.TrimPrefix(path.Base(f), "libcuda.so.")
+			driverStr := strings.SplitN(driver.Version, ".", 2)
+			driver.VersionMajor, _ = strconv.Atoi(driverStr[0])
+			if len(driverStr) > 1 {
+				driver.VersionMinor, _ = strconv.Atoi(driverStr[1])
+			}
+			break
+		}
+	}
+
+	return driver
+}
+
+func filesFingerprint(files []string) string {
+	sorted := make([]string, len(files))
+	copy(sorted, files)
+	sort.Strings(sorted)
+
+	var buf strings.Builder
+	for _, f := range sorted {
+		buf.WriteString(f)
+		if i := strings.Index(f, "="); i >= 0 {
+			f = f[i+1:]
+		}
+		if fi, err := os.Stat(f); err == nil {
+			buf.WriteString(fmt.Sprintf(":%d:%d", fi.Size(), fi.ModTime().UnixNano()))
+		}
+		buf.WriteString("\n")
+	}
+
+	return buf.String()
+}
+
 // #lizard forgives
 func (vm *VolumeManager) mirror(vols VolumeMap) error {
 	for driver, vol := range vols {
@@ -174,17 +351,16 @@ func (vm *VolumeManager) mirror(vols VolumeMap) error {
 			// ldconfig does since our volume will only show up at runtime.
 			for _, f := range d.files {
 				klog.V(2).Infof("Mirror %s to %s", f, vpath)
+				if d.name == configDir {
+					if err := vm.mirrorConfig(vpath, f); err != nil {
+						return err
+					}
+					continue
+				}
 				if err := vm.mirrorFiles(driver, vpath, f); err != nil {
 					return err
 				}
 
-				if strings.HasPrefix(path.Base(f), "libcuda.so") {
-					driverStr := strings.SplitN(strings.TrimPrefix(path.Base(f), "libcuda.so."), ".", 2)
-					types.DriverVersionMajor, _ = strconv.Atoi(driverStr[0])
-					types.DriverVersionMinor, _ = strconv.Atoi(driverStr[1])
-					klog.V(2).Infof("Driver version: %d.%d", types.DriverVersionMajor, types.DriverVersionMinor)
-				}
-
 				if strings.HasPrefix(path.Base(f), "libcuda-control.so") {
 					vm.cudaControlFile = f
 				}
@@ -201,6 +377,7 @@ func (vm *VolumeManager) mirror(vols VolumeMap) error {
 		if err := clone(vm.cudaControlFile, soFile); err != nil {
 			return err
 		}
+		vm.sources[soFile] = vm.cudaControlFile
 
 		klog.V(2).Infof("Vcuda %s to %s", vm.cudaControlFile, soFile)
 
@@ -213,6 +390,7 @@ func (vm *VolumeManager) mirror(vols VolumeMap) error {
 		if err := clone(vm.cudaControlFile, l); err != nil {
 			return err
 		}
+		vm.sources[l] = vm.cudaControlFile
 		klog.V(2).Infof("Vcuda %s to %s", vm.cudaControlFile, l)
 		return nil
 	}
@@ -263,6 +441,7 @@ func (vm *VolumeManager) mirrorFiles(driver, vpath string, file string) error {
 	if err := clone(file, l); err != nil {
 		return err
 	}
+	vm.sources[l] = file
 
 	soname, err := obj.DynString(elf.DT_SONAME)
 	if err != nil {
@@ -304,6 +483,32 @@ func (vm *VolumeManager) mirrorFiles(driver, vpath string, file string) error {
 	return nil
 }
 
+// mirrorConfig copies loader vendor file into vpath, keeping its directory
+// relative to the data directory, e.g. vulkan/icd.d/nvidia_icd.json
+func (vm *VolumeManager) mirrorConfig(vpath, file string) error {
+	name := filepath.Base(file)
+	for _, prefix := range []string{"/usr/local/share/", "/usr/share/", "/etc/"} {
+		if strings.HasPrefix(file, prefix) {
+			name = strings.TrimPrefix(file, prefix)
+			break
+		}
+	}
+
+	l := filepath.Join(vpath, name)
+	if err := os.MkdirAll(filepath.Dir(l), 0755); err != nil {
+		return err
+	}
+	if err := removeFile(l); err != nil {
+		return err
+	}
+	if err := fallbackCopy(file, l); err != nil {
+		return err
+	}
+	vm.sources[l] = file
+
+	return nil
+}
+
 func (v *Volume) exist() (bool, error) {
 	_, err := os.Stat(v.Path)
 	if os.IsNotExist(err) {
@@ -0,0 +1,287 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package volume
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"tkestack.io/gpu-manager/pkg/services/volume/ldcache"
+	"tkestack.io/gpu-manager/pkg/types"
+	"tkestack.io/gpu-manager/pkg/utils"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+)
+
+const (
+	driverVersionFile   = "/proc/driver/nvidia/version"
+	driverCheckPeriod   = 30 * time.Second
+	ldcacheSettlePeriod = 2 * time.Second
+	// gcGracePeriod is how long a mirror directory stays unused before it
+	// is removed, kubelet reports new containers some time after allocation
+	gcGracePeriod = 5 * time.Minute
+)
+
+var driverVersionRE = regexp.MustCompile(`\s(\d+\.\d+(?:\.\d+)?)\s`)
+
+// InUseFunc returns host paths referenced by running containers
+type InUseFunc func() sets.String
+
+// StartedBeforeFunc reports whether any running GPU pod was started before t
+type StartedBeforeFunc func(t time.Time) bool
+
+// allocations serializes picking mirror directories for new containers
+// with garbage collection, used records when each directory was last
+// given to a container
+var allocations = struct {
+	sync.Mutex
+	used map[string]time.Time
+}{used: make(map[string]time.Time)}
+
+// LockAllocation blocks garbage collection while the caller picks mirror
+// directories for a new container and records them with MarkInUse
+func LockAllocation() {
+	allocations.Lock()
+}
+
+// UnlockAllocation releases the lock taken by LockAllocation
+func UnlockAllocation() {
+	allocations.Unlock()
+}
+
+// MarkInUse records that a new container mounts path, the caller must hold
+// the allocation lock
+func MarkInUse(path string) {
+	allocations.used[path] = time.Now()
+}
+
+// WatchDriver re-mirrors volumes when ld.so.cache or the version of
+// loaded kernel driver changed, and removes mirror directories of old
+// drivers once no path returned by inUse references them for a grace
+// period. Unversioned directories of releases before driver upgrade
+// support are kept while startedBefore reports pods which may mount them.
+func (vm *VolumeManager) WatchDriver(inUse InUseFunc, startedBefore StartedBeforeFunc, stopChan <-chan struct{}) {
+	watcher, err := utils.NewFSWatcher(filepath.Dir(ldcache.Path))
+	if err != nil {
+		klog.Errorf("Can not watch %s, driver upgrade will not be detected, err %s", ldcache.Path, err)
+		return
+	}
+	defer watcher.Close()
+
+	ticker := time.NewTicker(driverCheckPeriod)
+	defer ticker.Stop()
+
+	// ldconfig会先写临时文件再重命名, 等待文件稳定后再重新镜像
+	settle := time.NewTimer(ldcacheSettlePeriod)
+	settle.Stop()
+	defer settle.Stop()
+
+	lastVersion := readDriverVersion()
+	for {
+		select {
+		case event := <-watcher.Events:
+			if event.Name == ldcache.Path && event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) != 0 {
+				klog.V(4).Infof("inotify: %s %s", event.Name, event.Op)
+				settle.Reset(ldcacheSettlePeriod)
+			}
+		case err := <-watcher.Errors:
+			klog.Warningf("inotify: %s", err)
+		case <-settle.C:
+			vm.resync(inUse, startedBefore)
+		case <-ticker.C:
+			version := readDriverVersion()
+			if version != lastVersion {
+				klog.Infof("Driver version changed from %q to %q", lastVersion, version)
+				lastVersion = version
+				vm.refresh()
+			}
+			vm.resync(inUse, startedBefore)
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// refresh runs the refresh command which rebuilds ld.so.cache for the new driver
+func (vm *VolumeManager) refresh() {
+	if len(vm.refreshCommand) == 0 {
+		return
+	}
+
+	klog.V(2).Infof("Run driver refresh command: %s", vm.refreshCommand)
+	if out, err := exec.Command("sh", "-c", vm.refreshCommand).CombinedOutput(); err != nil {
+		klog.Errorf("Driver refresh command failed, %s, %v", out, err)
+	}
+}
+
+func (vm *VolumeManager) resync(inUse InUseFunc, startedBefore StartedBeforeFunc) {
+	if err := vm.sync(); err != nil {
+		klog.Errorf("Can not mirror driver volumes, err %s", err)
+		return
+	}
+
+	vm.garbageCollect(inUse(), startedBefore, time.Now())
+}
+
+// garbageCollect removes mirror directories and capability views of old
+// manifest generations which have been neither used by new containers nor
+// referenced by running containers for gcGracePeriod.
+func (vm *VolumeManager) garbageCollect(inUse sets.String, startedBefore StartedBeforeFunc, now time.Time) {
+	vm.Lock()
+	defer vm.Unlock()
+	// 持有分配锁, 避免删除正在分配给新容器的目录
+	allocations.Lock()
+	defer allocations.Unlock()
+
+	if vm.unused == nil {
+		vm.unused = make(map[string]time.Time)
+	}
+
+	// 新容器在kubelet记录之前不在inUse中, 保留最近分配过的目录
+	inUse = sets.NewString(inUse.UnsortedList()...)
+	for p, t := range allocations.used {
+		if now.Sub(t) > gcGracePeriod {
+			delete(allocations.used, p)
+			continue
+		}
+		inUse.Insert(p)
+	}
+
+	driver := types.GetDriverInfo()
+	current := sets.NewString(driver.LibraryPath, driver.OriginLibraryPath)
+	found := sets.NewString()
+
+	for _, cfg := range vm.Config {
+		entries, err := os.ReadDir(cfg.BasePath)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() || (entry.Name() != cfg.Name && !strings.HasPrefix(entry.Name(), cfg.Name+"-")) {
+				continue
+			}
+
+			dir := filepath.Join(cfg.BasePath, entry.Name())
+			found.Insert(dir)
+			if current.Has(dir) || referenced(dir, inUse) {
+				delete(vm.unused, dir)
+				vm.collectViews(dir, inUse, now, found)
+				continue
+			}
+
+			if !vm.expired(dir, now) {
+				continue
+			}
+
+			// 升级前启动的容器可能挂载了不带版本号的旧目录
+			if entry.Name() == cfg.Name && startedBefore(vm.unused[dir]) {
+				klog.V(4).Infof("Keep legacy driver volume %s, pods started before upgrade are running", dir)
+				continue
+			}
+
+			vm.remove(dir)
+		}
+	}
+
+	for dir := range vm.unused {
+		if !found.Has(dir) {
+			delete(vm.unused, dir)
+		}
+	}
+}
+
+// collectViews removes capability views of volume dir which don't belong to
+// the current manifest generation and are not referenced by inUse.
+func (vm *VolumeManager) collectViews(dir string, inUse sets.String, now time.Time, found sets.String) {
+	m, err := readManifest(dir)
+	if err != nil || len(m.Generation) == 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, viewsDir))
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		view := filepath.Join(dir, viewsDir, entry.Name())
+		found.Insert(view)
+		if entry.Name() == m.Generation || referenced(view, inUse) {
+			delete(vm.unused, view)
+			continue
+		}
+
+		if vm.expired(view, now) {
+			vm.remove(view)
+		}
+	}
+}
+
+// expired reports whether dir has been unused for gcGracePeriod, the grace
+// period of dir starts at the first call.
+func (vm *VolumeManager) expired(dir string, now time.Time) bool {
+	since, ok := vm.unused[dir]
+	if !ok {
+		klog.V(2).Infof("Driver volume %s is unused, remove it after %s", dir, gcGracePeriod)
+		vm.unused[dir] = now
+		return false
+	}
+
+	return now.Sub(since) >= gcGracePeriod
+}
+
+func (vm *VolumeManager) remove(dir string) {
+	klog.V(2).Infof("Remove unused driver volume %s", dir)
+	if err := os.RemoveAll(dir); err != nil {
+		klog.Warningf("Can not remove %s, err %s", dir, err)
+		return
+	}
+	delete(vm.unused, dir)
+}
+
+func referenced(dir string, inUse sets.String) bool {
+	for p := range inUse {
+		if p == dir || strings.HasPrefix(p, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func readDriverVersion() string {
+	data, err := os.ReadFile(driverVersionFile)
+	if err != nil {
+		return ""
+	}
+
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	if m := driverVersionRE.FindStringSubmatch(line + " "); m != nil {
+		return m[1]
+	}
+
+	return ""
+}
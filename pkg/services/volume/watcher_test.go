@@ -0,0 +1,133 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package volume
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tkestack.io/gpu-manager/pkg/types"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestDriverInfoFromFiles(t *testing.T) {
+	driver := driverInfoFromFiles([]string{
+		"/usr/lib64/libnvidia-ml.so.418.67",
+		"/usr/lib64/libcuda.so.418.67",
+	})
+
+	if driver.Version != "418.67" || driver.VersionMajor != 418 || driver.VersionMinor != 67 {
+		t.Errorf("unexpected driver info %+v", driver)
+	}
+
+	if path := volumePath(Config{Name: "nvidia", BasePath: "/vdriver"}, driver.Version); path != "/vdriver/nvidia-418.67" {
+		t.Errorf("unexpected volume path %s", path)
+	}
+}
+
+func TestGarbageCollect(t *testing.T) {
+	base := t.TempDir()
+	for _, dir := range []string{"nvidia", "nvidia-390.12", "nvidia-418.67", "nvidia-440.33", "nvidia-450.80", "origin-450.80", "other"} {
+		if err := os.MkdirAll(filepath.Join(base, dir, "lib64"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vm := &VolumeManager{
+		Config: []Config{
+			{Name: "nvidia", BasePath: base},
+			{Name: "origin", BasePath: base},
+		},
+	}
+	types.SetDriverInfo(types.DriverInfo{
+		LibraryPath:       filepath.Join(base, "nvidia-450.80"),
+		OriginLibraryPath: filepath.Join(base, "origin-450.80"),
+	})
+	defer types.SetDriverInfo(types.DriverInfo{})
+
+	// 当前驱动目录中只保留当前generation和被容器引用的视图
+	current := &Manifest{Volume: "nvidia", Path: filepath.Join(base, "nvidia-450.80")}
+	if err := current.write(); err != nil {
+		t.Fatal(err)
+	}
+	for _, view := range []string{current.Generation, "old", "mounted"} {
+		if err := os.MkdirAll(filepath.Join(current.Path, viewsDir, view, "compute"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 分配中的容器还没有被kubelet记录
+	LockAllocation()
+	MarkInUse(filepath.Join(base, "nvidia-440.33", viewsDir))
+	UnlockAllocation()
+
+	inUse := sets.NewString(filepath.Join(base, "nvidia-418.67"),
+		filepath.Join(current.Path, viewsDir, "mounted", "compute"))
+	legacyPods := true
+	startedBefore := func(time.Time) bool { return legacyPods }
+	check := func(round string, expect map[string]bool) {
+		for dir, exist := range expect {
+			_, err := os.Stat(filepath.Join(base, dir))
+			if exist != (err == nil) {
+				t.Errorf("%s: %s expect exist %t, got err %v", round, dir, exist, err)
+			}
+		}
+	}
+
+	now := time.Now()
+	vm.garbageCollect(inUse, startedBefore, now)
+	check("unused", map[string]bool{
+		"nvidia":        true,
+		"nvidia-390.12": true,
+		"nvidia-418.67": true,
+		"nvidia-440.33": true,
+		"nvidia-450.80": true,
+		"origin-450.80": true,
+		"other":         true,
+	})
+
+	now = now.Add(gcGracePeriod + time.Second)
+	vm.garbageCollect(inUse, startedBefore, now)
+	check("grace period", map[string]bool{
+		filepath.Join("nvidia-450.80", viewsDir, current.Generation): true,
+		filepath.Join("nvidia-450.80", viewsDir, "old"):              false,
+		filepath.Join("nvidia-450.80", viewsDir, "mounted"):          true,
+		"nvidia":        true,
+		"nvidia-390.12": false,
+		"nvidia-418.67": true,
+		"nvidia-440.33": true,
+		"nvidia-450.80": true,
+		"origin-450.80": true,
+		"other":         true,
+	})
+
+	legacyPods = false
+	now = now.Add(gcGracePeriod + time.Second)
+	vm.garbageCollect(inUse, startedBefore, now)
+	check("legacy pods exited", map[string]bool{
+		"nvidia":        false,
+		"nvidia-418.67": true,
+		"nvidia-440.33": false,
+		"nvidia-450.80": true,
+		"origin-450.80": true,
+		"other":         true,
+	})
+}
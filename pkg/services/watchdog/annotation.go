@@ -4,23 +4,41 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"reflect"
+	"sync"
+	"time"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	apitypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/klog"
-	"strconv"
-	"time"
 	"tkestack.io/gpu-manager/pkg/config"
-	"tkestack.io/gpu-manager/pkg/device/nvidia"
-	"tkestack.io/gpu-manager/pkg/types"
+	"tkestack.io/gpu-manager/pkg/device"
 	"tkestack.io/gpu-manager/pkg/utils"
 )
 
+// allocationSource provides allocation state of devices
+type allocationSource interface {
+	Changes() <-chan struct{}
+	LeafStates() []device.LeafState
+}
+
+// deviceSource provides static information and health of devices
+type deviceSource interface {
+	Devices() []DeviceStatus
+	// Changes returns a new channel notified when devices or their health changed
+	Changes() <-chan struct{}
+}
+
 type nodeAnnotator struct {
-	config *config.Config
-	client v1core.CoreV1Interface
+	config     *config.Config
+	client     v1core.CoreV1Interface
+	devices    deviceSource
+	allocation allocationSource
+
+	// published are annotations patched successfully last time
+	published map[string]string
 }
 
 type GPUInfo struct {
@@ -33,91 +51,325 @@ type GPUInfo struct {
 	Health     bool   `json:"health"`
 }
 
-func NewNodeAnnotator(client v1core.CoreV1Interface, config *config.Config) *nodeAnnotator {
+// DeviceState is the versioned document of NodeAnnotationDeviceState
+type DeviceState struct {
+	Version string         `json:"version"`
+	Devices []DeviceStatus `json:"devices"`
+}
+
+// DeviceStatus contains information and allocatable resource of a device,
+// memory is in unit of the configured memory block size with scaling applied.
+type DeviceStatus struct {
+	GPUInfo
+	Index             int      `json:"index"`
+	AllocatableCore   int64    `json:"allocatableCore"`
+	AllocatableMemory int64    `json:"allocatableMemory"`
+	Reasons           []string `json:"reasons,omitempty"`
+	// Pool is the name of pool containing the device
+	Pool string `json:"pool,omitempty"`
+}
+
+// NewNodeAnnotator returns a new nodeAnnotator which publishes devices and
+// allocation state of tree.
+func NewNodeAnnotator(client v1core.CoreV1Interface, config *config.Config, tree device.GPUTree) *nodeAnnotator {
 	klog.V(2).Infof("Annotator for hostname %s", config.Hostname)
-	return &nodeAnnotator{
-		config: config,
-		client: client,
+	annotator := &nodeAnnotator{
+		config:     config,
+		client:     client,
+		devices:    deviceSourceOf(tree, config),
+		allocation: tree,
 	}
+
+	return annotator
 }
 
 const (
 	NodeAnnotationHeartbeat      = "tydic.io/node-gpu-heartbeat"
 	NodeAnnotationDeviceRegister = "tydic.io/nvidia-device-register"
+	// NodeAnnotationDeviceState contains DeviceState of the node
+	NodeAnnotationDeviceState = "tydic.io/nvidia-device-state"
+
+	DeviceStateVersion = "v1"
+
+	ReasonPendingReset = "PendingReset"
+	ReasonReserved     = "Reserved"
+
+	defaultHeartbeatPeriod = 30 * time.Second
 )
 
-// TODO 开启协程异步 更新节点注解 心跳、检测设备是否开启mig 每30秒执行一次
-func (nl *nodeAnnotator) Run() error {
-	go wait.UntilWithContext(context.Background(), func(ctx context.Context) {
-		annotations := nl.getMigAnnotations()
-		annotations[NodeAnnotationHeartbeat] = fmt.Sprintf("%d", time.Now().UnixNano())
-		patch := utils.NewPatchAnnotation(annotations)
-		bytes, err := json.Marshal(patch)
-		if err != nil {
-			klog.Errorf("JSON serialization failed: %v", err)
-			return
+// Run starts the heartbeat and publishes device state once devices or
+// their allocation changed until stopChan is closed
+func (nl *nodeAnnotator) Run(stopChan <-chan struct{}) error {
+	period := nl.config.HeartbeatPeriod
+	if period <= 0 {
+		period = defaultHeartbeatPeriod
+	}
+	go wait.UntilWithContext(wait.ContextForChannel(stopChan), func(ctx context.Context) {
+		annotations := map[string]string{
+			NodeAnnotationHeartbeat: fmt.Sprintf("%d", time.Now().UnixNano()),
 		}
-		_, err = nl.client.Nodes().Patch(ctx, nl.config.Hostname, apitypes.StrategicMergePatchType, bytes, metav1.PatchOptions{})
-		if err != nil {
+		if err := nl.patch(ctx, annotations); err != nil {
 			klog.V(2).Infof("patch node annotations heartbeat error, %v", err)
 		}
-	}, 30*time.Second)
+	}, period)
+
+	go nl.watch(stopChan)
+
 	klog.V(2).Infof("Auto annotator is running")
 	return nil
 }
 
-func (nl *nodeAnnotator) getMigAnnotations() map[string]string {
+func (nl *nodeAnnotator) watch(stopChan <-chan struct{}) {
+	// 设备健康状态变化由健康检查通知, 分配变化则由tree通知
+	health := nl.devices.Changes()
+	var changes <-chan struct{}
+	if nl.allocation != nil {
+		changes = nl.allocation.Changes()
+	}
+
+	for {
+		nl.publish(context.Background())
+
+		select {
+		case <-health:
+		case <-changes:
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// publish patches device annotations if they are changed since last time
+func (nl *nodeAnnotator) publish(ctx context.Context) {
+	annotations := nl.deviceAnnotations()
+	if reflect.DeepEqual(annotations, nl.published) {
+		klog.V(4).Infof("Device annotations are not changed, skip patching")
+		return
+	}
+
+	if err := nl.patch(ctx, annotations); err != nil {
+		klog.Warningf("patch node device annotations error, %v", err)
+		return
+	}
+	nl.published = annotations
+	klog.V(2).Infof("Publish device state %s", annotations[NodeAnnotationDeviceState])
+}
+
+func (nl *nodeAnnotator) patch(ctx context.Context, annotations map[string]string) error {
+	bytes, err := json.Marshal(utils.NewPatchAnnotation(annotations))
+	if err != nil {
+		return err
+	}
+	_, err = nl.client.Nodes().Patch(ctx, nl.config.Hostname, apitypes.StrategicMergePatchType, bytes, metav1.PatchOptions{})
+
+	return err
+}
+
+func (nl *nodeAnnotator) deviceAnnotations() map[string]string {
+	state := nl.deviceState()
+
+	// 保留旧的注解格式, 兼容旧版本的gpu-admission
+	gpuInfos := make([]GPUInfo, 0, len(state.Devices))
+	for _, dev := range state.Devices {
+		info := dev.GPUInfo
+		// 旧格式没有资源池, 预留的设备标记为不健康避免被调度
+		if nl.config.IsReserved(dev.Index, dev.Id) {
+			info.Health = false
+		}
+		gpuInfos = append(gpuInfos, info)
+	}
+
 	annotations := make(map[string]string)
-	if rs := nvml.Init(); rs != nvml.SUCCESS {
-		klog.Warningf("Can't initialize nvml library, %s", nvml.ErrorString(rs))
-	}
-	defer nvml.Shutdown()
-	count, rs := nvml.DeviceGetCount()
-	if rs != nvml.SUCCESS {
-		klog.Warningf("Can't get device count, %s", nvml.ErrorString(rs))
-	}
-	gpuInfos := make([]GPUInfo, count)
-	for index := 0; index < count; index++ {
-		gpuInfo := GPUInfo{Health: true}
-		dev, r := nvml.DeviceGetHandleByIndex(index)
-		if r != nvml.SUCCESS {
-			gpuInfo.Health = false
-			gpuInfos[index] = gpuInfo
-			continue
+	if bytes, err := json.Marshal(gpuInfos); err != nil {
+		annotations[NodeAnnotationDeviceRegister] = "[]"
+	} else {
+		annotations[NodeAnnotationDeviceRegister] = string(bytes)
+	}
+	if bytes, err := json.Marshal(state); err == nil {
+		annotations[NodeAnnotationDeviceState] = string(bytes)
+	}
+
+	return annotations
+}
+
+// deviceState merges allocation state of tree into device information
+func (nl *nodeAnnotator) deviceState() *DeviceState {
+	return mergeDeviceState(nl.devices.Devices(), leafStates(nl.allocation), nl.config)
+}
+
+// leafStates returns allocation state of leaves keyed by UUID
+func leafStates(allocation allocationSource) map[string]device.LeafState {
+	leaves := make(map[string]device.LeafState)
+	if allocation != nil {
+		for _, leaf := range allocation.LeafStates() {
+			leaves[leaf.UUID] = leaf
 		}
-		name, r := dev.GetName()
-		if r != nvml.SUCCESS {
-			gpuInfo.Health = false
+	}
+
+	return leaves
+}
+
+func mergeDeviceState(devices []DeviceStatus, leaves map[string]device.LeafState, cfg *config.Config) *DeviceState {
+	state := &DeviceState{
+		Version: DeviceStateVersion,
+		Devices: devices,
+	}
+
+	for i := range state.Devices {
+		dev := &state.Devices[i]
+		pool := cfg.PoolOf(dev.Index, dev.Id)
+		if pool != nil {
+			dev.Pool = pool.Name
 		}
-		memInfo, r := dev.GetMemoryInfo_v2()
-		if r != nvml.SUCCESS {
-			gpuInfo.Health = false
+		if !dev.Health {
+			dev.AllocatableCore, dev.AllocatableMemory = 0, 0
+			continue
 		}
-		uuid, r := dev.GetUUID()
-		if r != nvml.SUCCESS {
-			gpuInfo.Health = false
+		// 预留的设备不可分配
+		if pool != nil && pool.Mode == config.PoolReserved {
+			dev.AllocatableCore, dev.AllocatableMemory = 0, 0
+			dev.Reasons = append(dev.Reasons, ReasonReserved)
+			continue
 		}
-		if !gpuInfo.Health {
-			gpuInfos[index] = gpuInfo
+
+		dev.AllocatableCore, dev.AllocatableMemory = int64(dev.Core), dev.Memory
+		leaf, ok := leaves[dev.Id]
+		if !ok {
 			continue
 		}
-		major, minor, _ := dev.GetCudaComputeCapability()
-		level := fmt.Sprintf("%d%d", major, minor)
-		if capability, err := strconv.Atoi(level); err == nil {
-			gpuInfo.Capability = capability
+		// 显存按缩放后的总量扣除已分配的部分
+		used := (leaf.MemoryCapacity - leaf.AllocatableMemory) / cfg.GetMemoryBlockSize()
+		dev.AllocatableCore = leaf.AllocatableCores
+		dev.AllocatableMemory = dev.Memory - used
+		if dev.AllocatableMemory < 0 {
+			dev.AllocatableMemory = 0
+		}
+		if leaf.PendingReset {
+			dev.Reasons = append(dev.Reasons, ReasonPendingReset)
 		}
-		totalMemory := int64(nl.config.DeviceMemoryScaling * float64(memInfo.Total))
-		gpuInfo.Id = uuid
-		gpuInfo.Type = name
-		gpuInfo.Core = 100
-		gpuInfo.Memory = totalMemory / types.MemoryBlockSize
-		gpuInfo.IsMig = nvidia.IsMig(index)
-		gpuInfos[index] = gpuInfo
 	}
-	if bytes, err := json.Marshal(gpuInfos); err != nil {
-		annotations[NodeAnnotationDeviceRegister] = "[]"
-	} else {
-		annotations[NodeAnnotationDeviceRegister] = string(bytes)
+
+	return state
+}
+
+// treeDeviceSource converts devices of the tree into DeviceStatus with
+// memory scaling and overcommit ratios applied. Devices are probed once and
+// cached, the health monitor probes them again on each health check and
+// notifies watchers if they changed.
+type treeDeviceSource struct {
+	tree   device.GPUTree
+	config *config.Config
+
+	lock     sync.Mutex
+	probed   bool
+	infos    []device.DeviceInfo
+	err      error
+	watchers []chan struct{}
+}
+
+var deviceSources = struct {
+	sync.Mutex
+	sources map[device.GPUTree]*treeDeviceSource
+}{sources: make(map[device.GPUTree]*treeDeviceSource)}
+
+// deviceSourceOf returns the device source shared by watchers of tree, so
+// that the vendor library is not initialized by each of them
+func deviceSourceOf(tree device.GPUTree, cfg *config.Config) *treeDeviceSource {
+	deviceSources.Lock()
+	defer deviceSources.Unlock()
+
+	s, ok := deviceSources.sources[tree]
+	if !ok {
+		s = &treeDeviceSource{tree: tree, config: cfg}
+		deviceSources.sources[tree] = s
 	}
-	return annotations
+
+	return s
+}
+
+func (s *treeDeviceSource) Devices() []DeviceStatus {
+	devices, err := s.Cached()
+	if err != nil {
+		klog.Warningf("%v", err)
+		return []DeviceStatus{}
+	}
+
+	return devices
+}
+
+// Cached returns devices of the last probe, devices are probed if they
+// have never been probed
+func (s *treeDeviceSource) Cached() ([]DeviceStatus, error) {
+	s.lock.Lock()
+	probed, infos, err := s.probed, s.infos, s.err
+	s.lock.Unlock()
+
+	if !probed {
+		return s.Probe()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.convert(infos), nil
+}
+
+// Probe returns devices discovered by the tree, error is returned if the
+// underlying library can't be initialized or devices can't be counted.
+// Watchers are notified if devices or their health changed.
+func (s *treeDeviceSource) Probe() ([]DeviceStatus, error) {
+	infos, err := s.tree.Probe()
+
+	s.lock.Lock()
+	changed := !s.probed || !reflect.DeepEqual(infos, s.infos) || (err == nil) != (s.err == nil)
+	s.probed, s.infos, s.err = true, infos, err
+	if changed {
+		for _, w := range s.watchers {
+			select {
+			case w <- struct{}{}:
+			default:
+			}
+		}
+	}
+	s.lock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.convert(infos), nil
+}
+
+// Changes returns a new channel notified when probed devices changed
+func (s *treeDeviceSource) Changes() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	w := make(chan struct{}, 1)
+	s.watchers = append(s.watchers, w)
+
+	return w
+}
+
+func (s *treeDeviceSource) convert(infos []device.DeviceInfo) []DeviceStatus {
+	devices := make([]DeviceStatus, 0, len(infos))
+	for _, info := range infos {
+		status := DeviceStatus{
+			Index:   info.Index,
+			Reasons: info.Reasons,
+			GPUInfo: GPUInfo{Health: info.Healthy},
+		}
+		if info.Healthy {
+			status.Id = info.UUID
+			status.Type = info.Model
+			cores, memory := s.config.OvercommitOf(info.Index, info.UUID)
+			status.Core = int(config.Overcommitted(device.HundredCore, cores))
+			status.Memory = int64(s.config.DeviceMemoryScaling*float64(config.Overcommitted(int64(info.TotalMemory), memory))) / s.config.GetMemoryBlockSize()
+			status.IsMig = info.MIG
+			status.Capability = info.Capability
+		}
+		devices = append(devices, status)
+	}
+
+	return devices
 }
@@ -0,0 +1,240 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package watchdog
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"tkestack.io/gpu-manager/pkg/config"
+	"tkestack.io/gpu-manager/pkg/device"
+	"tkestack.io/gpu-manager/pkg/device/dummy"
+	"tkestack.io/gpu-manager/pkg/device/nvidia"
+	"tkestack.io/gpu-manager/pkg/types"
+)
+
+type fakeDeviceSource []DeviceStatus
+
+func (s fakeDeviceSource) Devices() []DeviceStatus {
+	devices := make([]DeviceStatus, len(s))
+	copy(devices, s)
+	return devices
+}
+
+func (s fakeDeviceSource) Changes() <-chan struct{} {
+	return nil
+}
+
+type fakeAllocationSource struct {
+	changes chan struct{}
+	leaves  []nvidia.LeafState
+}
+
+func (s *fakeAllocationSource) Changes() <-chan struct{} {
+	return s.changes
+}
+
+func (s *fakeAllocationSource) LeafStates() []nvidia.LeafState {
+	return s.leaves
+}
+
+func TestNodeAnnotatorPublish(t *testing.T) {
+	nodeName := "testnode"
+	k8sclient := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}})
+
+	const gib = 1024 * 1024 * 1024
+	allocation := &fakeAllocationSource{
+		changes: make(chan struct{}, 1),
+		leaves: []nvidia.LeafState{
+			{Index: 0, UUID: "GPU-0", TotalMemory: 16 * gib, CoreCapacity: 100, MemoryCapacity: 16 * gib, AllocatableCores: 70, AllocatableMemory: 12 * gib},
+			{Index: 1, UUID: "GPU-1", TotalMemory: 16 * gib, CoreCapacity: 100, MemoryCapacity: 16 * gib, AllocatableCores: 100, AllocatableMemory: 16 * gib, PendingReset: true},
+		},
+	}
+	annotator := &nodeAnnotator{
+		config: &config.Config{Hostname: nodeName},
+		client: k8sclient.CoreV1(),
+		devices: fakeDeviceSource{
+			{Index: 0, GPUInfo: GPUInfo{Id: "GPU-0", Core: 100, Memory: 16 * gib / types.MemoryBlockSize, Health: true}},
+			{Index: 1, GPUInfo: GPUInfo{Id: "GPU-1", Core: 100, Memory: 16 * gib / types.MemoryBlockSize, Health: true}},
+			{Index: 2, GPUInfo: GPUInfo{Health: false}, Reasons: []string{"DeviceGetUUID: Unknown Error"}},
+		},
+		allocation: allocation,
+	}
+
+	patches := func() int {
+		n := 0
+		for _, action := range k8sclient.Actions() {
+			if action.GetVerb() == "patch" {
+				n++
+			}
+		}
+		return n
+	}
+
+	annotator.publish(context.Background())
+	node, _ := k8sclient.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+	state := &DeviceState{}
+	if err := json.Unmarshal([]byte(node.Annotations[NodeAnnotationDeviceState]), state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != DeviceStateVersion || len(state.Devices) != 3 {
+		t.Fatalf("unexpected device state %+v", state)
+	}
+	expect := []struct {
+		core, memory int64
+		reasons      int
+	}{
+		{70, 12 * 1024, 0},
+		{100, 16 * 1024, 1},
+		{0, 0, 1},
+	}
+	for i, e := range expect {
+		dev := state.Devices[i]
+		if dev.AllocatableCore != e.core || dev.AllocatableMemory != e.memory || len(dev.Reasons) != e.reasons {
+			t.Errorf("device %d expect %+v, got %+v", i, e, dev)
+		}
+	}
+	if _, ok := node.Annotations[NodeAnnotationDeviceRegister]; !ok {
+		t.Errorf("legacy annotation %s is missing", NodeAnnotationDeviceRegister)
+	}
+
+	// 状态没有变化时不再patch节点
+	annotator.publish(context.Background())
+	if n := patches(); n != 1 {
+		t.Errorf("expect 1 patch, got %d", n)
+	}
+
+	allocation.leaves[0].AllocatableCores = 100
+	annotator.publish(context.Background())
+	if n := patches(); n != 2 {
+		t.Errorf("expect 2 patches, got %d", n)
+	}
+}
+
+func TestNodeAnnotatorWithDummyTree(t *testing.T) {
+	nodeName := "testnode"
+	k8sclient := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}})
+
+	const gib = 1024 * 1024 * 1024
+	tree := dummy.NewDummyTree(nil).(*dummy.DummyTree)
+	tree.Init(`[{"uuid":"GPU-0","model":"Dummy","totalMemory":1073741824},{"uuid":"GPU-1","model":"Dummy","totalMemory":1073741824}]`)
+	if err := tree.Occupy("/dev/nvidia0", 50, gib/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.SetHealth("/dev/nvidia1", "XID 79"); err != nil {
+		t.Fatal(err)
+	}
+
+	annotator := NewNodeAnnotator(k8sclient.CoreV1(), &config.Config{Hostname: nodeName, DeviceMemoryScaling: 1}, tree)
+	state := annotator.deviceState()
+	if len(state.Devices) != 2 {
+		t.Fatalf("unexpected device state %+v", state)
+	}
+	if dev := state.Devices[0]; dev.Id != "GPU-0" || dev.Type != "Dummy" || dev.Memory != 1024 ||
+		dev.AllocatableCore != 50 || dev.AllocatableMemory != 512 {
+		t.Errorf("unexpected device 0, %+v", dev)
+	}
+	if dev := state.Devices[1]; dev.Health || dev.AllocatableCore != 0 || len(dev.Reasons) != 1 {
+		t.Errorf("unexpected device 1, %+v", dev)
+	}
+}
+
+func TestNodeAnnotatorMemoryBlockSize(t *testing.T) {
+	nodeName := "testnode"
+	k8sclient := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}})
+
+	const gib = 1024 * 1024 * 1024
+	tree := dummy.NewDummyTree(nil).(*dummy.DummyTree)
+	tree.Init(`[{"uuid":"GPU-0","model":"Dummy","totalMemory":1073741824}]`)
+	if err := tree.Occupy("/dev/nvidia0", 50, gib/2); err != nil {
+		t.Fatal(err)
+	}
+
+	// 显存以配置的块大小(256MiB)为单位发布
+	cfg := &config.Config{Hostname: nodeName, DeviceMemoryScaling: 1, MemoryBlockSize: 256 << 20}
+	state := NewNodeAnnotator(k8sclient.CoreV1(), cfg, tree).deviceState()
+	if len(state.Devices) != 1 {
+		t.Fatalf("unexpected device state %+v", state)
+	}
+	if dev := state.Devices[0]; dev.Memory != 4 || dev.AllocatableMemory != 2 {
+		t.Errorf("unexpected device 0, %+v", dev)
+	}
+}
+
+// probeCounter counts probes of the wrapped tree
+type probeCounter struct {
+	device.GPUTree
+	probes  int
+	devices []device.DeviceInfo
+}
+
+func (t *probeCounter) Probe() ([]device.DeviceInfo, error) {
+	t.probes++
+	return t.devices, nil
+}
+
+func TestTreeDeviceSourceCache(t *testing.T) {
+	tree := &probeCounter{devices: []device.DeviceInfo{
+		{Index: 0, UUID: "GPU-0", Healthy: true, TotalMemory: 1 << 30},
+	}}
+	cfg := &config.Config{DeviceMemoryScaling: 1}
+
+	source := deviceSourceOf(tree, cfg)
+	if deviceSourceOf(tree, cfg) != source {
+		t.Fatalf("expect device source shared by watchers of the tree")
+	}
+	changes := source.Changes()
+
+	// 只在第一次读取时查询设备
+	for i := 0; i < 3; i++ {
+		if devices := source.Devices(); len(devices) != 1 || !devices[0].Health {
+			t.Fatalf("unexpected devices %+v", devices)
+		}
+	}
+	if tree.probes != 1 {
+		t.Errorf("expect 1 probe, got %d", tree.probes)
+	}
+	<-changes
+
+	// 健康检查查询到相同的结果时不通知
+	if _, err := source.Probe(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+		t.Errorf("unexpected notification for unchanged devices")
+	default:
+	}
+
+	tree.devices = []device.DeviceInfo{{Index: 0, Reasons: []string{"DeviceGetUUID: GPU is lost"}}}
+	if _, err := source.Probe(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	default:
+		t.Errorf("expect notification for health change")
+	}
+	if devices := source.Devices(); len(devices) != 1 || devices[0].Health || tree.probes != 3 {
+		t.Errorf("unexpected devices %+v after %d probes", devices, tree.probes)
+	}
+}
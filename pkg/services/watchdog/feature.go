@@ -0,0 +1,280 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package watchdog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// FeatureLabelPrefix is the prefix of all labels published by featureLabeler
+	FeatureLabelPrefix = "tydic.io/gpu."
+
+	featureResyncPeriod = 5 * time.Minute
+	maxModelNameLength  = 30
+	mixedProduct        = "mixed"
+)
+
+// GPUFeature describes a GPU used by feature discovery
+type GPUFeature struct {
+	// Model is the type name of GPU, e.g. A100-SXM4-40GB
+	Model string
+	// Memory is the total device memory in MiB
+	Memory            uint64
+	ComputeCapability string
+	MigCapable        bool
+	NVLink            bool
+}
+
+// NodeFeatures describes GPU features of a node
+type NodeFeatures struct {
+	DriverVersion string
+	CudaVersion   string
+	Sharing       bool
+	GPUs          []GPUFeature
+}
+
+// featureSource discovers GPU features of the host
+type featureSource interface {
+	Features() (*NodeFeatures, error)
+}
+
+type nvmlFeatureSource struct {
+	sharing bool
+}
+
+// NewNvmlFeatureSource returns a featureSource backed by nvml
+func NewNvmlFeatureSource(sharing bool) *nvmlFeatureSource {
+	return &nvmlFeatureSource{sharing: sharing}
+}
+
+// #lizard forgives
+func (s *nvmlFeatureSource) Features() (*NodeFeatures, error) {
+	if rs := nvml.Init(); rs != nvml.SUCCESS {
+		return nil, fmt.Errorf("can't initialize nvml library, %s", nvml.ErrorString(rs))
+	}
+	defer nvml.Shutdown()
+
+	features := &NodeFeatures{Sharing: s.sharing}
+	if version, rs := nvml.SystemGetDriverVersion(); rs == nvml.SUCCESS {
+		features.DriverVersion = version
+	}
+	if version, rs := nvml.SystemGetCudaDriverVersion(); rs == nvml.SUCCESS {
+		features.CudaVersion = fmt.Sprintf("%d.%d", version/1000, version%1000/10)
+	}
+
+	count, rs := nvml.DeviceGetCount()
+	if rs != nvml.SUCCESS {
+		return nil, fmt.Errorf("can't get device count, %s", nvml.ErrorString(rs))
+	}
+	for index := 0; index < count; index++ {
+		dev, rs := nvml.DeviceGetHandleByIndex(index)
+		if rs != nvml.SUCCESS {
+			return nil, fmt.Errorf("can't get device %d information, %s", index, nvml.ErrorString(rs))
+		}
+		rawName, rs := dev.GetName()
+		if rs != nvml.SUCCESS {
+			return nil, fmt.Errorf("can't get device %d name, %s", index, nvml.ErrorString(rs))
+		}
+
+		gpu := GPUFeature{Model: getTypeName(rawName)}
+		if mem, rs := dev.GetMemoryInfo(); rs == nvml.SUCCESS {
+			gpu.Memory = mem.Total >> 20
+		}
+		if major, minor, rs := dev.GetCudaComputeCapability(); rs == nvml.SUCCESS {
+			gpu.ComputeCapability = fmt.Sprintf("%d.%d", major, minor)
+		}
+		// 不支持MIG的设备会返回ERROR_NOT_SUPPORTED
+		if _, _, rs := dev.GetMigMode(); rs == nvml.SUCCESS {
+			gpu.MigCapable = true
+		}
+		for link := 0; link < nvml.NVLINK_MAX_LINKS; link++ {
+			if state, rs := dev.GetNvLinkState(link); rs == nvml.SUCCESS && state == nvml.FEATURE_ENABLED {
+				gpu.NVLink = true
+				break
+			}
+		}
+		features.GPUs = append(features.GPUs, gpu)
+	}
+
+	return features, nil
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// sanitize converts s to a valid label value
+func sanitize(s string, limit int) string {
+	s = invalidLabelChars.ReplaceAllString(s, "-")
+	if len(s) > limit {
+		s = s[:limit]
+	}
+
+	return strings.Trim(s, "-_.")
+}
+
+// Labels converts features to node labels. Labels of each model are keyed
+// by the model, so hosts with mixed models get one set of labels per model.
+func (f *NodeFeatures) Labels() map[string]string {
+	labels := map[string]string{
+		FeatureLabelPrefix + "count":         strconv.Itoa(len(f.GPUs)),
+		FeatureLabelPrefix + "vcuda-sharing": strconv.FormatBool(f.Sharing),
+	}
+	if v := sanitize(f.DriverVersion, 63); len(v) > 0 {
+		labels[FeatureLabelPrefix+"driver-version"] = v
+	}
+	if v := sanitize(f.CudaVersion, 63); len(v) > 0 {
+		labels[FeatureLabelPrefix+"cuda-version"] = v
+	}
+
+	models := make(map[string][]GPUFeature)
+	migCapable, nvlink := false, false
+	for _, gpu := range f.GPUs {
+		model := sanitize(gpu.Model, maxModelNameLength)
+		if len(model) == 0 {
+			model = "unknown"
+		}
+		models[model] = append(models[model], gpu)
+		migCapable = migCapable || gpu.MigCapable
+		nvlink = nvlink || gpu.NVLink
+	}
+	labels[FeatureLabelPrefix+"mig-capable"] = strconv.FormatBool(migCapable)
+	labels[FeatureLabelPrefix+"nvlink"] = strconv.FormatBool(nvlink)
+
+	for model, gpus := range models {
+		prefix := FeatureLabelPrefix + model + "."
+		// 同型号设备显存可能不同, 以最小的为准
+		memory, migCapable := gpus[0].Memory, true
+		for _, gpu := range gpus {
+			if gpu.Memory < memory {
+				memory = gpu.Memory
+			}
+			migCapable = migCapable && gpu.MigCapable
+		}
+		labels[prefix+"count"] = strconv.Itoa(len(gpus))
+		labels[prefix+"memory"] = strconv.FormatUint(memory, 10)
+		labels[prefix+"mig-capable"] = strconv.FormatBool(migCapable)
+		if len(gpus[0].ComputeCapability) > 0 {
+			labels[prefix+"compute-capability"] = gpus[0].ComputeCapability
+		}
+		labels[FeatureLabelPrefix+"product"] = model
+	}
+	if len(models) > 1 {
+		labels[FeatureLabelPrefix+"product"] = mixedProduct
+	}
+
+	return labels
+}
+
+type featureLabeler struct {
+	hostName string
+	client   v1core.CoreV1Interface
+	source   featureSource
+}
+
+// NewFeatureLabeler returns a labeler which publishes GPU features of host
+func NewFeatureLabeler(client v1core.CoreV1Interface, hostname string, source featureSource) *featureLabeler {
+	if len(hostname) == 0 {
+		hostname, _ = os.Hostname()
+	}
+
+	return &featureLabeler{
+		hostName: hostname,
+		client:   client,
+		source:   source,
+	}
+}
+
+// Run publishes features periodically until stopChan is closed
+func (fl *featureLabeler) Run(stopChan <-chan struct{}) {
+	klog.V(2).Infof("Feature labeler is running")
+
+	wait.Until(func() {
+		if err := fl.sync(context.Background()); err != nil {
+			klog.Warningf("Can't update feature labels of %s, %v", fl.hostName, err)
+		}
+	}, featureResyncPeriod, stopChan)
+}
+
+// sync updates feature labels and removes stale ones of hardware no longer present
+func (fl *featureLabeler) sync(ctx context.Context) error {
+	features, err := fl.source.Features()
+	if err != nil {
+		return err
+	}
+	labels := features.Labels()
+
+	return wait.PollUntilContextTimeout(ctx, time.Second, time.Minute, true,
+		func(ctx context.Context) (bool, error) {
+			node, err := fl.client.Nodes().Get(ctx, fl.hostName, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+
+			patch := make(map[string]interface{})
+			for k, v := range labels {
+				if node.Labels[k] != v {
+					patch[k] = v
+				}
+			}
+			for k := range node.Labels {
+				if _, ok := labels[k]; !ok && strings.HasPrefix(k, FeatureLabelPrefix) {
+					klog.V(2).Infof("Remove stale label %s of %s", k, fl.hostName)
+					patch[k] = nil
+				}
+			}
+			if len(patch) == 0 {
+				return true, nil
+			}
+
+			data, err := json.Marshal(map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"labels":          patch,
+					"resourceVersion": node.ResourceVersion,
+				},
+			})
+			if err != nil {
+				return false, err
+			}
+			// 携带resourceVersion, 避免并发修改时删除了新增的label
+			_, err = fl.client.Nodes().Patch(ctx, fl.hostName, types.MergePatchType, data, metav1.PatchOptions{})
+			if err != nil {
+				if errors.IsConflict(err) {
+					return false, nil
+				}
+				return false, err
+			}
+			klog.V(2).Infof("Update feature labels of %s, %v", fl.hostName, patch)
+
+			return true, nil
+		})
+}
@@ -0,0 +1,117 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package watchdog
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type fakeFeatureSource struct {
+	features *NodeFeatures
+}
+
+func (s *fakeFeatureSource) Features() (*NodeFeatures, error) {
+	return s.features, nil
+}
+
+func TestFeatureLabeler(t *testing.T) {
+	nodeName := "testnode"
+	k8sclient := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   nodeName,
+			Labels: map[string]string{"other": "value"},
+		},
+	})
+
+	source := &fakeFeatureSource{features: &NodeFeatures{
+		DriverVersion: "535.104.05",
+		CudaVersion:   "12.2",
+		Sharing:       true,
+		GPUs: []GPUFeature{
+			{Model: "A100-SXM4-40GB", Memory: 40960, ComputeCapability: "8.0", MigCapable: true, NVLink: true},
+			{Model: "A100-SXM4-40GB", Memory: 40960, ComputeCapability: "8.0", MigCapable: true, NVLink: true},
+			{Model: "T4", Memory: 15360, ComputeCapability: "7.5"},
+		},
+	}}
+	labeler := NewFeatureLabeler(k8sclient.CoreV1(), nodeName, source)
+
+	checkLabels := func(expect map[string]string, absent ...string) {
+		if err := labeler.sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		node, err := k8sclient.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range expect {
+			if node.Labels[k] != v {
+				t.Errorf("label %s expect %q, got %q", k, v, node.Labels[k])
+			}
+		}
+		for _, k := range absent {
+			if _, ok := node.Labels[k]; ok {
+				t.Errorf("label %s should be removed", k)
+			}
+		}
+	}
+
+	checkLabels(map[string]string{
+		"other":                                          "value",
+		"tydic.io/gpu.count":                             "3",
+		"tydic.io/gpu.product":                           "mixed",
+		"tydic.io/gpu.driver-version":                    "535.104.05",
+		"tydic.io/gpu.cuda-version":                      "12.2",
+		"tydic.io/gpu.vcuda-sharing":                     "true",
+		"tydic.io/gpu.nvlink":                            "true",
+		"tydic.io/gpu.mig-capable":                       "true",
+		"tydic.io/gpu.A100-SXM4-40GB.count":              "2",
+		"tydic.io/gpu.A100-SXM4-40GB.memory":             "40960",
+		"tydic.io/gpu.A100-SXM4-40GB.mig-capable":        "true",
+		"tydic.io/gpu.A100-SXM4-40GB.compute-capability": "8.0",
+		"tydic.io/gpu.T4.count":                          "1",
+		"tydic.io/gpu.T4.compute-capability":             "7.5",
+		"tydic.io/gpu.T4.mig-capable":                    "false",
+	})
+
+	// A100被拔掉后, 对应的label需要被删除
+	source.features.GPUs = source.features.GPUs[2:]
+	checkLabels(map[string]string{
+		"other":                "value",
+		"tydic.io/gpu.count":   "1",
+		"tydic.io/gpu.product": "T4",
+		"tydic.io/gpu.nvlink":  "false",
+	}, "tydic.io/gpu.A100-SXM4-40GB.count", "tydic.io/gpu.A100-SXM4-40GB.memory")
+}
+
+func TestSanitize(t *testing.T) {
+	testCases := map[string]string{
+		"A100-SXM4-40GB":      "A100-SXM4-40GB",
+		"RTX A6000 (Ada)":     "RTX-A6000-Ada",
+		"-GeForce/RTX 4090.-": "GeForce-RTX-4090",
+	}
+	for s, expect := range testCases {
+		if v := sanitize(s, maxModelNameLength); v != expect {
+			t.Errorf("%q expect %q, got %q", s, expect, v)
+		}
+	}
+}
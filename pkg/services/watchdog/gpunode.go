@@ -0,0 +1,245 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package watchdog
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+
+	"tkestack.io/gpu-manager/pkg/apis/gpu/v1alpha1"
+	gpuclient "tkestack.io/gpu-manager/pkg/client/clientset/versioned/typed/gpu/v1alpha1"
+	"tkestack.io/gpu-manager/pkg/config"
+	"tkestack.io/gpu-manager/pkg/device"
+	"tkestack.io/gpu-manager/pkg/services/response"
+	"tkestack.io/gpu-manager/pkg/types"
+)
+
+// publishDelay waits for the allocate response to be recorded after the
+// tree is changed
+const publishDelay = time.Second
+
+type gpuNodePublisher struct {
+	hostName   string
+	config     *config.Config
+	client     gpuclient.GPUNodeInterface
+	devices    deviceSource
+	allocation allocationSource
+	responses  response.Manager
+	// pods returns active pods keyed by uid
+	pods func() map[string]*v1.Pod
+
+	// published is the status updated successfully last time
+	published *v1alpha1.GPUNodeStatus
+}
+
+// NewGPUNodePublisher returns a publisher which maintains status of the
+// GPUNode named after the node
+func NewGPUNodePublisher(client gpuclient.GPUNodeInterface, config *config.Config, tree device.GPUTree,
+	responses response.Manager, podCache *PodCache) *gpuNodePublisher {
+	publisher := &gpuNodePublisher{
+		hostName:   config.Hostname,
+		config:     config,
+		client:     client,
+		devices:    deviceSourceOf(tree, config),
+		allocation: tree,
+		responses:  responses,
+		pods:       podCache.GetActivePods,
+	}
+
+	return publisher
+}
+
+// Run publishes status once devices or their allocation changed until
+// stopChan is closed
+func (p *gpuNodePublisher) Run(stopChan <-chan struct{}) {
+	klog.V(2).Infof("GPUNode publisher is running")
+
+	health := p.devices.Changes()
+	var changes <-chan struct{}
+	if p.allocation != nil {
+		changes = p.allocation.Changes()
+	}
+
+	for {
+		if err := p.sync(context.Background()); err != nil {
+			klog.Warningf("Can't update GPUNode %s, %v", p.hostName, err)
+		}
+
+		select {
+		case <-health:
+		case <-changes:
+			time.Sleep(publishDelay)
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// sync creates the GPUNode if not found and updates its status if changed
+func (p *gpuNodePublisher) sync(ctx context.Context) error {
+	status := p.status()
+	if p.published != nil && reflect.DeepEqual(status, p.published) {
+		klog.V(4).Infof("GPUNode status is not changed, skip updating")
+		return nil
+	}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := p.client.Get(ctx, p.hostName, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			node, err = p.client.Create(ctx, &v1alpha1.GPUNode{
+				ObjectMeta: metav1.ObjectMeta{Name: p.hostName},
+				Spec:       v1alpha1.GPUNodeSpec{NodeName: p.hostName},
+			}, metav1.CreateOptions{})
+		}
+		if err != nil {
+			return err
+		}
+
+		// 重启后状态未变化时不更新, 避免触发watch事件
+		current := node.Status.DeepCopy()
+		current.LastUpdateTime = metav1.Time{}
+		if reflect.DeepEqual(current, status) {
+			return nil
+		}
+
+		node.Status = *status.DeepCopy()
+		node.Status.LastUpdateTime = metav1.Now()
+		_, err = p.client.UpdateStatus(ctx, node, metav1.UpdateOptions{})
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	p.published = status
+	klog.V(2).Infof("Update GPUNode %s, allocatable %+v", p.hostName, status.Allocatable)
+
+	return nil
+}
+
+// status builds GPUNode status without LastUpdateTime, empty lists are
+// left nil so it can be compared with the status read back.
+func (p *gpuNodePublisher) status() *v1alpha1.GPUNodeStatus {
+	leaves := leafStates(p.allocation)
+	state := mergeDeviceState(p.devices.Devices(), leaves, p.config)
+	pods := p.allocatedPods(leaves)
+
+	status := &v1alpha1.GPUNodeStatus{}
+	for _, dev := range state.Devices {
+		d := v1alpha1.GPUDevice{
+			Index:             dev.Index,
+			UUID:              dev.Id,
+			Model:             dev.Type,
+			ComputeCapability: dev.Capability,
+			MIG:               dev.IsMig,
+			Healthy:           dev.Health,
+			Reasons:           dev.Reasons,
+			Pool:              dev.Pool,
+			Capacity:          v1alpha1.GPUResource{Cores: int64(dev.Core), Memory: dev.Memory},
+			Allocatable:       v1alpha1.GPUResource{Cores: dev.AllocatableCore, Memory: dev.AllocatableMemory},
+		}
+		if leaf, ok := leaves[dev.Id]; ok {
+			d.Path = leaf.MinorName
+			for _, link := range leaf.Topology {
+				d.Topology = append(d.Topology, v1alpha1.TopologyLink{
+					Level: link.Level,
+					Peers: append([]int(nil), link.Peers...),
+				})
+			}
+			d.Pods = pods[leaf.MinorName]
+		}
+		if dev.Health {
+			status.Capacity.Cores += d.Capacity.Cores
+			status.Capacity.Memory += d.Capacity.Memory
+			status.Allocatable.Cores += d.Allocatable.Cores
+			status.Allocatable.Memory += d.Allocatable.Memory
+		}
+		status.Devices = append(status.Devices, d)
+	}
+
+	return status
+}
+
+// allocatedPods returns containers allocated on each device keyed by
+// device path, resource of a container is shared evenly by its devices.
+func (p *gpuNodePublisher) allocatedPods(leaves map[string]device.LeafState) map[string][]v1alpha1.AllocatedPod {
+	paths := make(map[string]bool)
+	for _, leaf := range leaves {
+		paths[leaf.MinorName] = true
+	}
+
+	var activePods map[string]*v1.Pod
+	if p.pods != nil {
+		activePods = p.pods()
+	}
+
+	result := make(map[string][]v1alpha1.AllocatedPod)
+	if p.responses == nil {
+		return result
+	}
+	for podUID, containers := range p.responses.ListAll() {
+		for name, resp := range containers {
+			devices := make([]string, 0)
+			for _, dev := range resp.Devices {
+				if paths[dev.HostPath] {
+					devices = append(devices, dev.HostPath)
+				}
+			}
+			if len(devices) == 0 {
+				continue
+			}
+
+			cores, _ := strconv.ParseInt(resp.Annotations[types.VCoreAnnotation], 10, 64)
+			memory, _ := strconv.ParseInt(resp.Annotations[types.VMemoryAnnotation], 10, 64)
+			allocated := v1alpha1.AllocatedPod{
+				UID:       podUID,
+				Container: name,
+				Resource: v1alpha1.GPUResource{
+					Cores:  cores / int64(len(devices)),
+					Memory: memory / int64(len(devices)) / p.config.GetMemoryBlockSize(),
+				},
+			}
+			if pod, ok := activePods[podUID]; ok {
+				allocated.Namespace, allocated.Name = pod.Namespace, pod.Name
+			}
+			for _, dev := range devices {
+				result[dev] = append(result[dev], allocated)
+			}
+		}
+	}
+
+	for _, pods := range result {
+		sort.Slice(pods, func(i, j int) bool {
+			if pods[i].UID != pods[j].UID {
+				return pods[i].UID < pods[j].UID
+			}
+			return pods[i].Container < pods[j].Container
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,151 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package watchdog
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"tkestack.io/gpu-manager/pkg/apis/gpu/v1alpha1"
+	"tkestack.io/gpu-manager/pkg/client/clientset/versioned/fake"
+	"tkestack.io/gpu-manager/pkg/device/nvidia"
+	"tkestack.io/gpu-manager/pkg/services/response"
+	"tkestack.io/gpu-manager/pkg/types"
+)
+
+func TestGPUNodePublisherSync(t *testing.T) {
+	nodeName := "testnode"
+	clientset := fake.NewSimpleClientset()
+	client := clientset.GpuV1alpha1().GPUNodes()
+
+	const gib = 1024 * 1024 * 1024
+	allocation := &fakeAllocationSource{
+		changes: make(chan struct{}, 1),
+		leaves: []nvidia.LeafState{
+			{Index: 0, UUID: "GPU-0", MinorName: "/dev/nvidia0", TotalMemory: 16 * gib, AllocatableCores: 70, AllocatableMemory: 12 * gib,
+				CoreCapacity: 100, MemoryCapacity: 16 * gib,
+				Topology: []nvidia.TopologyLink{{Level: "PIX", Peers: []int{1}}}},
+			{Index: 1, UUID: "GPU-1", MinorName: "/dev/nvidia1", TotalMemory: 16 * gib, AllocatableCores: 100, AllocatableMemory: 16 * gib,
+				CoreCapacity: 100, MemoryCapacity: 16 * gib,
+				Topology: []nvidia.TopologyLink{{Level: "PIX", Peers: []int{0}}}},
+		},
+	}
+	responses := response.NewResponseManager()
+	responses.InsertResp("uid-1", "cuda", &pluginapi.ContainerAllocateResponse{
+		Devices: []*pluginapi.DeviceSpec{{HostPath: "/dev/nvidia0"}, {HostPath: "/dev/nvidiactl"}},
+		Annotations: map[string]string{
+			types.VCoreAnnotation:   "30",
+			types.VMemoryAnnotation: "4294967296",
+		},
+	})
+	newPublisher := func() *gpuNodePublisher {
+		return &gpuNodePublisher{
+			hostName: nodeName,
+			client:   client,
+			devices: fakeDeviceSource{
+				{Index: 0, GPUInfo: GPUInfo{Id: "GPU-0", Core: 100, Memory: 16 * gib / types.MemoryBlockSize, Health: true}},
+				{Index: 1, GPUInfo: GPUInfo{Id: "GPU-1", Core: 100, Memory: 16 * gib / types.MemoryBlockSize, Health: true}},
+				{Index: 2, GPUInfo: GPUInfo{Health: false}, Reasons: []string{"DeviceGetUUID: Unknown Error"}},
+			},
+			allocation: allocation,
+			responses:  responses,
+			pods: func() map[string]*v1.Pod {
+				return map[string]*v1.Pod{
+					"uid-1": {ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cuda-pod", UID: "uid-1"}},
+				}
+			},
+		}
+	}
+	updates := func() int {
+		n := 0
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "update" && action.GetSubresource() == "status" {
+				n++
+			}
+		}
+		return n
+	}
+
+	publisher := newPublisher()
+	if err := publisher.sync(context.Background()); err != nil {
+		t.Fatalf("sync failed, %v", err)
+	}
+
+	node, err := client.Get(context.Background(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get GPUNode failed, %v", err)
+	}
+	if node.Spec.NodeName != nodeName {
+		t.Errorf("expect node name %s, got %s", nodeName, node.Spec.NodeName)
+	}
+	status := node.Status
+	if status.Capacity != (v1alpha1.GPUResource{Cores: 200, Memory: 32 * 1024}) {
+		t.Errorf("unexpected capacity %+v", status.Capacity)
+	}
+	if status.Allocatable != (v1alpha1.GPUResource{Cores: 170, Memory: 28 * 1024}) {
+		t.Errorf("unexpected allocatable %+v", status.Allocatable)
+	}
+	if len(status.Devices) != 3 {
+		t.Fatalf("expect 3 devices, got %d", len(status.Devices))
+	}
+	dev := status.Devices[0]
+	if dev.Path != "/dev/nvidia0" || len(dev.Topology) != 1 || dev.Topology[0].Peers[0] != 1 {
+		t.Errorf("unexpected device %+v", dev)
+	}
+	expectPod := v1alpha1.AllocatedPod{Namespace: "default", Name: "cuda-pod", UID: "uid-1", Container: "cuda",
+		Resource: v1alpha1.GPUResource{Cores: 30, Memory: 4 * 1024}}
+	if len(dev.Pods) != 1 || dev.Pods[0] != expectPod {
+		t.Errorf("expect pods %+v, got %+v", expectPod, dev.Pods)
+	}
+	if len(status.Devices[1].Pods) != 0 {
+		t.Errorf("expect no pods on device 1, got %+v", status.Devices[1].Pods)
+	}
+	if unhealthy := status.Devices[2]; unhealthy.Healthy || len(unhealthy.Reasons) != 1 {
+		t.Errorf("unexpected unhealthy device %+v", unhealthy)
+	}
+	if updates() != 1 {
+		t.Fatalf("expect 1 status update, got %d", updates())
+	}
+
+	// 状态未变化时不更新, 重启后也一样
+	if err := publisher.sync(context.Background()); err != nil {
+		t.Fatalf("sync failed, %v", err)
+	}
+	if err := newPublisher().sync(context.Background()); err != nil {
+		t.Fatalf("sync failed, %v", err)
+	}
+	if updates() != 1 {
+		t.Errorf("expect no more status update, got %d", updates())
+	}
+
+	responses.DeleteResp("uid-1", "cuda")
+	allocation.leaves[0].AllocatableCores, allocation.leaves[0].AllocatableMemory = 100, 16*gib
+	if err := publisher.sync(context.Background()); err != nil {
+		t.Fatalf("sync failed, %v", err)
+	}
+	node, _ = client.Get(context.Background(), nodeName, metav1.GetOptions{})
+	if len(node.Status.Devices[0].Pods) != 0 || node.Status.Allocatable.Cores != 200 {
+		t.Errorf("expect pods released, got %+v", node.Status)
+	}
+	if updates() != 2 {
+		t.Errorf("expect 2 status updates, got %d", updates())
+	}
+}
@@ -0,0 +1,324 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package watchdog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+
+	"tkestack.io/gpu-manager/pkg/config"
+	"tkestack.io/gpu-manager/pkg/device"
+)
+
+const (
+	// NodeConditionGPUHealthy is the node condition maintained by healthMonitor
+	NodeConditionGPUHealthy v1.NodeConditionType = "GPUHealthy"
+	// TaintGPUUnhealthy is added to node with NoSchedule effect if taint is
+	// enabled and GPUs are unhealthy
+	TaintGPUUnhealthy = "tydic.io/gpu-unhealthy"
+
+	// RuleNVMLInitFailure is triggered if nvml can't be initialized
+	RuleNVMLInitFailure = "NVMLInitFailure"
+	// RuleGPUCountMismatch is triggered if number of GPUs discovered is not expected
+	RuleGPUCountMismatch = "GPUCountMismatch"
+	// RuleDeviceLost is triggered if a GPU can't be queried or disappears
+	RuleDeviceLost = "DeviceLost"
+	// RuleResetFailure is triggered if a GPU failed to reset too many times
+	RuleResetFailure = "ResetFailure"
+
+	reasonGPUsHealthy = "GPUsHealthy"
+
+	defaultMaxResetFailures = 3
+	healthCheckPeriod       = 30 * time.Second
+)
+
+// deviceProber discovers devices of the host
+type deviceProber interface {
+	// Probe queries devices from the vendor library again
+	Probe() ([]DeviceStatus, error)
+	// Cached returns devices of the last probe
+	Cached() ([]DeviceStatus, error)
+}
+
+type healthProblem struct {
+	rule    string
+	message string
+}
+
+type healthMonitor struct {
+	hostName   string
+	config     config.HealthConfig
+	live       *config.LiveConfig
+	client     v1core.CoreV1Interface
+	prober     deviceProber
+	allocation allocationSource
+
+	// reported is the condition updated successfully last time
+	reported *v1.NodeCondition
+}
+
+// NewHealthMonitor returns a monitor which maintains the GPUHealthy
+// condition and taint of node according to rules of cfg.Health
+func NewHealthMonitor(client v1core.CoreV1Interface, cfg *config.Config, tree device.GPUTree) *healthMonitor {
+	monitor := &healthMonitor{
+		hostName:   cfg.Hostname,
+		config:     cfg.Live.Health(),
+		live:       cfg.Live,
+		client:     client,
+		prober:     deviceSourceOf(tree, cfg),
+		allocation: tree,
+	}
+
+	return monitor
+}
+
+// Run checks health of GPUs periodically or once allocation changed until
+// stopChan is closed
+func (hm *healthMonitor) Run(stopChan <-chan struct{}) {
+	klog.V(2).Infof("GPU health monitor is running")
+
+	ticker := time.NewTicker(healthCheckPeriod)
+	defer ticker.Stop()
+
+	var changes <-chan struct{}
+	if hm.allocation != nil {
+		changes = hm.allocation.Changes()
+	}
+
+	// 只在定期检查时重新查询设备, 分配变化时使用上次查询的结果
+	probe := true
+	for {
+		if err := hm.sync(context.Background(), probe); err != nil {
+			klog.Warningf("Can't update GPU health of %s, %v", hm.hostName, err)
+		}
+
+		select {
+		case <-changes:
+			probe = false
+		case <-ticker.C:
+			probe = true
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+func (hm *healthMonitor) enabled(rule string) bool {
+	return !sets.NewString(hm.config.DisabledRules...).Has(rule)
+}
+
+// check returns problems found by enabled rules, devices are queried again
+// if probe is true
+func (hm *healthMonitor) check(probe bool) []healthProblem {
+	problems := make([]healthProblem, 0)
+	report := func(rule, format string, args ...interface{}) {
+		if hm.enabled(rule) {
+			problems = append(problems, healthProblem{rule: rule, message: fmt.Sprintf(format, args...)})
+		}
+	}
+
+	probeDevices := hm.prober.Cached
+	if probe {
+		probeDevices = hm.prober.Probe
+	}
+	devices, err := probeDevices()
+	if err != nil {
+		// nvml不可用时其他规则无法检查
+		report(RuleNVMLInitFailure, "%v", err)
+		return problems
+	}
+
+	if expected := hm.config.ExpectedGPUs; expected > 0 && len(devices) != expected {
+		report(RuleGPUCountMismatch, "expect %d GPUs, found %d", expected, len(devices))
+	}
+
+	found, lost := sets.NewString(), sets.NewInt()
+	for _, dev := range devices {
+		if len(dev.Id) > 0 {
+			found.Insert(dev.Id)
+		}
+		if !dev.Health {
+			lost.Insert(dev.Index)
+			report(RuleDeviceLost, "GPU %d is lost, %s", dev.Index, strings.Join(dev.Reasons, ", "))
+		}
+	}
+
+	if hm.allocation == nil {
+		return problems
+	}
+	maxResetFailures := hm.config.MaxResetFailures
+	if maxResetFailures <= 0 {
+		maxResetFailures = defaultMaxResetFailures
+	}
+	for _, leaf := range hm.allocation.LeafStates() {
+		if len(leaf.UUID) > 0 && !found.Has(leaf.UUID) && !lost.Has(leaf.Index) {
+			report(RuleDeviceLost, "GPU %d(%s) is not found", leaf.Index, leaf.UUID)
+		}
+		if leaf.PendingReset && leaf.ResetFailures >= maxResetFailures {
+			report(RuleResetFailure, "GPU %d failed to reset %d times", leaf.Index, leaf.ResetFailures)
+		}
+	}
+
+	return problems
+}
+
+// conditionOf converts problems to the GPUHealthy condition, reason of the
+// condition is the rule of first problem.
+func conditionOf(problems []healthProblem) v1.NodeCondition {
+	if len(problems) == 0 {
+		return v1.NodeCondition{
+			Type:    NodeConditionGPUHealthy,
+			Status:  v1.ConditionTrue,
+			Reason:  reasonGPUsHealthy,
+			Message: "All GPUs are healthy",
+		}
+	}
+
+	messages := make([]string, 0, len(problems))
+	for _, p := range problems {
+		messages = append(messages, p.message)
+	}
+
+	return v1.NodeCondition{
+		Type:    NodeConditionGPUHealthy,
+		Status:  v1.ConditionFalse,
+		Reason:  problems[0].rule,
+		Message: strings.Join(messages, "; "),
+	}
+}
+
+// sync updates condition and taint of node if health of GPUs changed
+func (hm *healthMonitor) sync(ctx context.Context, probe bool) error {
+	// 规则在运行中被修改时需要重新设置condition和taint
+	if hm.live != nil {
+		if health := hm.live.Health(); !reflect.DeepEqual(health, hm.config) {
+			klog.V(2).Infof("GPU health rules of %s changed to %+v", hm.hostName, health)
+			hm.config = health
+			hm.reported = nil
+		}
+	}
+	condition := conditionOf(hm.check(probe))
+	if hm.reported != nil && hm.reported.Status == condition.Status &&
+		hm.reported.Reason == condition.Reason && hm.reported.Message == condition.Message {
+		return nil
+	}
+
+	if condition.Status != v1.ConditionTrue {
+		klog.Warningf("GPUs of %s are unhealthy, %s: %s", hm.hostName, condition.Reason, condition.Message)
+	}
+	if err := hm.updateCondition(ctx, &condition); err != nil {
+		return err
+	}
+	// 恢复健康后自动删除taint, 关闭taint后也删除之前添加的taint
+	if err := hm.updateTaint(ctx, hm.config.Taint && condition.Status != v1.ConditionTrue); err != nil {
+		return err
+	}
+	hm.reported = &condition
+
+	return nil
+}
+
+func (hm *healthMonitor) updateCondition(ctx context.Context, condition *v1.NodeCondition) error {
+	node, err := hm.client.Nodes().Get(ctx, hm.hostName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	now := metav1.Now()
+	condition.LastHeartbeatTime, condition.LastTransitionTime = now, now
+	for _, c := range node.Status.Conditions {
+		if c.Type == condition.Type && c.Status == condition.Status {
+			condition.LastTransitionTime = c.LastTransitionTime
+		}
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []v1.NodeCondition{*condition},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = hm.client.Nodes().PatchStatus(ctx, hm.hostName, data)
+	if err == nil {
+		klog.V(2).Infof("Update condition %s of %s to %s", condition.Type, hm.hostName, condition.Status)
+	}
+
+	return err
+}
+
+func (hm *healthMonitor) updateTaint(ctx context.Context, tainted bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := hm.client.Nodes().Get(ctx, hm.hostName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		taints := make([]v1.Taint, 0, len(node.Spec.Taints))
+		exists := false
+		for _, taint := range node.Spec.Taints {
+			if taint.Key == TaintGPUUnhealthy {
+				exists = true
+				continue
+			}
+			taints = append(taints, taint)
+		}
+		if exists == tainted {
+			return nil
+		}
+		if tainted {
+			taints = append(taints, v1.Taint{
+				Key:       TaintGPUUnhealthy,
+				Effect:    v1.TaintEffectNoSchedule,
+				TimeAdded: &metav1.Time{Time: time.Now()},
+			})
+		}
+
+		data, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": node.ResourceVersion,
+			},
+			"spec": map[string]interface{}{
+				"taints": taints,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		// 携带resourceVersion, 避免覆盖其他组件同时修改的taint
+		_, err = hm.client.Nodes().Patch(ctx, hm.hostName, apitypes.MergePatchType, data, metav1.PatchOptions{})
+		if err == nil {
+			klog.V(2).Infof("Set taint %s of %s to %t", TaintGPUUnhealthy, hm.hostName, tainted)
+		}
+
+		return err
+	})
+}
@@ -0,0 +1,120 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"tkestack.io/gpu-manager/pkg/config"
+	"tkestack.io/gpu-manager/pkg/device/nvidia"
+)
+
+type fakeProber struct {
+	devices []DeviceStatus
+	err     error
+}
+
+func (p *fakeProber) Probe() ([]DeviceStatus, error) {
+	return p.devices, p.err
+}
+
+func (p *fakeProber) Cached() ([]DeviceStatus, error) {
+	return p.devices, p.err
+}
+
+func TestHealthMonitorSync(t *testing.T) {
+	nodeName := "testnode"
+	k8sclient := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+		Spec: v1.NodeSpec{Taints: []v1.Taint{
+			{Key: "dedicated", Value: "gpu", Effect: v1.TaintEffectNoSchedule},
+		}},
+	})
+
+	healthy := []DeviceStatus{
+		{Index: 0, GPUInfo: GPUInfo{Id: "GPU-0", Health: true}},
+		{Index: 1, GPUInfo: GPUInfo{Id: "GPU-1", Health: true}},
+	}
+	prober := &fakeProber{devices: healthy}
+	allocation := &fakeAllocationSource{
+		leaves: []nvidia.LeafState{{Index: 0, UUID: "GPU-0"}, {Index: 1, UUID: "GPU-1"}},
+	}
+	monitor := &healthMonitor{
+		hostName:   nodeName,
+		config:     config.HealthConfig{ExpectedGPUs: 2, Taint: true},
+		client:     k8sclient.CoreV1(),
+		prober:     prober,
+		allocation: allocation,
+	}
+
+	expect := func(status v1.ConditionStatus, reason string, tainted bool) {
+		t.Helper()
+		if err := monitor.sync(context.Background(), true); err != nil {
+			t.Fatalf("sync failed, %v", err)
+		}
+		node, _ := k8sclient.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+		var condition *v1.NodeCondition
+		for i, c := range node.Status.Conditions {
+			if c.Type == NodeConditionGPUHealthy {
+				condition = &node.Status.Conditions[i]
+			}
+		}
+		if condition == nil || condition.Status != status || condition.Reason != reason {
+			t.Errorf("expect condition %s %s, got %+v", status, reason, condition)
+		}
+		found, others := false, 0
+		for _, taint := range node.Spec.Taints {
+			if taint.Key == TaintGPUUnhealthy {
+				found = taint.Effect == v1.TaintEffectNoSchedule
+			} else {
+				others++
+			}
+		}
+		if found != tainted || others != 1 {
+			t.Errorf("expect tainted %t, got taints %+v", tainted, node.Spec.Taints)
+		}
+	}
+
+	expect(v1.ConditionTrue, reasonGPUsHealthy, false)
+
+	prober.devices, prober.err = nil, errors.New("can't initialize nvml library, Driver Not Loaded")
+	expect(v1.ConditionFalse, RuleNVMLInitFailure, true)
+
+	prober.devices, prober.err = healthy[:1], nil
+	expect(v1.ConditionFalse, RuleGPUCountMismatch, true)
+	if msg := monitor.reported.Message; msg != "expect 2 GPUs, found 1; GPU 1(GPU-1) is not found" {
+		t.Errorf("unexpected message %s", msg)
+	}
+
+	prober.devices = healthy
+	allocation.leaves[1].PendingReset, allocation.leaves[1].ResetFailures = true, 3
+	expect(v1.ConditionFalse, RuleResetFailure, true)
+
+	// 恢复后删除taint
+	allocation.leaves[1].PendingReset, allocation.leaves[1].ResetFailures = false, 0
+	expect(v1.ConditionTrue, reasonGPUsHealthy, false)
+
+	monitor.config.DisabledRules = []string{RuleNVMLInitFailure}
+	prober.err = errors.New("can't initialize nvml library")
+	expect(v1.ConditionTrue, reasonGPUsHealthy, false)
+}
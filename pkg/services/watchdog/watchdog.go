@@ -19,6 +19,8 @@ package watchdog
 
 import (
 	"fmt"
+	"strconv"
+	"sync"
 	"time"
 
 	"tkestack.io/gpu-manager/pkg/utils"
@@ -29,95 +31,235 @@ import (
 	"k8s.io/client-go/informers"
 	informerCore "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
 )
 
 const (
 	podHostField = "spec.nodeName"
+
+	// IndexPodUID indexes pods by uid
+	IndexPodUID = "uid"
+	// IndexGPURequired indexes pods by whether they request GPU resource
+	IndexGPURequired = "gpuRequired"
+
+	releaseQueueSize = 100
 )
 
-// PodCache contains a podInformer of pod
+// PodCache contains a podInformer of pods on the node, handlers registered
+// by OnRelease are called once a GPU pod is terminated or deleted.
 type PodCache struct {
+	factory     informers.SharedInformerFactory
 	podInformer informerCore.PodInformer
-}
 
-var (
-	podCache *PodCache
-)
+	handlerLock     sync.Mutex
+	releaseHandlers []func(pod *v1.Pod)
+	released        chan *v1.Pod
 
-// NewPodCache creates a new podCache
-func NewPodCache(client kubernetes.Interface, hostName string) {
-	podCache = new(PodCache)
+	stopChan   chan struct{}
+	stopOnce   sync.Once
+	dispatched sync.WaitGroup
+}
+
+// NewPodCache creates a new PodCache of pods on node hostName and waits
+// until it's synced
+func NewPodCache(client kubernetes.Interface, hostName string) *PodCache {
 	factory := informers.NewSharedInformerFactoryWithOptions(client, time.Minute,
 		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
 			// 查询范围：当前节点下的pod
 			options.FieldSelector = fields.OneTermEqualSelector(podHostField, hostName).String()
 		}))
-	podCache.podInformer = factory.Core().V1().Pods()
 
-	ch := make(chan struct{})
-	go podCache.podInformer.Informer().Run(ch)
-	for !podCache.podInformer.Informer().HasSynced() {
-		time.Sleep(time.Second)
+	return newPodCache(factory)
+}
+
+// NewPodCacheForTest creates a new PodCache of all pods for testing
+func NewPodCacheForTest(client kubernetes.Interface) *PodCache {
+	return newPodCache(informers.NewSharedInformerFactory(client, 0))
+}
+
+func newPodCache(factory informers.SharedInformerFactory) *PodCache {
+	p := &PodCache{
+		factory:     factory,
+		podInformer: factory.Core().V1().Pods(),
+		released:    make(chan *v1.Pod, releaseQueueSize),
+		stopChan:    make(chan struct{}),
 	}
+	informer := p.podInformer.Informer()
+	if err := informer.AddIndexers(cache.Indexers{
+		IndexPodUID:      podUIDIndexFunc,
+		IndexGPURequired: gpuRequiredIndexFunc,
+	}); err != nil {
+		klog.Fatalf("Can't add indexers to pod informer, %v", err)
+	}
+	informer.AddEventHandler(p)
+	p.dispatched.Add(1)
+	go p.dispatch()
+
+	factory.Start(p.stopChan)
+	cache.WaitForCacheSync(p.stopChan, informer.HasSynced)
 	klog.V(2).Infof("Pod cache is running")
+
+	return p
 }
 
-// NewPodCacheForTest creates a new podCache for testing
-func NewPodCacheForTest(client kubernetes.Interface) {
-	podCache = new(PodCache)
-	factory := informers.NewSharedInformerFactory(client, 0)
-	podCache.podInformer = factory.Core().V1().Pods()
-	podCache.podInformer.Informer().AddEventHandler(podCache)
-	ch := make(chan struct{})
-	factory.Start(ch)
+// Stop stops the informer and waits until the running release handlers
+// return, pods released after that are ignored
+func (p *PodCache) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopChan)
+		p.factory.Shutdown()
+		p.dispatched.Wait()
+		klog.V(2).Infof("Pod cache is stopped")
+	})
+}
 
-	for !podCache.podInformer.Informer().HasSynced() {
-		time.Sleep(time.Second)
+func podUIDIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+
+	return []string{string(pod.UID)}, nil
+}
+
+func gpuRequiredIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+
+	return []string{strconv.FormatBool(usesGPU(pod))}, nil
+}
+
+// usesGPU returns true if the pod requests vcuda resources or whole GPUs
+func usesGPU(pod *v1.Pod) bool {
+	return utils.IsGPURequiredPod(pod) || utils.IsWholeGPURequiredPod(pod)
+}
+
+// OnRelease registers handler which is called once a GPU pod is terminated
+// or deleted, handlers are called in order of registration in one goroutine
+// and may be called more than once for a pod.
+func (p *PodCache) OnRelease(handler func(pod *v1.Pod)) {
+	p.handlerLock.Lock()
+	defer p.handlerLock.Unlock()
+
+	p.releaseHandlers = append(p.releaseHandlers, handler)
+}
+
+// dispatch calls release handlers outside of informer, so slow handlers
+// don't block delivering of pod events
+func (p *PodCache) dispatch() {
+	defer p.dispatched.Done()
+
+	for {
+		var pod *v1.Pod
+		select {
+		case pod = <-p.released:
+		case <-p.stopChan:
+			return
+		}
+
+		p.handlerLock.Lock()
+		handlers := append([]func(pod *v1.Pod){}, p.releaseHandlers...)
+		p.handlerLock.Unlock()
+
+		klog.V(4).Infof("Pod %s/%s(%s) is released", pod.Namespace, pod.Name, pod.UID)
+		for _, handler := range handlers {
+			handler(pod)
+		}
+	}
+}
+
+// release queues the pod for release handlers unless the cache is stopped
+func (p *PodCache) release(pod *v1.Pod) {
+	select {
+	case p.released <- pod:
+	case <-p.stopChan:
 	}
-	klog.V(2).Infof("Pod cache is running")
 }
 
 // OnAdd is a callback function for podInformer, do nothing for now.
 func (p *PodCache) OnAdd(obj interface{}, isInInitialList bool) {}
 
-// OnUpdate is a callback function for podInformer, do nothing for now.
-func (p *PodCache) OnUpdate(oldObj, newObj interface{}) {}
+// OnUpdate is a callback function for podInformer, GPU pods which become
+// terminated are released.
+func (p *PodCache) OnUpdate(oldObj, newObj interface{}) {
+	oldPod, ok := oldObj.(*v1.Pod)
+	if !ok {
+		return
+	}
+	newPod, ok := newObj.(*v1.Pod)
+	if !ok {
+		return
+	}
+
+	if !podIsTerminated(oldPod) && podIsTerminated(newPod) && usesGPU(newPod) {
+		p.release(newPod)
+	}
+}
 
-// OnDelete is a callback function for podInformer, do nothing for now.
-func (p *PodCache) OnDelete(obj interface{}) {}
+// OnDelete is a callback function for podInformer, deleted GPU pods are released.
+func (p *PodCache) OnDelete(obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		if pod, ok = tombstone.Obj.(*v1.Pod); !ok {
+			return
+		}
+	}
 
-// GetActivePods get all active pods from podCache and returns them.
-func GetActivePods() map[string]*v1.Pod {
-	if podCache == nil {
-		return nil
+	if usesGPU(pod) {
+		p.release(pod)
 	}
+}
+
+// GetActivePods returns active GPU pods keyed by uid
+func (p *PodCache) GetActivePods() map[string]*v1.Pod {
 	activePods := make(map[string]*v1.Pod)
-	// 从缓存中筛选出活动中的pod
-	for _, item := range podCache.podInformer.Informer().GetStore().List() {
+
+	items, err := p.podInformer.Informer().GetIndexer().ByIndex(IndexGPURequired, strconv.FormatBool(true))
+	if err != nil {
+		klog.Errorf("Can't list GPU pods, %v", err)
+		return activePods
+	}
+	for _, item := range items {
 		pod, ok := item.(*v1.Pod)
-		if !ok {
-			continue
-		}
 		// 筛选掉没有启动的pod
 		// 包含状态失败的pod、运行完毕的、容器运行不成功的
-		if podIsTerminated(pod) {
-			continue
-		}
-		// 筛选掉没有请求gpu资源的pod
-		if !utils.IsGPURequiredPod(pod) {
+		if !ok || podIsTerminated(pod) {
 			continue
 		}
-		// 将符合条件的pod装载
 		activePods[string(pod.UID)] = pod
 	}
 
 	return activePods
 }
 
+// GetActivePod returns the GPU pod with uid if it's active
+func (p *PodCache) GetActivePod(uid string) (*v1.Pod, bool) {
+	items, err := p.podInformer.Informer().GetIndexer().ByIndex(IndexPodUID, uid)
+	if err != nil {
+		klog.Errorf("Can't get pod %s, %v", uid, err)
+		return nil, false
+	}
+	for _, item := range items {
+		pod, ok := item.(*v1.Pod)
+		if ok && !podIsTerminated(pod) && usesGPU(pod) {
+			return pod, true
+		}
+	}
+
+	return nil, false
+}
+
+// GetPod returns the GPU pod with namespace and name if it's not terminated
 // 根据namespace、name 获取未终止的gpu pod
-func GetPod(namespace, name string) (*v1.Pod, error) {
-	pod, err := podCache.podInformer.Lister().Pods(namespace).Get(name)
+func (p *PodCache) GetPod(namespace, name string) (*v1.Pod, error) {
+	pod, err := p.podInformer.Lister().Pods(namespace).Get(name)
 	if err != nil {
 		return nil, err
 	}
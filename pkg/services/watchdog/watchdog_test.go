@@ -21,9 +21,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"runtime"
 	"testing"
 	"time"
 
+	"tkestack.io/gpu-manager/pkg/config"
 	"tkestack.io/gpu-manager/pkg/types"
 
 	"k8s.io/api/core/v1"
@@ -66,20 +68,101 @@ func TestWatchdog(t *testing.T) {
 		Status: v1.PodStatus{Phase: v1.PodRunning},
 	}
 	k8sclient.CoreV1().Pods(ns).Create(context.Background(), pod, metav1.CreateOptions{})
+	// 申请整卡资源的pod
+	wholeGPUPod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "wholegpu",
+			UID:  k8stypes.UID("wholegpu-uid"),
+		},
+		Spec: v1.PodSpec{Containers: []v1.Container{
+			{
+				Name: containerName,
+				Resources: v1.ResourceRequirements{
+					Limits: v1.ResourceList{
+						types.NvidiaGPUResource: resource.MustParse("1"),
+					},
+				},
+			},
+		}},
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}
+	k8sclient.CoreV1().Pods(ns).Create(context.Background(), wholeGPUPod, metav1.CreateOptions{})
 
 	// create watchdog and run
-	NewPodCacheForTest(k8sclient)
+	podCache := NewPodCacheForTest(k8sclient)
+	released := make(chan string, 1)
+	podCache.OnRelease(func(pod *v1.Pod) {
+		released <- string(pod.UID)
+	})
 
 	// check if watchdog work well
 	err := wait.PollImmediate(time.Second, time.Minute, func() (bool, error) {
-		activepods := GetActivePods()
+		activepods := podCache.GetActivePods()
 		if v, ok := activepods[podUID]; !ok || v.Name != podName {
 			t.Logf("can't find pod %s", podName)
 			return false, nil
 		}
+		if _, ok := activepods[string(wholeGPUPod.UID)]; !ok {
+			t.Logf("can't find pod %s", wholeGPUPod.Name)
+			return false, nil
+		}
 		return true, nil
 	})
 	if err != nil {
 		t.Fatalf("test failed: %s", err.Error())
 	}
+	if p, ok := podCache.GetActivePod(podUID); !ok || p.Name != podName {
+		t.Fatalf("can't get pod %s by uid", podName)
+	}
+
+	// pod删除后立即通知
+	k8sclient.CoreV1().Pods(ns).Delete(context.Background(), podName, metav1.DeleteOptions{})
+	select {
+	case uid := <-released:
+		if uid != podUID {
+			t.Errorf("expect released pod %s, got %s", podUID, uid)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("pod %s is not released after deleted", podName)
+	}
+	if _, ok := podCache.GetActivePod(podUID); ok {
+		t.Errorf("deleted pod %s is still active", podName)
+	}
+}
+
+// expectNoGoroutineLeak waits until the number of goroutines goes back to
+// before
+func expectNoGoroutineLeak(t *testing.T, before int) {
+	t.Helper()
+	err := wait.PollImmediate(100*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return runtime.NumGoroutine() <= before, nil
+	})
+	if err != nil {
+		buf := make([]byte, 1<<20)
+		t.Errorf("goroutines leaked, %d before, %d after\n%s", before, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestStopWithoutGoroutineLeak(t *testing.T) {
+	nodeName := "testnode"
+	k8sclient := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}})
+	before := runtime.NumGoroutine()
+
+	podCache := NewPodCacheForTest(k8sclient)
+	podCache.OnRelease(func(pod *v1.Pod) {})
+	annotator := &nodeAnnotator{
+		config:  &config.Config{Hostname: nodeName},
+		client:  k8sclient.CoreV1(),
+		devices: fakeDeviceSource{},
+	}
+	stopChan := make(chan struct{})
+	if err := annotator.Run(stopChan); err != nil {
+		t.Fatal(err)
+	}
+
+	close(stopChan)
+	podCache.Stop()
+	// 重复调用Stop不会阻塞
+	podCache.Stop()
+	expectNoGoroutineLeak(t, before)
 }
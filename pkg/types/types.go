@@ -18,6 +18,8 @@
 package types
 
 import (
+	"sync/atomic"
+
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
@@ -31,10 +33,18 @@ const (
 	GPUAssigned             = "nvidia.com/gpu-assigned"
 	ClusterNameAnnotation   = "clusterName"
 
+	// NvidiaGPUResource is the whole GPU resource compatible with NVIDIA device plugin
+	NvidiaGPUResource = "nvidia.com/gpu"
+
+	// PredicateInitGPUIndexPrefix is the prefix of predicate index of init containers
+	PredicateInitGPUIndexPrefix = "nvidia.com/predicate-init-gpu-idx-"
+
 	// TODO 作用于pod上指定要分配的设备类型 例如：A100
 	PodAnnotationUseGpuType = "nvidia.com/use-gputype"
 	// TODO 作用于pod上指定不要分配的设备类型 例如：3080
 	PodAnnotationUnUseGpuType = "nvidia.com/nouse-gputype"
+	// PodAnnotationGPUPool selects the GPU pool of the node used by pod
+	PodAnnotationGPUPool = "nvidia.com/gpu-pool"
 
 	// 节点绑定时间
 	PodLabelBindTime = "tydic.io/bind-time"
@@ -64,6 +74,14 @@ const (
 	DeviceBindSuccess    DeviceBindPhase = "success"
 )
 
+// share mode的实现方式
+const (
+	// ShareBackendVCuda limits containers by intercepting the cuda library
+	ShareBackendVCuda = "vcuda"
+	// ShareBackendMPS limits containers by CUDA Multi-Process Service
+	ShareBackendMPS = "mps"
+)
+
 const (
 	NvidiaCtlDevice    = "/dev/nvidiactl"
 	NvidiaUVMDevice    = "/dev/nvidia-uvm"
@@ -128,12 +146,30 @@ type CheckpointData struct {
 	Data *Checkpoint `json:"Data"`
 }
 
-var (
-	DriverVersionMajor      int
-	DriverVersionMinor      int
-	DriverLibraryPath       string
-	DriverOriginLibraryPath string
-)
+// DriverInfo describes the mirrored driver used by new containers
+type DriverInfo struct {
+	Version           string
+	VersionMajor      int
+	VersionMinor      int
+	LibraryPath       string
+	OriginLibraryPath string
+}
+
+var driverInfo atomic.Value
+
+// GetDriverInfo returns the mirrored driver currently in use
+func GetDriverInfo() DriverInfo {
+	if info, ok := driverInfo.Load().(DriverInfo); ok {
+		return info
+	}
+
+	return DriverInfo{}
+}
+
+// SetDriverInfo atomically switches the mirrored driver used by new containers
+func SetDriverInfo(info DriverInfo) {
+	driverInfo.Store(info)
+}
 
 const (
 	ContainerNameLabelKey = "io.kubernetes.container.name"
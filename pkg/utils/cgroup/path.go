@@ -0,0 +1,147 @@
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+const (
+	// DriverSystemd is the systemd cgroup driver of kubelet
+	DriverSystemd = "systemd"
+	// DriverCgroupfs is the cgroupfs cgroup driver of kubelet
+	DriverCgroupfs = "cgroupfs"
+)
+
+// systemdScopePrefixes maps the runtime name reported by CRI Version to the
+// prefix of the systemd scope unit which the runtime creates for a container.
+var systemdScopePrefixes = map[string]string{
+	"containerd": "cri-containerd",
+	"cri-o":      "crio",
+	"docker":     "docker",
+}
+
+// SystemdPathPrefixOfRuntime returns the systemd scope prefix of a container runtime,
+// runtimes not in the table are assumed to use their own name.
+func SystemdPathPrefixOfRuntime(runtimeName string) string {
+	if prefix, ok := systemdScopePrefixes[runtimeName]; ok {
+		return prefix
+	}
+	klog.V(2).Infof("prefix of container runtime %s was not tested. Maybe not correct!", runtimeName)
+	return runtimeName
+}
+
+// HierarchyRoot returns the directory container cgroups are looked up in,
+// the unified hierarchy on cgroup v2 and the memory controller on cgroup v1.
+func HierarchyRoot(base string, unified bool) string {
+	if unified {
+		return base
+	}
+	return filepath.Join(base, "memory")
+}
+
+// Resolver finds the cgroup directory of a container. The layout depends on the
+// cgroup driver of kubelet and the container runtime, for example:
+//
+// systemd, containerd:
+// kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod<uid>.slice/cri-containerd-<id>.scope
+// system.slice/containerd.service/kubepods-besteffort-pod<uid>.slice:cri-containerd:<id>
+//
+// systemd, docker:
+// kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod<uid>.slice/docker-<id>.scope
+// kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod<uid>.slice/<id>
+//
+// systemd, cri-o:
+// kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod<uid>.slice/crio-<id>.scope
+//
+// cgroupfs:
+// kubepods/besteffort/pod<uid>/<id>
+// kubepods/besteffort/pod<uid>/crio-<id>
+type Resolver struct {
+	// Root is the hierarchy root, see HierarchyRoot
+	Root        string
+	Driver      string
+	RuntimeName string
+}
+
+// NewResolver returns a resolver of the given hierarchy root, cgroup driver and runtime
+func NewResolver(root, driver, runtimeName string) *Resolver {
+	return &Resolver{
+		Root:        root,
+		Driver:      strings.ToLower(driver),
+		RuntimeName: runtimeName,
+	}
+}
+
+// podPath returns the pod cgroup path relative to the hierarchy root
+func (r *Resolver) podPath(podCgroup CgroupName) (string, error) {
+	switch r.Driver {
+	case DriverSystemd:
+		return podCgroup.ToSystemd(), nil
+	case DriverCgroupfs:
+		return podCgroup.ToCgroupfs(), nil
+	}
+	return "", fmt.Errorf("unsupported cgroup driver %s", r.Driver)
+}
+
+// Candidates returns the paths relative to the hierarchy root where the
+// container cgroup may be, the most common layout first.
+func (r *Resolver) Candidates(podCgroup CgroupName, containerID string) ([]string, error) {
+	podPath, err := r.podPath(podCgroup)
+	if err != nil {
+		return nil, err
+	}
+	prefix := SystemdPathPrefixOfRuntime(r.RuntimeName)
+
+	var candidates []string
+	switch r.Driver {
+	case DriverSystemd:
+		candidates = append(candidates,
+			fmt.Sprintf("%s/%s-%s.scope", podPath, prefix, containerID),
+			fmt.Sprintf("%s/%s", podPath, containerID))
+		// 部分版本的containerd将容器cgroup放在自身的service下
+		if r.RuntimeName == "containerd" {
+			candidates = append(candidates, fmt.Sprintf("system.slice/%s.service/%s:%s:%s",
+				r.RuntimeName, podCgroup.ToSystemd2(), prefix, containerID))
+		}
+	case DriverCgroupfs:
+		candidates = append(candidates,
+			fmt.Sprintf("%s/%s", podPath, containerID),
+			fmt.Sprintf("%s/%s-%s", podPath, prefix, containerID))
+	}
+	return candidates, nil
+}
+
+// Resolve returns the absolute cgroup directory of the container. When none of
+// the known layouts exists, the pod cgroup is searched for a directory named
+// after the container id, so that untested CRI runtimes still work.
+func (r *Resolver) Resolve(podCgroup CgroupName, containerID string) (string, error) {
+	candidates, err := r.Candidates(podCgroup, containerID)
+	if err != nil {
+		return "", err
+	}
+	for _, candidate := range candidates {
+		dir := filepath.Join(r.Root, candidate)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir, nil
+		}
+	}
+
+	podPath, _ := r.podPath(podCgroup)
+	podDir := filepath.Join(r.Root, podPath)
+	entries, err := os.ReadDir(podDir)
+	if err != nil {
+		return "", fmt.Errorf("can't read pod cgroup %s, %v", podDir, err)
+	}
+	for _, entry := range entries {
+		// cri-o的conmon进程在单独的scope中，不属于容器
+		if entry.IsDir() && strings.Contains(entry.Name(), containerID) && !strings.Contains(entry.Name(), "conmon") {
+			klog.V(4).Infof("found cgroup %s of container %s by scanning pod cgroup", entry.Name(), containerID)
+			return filepath.Join(podDir, entry.Name()), nil
+		}
+	}
+	return "", fmt.Errorf("cgroup of container %s not found under %s", containerID, podDir)
+}
@@ -0,0 +1,140 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testPodUID      = "podb39963e8-cc41-4d44-912a-ed5394b6d4d5"
+	testContainerID = "12da3d97e9069757d06fa9862b9e3f8d8555ff62281877333326a205ff283b50"
+)
+
+// makeFixture creates the given cgroup directories under a fake /sys/fs/cgroup
+func makeFixture(t *testing.T, unified bool, dirs ...string) string {
+	base := t.TempDir()
+	root := HierarchyRoot(base, unified)
+	if unified {
+		if err := os.WriteFile(filepath.Join(base, "cgroup.controllers"), []byte("cpu memory pids"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, dir, "cgroup.procs"), []byte("1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestResolve(t *testing.T) {
+	podCgroup := NewCgroupName(NewCgroupName(nil, "kubepods"), "besteffort", testPodUID)
+	systemdPod := "kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-podb39963e8_cc41_4d44_912a_ed5394b6d4d5.slice"
+	cgroupfsPod := "kubepods/besteffort/" + testPodUID
+
+	testCases := []struct {
+		name    string
+		driver  string
+		runtime string
+		dirs    []string
+		expect  string
+	}{
+		{
+			name:    "containerd systemd",
+			driver:  DriverSystemd,
+			runtime: "containerd",
+			dirs:    []string{systemdPod + "/cri-containerd-" + testContainerID + ".scope"},
+			expect:  systemdPod + "/cri-containerd-" + testContainerID + ".scope",
+		},
+		{
+			name:    "containerd systemd service",
+			driver:  DriverSystemd,
+			runtime: "containerd",
+			dirs: []string{"system.slice/containerd.service/kubepods-besteffort-podb39963e8_cc41_4d44_912a_ed5394b6d4d5.slice:cri-containerd:" +
+				testContainerID},
+			expect: "system.slice/containerd.service/kubepods-besteffort-podb39963e8_cc41_4d44_912a_ed5394b6d4d5.slice:cri-containerd:" +
+				testContainerID,
+		},
+		{
+			name:    "docker systemd scope",
+			driver:  DriverSystemd,
+			runtime: "docker",
+			dirs:    []string{systemdPod + "/docker-" + testContainerID + ".scope"},
+			expect:  systemdPod + "/docker-" + testContainerID + ".scope",
+		},
+		{
+			name:    "docker systemd",
+			driver:  DriverSystemd,
+			runtime: "docker",
+			dirs:    []string{systemdPod + "/" + testContainerID},
+			expect:  systemdPod + "/" + testContainerID,
+		},
+		{
+			name:    "cri-o systemd",
+			driver:  "Systemd",
+			runtime: "cri-o",
+			dirs: []string{
+				systemdPod + "/crio-conmon-" + testContainerID + ".scope",
+				systemdPod + "/crio-" + testContainerID + ".scope",
+			},
+			expect: systemdPod + "/crio-" + testContainerID + ".scope",
+		},
+		{
+			name:    "unknown runtime systemd",
+			driver:  DriverSystemd,
+			runtime: "isulad",
+			dirs: []string{
+				systemdPod + "/conmon-" + testContainerID,
+				systemdPod + "/runtime-" + testContainerID + ".scope",
+			},
+			expect: systemdPod + "/runtime-" + testContainerID + ".scope",
+		},
+		{
+			name:    "containerd cgroupfs",
+			driver:  DriverCgroupfs,
+			runtime: "containerd",
+			dirs:    []string{cgroupfsPod + "/" + testContainerID},
+			expect:  cgroupfsPod + "/" + testContainerID,
+		},
+		{
+			name:    "cri-o cgroupfs",
+			driver:  DriverCgroupfs,
+			runtime: "cri-o",
+			dirs: []string{
+				cgroupfsPod + "/crio-conmon-" + testContainerID,
+				cgroupfsPod + "/crio-" + testContainerID,
+			},
+			expect: cgroupfsPod + "/crio-" + testContainerID,
+		},
+	}
+
+	for _, unified := range []bool{false, true} {
+		for _, tc := range testCases {
+			root := makeFixture(t, unified, tc.dirs...)
+			dir, err := NewResolver(root, tc.driver, tc.runtime).Resolve(podCgroup, testContainerID)
+			if err != nil {
+				t.Errorf("%s (cgroup v2: %t): %v", tc.name, unified, err)
+				continue
+			}
+			if expect := filepath.Join(root, tc.expect); dir != expect {
+				t.Errorf("%s (cgroup v2: %t): expect %s, got %s", tc.name, unified, expect, dir)
+			}
+		}
+	}
+}
+
+func TestResolveNotFound(t *testing.T) {
+	podCgroup := NewCgroupName(NewCgroupName(nil, "kubepods"), testPodUID)
+	root := makeFixture(t, true, "kubepods.slice/kubepods-"+escapeSystemdCgroupName(testPodUID)+".slice/crio-conmon-"+testContainerID+".scope")
+
+	if _, err := NewResolver(root, DriverSystemd, "cri-o").Resolve(podCgroup, testContainerID); err == nil {
+		t.Errorf("expect error when container cgroup is missing")
+	}
+	if _, err := NewResolver(root, "unknown", "cri-o").Resolve(podCgroup, testContainerID); err == nil {
+		t.Errorf("expect error for unsupported cgroup driver")
+	}
+}
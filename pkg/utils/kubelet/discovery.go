@@ -0,0 +1,206 @@
+package kubelet
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	DefaultProcRoot   = "/proc"
+	DefaultRootDir    = "/var/lib/kubelet"
+	DefaultConfigFile = DefaultRootDir + "/config.yaml"
+
+	// DefaultCgroupDriver is the cgroup driver kubelet uses when not configured
+	DefaultCgroupDriver = "cgroupfs"
+
+	configurationKind = "KubeletConfiguration"
+)
+
+// kubeletConfiguration holds the fields of KubeletConfiguration (kubelet.config.k8s.io/v1beta1)
+// gpu-manager depends on
+type kubeletConfiguration struct {
+	metav1.TypeMeta          `json:",inline"`
+	CgroupDriver             string `json:"cgroupDriver,omitempty"`
+	ContainerRuntimeEndpoint string `json:"containerRuntimeEndpoint,omitempty"`
+}
+
+// Source describes where a setting came from
+type Source string
+
+const (
+	SourceDefault     Source = "default"
+	SourceConfigFile  Source = "config file"
+	SourceCommandLine Source = "command line"
+)
+
+// Setting is a kubelet setting with the place it came from
+type Setting struct {
+	Value  string
+	Source Source
+}
+
+func (s Setting) String() string {
+	return s.Value + " (" + string(s.Source) + ")"
+}
+
+// Settings are the effective kubelet settings gpu-manager depends on
+type Settings struct {
+	ConfigFile               Setting
+	CgroupDriver             Setting
+	ContainerRuntimeEndpoint Setting
+}
+
+// Discovery resolves the effective kubelet settings. Values are taken from the
+// kubelet defaults, then the KubeletConfiguration file, then the command line of
+// the running kubelet, the later one wins as kubelet itself does.
+type Discovery struct {
+	// ProcRoot is the proc filesystem to find the kubelet process in, gpu-manager
+	// needs hostPID to see it
+	ProcRoot string
+	// ConfigFile is used when the kubelet process is not found or runs without --config
+	ConfigFile string
+}
+
+// NewDiscovery returns a discovery with default paths
+func NewDiscovery() *Discovery {
+	return &Discovery{
+		ProcRoot:   DefaultProcRoot,
+		ConfigFile: DefaultConfigFile,
+	}
+}
+
+// Discover resolves and logs the kubelet settings. ContainerRuntimeEndpoint is
+// left empty when kubelet doesn't configure it.
+func (d *Discovery) Discover() *Settings {
+	settings := &Settings{
+		ConfigFile:   Setting{d.ConfigFile, SourceDefault},
+		CgroupDriver: Setting{DefaultCgroupDriver, SourceDefault},
+	}
+
+	pid, flags := d.findKubelet()
+	if path, ok := flags["config"]; ok {
+		settings.ConfigFile = Setting{path, SourceCommandLine}
+	}
+
+	if cfg, err := d.readConfig(pid, settings.ConfigFile.Value); err != nil {
+		klog.Warningf("can't read kubelet config %s, %v", settings.ConfigFile.Value, err)
+	} else {
+		if len(cfg.CgroupDriver) > 0 {
+			settings.CgroupDriver = Setting{cfg.CgroupDriver, SourceConfigFile}
+		}
+		if len(cfg.ContainerRuntimeEndpoint) > 0 {
+			settings.ContainerRuntimeEndpoint = Setting{cfg.ContainerRuntimeEndpoint, SourceConfigFile}
+		}
+	}
+
+	if driver, ok := flags["cgroup-driver"]; ok {
+		settings.CgroupDriver = Setting{driver, SourceCommandLine}
+	}
+	if endpoint, ok := flags["container-runtime-endpoint"]; ok {
+		settings.ContainerRuntimeEndpoint = Setting{endpoint, SourceCommandLine}
+	}
+
+	settings.CgroupDriver.Value = strings.ToLower(settings.CgroupDriver.Value)
+	if len(settings.ContainerRuntimeEndpoint.Value) > 0 {
+		settings.ContainerRuntimeEndpoint.Value = socketPath(settings.ContainerRuntimeEndpoint.Value)
+	}
+
+	klog.V(2).Infof("kubelet config file: %s", settings.ConfigFile)
+	klog.V(2).Infof("kubelet cgroup driver: %s", settings.CgroupDriver)
+	klog.V(2).Infof("kubelet container runtime endpoint: %s", settings.ContainerRuntimeEndpoint)
+	return settings
+}
+
+// findKubelet returns the pid and command line flags of the running kubelet,
+// pid is 0 when kubelet is not found
+func (d *Discovery) findKubelet() (int, map[string]string) {
+	entries, err := os.ReadDir(d.ProcRoot)
+	if err != nil {
+		klog.Warningf("can't read %s, %v", d.ProcRoot, err)
+		return 0, nil
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join(d.ProcRoot, entry.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		args := strings.Split(string(bytes.TrimRight(cmdline, "\x00")), "\x00")
+		// hyperkube以子命令的方式运行kubelet
+		if filepath.Base(args[0]) == "hyperkube" && len(args) > 1 {
+			args = args[1:]
+		}
+		if filepath.Base(args[0]) != "kubelet" {
+			continue
+		}
+		klog.V(2).Infof("found kubelet process %d", pid)
+		return pid, parseFlags(args[1:])
+	}
+	klog.Warningf("kubelet process not found in %s", d.ProcRoot)
+	return 0, nil
+}
+
+// parseFlags parses flags in the form of --name=value or --name value
+func parseFlags(args []string) map[string]string {
+	flags := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if kv := strings.SplitN(name, "=", 2); len(kv) == 2 {
+			flags[kv[0]] = kv[1]
+		} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			flags[name] = args[i+1]
+			i++
+		} else {
+			flags[name] = "true"
+		}
+	}
+	return flags
+}
+
+// readConfig decodes the KubeletConfiguration file. The file is a path on the
+// host, when it's not mounted into gpu-manager it's read through the root of
+// the kubelet process.
+func (d *Discovery) readConfig(pid int, path string) (*kubeletConfiguration, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && pid > 0 {
+		data, err = os.ReadFile(filepath.Join(d.ProcRoot, strconv.Itoa(pid), "root", path))
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := &kubeletConfiguration{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Kind) > 0 && cfg.Kind != configurationKind {
+		return nil, fmt.Errorf("unexpected kind %s", cfg.Kind)
+	}
+	return cfg, nil
+}
+
+// socketPath converts a CRI endpoint to a socket path. gpu-manager only mounts
+// /var/run of the host, so endpoints under /run are mapped to /var/run.
+func socketPath(endpoint string) string {
+	path := strings.TrimPrefix(endpoint, "unix://")
+	if strings.HasPrefix(path, "/run/") {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			path = "/var" + path
+		}
+	}
+	return path
+}
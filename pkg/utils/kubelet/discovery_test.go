@@ -0,0 +1,96 @@
+package kubelet
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `# cgroupDriver: systemd is recommended, see kubeadm docs
+apiVersion: kubelet.config.k8s.io/v1beta1
+kind: KubeletConfiguration
+cgroupDriver: cgroupfs
+containerRuntimeEndpoint: unix:///var/run/crio/crio.sock
+`
+
+// makeProc creates a fake proc filesystem with the given process command lines
+func makeProc(t *testing.T, cmdlines map[string][]string) string {
+	procRoot := t.TempDir()
+	for pid, args := range cmdlines {
+		if err := os.MkdirAll(filepath.Join(procRoot, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		cmdline := strings.Join(args, "\x00") + "\x00"
+		if err := os.WriteFile(filepath.Join(procRoot, pid, "cmdline"), []byte(cmdline), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return procRoot
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDiscoverConfigFile(t *testing.T) {
+	d := &Discovery{
+		ProcRoot:   makeProc(t, map[string][]string{"1": {"/sbin/init"}}),
+		ConfigFile: writeConfig(t, testConfig),
+	}
+	settings := d.Discover()
+	// 注释中的systemd不会影响解析结果
+	if settings.CgroupDriver != (Setting{"cgroupfs", SourceConfigFile}) {
+		t.Errorf("unexpected cgroup driver %s", settings.CgroupDriver)
+	}
+	if settings.ContainerRuntimeEndpoint != (Setting{"/var/run/crio/crio.sock", SourceConfigFile}) {
+		t.Errorf("unexpected runtime endpoint %s", settings.ContainerRuntimeEndpoint)
+	}
+}
+
+func TestDiscoverCommandLine(t *testing.T) {
+	config := writeConfig(t, testConfig)
+	d := &Discovery{
+		ProcRoot: makeProc(t, map[string][]string{
+			"1": {"/sbin/init"},
+			"1024": {"/usr/bin/kubelet", "--config=" + config, "--cgroup-driver", "Systemd",
+				"--container-runtime-endpoint=unix:///var/run/containerd/containerd.sock",
+				"--root-dir=/data/kubelet", "--v=2"},
+		}),
+		ConfigFile: "/not/exist/config.yaml",
+	}
+	settings := d.Discover()
+	expect := map[string]Setting{
+		"config file":   {config, SourceCommandLine},
+		"cgroup driver": {"systemd", SourceCommandLine},
+		"runtime":       {"/var/run/containerd/containerd.sock", SourceCommandLine},
+	}
+	got := map[string]Setting{
+		"config file":   settings.ConfigFile,
+		"cgroup driver": settings.CgroupDriver,
+		"runtime":       settings.ContainerRuntimeEndpoint,
+	}
+	for name, e := range expect {
+		if got[name] != e {
+			t.Errorf("%s expect %s, got %s", name, e, got[name])
+		}
+	}
+}
+
+func TestDiscoverDefault(t *testing.T) {
+	d := &Discovery{
+		ProcRoot:   makeProc(t, nil),
+		ConfigFile: writeConfig(t, "apiVersion: v1\nkind: ConfigMap\n"),
+	}
+	settings := d.Discover()
+	if settings.CgroupDriver != (Setting{DefaultCgroupDriver, SourceDefault}) {
+		t.Errorf("unexpected cgroup driver %s", settings.CgroupDriver)
+	}
+	if len(settings.ContainerRuntimeEndpoint.Value) > 0 {
+		t.Errorf("unexpected runtime endpoint %s", settings.ContainerRuntimeEndpoint)
+	}
+}
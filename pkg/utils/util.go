@@ -32,7 +32,7 @@ import (
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 
-	nvtree "tkestack.io/gpu-manager/pkg/device/nvidia"
+	"tkestack.io/gpu-manager/pkg/device"
 	"tkestack.io/gpu-manager/pkg/types"
 
 	"github.com/fsnotify/fsnotify"
@@ -261,7 +261,7 @@ func IsGPURequiredPod(pod *v1.Pod) bool {
 	vmemory := GetGPUResourceOfPod(pod, types.VMemoryAnnotation)
 
 	// Check if pod request for GPU resource
-	if vcore <= 0 || (vcore < nvtree.HundredCore && vmemory <= 0) {
+	if vcore <= 0 || (vcore < device.HundredCore && vmemory <= 0) {
 		klog.V(4).Infof("Pod %s in namespace %s does not Request for GPU resource",
 			pod.Name,
 			pod.Namespace)
@@ -271,6 +271,11 @@ func IsGPURequiredPod(pod *v1.Pod) bool {
 	return true
 }
 
+// IsWholeGPURequiredPod returns true if the pod requests whole GPUs as nvidia.com/gpu
+func IsWholeGPURequiredPod(pod *v1.Pod) bool {
+	return GetGPUResourceOfPod(pod, types.NvidiaGPUResource) > 0
+}
+
 func IsGPURequiredContainer(c *v1.Container) bool {
 	klog.V(4).Infof("Determine if the container %s needs GPU resource", c.Name)
 
@@ -278,7 +283,7 @@ func IsGPURequiredContainer(c *v1.Container) bool {
 	vmemory := GetGPUResourceOfContainer(c, types.VMemoryAnnotation)
 
 	// Check if container request for GPU resource
-	if vcore <= 0 || (vcore < nvtree.HundredCore && vmemory <= 0) {
+	if vcore <= 0 || (vcore < device.HundredCore && vmemory <= 0) {
 		klog.V(4).Infof("Container %s does not Request for GPU resource", c.Name)
 		return false
 	}
@@ -286,17 +291,67 @@ func IsGPURequiredContainer(c *v1.Container) bool {
 	return true
 }
 
+// GetGPUResourceOfPod returns the effective request of pod like kubernetes,
+// which is the larger one of containers with sidecars and any init container
+// with sidecars started before it.
 func GetGPUResourceOfPod(pod *v1.Pod, resourceName v1.ResourceName) uint {
-	var total uint
-	containers := pod.Spec.Containers
-	for _, container := range containers {
-		if val, ok := container.Resources.Limits[resourceName]; ok {
-			total += uint(val.Value())
+	var total, sidecars, initMax uint
+	for i := range pod.Spec.InitContainers {
+		c := &pod.Spec.InitContainers[i]
+		count := GetGPUResourceOfContainer(c, resourceName)
+		if IsRestartableInitContainer(pod, c.Name) {
+			sidecars += count
+			continue
 		}
+		if sidecars+count > initMax {
+			initMax = sidecars + count
+		}
+	}
+	for i := range pod.Spec.Containers {
+		total += GetGPUResourceOfContainer(&pod.Spec.Containers[i], resourceName)
+	}
+	total += sidecars
+	if initMax > total {
+		total = initMax
 	}
 	return total
 }
 
+// GetPodContainers returns init containers and containers of pod in the
+// order kubelet allocates devices for them
+func GetPodContainers(pod *v1.Pod) []*v1.Container {
+	containers := make([]*v1.Container, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	for i := range pod.Spec.InitContainers {
+		containers = append(containers, &pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		containers = append(containers, &pod.Spec.Containers[i])
+	}
+	return containers
+}
+
+// IsInitContainer returns true if name is an init container of pod
+func IsInitContainer(pod *v1.Pod, name string) bool {
+	for _, c := range pod.Spec.InitContainers {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRestartableInitContainer returns true if name is a sidecar of pod, that
+// is an init container with restartPolicy Always which keeps running with
+// containers of pod
+func IsRestartableInitContainer(pod *v1.Pod, name string) bool {
+	for _, c := range pod.Spec.InitContainers {
+		if c.Name == name {
+			return c.RestartPolicy != nil && *c.RestartPolicy == v1.ContainerRestartPolicyAlways
+		}
+	}
+	return false
+}
+
 func ShouldDelete(pod *v1.Pod) bool {
 	for _, status := range pod.Status.ContainerStatuses {
 		if status.State.Waiting != nil &&
@@ -418,6 +473,21 @@ func GetContainerIndexByName(pod *v1.Pod, containerName string) (int, error) {
 	return containerIndex, nil
 }
 
+// GetPredicateIndexAnnotation returns key of the predicate index annotation
+// of container, init containers are indexed separately.
+func GetPredicateIndexAnnotation(pod *v1.Pod, containerName string) (string, error) {
+	for i, c := range pod.Spec.InitContainers {
+		if c.Name == containerName {
+			return types.PredicateInitGPUIndexPrefix + strconv.Itoa(i), nil
+		}
+	}
+	containerIndex, err := GetContainerIndexByName(pod, containerName)
+	if err != nil {
+		return "", err
+	}
+	return types.PredicateGPUIndexPrefix + strconv.Itoa(containerIndex), nil
+}
+
 func GetVirtualControllerMountPath(resp *pluginapi.ContainerAllocateResponse) string {
 	for _, mnt := range resp.Mounts {
 		if mnt.ContainerPath == types.VCUDA_MOUNTPOINT {